@@ -0,0 +1,395 @@
+// Package connlimit implements connection rate limits (token buckets) and
+// concurrency caps, per source IP address, per source network prefix, and
+// globally.
+package connlimit // import "github.com/RACECAR-GU/obfsX/common/connlimit"
+
+import (
+	"container/list"
+	"fmt"
+	"math"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultIPv4PrefixLen and DefaultIPv6PrefixLen are the lengths of the
+	// prefixes that PerPrefix applies to, if not configured.
+	DefaultIPv4PrefixLen = 24
+	DefaultIPv6PrefixLen = 48
+
+	// maxEntries bounds the number of tracked sources (and prefixes).  A
+	// new source that does not fit replaces the least recently seen one
+	// without active connections, whose limits start afresh.
+	maxEntries = 1 << 16
+
+	// maxEvictScan bounds the least recently seen entries that are looked
+	// at for one to replace.  Those with active connections are moved to
+	// the back, so the next scan starts past them.
+	maxEvictScan = 64
+
+	sweepInterval = time.Minute
+
+	// minSweepInterval rate limits the sweeps when an entry table is full.
+	minSweepInterval = time.Second
+)
+
+// The scopes of the limits.
+const (
+	ScopeIP     = "ip"
+	ScopePrefix = "prefix"
+	ScopeGlobal = "global"
+)
+
+// Limit is a rate limit on new connections, and a cap on the concurrent ones.
+// The zero value is unlimited.
+type Limit struct {
+	// Rate is the sustained rate of new connections per second, 0 is
+	// unlimited.
+	Rate float64
+
+	// Burst is the number of new connections allowed at once, which
+	// defaults to the rate rounded up (and at least 1).
+	Burst int
+
+	// Concurrent is the maximum number of concurrent connections, 0 is
+	// unlimited.
+	Concurrent int
+}
+
+func (lim *Limit) unlimited() bool {
+	return lim.Rate == 0 && lim.Concurrent == 0
+}
+
+func (lim *Limit) burst() float64 {
+	if lim.Burst > 0 {
+		return float64(lim.Burst)
+	}
+	return math.Max(1, math.Ceil(lim.Rate))
+}
+
+func (lim *Limit) validate() error {
+	if lim.Rate < 0 || math.IsNaN(lim.Rate) || math.IsInf(lim.Rate, 0) {
+		return fmt.Errorf("invalid rate %v", lim.Rate)
+	}
+	if lim.Burst < 0 {
+		return fmt.Errorf("invalid burst %d", lim.Burst)
+	}
+	if lim.Concurrent < 0 {
+		return fmt.Errorf("invalid concurrency cap %d", lim.Concurrent)
+	}
+	return nil
+}
+
+// Config is the configuration of a Limiter.
+type Config struct {
+	// PerIP limits each source IP address.
+	PerIP Limit
+
+	// PerPrefix limits each source network, of IPv4PrefixLen or
+	// IPv6PrefixLen bits (0 uses the defaults).
+	PerPrefix     Limit
+	IPv4PrefixLen int
+	IPv6PrefixLen int
+
+	// Global limits all of the connections.
+	Global Limit
+}
+
+// Validate checks the configuration.
+func (cfg *Config) Validate() error {
+	for _, v := range []struct {
+		scope string
+		lim   *Limit
+	}{
+		{ScopeIP, &cfg.PerIP},
+		{ScopePrefix, &cfg.PerPrefix},
+		{ScopeGlobal, &cfg.Global},
+	} {
+		if err := v.lim.validate(); err != nil {
+			return fmt.Errorf("%s: %s", v.scope, err)
+		}
+	}
+	if cfg.IPv4PrefixLen < 0 || cfg.IPv4PrefixLen > 32 {
+		return fmt.Errorf("invalid IPv4 prefix length %d", cfg.IPv4PrefixLen)
+	}
+	if cfg.IPv6PrefixLen < 0 || cfg.IPv6PrefixLen > 128 {
+		return fmt.Errorf("invalid IPv6 prefix length %d", cfg.IPv6PrefixLen)
+	}
+	return nil
+}
+
+// LimitError is the error returned when a connection is over a limit.
+type LimitError struct {
+	// Scope is the scope of the limit (ScopeIP, ScopePrefix or
+	// ScopeGlobal).
+	Scope string
+
+	// Concurrency is set if the concurrency cap was reached, instead of the
+	// rate limit.
+	Concurrency bool
+}
+
+func (e *LimitError) Error() string {
+	if e.Concurrency {
+		return fmt.Sprintf("%s concurrency cap reached", e.Scope)
+	}
+	return fmt.Sprintf("%s rate limit exceeded", e.Scope)
+}
+
+// entry is the state of a source, prefix, or of all connections.
+type entry struct {
+	tokens float64
+	last   time.Time
+	active int
+
+	// elem is the entry's element in its table's LRU list, or nil.
+	elem *list.Element
+}
+
+// refill adds the tokens accrued since the last refill.
+func (e *entry) refill(lim *Limit, now time.Time) {
+	if lim.Rate == 0 {
+		return
+	}
+	e.tokens = math.Min(lim.burst(), e.tokens+now.Sub(e.last).Seconds()*lim.Rate)
+	e.last = now
+}
+
+// check returns the error if a new connection is over lim.
+func (e *entry) check(lim *Limit, scope string) error {
+	if lim.Concurrent > 0 && e.active >= lim.Concurrent {
+		return &LimitError{Scope: scope, Concurrency: true}
+	}
+	if lim.Rate > 0 && e.tokens < 1 {
+		return &LimitError{Scope: scope}
+	}
+	return nil
+}
+
+// idle returns if the entry is at its initial state, so it can be removed.
+func (e *entry) idle(lim *Limit) bool {
+	return e.active == 0 && (lim.Rate == 0 || e.tokens >= lim.burst())
+}
+
+// table is the entries of the sources or of the prefixes, with their keys in
+// order of use.
+type table struct {
+	m   map[string]*entry
+	lru *list.List
+}
+
+func newTable() *table {
+	return &table{m: make(map[string]*entry), lru: list.New()}
+}
+
+func (t *table) len() int {
+	return len(t.m)
+}
+
+// get returns the entry of key, marking it as the most recently used, or nil.
+func (t *table) get(key string) *entry {
+	e := t.m[key]
+	if e != nil {
+		t.lru.MoveToBack(e.elem)
+	}
+	return e
+}
+
+func (t *table) add(key string, e *entry) {
+	e.elem = t.lru.PushBack(key)
+	t.m[key] = e
+}
+
+func (t *table) remove(key string) {
+	if e := t.m[key]; e != nil {
+		t.lru.Remove(e.elem)
+		delete(t.m, key)
+	}
+}
+
+// evict removes the least recently used entry without active connections,
+// looking at up to maxEvictScan entries.  It returns false if there was none.
+func (t *table) evict() bool {
+	n := t.lru.Len()
+	if n > maxEvictScan {
+		n = maxEvictScan
+	}
+	for i := 0; i < n; i++ {
+		elem := t.lru.Front()
+		key := elem.Value.(string)
+		if t.m[key].active == 0 {
+			t.remove(key)
+			return true
+		}
+		t.lru.MoveToBack(elem)
+	}
+	return false
+}
+
+// Limiter admits connections within the limits.  It is safe for concurrent
+// use.
+type Limiter struct {
+	sync.Mutex
+
+	cfg      Config
+	ips      *table
+	prefixes *table
+	global   entry
+
+	maxEntries int
+	lastSweep  time.Time
+	now        func() time.Time
+}
+
+// New returns a Limiter with the configuration.
+func New(cfg Config) (*Limiter, error) {
+	l := &Limiter{
+		ips:        newTable(),
+		prefixes:   newTable(),
+		maxEntries: maxEntries,
+		now:        time.Now,
+	}
+	l.lastSweep = l.now()
+	l.global.last = l.lastSweep
+	if err := l.SetConfig(cfg); err != nil {
+		return nil, err
+	}
+	l.global.tokens = l.cfg.Global.burst()
+	return l, nil
+}
+
+// SetConfig changes the configuration.  The connections that were admitted
+// still count towards the concurrency caps.
+func (l *Limiter) SetConfig(cfg Config) error {
+	if err := cfg.Validate(); err != nil {
+		return err
+	}
+	if cfg.IPv4PrefixLen == 0 {
+		cfg.IPv4PrefixLen = DefaultIPv4PrefixLen
+	}
+	if cfg.IPv6PrefixLen == 0 {
+		cfg.IPv6PrefixLen = DefaultIPv6PrefixLen
+	}
+
+	l.Lock()
+	defer l.Unlock()
+	if cfg.IPv4PrefixLen != l.cfg.IPv4PrefixLen || cfg.IPv6PrefixLen != l.cfg.IPv6PrefixLen {
+		// The prefixes are keyed differently, start afresh, keeping the
+		// entries that admitted connections will release.
+		for k, e := range l.prefixes.m {
+			if e.active == 0 {
+				l.prefixes.remove(k)
+			}
+		}
+	}
+	l.cfg = cfg
+	return nil
+}
+
+// Admit admits a new connection from ip, returning the function to call once
+// it is closed, or a *LimitError if it is over a limit.
+func (l *Limiter) Admit(ip net.IP) (release func(), err error) {
+	l.Lock()
+	defer l.Unlock()
+
+	now := l.now()
+	if now.Sub(l.lastSweep) >= sweepInterval {
+		l.sweep(now)
+	}
+
+	ipKey, prefixKey := l.keys(ip)
+	var entries [3]*entry
+	var limits [3]*Limit
+	for i, v := range []struct {
+		t     *table
+		key   string
+		lim   *Limit
+		scope string
+	}{
+		{l.ips, ipKey, &l.cfg.PerIP, ScopeIP},
+		{l.prefixes, prefixKey, &l.cfg.PerPrefix, ScopePrefix},
+		{nil, "", &l.cfg.Global, ScopeGlobal},
+	} {
+		if v.lim.unlimited() {
+			continue
+		}
+		e := &l.global
+		if v.t != nil {
+			if e = v.t.get(v.key); e == nil {
+				if v.t.len() >= l.maxEntries && now.Sub(l.lastSweep) >= minSweepInterval {
+					l.sweep(now)
+				}
+				if v.t.len() >= l.maxEntries && !v.t.evict() {
+					// Every source that was looked at has
+					// active connections.
+					return nil, &LimitError{Scope: v.scope, Concurrency: true}
+				}
+				e = &entry{tokens: v.lim.burst(), last: now}
+				v.t.add(v.key, e)
+			}
+		}
+		e.refill(v.lim, now)
+		if err = e.check(v.lim, v.scope); err != nil {
+			return nil, err
+		}
+		entries[i], limits[i] = e, v.lim
+	}
+
+	// Within all of the limits, so take a token from, and count the
+	// connection against, each.
+	for i, e := range entries {
+		if e == nil {
+			continue
+		}
+		if limits[i].Rate > 0 {
+			e.tokens--
+		}
+		e.active++
+	}
+	released := false
+	return func() {
+		l.Lock()
+		defer l.Unlock()
+		if released {
+			return
+		}
+		released = true
+		for _, e := range entries {
+			if e != nil {
+				e.active--
+			}
+		}
+	}, nil
+}
+
+// keys returns the map keys of ip, and its prefix.
+func (l *Limiter) keys(ip net.IP) (ipKey, prefixKey string) {
+	var mask net.IPMask
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+		mask = net.CIDRMask(l.cfg.IPv4PrefixLen, 32)
+	} else {
+		mask = net.CIDRMask(l.cfg.IPv6PrefixLen, 128)
+	}
+	return ip.String(), ip.Mask(mask).String()
+}
+
+// sweep removes the idle entries.
+func (l *Limiter) sweep(now time.Time) {
+	for _, v := range []struct {
+		t   *table
+		lim *Limit
+	}{
+		{l.ips, &l.cfg.PerIP},
+		{l.prefixes, &l.cfg.PerPrefix},
+	} {
+		for k, e := range v.t.m {
+			e.refill(v.lim, now)
+			if e.idle(v.lim) {
+				v.t.remove(k)
+			}
+		}
+	}
+	l.lastSweep = now
+}
@@ -0,0 +1,168 @@
+package connlimit
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+// testLimiter returns a Limiter with a clock that only the test advances.
+func testLimiter(t *testing.T, cfg Config) (*Limiter, func(time.Duration)) {
+	l, err := New(cfg)
+	if err != nil {
+		t.Fatalf("New failed: %s", err)
+	}
+	now := time.Unix(1500000000, 0)
+	l.now = func() time.Time { return now }
+	l.lastSweep, l.global.last = now, now
+	return l, func(d time.Duration) { now = now.Add(d) }
+}
+
+// admit admits a connection from addr, expecting the error scope (or "" for
+// success).
+func admit(t *testing.T, l *Limiter, addr, scope string, concurrency bool) func() {
+	release, err := l.Admit(net.ParseIP(addr))
+	if scope == "" {
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %s", addr, err)
+		}
+		return release
+	}
+	e, ok := err.(*LimitError)
+	if !ok || e.Scope != scope || e.Concurrency != concurrency {
+		t.Fatalf("%s: error %v, expected %s (concurrency: %v)", addr, err, scope, concurrency)
+	}
+	return nil
+}
+
+func TestRate(t *testing.T) {
+	l, advance := testLimiter(t, Config{PerIP: Limit{Rate: 0.5, Burst: 2}})
+
+	admit(t, l, "192.0.2.1", "", false)
+	admit(t, l, "192.0.2.1", "", false)
+	admit(t, l, "192.0.2.1", ScopeIP, false)
+	admit(t, l, "192.0.2.2", "", false)
+
+	advance(time.Second)
+	admit(t, l, "192.0.2.1", ScopeIP, false)
+	advance(time.Second)
+	admit(t, l, "192.0.2.1", "", false)
+	admit(t, l, "192.0.2.1", ScopeIP, false)
+
+	// Rejected connections do not take tokens, and the bucket does not
+	// fill past the burst.
+	advance(time.Hour)
+	admit(t, l, "192.0.2.1", "", false)
+	admit(t, l, "192.0.2.1", "", false)
+	admit(t, l, "192.0.2.1", ScopeIP, false)
+}
+
+func TestConcurrency(t *testing.T) {
+	l, _ := testLimiter(t, Config{PerIP: Limit{Concurrent: 2}, Global: Limit{Concurrent: 3}})
+
+	r1 := admit(t, l, "192.0.2.1", "", false)
+	admit(t, l, "192.0.2.1", "", false)
+	admit(t, l, "192.0.2.1", ScopeIP, true)
+	admit(t, l, "2001:db8::1", "", false)
+	admit(t, l, "2001:db8::2", ScopeGlobal, true)
+
+	// Releasing is idempotent.
+	r1()
+	r1()
+	r4 := admit(t, l, "2001:db8::2", "", false)
+	admit(t, l, "192.0.2.1", ScopeGlobal, true)
+	r4()
+	admit(t, l, "192.0.2.1", "", false)
+	admit(t, l, "192.0.2.1", ScopeIP, true)
+}
+
+func TestPrefix(t *testing.T) {
+	l, _ := testLimiter(t, Config{PerPrefix: Limit{Concurrent: 2}})
+
+	admit(t, l, "192.0.2.1", "", false)
+	admit(t, l, "192.0.2.200", "", false)
+	admit(t, l, "192.0.2.3", ScopePrefix, true)
+	admit(t, l, "::ffff:192.0.2.4", ScopePrefix, true)
+	admit(t, l, "192.0.3.1", "", false)
+
+	admit(t, l, "2001:db8:1:1::1", "", false)
+	admit(t, l, "2001:db8:1:ffff::1", "", false)
+	admit(t, l, "2001:db8:1::2", ScopePrefix, true)
+	admit(t, l, "2001:db8:2::1", "", false)
+
+	// Narrower prefixes only apply to new connections.
+	if err := l.SetConfig(Config{PerPrefix: Limit{Concurrent: 2}, IPv4PrefixLen: 32, IPv6PrefixLen: 64}); err != nil {
+		t.Fatalf("SetConfig failed: %s", err)
+	}
+	admit(t, l, "192.0.2.3", "", false)
+	admit(t, l, "2001:db8:1:2::1", "", false)
+}
+
+func TestSweep(t *testing.T) {
+	l, advance := testLimiter(t, Config{PerIP: Limit{Rate: 1, Concurrent: 1}, PerPrefix: Limit{Rate: 10}})
+
+	release := admit(t, l, "192.0.2.1", "", false)
+	admit(t, l, "192.0.2.2", "", false)()
+	advance(sweepInterval)
+	admit(t, l, "192.0.2.3", "", false)()
+	if l.ips.len() != 2 || l.prefixes.len() != 1 {
+		t.Fatalf("after sweep: %d sources, %d prefixes", l.ips.len(), l.prefixes.len())
+	}
+	release()
+	advance(sweepInterval)
+	admit(t, l, "198.51.100.1", "", false)()
+	if l.ips.len() != 1 || l.prefixes.len() != 1 {
+		t.Fatalf("after second sweep: %d sources, %d prefixes", l.ips.len(), l.prefixes.len())
+	}
+}
+
+func TestFull(t *testing.T) {
+	l, advance := testLimiter(t, Config{PerIP: Limit{Rate: 1, Concurrent: 1}})
+	l.maxEntries = 2
+
+	// A new source replaces the least recently seen one without active
+	// connections, even if it is not idle yet.
+	release := admit(t, l, "192.0.2.1", "", false)
+	admit(t, l, "192.0.2.2", "", false)()
+	admit(t, l, "192.0.2.3", "", false)()
+	if e := l.ips.get("192.0.2.2"); e != nil {
+		t.Fatalf("the full table kept the least recently seen source")
+	}
+	if e := l.ips.get("192.0.2.1"); e == nil {
+		t.Fatalf("the full table dropped a source with active connections")
+	}
+
+	// The table is only swept again once minSweepInterval passes.
+	lastSweep := l.lastSweep
+	admit(t, l, "192.0.2.4", "", false)()
+	if l.lastSweep != lastSweep {
+		t.Fatalf("the full table was swept within minSweepInterval")
+	}
+	advance(minSweepInterval)
+	admit(t, l, "192.0.2.5", "", false)()
+	if l.lastSweep == lastSweep {
+		t.Fatalf("the full table was not swept after minSweepInterval")
+	}
+
+	// With every source active, new ones are turned away at the source
+	// scope.
+	release()
+	l.maxEntries = 1
+	advance(sweepInterval)
+	admit(t, l, "192.0.2.6", "", false)
+	admit(t, l, "192.0.2.7", ScopeIP, true)
+}
+
+func TestInvalidConfig(t *testing.T) {
+	for _, cfg := range []Config{
+		{PerIP: Limit{Rate: -1}},
+		{PerPrefix: Limit{Burst: -1}},
+		{Global: Limit{Concurrent: -1}},
+		{IPv4PrefixLen: 33},
+		{IPv6PrefixLen: -1},
+	} {
+		if _, err := New(cfg); err == nil {
+			t.Errorf("%+v: accepted", cfg)
+		}
+	}
+}
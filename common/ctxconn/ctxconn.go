@@ -0,0 +1,67 @@
+// Package ctxconn provides helpers for bounding blocking net.Conn operations
+// (eg: handshakes) by a context.Context.
+package ctxconn // import "github.com/RACECAR-GU/obfsX/common/ctxconn"
+
+import (
+	"context"
+	"net"
+	"time"
+)
+
+// aLongTimeAgo is a deadline that has always already expired, used to abort
+// pending I/O.
+var aLongTimeAgo = time.Unix(1, 0)
+
+// Guard arranges for all pending and future I/O on conn to fail once ctx is
+// done.  The returned stop function MUST be called with the guarded
+// operation's error once it completes.  It returns ctx.Err() if the context
+// is done (including when the operation timed out because of ctx's deadline),
+// and the operation's error otherwise.  In the former case conn's deadline may
+// have been clobbered, and the caller should treat the operation as failed.
+func Guard(ctx context.Context, conn net.Conn) (stop func(err error) error) {
+	if ctx.Done() == nil {
+		// The context can never be cancelled, don't bother with a goroutine.
+		return func(err error) error { return err }
+	}
+
+	done := make(chan struct{})
+	result := make(chan error, 1)
+	go func() {
+		select {
+		case <-ctx.Done():
+			_ = conn.SetDeadline(aLongTimeAgo)
+			result <- ctx.Err()
+		case <-done:
+			result <- nil
+		}
+	}()
+
+	return func(err error) error {
+		close(done)
+		if cerr := <-result; cerr != nil {
+			return cerr
+		}
+
+		// The operation may have failed due to the deadline from Deadline
+		// just before the watcher noticed ctx being done.  The context's
+		// timer can also fire a little after the socket deadline passes.
+		// Either way, the failure (eg: an "i/o timeout") is reported as
+		// the context's.
+		if d, ok := ctx.Deadline(); ok && !time.Now().Before(d) {
+			<-ctx.Done()
+		}
+		if cerr := ctx.Err(); cerr != nil {
+			return cerr
+		}
+		return err
+	}
+}
+
+// Deadline returns the earlier of ctx's deadline (if any) and now + timeout.
+func Deadline(ctx context.Context, timeout time.Duration) time.Time {
+	deadline := time.Now().Add(timeout)
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		return d
+	}
+	return deadline
+}
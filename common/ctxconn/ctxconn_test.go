@@ -0,0 +1,47 @@
+package ctxconn
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestGuard(t *testing.T) {
+	c, s := net.Pipe()
+	defer c.Close()
+	defer s.Close()
+
+	// A timeout caused by ctx's deadline is reported as the context's.
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := c.SetDeadline(Deadline(ctx, time.Hour)); err != nil {
+		t.Fatalf("SetDeadline failed: %s", err)
+	}
+	stop := Guard(ctx, c)
+	_, err := c.Read(make([]byte, 1))
+	if err = stop(err); err != context.DeadlineExceeded {
+		t.Fatalf("stop: %v, expected %v", err, context.DeadlineExceeded)
+	}
+
+	// Cancellation aborts pending I/O.
+	ctx, cancel = context.WithCancel(context.Background())
+	if err = c.SetDeadline(time.Time{}); err != nil {
+		t.Fatalf("SetDeadline failed: %s", err)
+	}
+	stop = Guard(ctx, c)
+	time.AfterFunc(50*time.Millisecond, cancel)
+	_, err = c.Read(make([]byte, 1))
+	if err = stop(err); err != context.Canceled {
+		t.Fatalf("stop: %v, expected %v", err, context.Canceled)
+	}
+
+	// Other errors are returned as is.
+	ctx, cancel = context.WithTimeout(context.Background(), time.Hour)
+	defer cancel()
+	opErr := errors.New("failed")
+	if err = Guard(ctx, c)(opErr); err != opErr {
+		t.Fatalf("stop: %v, expected %v", err, opErr)
+	}
+}
@@ -0,0 +1,147 @@
+// Package exitproxy implements the preamble that an unmanaged client sends
+// over an established transport connection to have the server connect to a
+// destination of its choosing, and the server's destination policy.
+package exitproxy // import "github.com/RACECAR-GU/obfsX/common/exitproxy"
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"time"
+
+	"github.com/RACECAR-GU/obfsX/common/socks5"
+)
+
+const (
+	version = 0x01
+
+	// MaxTargetLength is the maximum length of a target "host:port".
+	MaxTargetLength = 255
+
+	macLength = 16
+
+	requestMACContext = "obfsX exit request"
+	replyMACContext   = "obfsX exit reply"
+
+	handshakeTimeout = 30 * time.Second
+)
+
+// ErrInvalidMAC is the error returned when the peer's preamble fails
+// authentication, ie: the peer does not know the secret.
+var ErrInvalidMAC = errors.New("exitproxy: preamble MAC mismatch")
+
+// Request is an exit request received by the server.
+type Request struct {
+	// Target is the destination "host:port" that the client asked for.
+	Target string
+
+	conn net.Conn
+	key  []byte
+	mac  []byte
+}
+
+func mac(key []byte, context string, msgs ...[]byte) []byte {
+	h := hmac.New(sha256.New, key)
+	_, _ = h.Write([]byte(context))
+	for _, m := range msgs {
+		_, _ = h.Write(m)
+	}
+	return h.Sum(nil)[:macLength]
+}
+
+// ClientHandshake sends the request for target over conn, authenticated with
+// secret, and returns the server's reply code.  Any error is returned as a
+// failure reply code, suitable for relaying to a SOCKS client, along with
+// the error.
+func ClientHandshake(conn net.Conn, secret []byte, target string) (socks5.ReplyCode, error) {
+	// The client sends a request.
+	//  uint8_t ver (0x01)
+	//  uint8_t target_len
+	//  uint8_t target[target_len] ("host:port")
+	//  uint8_t mac[16]
+	if len(target) == 0 || len(target) > MaxTargetLength {
+		return socks5.ReplyAddressNotSupported, fmt.Errorf("exitproxy: invalid target length %d", len(target))
+	}
+	hdr := []byte{version, byte(len(target))}
+	reqMAC := mac(secret, requestMACContext, hdr, []byte(target))
+	req := make([]byte, 0, len(hdr)+len(target)+macLength)
+	req = append(req, hdr...)
+	req = append(req, target...)
+	req = append(req, reqMAC...)
+
+	if err := conn.SetReadDeadline(time.Now().Add(handshakeTimeout)); err != nil {
+		return socks5.ReplyGeneralFailure, err
+	}
+	if _, err := conn.Write(req); err != nil {
+		return socks5.ReplyGeneralFailure, err
+	}
+
+	// The server sends a reply.
+	//  uint8_t ver (0x01)
+	//  uint8_t rep (SOCKS 5 reply code)
+	//  uint8_t mac[16]
+	var resp [2 + macLength]byte
+	if _, err := io.ReadFull(conn, resp[:]); err != nil {
+		return socks5.ReplyGeneralFailure, err
+	}
+	if err := conn.SetReadDeadline(time.Time{}); err != nil {
+		return socks5.ReplyGeneralFailure, err
+	}
+	if resp[0] != version {
+		return socks5.ReplyGeneralFailure, fmt.Errorf("exitproxy: invalid reply version 0x%02x", resp[0])
+	}
+	if !hmac.Equal(resp[2:], mac(secret, replyMACContext, reqMAC, resp[:2])) {
+		return socks5.ReplyGeneralFailure, ErrInvalidMAC
+	}
+
+	code := socks5.ReplyCode(resp[1])
+	if code != socks5.ReplySucceeded {
+		return code, fmt.Errorf("exitproxy: server replied 0x%02x", resp[1])
+	}
+	return code, nil
+}
+
+// ServerHandshake reads an exit request from conn, and authenticates it with
+// secret.  The caller MUST send a reply with Request.Reply.  No reply is
+// possible if the request fails authentication, as the client does not know
+// the secret.
+func ServerHandshake(conn net.Conn, secret []byte) (*Request, error) {
+	if err := conn.SetReadDeadline(time.Now().Add(handshakeTimeout)); err != nil {
+		return nil, err
+	}
+
+	var hdr [2]byte
+	if _, err := io.ReadFull(conn, hdr[:]); err != nil {
+		return nil, err
+	}
+	if hdr[0] != version {
+		return nil, fmt.Errorf("exitproxy: invalid request version 0x%02x", hdr[0])
+	}
+	if hdr[1] == 0 {
+		return nil, fmt.Errorf("exitproxy: empty target")
+	}
+	buf := make([]byte, int(hdr[1])+macLength)
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		return nil, err
+	}
+	target, reqMAC := buf[:hdr[1]], buf[hdr[1]:]
+	if !hmac.Equal(reqMAC, mac(secret, requestMACContext, hdr[:], target)) {
+		return nil, ErrInvalidMAC
+	}
+
+	if err := conn.SetReadDeadline(time.Time{}); err != nil {
+		return nil, err
+	}
+	return &Request{Target: string(target), conn: conn, key: secret, mac: reqMAC}, nil
+}
+
+// Reply sends the reply to the corresponding request.
+func (req *Request) Reply(code socks5.ReplyCode) error {
+	resp := []byte{version, byte(code)}
+	resp = append(resp, mac(req.key, replyMACContext, req.mac, resp)...)
+	_, err := req.conn.Write(resp)
+	return err
+}
@@ -0,0 +1,122 @@
+package exitproxy
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	"github.com/RACECAR-GU/obfsX/common/socks5"
+)
+
+func TestHandshake(t *testing.T) {
+	secret := []byte("correct horse battery staple")
+	for _, v := range []struct {
+		clientSecret []byte
+		code         socks5.ReplyCode
+	}{
+		{secret, socks5.ReplySucceeded},
+		{secret, socks5.ReplyConnectionNotAllowed},
+		{[]byte("wrong"), socks5.ReplyGeneralFailure},
+	} {
+		c, s := net.Pipe()
+		errCh := make(chan error, 1)
+		go func() {
+			defer s.Close()
+			req, err := ServerHandshake(s, secret)
+			if err != nil {
+				errCh <- err
+				return
+			}
+			if req.Target != "example.com:443" {
+				t.Errorf("ServerHandshake() target = '%s'", req.Target)
+			}
+			errCh <- req.Reply(v.code)
+		}()
+
+		code, err := ClientHandshake(c, v.clientSecret, "example.com:443")
+		c.Close()
+		serr := <-errCh
+		if string(v.clientSecret) != string(secret) {
+			if serr != ErrInvalidMAC {
+				t.Errorf("ServerHandshake() with the wrong secret returned %v", serr)
+			}
+			if err == nil {
+				t.Errorf("ClientHandshake() with the wrong secret succeeded")
+			}
+			continue
+		}
+		if serr != nil {
+			t.Fatalf("server failed: %s", serr)
+		}
+		if code != v.code {
+			t.Errorf("ClientHandshake() = 0x%02x, expected 0x%02x", code, v.code)
+		}
+		if (err == nil) != (v.code == socks5.ReplySucceeded) {
+			t.Errorf("ClientHandshake() returned %v for 0x%02x", err, v.code)
+		}
+	}
+}
+
+func TestPolicy(t *testing.T) {
+	p, err := ParsePolicy(append([]string{
+		"allow 127.0.0.1:8080",
+		"deny *.example.com:*",
+		"allow [2001:db8::]/32:443",
+		"deny *:25",
+		"allow *:1-1024",
+	}, DefaultPolicy...))
+	if err != nil {
+		t.Fatalf("ParsePolicy() failed: %s", err)
+	}
+
+	for _, v := range []struct {
+		host string
+		ip   string
+		port int
+		ok   bool
+	}{
+		{"127.0.0.1", "127.0.0.1", 8080, true},
+		{"127.0.0.1", "127.0.0.1", 8081, false},
+		{"localhost", "127.0.0.1", 2000, false},
+		{"www.example.com", "192.0.2.1", 443, false},
+		{"WWW.Example.COM.", "192.0.2.1", 443, false},
+		{"example.org", "192.0.2.1", 443, true},
+		{"2001:db8::1", "2001:db8::1", 443, true},
+		{"192.0.2.1", "192.0.2.1", 25, false},
+		{"192.0.2.1", "192.0.2.1", 2000, true},
+		{"10.1.2.3", "10.1.2.3", 2000, false},
+		{"::1", "::1", 2000, false},
+	} {
+		if ok := p.allowed(v.host, net.ParseIP(v.ip), v.port); ok != v.ok {
+			t.Errorf("allowed(%s, %s, %d) = %v", v.host, v.ip, v.port, ok)
+		}
+	}
+
+	// No rules, no destinations.
+	p, _ = ParsePolicy(nil)
+	if _, err = p.Resolve(context.Background(), "192.0.2.1:80"); err != ErrNotAllowed {
+		t.Errorf("Resolve() with no rules returned %v", err)
+	}
+
+	p, _ = ParsePolicy(DefaultPolicy)
+	if addrs, err := p.Resolve(context.Background(), "192.0.2.1:80"); err != nil || len(addrs) != 1 || addrs[0] != "192.0.2.1:80" {
+		t.Errorf("Resolve() returned %v, %v", addrs, err)
+	}
+	if _, err = p.Resolve(context.Background(), "127.0.0.1:80"); err != ErrNotAllowed {
+		t.Errorf("Resolve() allowed loopback: %v", err)
+	}
+
+	for _, s := range []string{
+		"allow",
+		"permit *:*",
+		"allow *",
+		"allow 10.0.0.0/33:*",
+		"allow *:0",
+		"allow *:80-22",
+		"allow *:http",
+	} {
+		if _, err = ParsePolicy([]string{s}); err == nil {
+			t.Errorf("ParsePolicy(%s) succeeded", s)
+		}
+	}
+}
@@ -0,0 +1,195 @@
+package exitproxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// ErrNotAllowed is the error returned when the policy rejects a destination.
+var ErrNotAllowed = errors.New("exitproxy: destination not allowed by policy")
+
+// DefaultPolicy is the policy used when none is configured.  It keeps clients
+// from reaching the server's own network.
+var DefaultPolicy = []string{
+	"deny 0.0.0.0/8:*",
+	"deny 127.0.0.0/8:*",
+	"deny 10.0.0.0/8:*",
+	"deny 100.64.0.0/10:*",
+	"deny 169.254.0.0/16:*",
+	"deny 172.16.0.0/12:*",
+	"deny 192.168.0.0/16:*",
+	"deny ::1/128:*",
+	"deny fc00::/7:*",
+	"deny fe80::/10:*",
+	"allow *:*",
+}
+
+// rule is a single policy rule, that matches destinations by address (a
+// network or a host name pattern) and port range.
+type rule struct {
+	allow bool
+
+	// At most one of network or host is set, neither matches everything.
+	network *net.IPNet
+	host    string
+
+	minPort, maxPort int
+}
+
+// Policy is an ordered list of allow/deny rules.  The first rule that matches
+// a destination decides, and destinations that match no rule are denied.
+type Policy struct {
+	rules []rule
+}
+
+// ParsePolicy parses the rules, each of the form:
+//
+//	allow|deny <address>:<ports>
+//
+// Where address is "*", an IP address, a network in CIDR notation ("[]" are
+// optional around IPv6 networks), a host name, or a "*." prefixed domain
+// suffix, and ports is "*", a port, or a "min-max" range.
+func ParsePolicy(rules []string) (*Policy, error) {
+	p := new(Policy)
+	for _, s := range rules {
+		r, err := parseRule(s)
+		if err != nil {
+			return nil, err
+		}
+		p.rules = append(p.rules, *r)
+	}
+	return p, nil
+}
+
+func parseRule(s string) (*rule, error) {
+	fields := strings.Fields(s)
+	if len(fields) != 2 {
+		return nil, fmt.Errorf("exitproxy: malformed rule '%s'", s)
+	}
+
+	r := new(rule)
+	switch strings.ToLower(fields[0]) {
+	case "allow":
+		r.allow = true
+	case "deny":
+	default:
+		return nil, fmt.Errorf("exitproxy: rule '%s' is not allow or deny", s)
+	}
+
+	idx := strings.LastIndexByte(fields[1], ':')
+	if idx <= 0 {
+		return nil, fmt.Errorf("exitproxy: rule '%s' is missing the ports", s)
+	}
+	addr, ports := fields[1][:idx], fields[1][idx+1:]
+	addr = strings.NewReplacer("[", "", "]", "").Replace(addr)
+
+	switch {
+	case addr == "*":
+	case strings.Contains(addr, "/"):
+		_, network, err := net.ParseCIDR(addr)
+		if err != nil {
+			return nil, fmt.Errorf("exitproxy: rule '%s' has an invalid network: %s", s, err)
+		}
+		r.network = network
+	case net.ParseIP(addr) != nil:
+		ip := net.ParseIP(addr)
+		bits := 8 * net.IPv6len
+		if ip4 := ip.To4(); ip4 != nil {
+			ip, bits = ip4, 8*net.IPv4len
+		}
+		r.network = &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}
+	default:
+		r.host = strings.ToLower(addr)
+	}
+
+	r.minPort, r.maxPort = 0, 65535
+	if ports != "*" {
+		lo, hi := ports, ports
+		if i := strings.IndexByte(ports, '-'); i >= 0 {
+			lo, hi = ports[:i], ports[i+1:]
+		}
+		var err error
+		if r.minPort, err = strconv.Atoi(lo); err != nil {
+			return nil, fmt.Errorf("exitproxy: rule '%s' has invalid ports", s)
+		}
+		if r.maxPort, err = strconv.Atoi(hi); err != nil {
+			return nil, fmt.Errorf("exitproxy: rule '%s' has invalid ports", s)
+		}
+		if r.minPort < 1 || r.maxPort > 65535 || r.minPort > r.maxPort {
+			return nil, fmt.Errorf("exitproxy: rule '%s' has invalid ports", s)
+		}
+	}
+
+	return r, nil
+}
+
+func (r *rule) matches(host string, ip net.IP, port int) bool {
+	if port < r.minPort || port > r.maxPort {
+		return false
+	}
+	switch {
+	case r.network != nil:
+		return r.network.Contains(ip)
+	case r.host != "":
+		if strings.HasPrefix(r.host, "*.") {
+			return strings.HasSuffix(host, r.host[1:])
+		}
+		return host == r.host
+	}
+	return true
+}
+
+// allowed checks if the destination host (as requested, which may be an IP
+// address), resolved to ip, is allowed.
+func (p *Policy) allowed(host string, ip net.IP, port int) bool {
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	for i := range p.rules {
+		if p.rules[i].matches(host, ip, port) {
+			return p.rules[i].allow
+		}
+	}
+	return false
+}
+
+// Resolve resolves the target "host:port", and checks all of its addresses
+// against the policy.  It returns the addresses that are allowed, in the
+// resolver's order, or ErrNotAllowed.  Dialing the returned addresses instead
+// of target ensures that the destination can not change after the check.
+func (p *Policy) Resolve(ctx context.Context, target string) ([]string, error) {
+	host, portStr, err := net.SplitHostPort(target)
+	if err != nil {
+		return nil, err
+	}
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil || port == 0 {
+		return nil, fmt.Errorf("exitproxy: invalid port '%s'", portStr)
+	}
+
+	var ips []net.IP
+	if ip := net.ParseIP(host); ip != nil {
+		ips = []net.IP{ip}
+	} else {
+		addrs, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+		if err != nil {
+			return nil, err
+		}
+		for _, a := range addrs {
+			ips = append(ips, a.IP)
+		}
+	}
+
+	var allowed []string
+	for _, ip := range ips {
+		if p.allowed(host, ip, int(port)) {
+			allowed = append(allowed, net.JoinHostPort(ip.String(), portStr))
+		}
+	}
+	if len(allowed) == 0 {
+		return nil, ErrNotAllowed
+	}
+	return allowed, nil
+}
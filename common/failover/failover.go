@@ -0,0 +1,354 @@
+// Package failover connects to one of a set of equivalent endpoints (eg:
+// bridges), racing the attempts Happy Eyeballs style (RFC 8305), and keeps
+// per-endpoint health scores, so that later attempts prefer the endpoints
+// that are up and fast.
+//
+// Notes:
+//   - The most preferred endpoint is tried first, the next one once it
+//     fails, or once the attempt delay passes without it connecting, and so
+//     on, until one connects.  The others are then abandoned, or closed if
+//     they connect anyway.
+//   - Failed attempts count against the endpoint, unless they were
+//     abandoned (the context was canceled), so that errors on the
+//     application's side do not.
+//   - The scores can be saved to a JSON file, and are saved after a change
+//     once a delay passes, so that busy clients do not write them on every
+//     connection.
+package failover // import "github.com/RACECAR-GU/obfsX/common/failover"
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultAttemptDelay is the delay before racing the next endpoint.
+	DefaultAttemptDelay = 2 * time.Second
+
+	// retryInterval is how long an endpoint that failed is only tried
+	// after the others, doubling with each consecutive failure, up to
+	// maxRetryInterval.
+	retryInterval    = time.Minute
+	maxRetryInterval = time.Hour
+
+	// latencyWeight is the weight of a new sample in the average latency.
+	latencyWeight = 0.3
+
+	// saveDelay is how long the scores wait to be saved after a change.
+	saveDelay = 10 * time.Second
+)
+
+// ErrNoEndpoints is the error returned when there is nothing to connect to.
+var ErrNoEndpoints = errors.New("failover: no endpoints")
+
+// Score is the health of an endpoint.
+type Score struct {
+	// Successes and Failures are the number of attempts that connected,
+	// and that failed.
+	Successes uint64 `json:"successes"`
+	Failures  uint64 `json:"failures"`
+
+	// ConsecutiveFailures is the number of attempts that failed since the
+	// last one that connected.
+	ConsecutiveFailures int `json:"consecutiveFailures"`
+
+	// LatencyMs is the moving average of the time taken to connect, in
+	// milliseconds, or 0 if it never has.
+	LatencyMs float64 `json:"latencyMs"`
+
+	// LastSuccess and LastFailure are the times of the last attempts that
+	// connected, and that failed.
+	LastSuccess time.Time `json:"lastSuccess"`
+	LastFailure time.Time `json:"lastFailure"`
+}
+
+// failing returns if the endpoint failed recently, and should only be tried
+// after the others.
+func (s *Score) failing(now time.Time) bool {
+	if s.ConsecutiveFailures == 0 {
+		return false
+	}
+	backoff := maxRetryInterval
+	if s.ConsecutiveFailures < 8 {
+		if d := retryInterval << uint(s.ConsecutiveFailures-1); d < backoff {
+			backoff = d
+		}
+	}
+	return now.Sub(s.LastFailure) < backoff
+}
+
+// Scores are the scores of the endpoints, keyed by an endpoint identifier
+// (eg: the transport and address of a bridge).  They are safe for
+// concurrent use.
+type Scores struct {
+	sync.Mutex
+
+	path   string
+	scores map[string]*Score
+	timer  *time.Timer
+}
+
+// NewScores returns empty scores, that are not saved.
+func NewScores() *Scores {
+	return &Scores{scores: make(map[string]*Score)}
+}
+
+// LoadScores loads the scores saved to path, if any, and saves the changes to
+// it.  If the file is invalid, the scores start empty, and the error is
+// returned along with them.
+func LoadScores(path string) (*Scores, error) {
+	s := NewScores()
+	s.path = path
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return s, nil
+		}
+		return s, err
+	}
+	if err = json.Unmarshal(b, &s.scores); err != nil {
+		s.scores = make(map[string]*Score)
+		return s, err
+	}
+	for k, v := range s.scores {
+		if v == nil {
+			delete(s.scores, k)
+		}
+	}
+	return s, nil
+}
+
+// Get returns the score of the endpoint.
+func (s *Scores) Get(key string) Score {
+	s.Lock()
+	defer s.Unlock()
+	if sc := s.scores[key]; sc != nil {
+		return *sc
+	}
+	return Score{}
+}
+
+// Success records an attempt that connected, in latency.
+func (s *Scores) Success(key string, latency time.Duration) {
+	s.update(key, func(sc *Score, now time.Time) {
+		ms := float64(latency) / float64(time.Millisecond)
+		if sc.LatencyMs == 0 {
+			sc.LatencyMs = ms
+		} else {
+			sc.LatencyMs += latencyWeight * (ms - sc.LatencyMs)
+		}
+		sc.Successes++
+		sc.ConsecutiveFailures = 0
+		sc.LastSuccess = now
+	})
+}
+
+// Failure records an attempt that failed.
+func (s *Scores) Failure(key string) {
+	s.update(key, func(sc *Score, now time.Time) {
+		sc.Failures++
+		sc.ConsecutiveFailures++
+		sc.LastFailure = now
+	})
+}
+
+func (s *Scores) update(key string, fn func(sc *Score, now time.Time)) {
+	s.Lock()
+	defer s.Unlock()
+	sc := s.scores[key]
+	if sc == nil {
+		sc = new(Score)
+		s.scores[key] = sc
+	}
+	fn(sc, time.Now())
+	if s.path != "" && s.timer == nil {
+		s.timer = time.AfterFunc(saveDelay, func() {
+			_ = s.Save()
+		})
+	}
+}
+
+// Save saves the scores, if they were loaded from a file.
+func (s *Scores) Save() error {
+	s.Lock()
+	defer s.Unlock()
+	if s.timer != nil {
+		s.timer.Stop()
+		s.timer = nil
+	}
+	if s.path == "" {
+		return nil
+	}
+	b, err := json.MarshalIndent(s.scores, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	// Replace the file, so that it is never left partially written.
+	tmp := s.path + ".tmp"
+	if err = ioutil.WriteFile(tmp, b, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.path)
+}
+
+// Order returns the indexes of the endpoints, most preferred first: the ones
+// that did not fail recently, fastest first, then the ones that never
+// connected, then the ones that failed recently, least consecutive failures
+// first.  Ties keep the order of keys.
+func (s *Scores) Order(keys []string) []int {
+	s.Lock()
+	scores := make([]Score, len(keys))
+	for i, k := range keys {
+		if sc := s.scores[k]; sc != nil {
+			scores[i] = *sc
+		}
+	}
+	s.Unlock()
+
+	now := time.Now()
+	rank := func(sc *Score) int {
+		switch {
+		case sc.failing(now):
+			return 2
+		case sc.LatencyMs == 0:
+			return 1
+		}
+		return 0
+	}
+	order := make([]int, len(keys))
+	for i := range order {
+		order[i] = i
+	}
+	sort.SliceStable(order, func(a, b int) bool {
+		sa, sb := &scores[order[a]], &scores[order[b]]
+		ra, rb := rank(sa), rank(sb)
+		switch {
+		case ra != rb:
+			return ra < rb
+		case ra == 0:
+			return sa.LatencyMs < sb.LatencyMs
+		case ra == 2:
+			return sa.ConsecutiveFailures < sb.ConsecutiveFailures
+		}
+		return false
+	})
+	return order
+}
+
+// DialFunc connects to the endpoint at index i.
+type DialFunc func(ctx context.Context, i int) (net.Conn, error)
+
+// Dialer races the connections to a set of endpoints.
+type Dialer struct {
+	// Keys are the identifiers of the endpoints in Scores.
+	Keys []string
+
+	// Scores are the endpoints' scores, which are updated with the
+	// outcome of each attempt.
+	Scores *Scores
+
+	// AttemptDelay is the delay before racing the next endpoint, or
+	// DefaultAttemptDelay if 0.
+	AttemptDelay time.Duration
+
+	// Dial connects to an endpoint.
+	Dial DialFunc
+}
+
+type attempt struct {
+	i       int
+	rank    int
+	conn    net.Conn
+	err     error
+	latency time.Duration
+}
+
+// DialContext connects to one of the endpoints, returning the connection and
+// the endpoint's index.  If all of them fail, the error of the most
+// preferred one is returned.
+func (d *Dialer) DialContext(ctx context.Context) (net.Conn, int, error) {
+	if len(d.Keys) == 0 {
+		return nil, -1, ErrNoEndpoints
+	}
+	delay := d.AttemptDelay
+	if delay <= 0 {
+		delay = DefaultAttemptDelay
+	}
+	order := d.Scores.Order(d.Keys)
+
+	raceCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	results := make(chan *attempt, len(order))
+	next, pending := 0, 0
+	start := func() {
+		i, rank := order[next], next
+		next++
+		pending++
+		go func() {
+			t := time.Now()
+			conn, err := d.Dial(raceCtx, i)
+			results <- &attempt{i: i, rank: rank, conn: conn, err: err, latency: time.Since(t)}
+		}()
+	}
+	record := func(a *attempt) {
+		switch {
+		case a.err == nil:
+			d.Scores.Success(d.Keys[a.i], a.latency)
+		case raceCtx.Err() == nil:
+			d.Scores.Failure(d.Keys[a.i])
+		}
+	}
+
+	start()
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	var preferredErr error
+	for pending > 0 {
+		select {
+		case a := <-results:
+			pending--
+			record(a)
+			if a.err == nil {
+				// Abandon the other attempts, closing the ones that
+				// connect anyway.
+				cancel()
+				go func(pending int) {
+					for ; pending > 0; pending-- {
+						if a := <-results; a.conn != nil {
+							record(a)
+							a.conn.Close()
+						}
+					}
+				}(pending)
+				return a.conn, a.i, nil
+			}
+			if a.rank == 0 {
+				preferredErr = a.err
+			}
+			if next < len(order) && ctx.Err() == nil {
+				start()
+				if !timer.Stop() {
+					select {
+					case <-timer.C:
+					default:
+					}
+				}
+				timer.Reset(delay)
+			}
+		case <-timer.C:
+			if next < len(order) {
+				start()
+				timer.Reset(delay)
+			}
+		}
+	}
+	return nil, -1, preferredErr
+}
@@ -0,0 +1,209 @@
+package failover
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestOrder(t *testing.T) {
+	s := NewScores()
+	now := time.Now()
+	s.scores["slow"] = &Score{LatencyMs: 300}
+	s.scores["fast"] = &Score{LatencyMs: 100}
+	s.scores["down"] = &Score{LatencyMs: 50, ConsecutiveFailures: 1, LastFailure: now}
+	s.scores["very-down"] = &Score{ConsecutiveFailures: 3, LastFailure: now}
+	s.scores["recovered"] = &Score{LatencyMs: 200, ConsecutiveFailures: 1, LastFailure: now.Add(-2 * retryInterval)}
+
+	keys := []string{"very-down", "new", "down", "slow", "recovered", "fast", "other-new"}
+	var got []string
+	for _, i := range s.Order(keys) {
+		got = append(got, keys[i])
+	}
+	expected := []string{"fast", "recovered", "slow", "new", "other-new", "down", "very-down"}
+	if !reflect.DeepEqual(got, expected) {
+		t.Fatalf("Order: %v, expected %v", got, expected)
+	}
+}
+
+func TestScores(t *testing.T) {
+	dir, err := ioutil.TempDir("", "failover")
+	if err != nil {
+		t.Fatalf("TempDir failed: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "scores.json")
+
+	s, err := LoadScores(path)
+	if err != nil {
+		t.Fatalf("LoadScores without a file failed: %s", err)
+	}
+	s.Success("a", 100*time.Millisecond)
+	s.Success("a", 200*time.Millisecond)
+	s.Failure("b")
+	s.Failure("a")
+	if err = s.Save(); err != nil {
+		t.Fatalf("Save failed: %s", err)
+	}
+
+	s, err = LoadScores(path)
+	if err != nil {
+		t.Fatalf("LoadScores failed: %s", err)
+	}
+	a, b := s.Get("a"), s.Get("b")
+	if a.Successes != 2 || a.Failures != 1 || a.ConsecutiveFailures != 1 || a.LatencyMs != 130 {
+		t.Fatalf("a: %+v", a)
+	}
+	if b.Successes != 0 || b.Failures != 1 || b.LastFailure.IsZero() {
+		t.Fatalf("b: %+v", b)
+	}
+	s.Success("b", time.Second)
+	if b = s.Get("b"); b.ConsecutiveFailures != 0 || b.LatencyMs != 1000 {
+		t.Fatalf("b after a success: %+v", b)
+	}
+
+	if err = ioutil.WriteFile(path, []byte("{"), 0600); err != nil {
+		t.Fatalf("WriteFile failed: %s", err)
+	}
+	if s, err = LoadScores(path); err == nil || s == nil || s.Get("a").Successes != 0 {
+		t.Fatalf("LoadScores accepted an invalid file")
+	}
+}
+
+// testDialer returns a dialer over endpoints that connect (with a
+// net.Pipe) after their delay, or fail after its opposite if it is negative,
+// or block until abandoned if it is 0.
+func testDialer(s *Scores, delays map[string]time.Duration) (*Dialer, *sync.WaitGroup) {
+	var keys []string
+	for k := range delays {
+		keys = append(keys, k)
+	}
+	var wg sync.WaitGroup
+	d := &Dialer{
+		Keys:         keys,
+		Scores:       s,
+		AttemptDelay: 50 * time.Millisecond,
+		Dial: func(ctx context.Context, i int) (net.Conn, error) {
+			wg.Add(1)
+			defer wg.Done()
+			delay := delays[keys[i]]
+			switch {
+			case delay < 0:
+				time.Sleep(-delay)
+				return nil, errors.New(keys[i] + " failed")
+			case delay == 0:
+				<-ctx.Done()
+				return nil, ctx.Err()
+			}
+			select {
+			case <-time.After(delay):
+				c, _ := net.Pipe()
+				return c, nil
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			}
+		},
+	}
+	return d, &wg
+}
+
+func TestDialFailover(t *testing.T) {
+	s := NewScores()
+	s.Success("broken", time.Millisecond)
+	d, _ := testDialer(s, map[string]time.Duration{"broken": -1, "working": time.Millisecond})
+
+	conn, i, err := d.DialContext(context.Background())
+	if err != nil {
+		t.Fatalf("DialContext failed: %s", err)
+	}
+	conn.Close()
+	if d.Keys[i] != "working" {
+		t.Fatalf("connected to %s", d.Keys[i])
+	}
+	if sc := s.Get("broken"); sc.Failures != 1 {
+		t.Fatalf("the failure was not counted: %+v", sc)
+	}
+
+	// The broken endpoint is now tried last.
+	if order := s.Order(d.Keys); d.Keys[order[0]] != "working" {
+		t.Fatalf("the broken endpoint is still preferred")
+	}
+}
+
+func TestDialRace(t *testing.T) {
+	s := NewScores()
+	s.Success("hanging", time.Millisecond)
+	d, wg := testDialer(s, map[string]time.Duration{"hanging": 0, "slow": time.Second, "working": time.Millisecond})
+	s.Success("slow", 2*time.Millisecond)
+
+	start := time.Now()
+	conn, i, err := d.DialContext(context.Background())
+	if err != nil {
+		t.Fatalf("DialContext failed: %s", err)
+	}
+	conn.Close()
+	if d.Keys[i] != "working" {
+		t.Fatalf("connected to %s", d.Keys[i])
+	}
+	if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+		t.Fatalf("the race took %s", elapsed)
+	}
+
+	// The abandoned attempts are not failures.
+	wg.Wait()
+	for _, k := range []string{"hanging", "slow"} {
+		if sc := s.Get(k); sc.Failures != 0 {
+			t.Fatalf("%s: the abandoned attempt was counted: %+v", k, sc)
+		}
+	}
+}
+
+func TestDialCanceled(t *testing.T) {
+	s := NewScores()
+	d, _ := testDialer(s, map[string]time.Duration{"a": 0, "b": 0})
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(100*time.Millisecond, cancel)
+	if _, _, err := d.DialContext(ctx); err != context.Canceled {
+		t.Fatalf("DialContext: %v, expected context.Canceled", err)
+	}
+	for _, k := range d.Keys {
+		if sc := s.Get(k); sc.Failures != 0 {
+			t.Fatalf("%s: the canceled attempt was counted: %+v", k, sc)
+		}
+	}
+}
+
+func TestDialAllFail(t *testing.T) {
+	s := NewScores()
+	s.Success("first", time.Millisecond)
+	d, _ := testDialer(s, map[string]time.Duration{"first": -1, "second": -1})
+	_, _, err := d.DialContext(context.Background())
+	if err == nil || err.Error() != "first failed" {
+		t.Fatalf("DialContext: %v, expected the first endpoint's error", err)
+	}
+	for _, k := range d.Keys {
+		if sc := s.Get(k); sc.Failures != 1 {
+			t.Fatalf("%s: %+v", k, sc)
+		}
+	}
+
+	// Even if it is the last one to fail.
+	s = NewScores()
+	s.Success("first", time.Millisecond)
+	d, _ = testDialer(s, map[string]time.Duration{"first": -200 * time.Millisecond, "second": -1})
+	if _, _, err = d.DialContext(context.Background()); err == nil || err.Error() != "first failed" {
+		t.Fatalf("DialContext: %v, expected the first endpoint's error", err)
+	}
+
+	d.Keys = nil
+	if _, _, err = d.DialContext(context.Background()); err != ErrNoEndpoints {
+		t.Fatalf("DialContext without endpoints: %v", err)
+	}
+}
@@ -0,0 +1,158 @@
+// Package httpconnect implements an HTTP CONNECT proxy server handshake, and
+// the pluggable transport specific extension of passing the arguments in the
+// Proxy-Authorization header, the same way as the socks5 package does with
+// the RFC 1929 username and password.
+//
+// Notes:
+//   - Only the CONNECT method is supported.
+//   - Only the Basic authentication scheme is supported.  The credentials are
+//     always accepted, as they are used as a channel to pass information
+//     rather than for authentication.
+package httpconnect // import "github.com/RACECAR-GU/obfsX/common/httpconnect"
+
+import (
+	"bufio"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"git.torproject.org/pluggable-transports/goptlib.git"
+	"github.com/RACECAR-GU/obfsX/common/socks5"
+)
+
+const (
+	requestTimeout = 5 * time.Second
+
+	// maxRequestLength bounds the request line and headers.
+	maxRequestLength = 64 * 1024
+
+	basicScheme = "Basic "
+)
+
+// Request describes an HTTP CONNECT request.
+type Request struct {
+	// Target is the "host:port" to connect to.
+	Target string
+
+	// Args are the arguments from the Proxy-Authorization header.
+	Args pt.Args
+
+	conn net.Conn
+	br   *bufio.Reader
+}
+
+// Handshake reads an HTTP CONNECT request from the provided connection.  The
+// routine handles sending appropriate errors if applicable, but will not
+// close the connection.
+func Handshake(conn net.Conn) (*Request, error) {
+	// Arm the handshake timeout.
+	var err error
+	if err = conn.SetDeadline(time.Now().Add(requestTimeout)); err != nil {
+		return nil, err
+	}
+	defer func() {
+		// Disarm the handshake timeout, only propagate the error if
+		// the handshake was successful.
+		nerr := conn.SetDeadline(time.Time{})
+		if err == nil {
+			err = nerr
+		}
+	}()
+
+	req := &Request{
+		conn: conn,
+		br:   bufio.NewReader(&io.LimitedReader{R: conn, N: maxRequestLength}),
+	}
+	var hreq *http.Request
+	if hreq, err = http.ReadRequest(req.br); err != nil {
+		_ = req.writeStatus(http.StatusBadRequest)
+		return nil, fmt.Errorf("malformed request: %s", err)
+	}
+	if hreq.Method != http.MethodConnect {
+		_ = req.writeStatus(http.StatusMethodNotAllowed)
+		return nil, fmt.Errorf("unsupported method '%s'", hreq.Method)
+	}
+
+	// The request target is the authority ("host:port").
+	req.Target = hreq.RequestURI
+	if _, _, err = net.SplitHostPort(req.Target); err != nil {
+		_ = req.writeStatus(http.StatusBadRequest)
+		return nil, fmt.Errorf("invalid target '%s'", req.Target)
+	}
+
+	req.Args = make(pt.Args)
+	if auth := hreq.Header.Get("Proxy-Authorization"); auth != "" {
+		var argStr string
+		if argStr, err = parseProxyAuthorization(auth); err == nil {
+			req.Args, err = socks5.ParseClientParameters(argStr)
+		}
+		if err != nil {
+			_ = req.writeStatus(http.StatusBadRequest)
+			return nil, err
+		}
+	}
+
+	return req, nil
+}
+
+// parseProxyAuthorization returns the argument string passed in the Basic
+// credentials, the username and password combined.
+func parseProxyAuthorization(auth string) (string, error) {
+	if len(auth) < len(basicScheme) || !strings.EqualFold(auth[:len(basicScheme)], basicScheme) {
+		return "", fmt.Errorf("unsupported authorization scheme")
+	}
+	decoded, err := base64.StdEncoding.DecodeString(strings.TrimSpace(auth[len(basicScheme):]))
+	if err != nil {
+		return "", fmt.Errorf("malformed credentials: %s", err)
+	}
+	creds := string(decoded)
+	if idx := strings.IndexByte(creds, ':'); idx >= 0 {
+		return creds[:idx] + creds[idx+1:], nil
+	}
+	return creds, nil
+}
+
+// Buffered returns the data that the client sent after the request (eg: a
+// pipelined TLS ClientHello), which must be relayed before anything else.
+func (req *Request) Buffered() []byte {
+	b, _ := req.br.Peek(req.br.Buffered())
+	return b
+}
+
+// Reply sends the HTTP response that corresponds to the SOCKS5 reply code, so
+// that the callers can handle both protocols alike.
+func (req *Request) Reply(code socks5.ReplyCode) error {
+	return req.writeStatus(replyStatus(code))
+}
+
+func replyStatus(code socks5.ReplyCode) int {
+	switch code {
+	case socks5.ReplySucceeded:
+		return http.StatusOK
+	case socks5.ReplyConnectionNotAllowed:
+		return http.StatusForbidden
+	case socks5.ReplyTTLExpired:
+		return http.StatusGatewayTimeout
+	case socks5.ReplyCommandNotSupported, socks5.ReplyAddressNotSupported:
+		return http.StatusBadRequest
+	default:
+		return http.StatusBadGateway
+	}
+}
+
+func (req *Request) writeStatus(status int) error {
+	resp := fmt.Sprintf("HTTP/1.1 %d %s\r\n", status, http.StatusText(status))
+	switch status {
+	case http.StatusOK:
+	case http.StatusMethodNotAllowed:
+		resp += "Allow: CONNECT\r\nConnection: close\r\nContent-Length: 0\r\n"
+	default:
+		resp += "Connection: close\r\nContent-Length: 0\r\n"
+	}
+	_, err := io.WriteString(req.conn, resp+"\r\n")
+	return err
+}
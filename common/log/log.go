@@ -36,6 +36,7 @@ import (
 	"net"
 	"os"
 	"strings"
+	"sync/atomic"
 )
 
 const (
@@ -54,7 +55,8 @@ const (
 	LevelDebug
 )
 
-var logLevel = LevelInfo
+// logLevel is accessed atomically, as it can be changed at runtime.
+var logLevel int32 = LevelInfo
 var enableLogging bool
 var unsafeLogging bool
 
@@ -86,27 +88,42 @@ func Unsafe() bool {
 
 // Level returns the current log level.
 func Level() int {
-	return logLevel
+	return int(atomic.LoadInt32(&logLevel))
 }
 
 // SetLogLevel sets the log level to the value indicated by the given string
 // (case-insensitive).
 func SetLogLevel(logLevelStr string) error {
+	var level int32
 	switch strings.ToUpper(logLevelStr) {
 	case "ERROR":
-		logLevel = LevelError
+		level = LevelError
 	case "WARN":
-		logLevel = LevelWarn
+		level = LevelWarn
 	case "INFO":
-		logLevel = LevelInfo
+		level = LevelInfo
 	case "DEBUG":
-		logLevel = LevelDebug
+		level = LevelDebug
 	default:
 		return fmt.Errorf("invalid log level '%s'", logLevelStr)
 	}
+	atomic.StoreInt32(&logLevel, level)
 	return nil
 }
 
+// LevelName returns the name of the current log level (eg: "INFO").
+func LevelName() string {
+	switch Level() {
+	case LevelError:
+		return "ERROR"
+	case LevelWarn:
+		return "WARN"
+	case LevelInfo:
+		return "INFO"
+	}
+	return "DEBUG"
+}
+
 // Noticef logs the given format string/arguments at the NOTICE log level.
 // Unless logging is disabled, Noticef logs are always emitted.
 func Noticef(format string, a ...interface{}) {
@@ -118,7 +135,7 @@ func Noticef(format string, a ...interface{}) {
 
 // Errorf logs the given format string/arguments at the ERROR log level.
 func Errorf(format string, a ...interface{}) {
-	if enableLogging && logLevel >= LevelError {
+	if enableLogging && Level() >= LevelError {
 		msg := fmt.Sprintf(format, a...)
 		log.Print("[ERROR]: " + msg)
 	}
@@ -126,7 +143,7 @@ func Errorf(format string, a ...interface{}) {
 
 // Warnf logs the given format string/arguments at the WARN log level.
 func Warnf(format string, a ...interface{}) {
-	if enableLogging && logLevel >= LevelWarn {
+	if enableLogging && Level() >= LevelWarn {
 		msg := fmt.Sprintf(format, a...)
 		log.Print("[WARN]: " + msg)
 	}
@@ -134,7 +151,7 @@ func Warnf(format string, a ...interface{}) {
 
 // Infof logs the given format string/arguments at the INFO log level.
 func Infof(format string, a ...interface{}) {
-	if enableLogging && logLevel >= LevelInfo {
+	if enableLogging && Level() >= LevelInfo {
 		msg := fmt.Sprintf(format, a...)
 		log.Print("[INFO]: " + msg)
 	}
@@ -142,7 +159,7 @@ func Infof(format string, a ...interface{}) {
 
 // Debugf logs the given format string/arguments at the DEBUG log level.
 func Debugf(format string, a ...interface{}) {
-	if enableLogging && logLevel >= LevelDebug {
+	if enableLogging && Level() >= LevelDebug {
 		msg := fmt.Sprintf(format, a...)
 		log.Print("[DEBUG]: " + msg)
 	}
@@ -0,0 +1,67 @@
+package metrics
+
+import (
+	"errors"
+	"net"
+	"sync/atomic"
+)
+
+var errHalfCloseUnsupported = errors.New("half-close not supported")
+
+// Conn is a net.Conn that counts the bytes read and written, both for the
+// connection itself and in the (optional) shared counters.
+type Conn struct {
+	// The 64 bit values are first, for alignment on 32 bit platforms.
+	nRead, nWritten uint64
+
+	net.Conn
+
+	read, written *Counter
+}
+
+// NewConn wraps conn, adding the bytes read from and written to it to read
+// and written, either of which may be nil.
+func NewConn(conn net.Conn, read, written *Counter) *Conn {
+	return &Conn{Conn: conn, read: read, written: written}
+}
+
+func (c *Conn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	if n > 0 {
+		atomic.AddUint64(&c.nRead, uint64(n))
+		if c.read != nil {
+			c.read.Add(uint64(n))
+		}
+	}
+	return n, err
+}
+
+func (c *Conn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	if n > 0 {
+		atomic.AddUint64(&c.nWritten, uint64(n))
+		if c.written != nil {
+			c.written.Add(uint64(n))
+		}
+	}
+	return n, err
+}
+
+// CloseWrite closes the write side of the wrapped connection, if it supports
+// half-closes.
+func (c *Conn) CloseWrite() error {
+	if hc, ok := c.Conn.(interface{ CloseWrite() error }); ok {
+		return hc.CloseWrite()
+	}
+	return &net.OpError{Op: "close", Net: "metrics", Err: errHalfCloseUnsupported}
+}
+
+// BytesRead returns the number of bytes read from the connection.
+func (c *Conn) BytesRead() uint64 {
+	return atomic.LoadUint64(&c.nRead)
+}
+
+// BytesWritten returns the number of bytes written to the connection.
+func (c *Conn) BytesWritten() uint64 {
+	return atomic.LoadUint64(&c.nWritten)
+}
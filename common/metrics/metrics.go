@@ -0,0 +1,321 @@
+// Package metrics implements counters and gauges that are exposed over HTTP
+// in the Prometheus text format, without depending on the Prometheus client
+// library.
+package metrics // import "github.com/RACECAR-GU/obfsX/common/metrics"
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	typeCounter = "counter"
+	typeGauge   = "gauge"
+
+	// ContentType is the Prometheus text exposition format content type.
+	ContentType = "text/plain; version=0.0.4; charset=utf-8"
+
+	// Path is the path that ListenAndServe serves the metrics on.
+	Path = "/metrics"
+)
+
+// Counter is a monotonically increasing value.
+type Counter struct {
+	v uint64
+}
+
+// Add increments the counter by n.
+func (c *Counter) Add(n uint64) {
+	atomic.AddUint64(&c.v, n)
+}
+
+// Inc increments the counter by 1.
+func (c *Counter) Inc() {
+	c.Add(1)
+}
+
+// Value returns the current value of the counter.
+func (c *Counter) Value() uint64 {
+	return atomic.LoadUint64(&c.v)
+}
+
+// Gauge is a value that can go up and down.
+type Gauge struct {
+	v int64
+}
+
+// Add adds n (which may be negative) to the gauge.
+func (g *Gauge) Add(n int64) {
+	atomic.AddInt64(&g.v, n)
+}
+
+// Set sets the gauge to n.
+func (g *Gauge) Set(n int64) {
+	atomic.StoreInt64(&g.v, n)
+}
+
+// Value returns the current value of the gauge.
+func (g *Gauge) Value() int64 {
+	return atomic.LoadInt64(&g.v)
+}
+
+// metric is a single time series of a family.
+type metric struct {
+	labels string
+	value  func() float64
+	impl   interface{}
+}
+
+// family is all of the time series that share a name.
+type family struct {
+	name, help, typ string
+	metrics         map[string]*metric
+}
+
+// Registry is a set of metrics.  It is safe for concurrent use, and
+// implements http.Handler to serve them.
+type Registry struct {
+	sync.Mutex
+
+	families map[string]*family
+}
+
+// NewRegistry creates an empty Registry.
+func NewRegistry() *Registry {
+	return &Registry{families: make(map[string]*family)}
+}
+
+// Counter returns the counter with the name and labels, which are key/value
+// pairs, creating it if needed.  It panics if the name is registered with a
+// different type, or the labels are malformed.
+func (r *Registry) Counter(name, help string, labels ...string) *Counter {
+	m := r.get(name, help, typeCounter, labels, func() *metric {
+		c := new(Counter)
+		return &metric{value: func() float64 { return float64(c.Value()) }, impl: c}
+	})
+	return m.impl.(*Counter)
+}
+
+// Gauge returns the gauge with the name and labels, which are key/value
+// pairs, creating it if needed.  It panics if the name is registered with a
+// different type, or the labels are malformed.
+func (r *Registry) Gauge(name, help string, labels ...string) *Gauge {
+	m := r.get(name, help, typeGauge, labels, func() *metric {
+		g := new(Gauge)
+		return &metric{value: func() float64 { return float64(g.Value()) }, impl: g}
+	})
+	return m.impl.(*Gauge)
+}
+
+// GaugeFunc registers a gauge with the name and labels, that is sampled by
+// calling fn each time the metrics are collected.  Registering the same
+// gauge again replaces fn.
+func (r *Registry) GaugeFunc(name, help string, fn func() float64, labels ...string) {
+	r.sampled(name, help, typeGauge, fn, labels)
+}
+
+// CounterFunc registers a counter with the name and labels, that is sampled
+// by calling fn each time the metrics are collected (eg: to export a count
+// kept elsewhere).  fn MUST NOT decrease.  Registering the same counter
+// again replaces fn.
+func (r *Registry) CounterFunc(name, help string, fn func() float64, labels ...string) {
+	r.sampled(name, help, typeCounter, fn, labels)
+}
+
+func (r *Registry) sampled(name, help, typ string, fn func() float64, labels []string) {
+	m := r.get(name, help, typ, labels, func() *metric {
+		return &metric{value: fn}
+	})
+
+	r.Lock()
+	defer r.Unlock()
+	m.value, m.impl = fn, nil
+}
+
+func (r *Registry) get(name, help, typ string, labels []string, newMetric func() *metric) *metric {
+	if !validName(name) {
+		panic(fmt.Sprintf("metrics: invalid name '%s'", name))
+	}
+	key := formatLabels(labels)
+
+	r.Lock()
+	defer r.Unlock()
+
+	fam := r.families[name]
+	if fam == nil {
+		fam = &family{name: name, help: help, typ: typ, metrics: make(map[string]*metric)}
+		r.families[name] = fam
+	} else if fam.typ != typ {
+		panic(fmt.Sprintf("metrics: '%s' is a %s, not a %s", name, fam.typ, typ))
+	}
+	m := fam.metrics[key]
+	if m == nil {
+		m = newMetric()
+		m.labels = key
+		fam.metrics[key] = m
+	}
+	return m
+}
+
+// WriteTo writes the metrics to w in the Prometheus text format, sorted by
+// name and labels.
+func (r *Registry) WriteTo(w io.Writer) (int64, error) {
+	type sample struct {
+		labels string
+		value  float64
+	}
+
+	// Sample everything first, so that the lock is not held while writing.
+	r.Lock()
+	families := make([]*family, 0, len(r.families))
+	samples := make(map[string][]sample)
+	for _, fam := range r.families {
+		families = append(families, fam)
+		for _, m := range fam.metrics {
+			samples[fam.name] = append(samples[fam.name], sample{m.labels, m.value()})
+		}
+	}
+	r.Unlock()
+	sort.Slice(families, func(i, j int) bool { return families[i].name < families[j].name })
+
+	cw := &countingWriter{w: bufio.NewWriter(w)}
+	for _, fam := range families {
+		s := samples[fam.name]
+		sort.Slice(s, func(i, j int) bool { return s[i].labels < s[j].labels })
+
+		fmt.Fprintf(cw, "# HELP %s %s\n", fam.name, helpEscaper.Replace(fam.help))
+		fmt.Fprintf(cw, "# TYPE %s %s\n", fam.name, fam.typ)
+		for _, v := range s {
+			fmt.Fprintf(cw, "%s%s %s\n", fam.name, v.labels, formatValue(v.value))
+		}
+	}
+	if cw.err == nil {
+		cw.err = cw.w.Flush()
+	}
+	return cw.n, cw.err
+}
+
+// ServeHTTP serves the metrics in the Prometheus text format.
+func (r *Registry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet && req.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", ContentType)
+	if req.Method == http.MethodGet {
+		_, _ = r.WriteTo(w)
+	}
+}
+
+// ListenAndServe serves the metrics on Path at the TCP address addr, until
+// the returned listener is closed.
+func (r *Registry) ListenAndServe(addr string) (net.Listener, error) {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle(Path, r)
+	srv := &http.Server{
+		Handler:           mux,
+		ReadHeaderTimeout: 10 * time.Second,
+		WriteTimeout:      10 * time.Second,
+	}
+	go func() {
+		_ = srv.Serve(ln)
+	}()
+	return ln, nil
+}
+
+type countingWriter struct {
+	w   *bufio.Writer
+	n   int64
+	err error
+}
+
+func (cw *countingWriter) Write(p []byte) (int, error) {
+	if cw.err != nil {
+		return 0, cw.err
+	}
+	n, err := cw.w.Write(p)
+	cw.n += int64(n)
+	cw.err = err
+	return n, err
+}
+
+var (
+	helpEscaper  = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+	valueEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`)
+)
+
+func validName(name string) bool {
+	if name == "" {
+		return false
+	}
+	for i, c := range name {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c == '_', c == ':':
+		case c >= '0' && c <= '9' && i > 0:
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// formatLabels renders the key/value pairs as `{k="v",...}`, sorted by key.
+func formatLabels(labels []string) string {
+	if len(labels)%2 != 0 {
+		panic("metrics: labels must be key/value pairs")
+	}
+	if len(labels) == 0 {
+		return ""
+	}
+
+	pairs := make([][2]string, 0, len(labels)/2)
+	for i := 0; i < len(labels); i += 2 {
+		if !validName(labels[i]) || strings.Contains(labels[i], ":") {
+			panic(fmt.Sprintf("metrics: invalid label name '%s'", labels[i]))
+		}
+		pairs = append(pairs, [2]string{labels[i], labels[i+1]})
+	}
+	sort.Slice(pairs, func(i, j int) bool { return pairs[i][0] < pairs[j][0] })
+
+	var b strings.Builder
+	b.WriteByte('{')
+	for i, p := range pairs {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		fmt.Fprintf(&b, "%s=\"%s\"", p[0], valueEscaper.Replace(p[1]))
+	}
+	b.WriteByte('}')
+	return b.String()
+}
+
+func formatValue(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	case math.IsNaN(v):
+		return "NaN"
+	}
+	if v == math.Trunc(v) && math.Abs(v) < 1e15 {
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
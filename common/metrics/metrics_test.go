@@ -0,0 +1,174 @@
+package metrics
+
+import (
+	"bufio"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// scrape fetches the metrics from addr, and parses the samples into a map
+// keyed by `name{labels}`, checking that each family has HELP and TYPE lines.
+func scrape(t *testing.T, addr string) map[string]float64 {
+	resp, err := http.Get("http://" + addr + Path)
+	if err != nil {
+		t.Fatalf("scrape failed: %s", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("scrape status: %s", resp.Status)
+	}
+	if ct := resp.Header.Get("Content-Type"); ct != ContentType {
+		t.Fatalf("scrape Content-Type: %s", ct)
+	}
+
+	samples := make(map[string]float64)
+	typed := make(map[string]bool)
+	scanner := bufio.NewScanner(resp.Body)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if strings.HasPrefix(line, "# TYPE ") {
+			typed[strings.Fields(line)[2]] = true
+			continue
+		}
+		if strings.HasPrefix(line, "#") {
+			continue
+		}
+		idx := strings.LastIndexByte(line, ' ')
+		if idx < 0 {
+			t.Fatalf("malformed sample: '%s'", line)
+		}
+		series := line[:idx]
+		name := series
+		if i := strings.IndexByte(series, '{'); i >= 0 {
+			name = series[:i]
+		}
+		if !typed[name] {
+			t.Fatalf("sample before TYPE: '%s'", line)
+		}
+		v, err := strconv.ParseFloat(line[idx+1:], 64)
+		if err != nil {
+			t.Fatalf("malformed value: '%s'", line)
+		}
+		samples[series] = v
+	}
+	if err = scanner.Err(); err != nil {
+		t.Fatalf("scrape read failed: %s", err)
+	}
+	return samples
+}
+
+func TestRegistry(t *testing.T) {
+	r := NewRegistry()
+	ln, err := r.ListenAndServe("127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("ListenAndServe failed: %s", err)
+	}
+	defer ln.Close()
+
+	c := r.Counter("test_total", "A counter.", "transport", "obfs4", "class", "invalid")
+	c.Add(41)
+	r.Counter("test_total", "A counter.", "class", "invalid", "transport", "obfs4").Inc()
+	r.Counter("test_total", "A counter.", "transport", "obfs5", "class", "invalid").Inc()
+	g := r.Gauge("test_active", "A gauge.")
+	g.Add(3)
+	g.Add(-1)
+	r.GaugeFunc("test_func", "A sampled gauge.", func() float64 { return 0.5 })
+	r.CounterFunc("test_func_total", "A sampled counter.", func() float64 { return 7 })
+	r.Counter("test_escape_total", "Help with a \\ and\na newline.", "v", "a\"b\\c\nd").Add(1 << 53)
+
+	samples := scrape(t, ln.Addr().String())
+	for k, v := range map[string]float64{
+		`test_total{class="invalid",transport="obfs4"}`: 42,
+		`test_total{class="invalid",transport="obfs5"}`: 1,
+		`test_active`:                       2,
+		`test_func`:                         0.5,
+		`test_func_total`:                   7,
+		`test_escape_total{v="a\"b\\c\nd"}`: 1 << 53,
+	} {
+		if got, ok := samples[k]; !ok || got != v {
+			t.Errorf("%s = %v (present: %v), expected %v", k, got, ok, v)
+		}
+	}
+	if len(samples) != 6 {
+		t.Errorf("unexpected samples: %v", samples)
+	}
+
+	// Other paths and methods are rejected.
+	resp, err := http.Get("http://" + ln.Addr().String() + "/")
+	if err != nil {
+		t.Fatalf("GET / failed: %s", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("GET / status: %s", resp.Status)
+	}
+	resp, err = http.Post("http://"+ln.Addr().String()+Path, "text/plain", strings.NewReader("x"))
+	if err != nil {
+		t.Fatalf("POST failed: %s", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusMethodNotAllowed {
+		t.Errorf("POST status: %s", resp.Status)
+	}
+}
+
+func TestRegistryMisuse(t *testing.T) {
+	r := NewRegistry()
+	r.Counter("misuse_total", "")
+	for _, fn := range []func(){
+		func() { r.Gauge("misuse_total", "") },
+		func() { r.Counter("misuse total", "") },
+		func() { r.Counter("misuse_total", "", "odd") },
+		func() { r.Counter("misuse_total", "", "bad-label", "v") },
+	} {
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Errorf("misuse did not panic")
+				}
+			}()
+			fn()
+		}()
+	}
+}
+
+func TestConn(t *testing.T) {
+	r := NewRegistry()
+	read := r.Counter("conn_read_total", "")
+	written := r.Counter("conn_written_total", "")
+
+	a, b := net.Pipe()
+	ca := NewConn(a, read, written)
+	cb := NewConn(b, read, nil)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		_, _ = ca.Write([]byte("hello"))
+		_, _ = io.Copy(ioutil.Discard, ca)
+	}()
+	buf := make([]byte, 5)
+	if _, err := io.ReadFull(cb, buf); err != nil {
+		t.Fatalf("read failed: %s", err)
+	}
+	if _, err := cb.Write([]byte("hi")); err != nil {
+		t.Fatalf("write failed: %s", err)
+	}
+	cb.Close()
+	<-done
+	ca.Close()
+
+	if cb.BytesRead() != 5 || cb.BytesWritten() != 2 {
+		t.Errorf("per connection counts: %d/%d", cb.BytesRead(), cb.BytesWritten())
+	}
+	if read.Value() != 7 || written.Value() != 5 {
+		t.Errorf("shared counts: %d/%d", read.Value(), written.Value())
+	}
+	if err := cb.CloseWrite(); err == nil {
+		t.Errorf("CloseWrite succeeded on a net.Pipe")
+	}
+}
@@ -25,10 +25,11 @@
  * POSSIBILITY OF SUCH DAMAGE.
  */
 
-package main
+package proxydialer
 
 import (
 	"bufio"
+	"context"
 	"encoding/base64"
 	"fmt"
 	"net"
@@ -63,11 +64,22 @@ func newHTTP(uri *url.URL, forward proxy.Dialer) (proxy.Dialer, error) {
 }
 
 func (s *httpProxy) Dial(network, addr string) (net.Conn, error) {
-	// Dial and create the http client connection.
-	c, err := s.forward.Dial("tcp", s.hostPort)
+	return s.DialContext(context.Background(), network, addr)
+}
+
+func (s *httpProxy) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	c, err := dialForward(ctx, s.forward, "tcp", s.hostPort)
 	if err != nil {
 		return nil, err
 	}
+	return handshakeContext(ctx, c, func() (net.Conn, error) {
+		return s.connect(c, network, addr)
+	})
+}
+
+func (s *httpProxy) connect(c net.Conn, network, addr string) (net.Conn, error) {
+	// Create the http client connection.
+	var err error
 	conn := new(httpConn)
 	conn.httpConn = httputil.NewClientConn(c, nil) // nolint: staticcheck
 	conn.remoteAddr, err = net.ResolveTCPAddr(network, addr)
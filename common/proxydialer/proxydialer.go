@@ -0,0 +1,52 @@
+// Package proxydialer implements the upstream proxy types that are required
+// by the pluggable transport specification but are not provided by
+// golang.org/x/net/proxy (HTTP CONNECT and SOCKS4a).  Importing this package
+// registers the "http" and "socks4a" schemes with proxy.FromURL.
+package proxydialer // import "github.com/RACECAR-GU/obfsX/common/proxydialer"
+
+import (
+	"context"
+	"net"
+	"time"
+
+	"github.com/RACECAR-GU/obfsX/common/ctxconn"
+	"golang.org/x/net/proxy"
+)
+
+// dialForward dials via the forward dialer, honoring ctx if the forward
+// dialer supports it.
+func dialForward(ctx context.Context, forward proxy.Dialer, network, addr string) (net.Conn, error) {
+	if d, ok := forward.(proxy.ContextDialer); ok {
+		return d.DialContext(ctx, network, addr)
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return forward.Dial(network, addr)
+}
+
+// handshakeContext runs the proxy handshake fn over c, bounded by ctx.  fn is
+// responsible for closing c on failure.
+func handshakeContext(ctx context.Context, c net.Conn, fn func() (net.Conn, error)) (net.Conn, error) {
+	if d, ok := ctx.Deadline(); ok {
+		if err := c.SetDeadline(d); err != nil {
+			c.Close()
+			return nil, err
+		}
+	}
+
+	stop := ctxconn.Guard(ctx, c)
+	conn, err := fn()
+	if serr := stop(err); serr != nil {
+		if err == nil {
+			conn.Close()
+		}
+		return nil, serr
+	}
+
+	if err = c.SetDeadline(time.Time{}); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
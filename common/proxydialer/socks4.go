@@ -31,9 +31,10 @@
  * license that can be found in the LICENSE file.
  */
 
-package main
+package proxydialer
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"io"
@@ -74,6 +75,10 @@ func newSOCKS4(uri *url.URL, forward proxy.Dialer) (proxy.Dialer, error) {
 }
 
 func (s *socks4Proxy) Dial(network, addr string) (net.Conn, error) {
+	return s.DialContext(context.Background(), network, addr)
+}
+
+func (s *socks4Proxy) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
 	if network != "tcp" && network != "tcp4" {
 		return nil, errors.New("invalid network type")
 	}
@@ -97,11 +102,16 @@ func (s *socks4Proxy) Dial(network, addr string) (net.Conn, error) {
 	}
 
 	// Connect to the proxy.
-	c, err := s.forward.Dial("tcp", s.hostPort)
+	c, err := dialForward(ctx, s.forward, "tcp", s.hostPort)
 	if err != nil {
 		return nil, err
 	}
+	return handshakeContext(ctx, c, func() (net.Conn, error) {
+		return s.connect(c, ip4, port)
+	})
+}
 
+func (s *socks4Proxy) connect(c net.Conn, ip4 net.IP, port uint64) (net.Conn, error) {
 	// Make/write the request:
 	//  +----+----+----+----+----+----+----+----+----+----+....+----+
 	//  | VN | CD | DSTPORT |      DSTIP        | USERID       |NULL|
@@ -116,7 +126,7 @@ func (s *socks4Proxy) Dial(network, addr string) (net.Conn, error) {
 		req = append(req, s.username...)
 	}
 	req = append(req, socks4Null)
-	_, err = c.Write(req)
+	_, err := c.Write(req)
 	if err != nil {
 		c.Close()
 		return nil, err
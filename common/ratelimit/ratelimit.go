@@ -0,0 +1,327 @@
+// Package ratelimit implements bandwidth limits on net.Conns, with token
+// buckets per connection, and shared by all of the connections of a Limiter,
+// separately for each direction.
+package ratelimit // import "github.com/RACECAR-GU/obfsX/common/ratelimit"
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// MinBurst is the smallest default burst, so that low rates do not split the
+// reads and writes into tiny pieces.
+const MinBurst = 16 * 1024
+
+// ErrClosed is returned when a connection is closed while being throttled.
+var ErrClosed = errors.New("ratelimit: connection closed")
+
+// Direction is the direction of the traffic.
+type Direction int
+
+const (
+	// Up is the traffic that is read from the wrapped connections (from
+	// the peer), and Down the traffic written to them.
+	Up Direction = iota
+	Down
+)
+
+func (d Direction) String() string {
+	if d == Up {
+		return "up"
+	}
+	return "down"
+}
+
+// Limit is a bandwidth limit.  The zero value is unlimited.
+type Limit struct {
+	// Rate is the sustained rate in bytes per second, 0 is unlimited.
+	Rate float64
+
+	// Burst is the number of bytes allowed at once, which defaults to a
+	// second's worth at the rate (and at least MinBurst).
+	Burst int
+}
+
+func (lim *Limit) burst() float64 {
+	if lim.Burst > 0 {
+		return float64(lim.Burst)
+	}
+	return math.Max(MinBurst, math.Ceil(lim.Rate))
+}
+
+func (lim *Limit) validate() error {
+	if lim.Rate < 0 || math.IsNaN(lim.Rate) || math.IsInf(lim.Rate, 0) {
+		return fmt.Errorf("invalid rate %v", lim.Rate)
+	}
+	if lim.Burst < 0 {
+		return fmt.Errorf("invalid burst %d", lim.Burst)
+	}
+	return nil
+}
+
+// Limits are the bandwidth limits of each direction.
+type Limits struct {
+	Up   Limit
+	Down Limit
+}
+
+func (l *Limits) limit(d Direction) *Limit {
+	if d == Up {
+		return &l.Up
+	}
+	return &l.Down
+}
+
+// Config is the configuration of a Limiter.
+type Config struct {
+	// PerSession limits each connection.
+	PerSession Limits
+
+	// Global limits all of the connections.
+	Global Limits
+}
+
+// Validate checks the configuration.
+func (cfg *Config) Validate() error {
+	for _, v := range []struct {
+		name string
+		lim  *Limit
+	}{
+		{"perSession.up", &cfg.PerSession.Up},
+		{"perSession.down", &cfg.PerSession.Down},
+		{"global.up", &cfg.Global.Up},
+		{"global.down", &cfg.Global.Down},
+	} {
+		if err := v.lim.validate(); err != nil {
+			return fmt.Errorf("%s: %s", v.name, err)
+		}
+	}
+	return nil
+}
+
+// bucket is a token bucket, that goes into debt to admit a chunk larger than
+// the tokens available, the debt being the time to wait.
+type bucket struct {
+	tokens float64
+	last   time.Time
+	full   bool
+}
+
+// reserve takes n tokens, returning how long to wait for them.
+func (b *bucket) reserve(lim *Limit, now time.Time, n int) time.Duration {
+	if lim.Rate == 0 {
+		b.full = true
+		return 0
+	}
+	if b.full {
+		b.tokens, b.full = lim.burst(), false
+	} else {
+		b.tokens = math.Min(lim.burst(), b.tokens+now.Sub(b.last).Seconds()*lim.Rate)
+	}
+	b.last = now
+	b.tokens -= float64(n)
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / lim.Rate * float64(time.Second))
+}
+
+// ThrottleFunc is called when n bytes were delayed in direction d.
+type ThrottleFunc func(d Direction, n int, delay time.Duration)
+
+// Limiter limits the bandwidth of the connections that it wraps.  It is safe
+// for concurrent use.
+type Limiter struct {
+	sync.Mutex
+
+	cfg    Config
+	global [2]bucket
+
+	onThrottle ThrottleFunc
+	now        func() time.Time
+}
+
+// New returns a Limiter with the configuration.  onThrottle, if not nil, is
+// called each time a connection is throttled.
+func New(cfg Config, onThrottle ThrottleFunc) (*Limiter, error) {
+	l := &Limiter{
+		onThrottle: onThrottle,
+		now:        time.Now,
+	}
+	for i := range l.global {
+		l.global[i].full = true
+	}
+	if err := l.SetConfig(cfg); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+// SetConfig changes the configuration, which applies to the connections
+// that were wrapped as well.
+func (l *Limiter) SetConfig(cfg Config) error {
+	if err := cfg.Validate(); err != nil {
+		return err
+	}
+	l.Lock()
+	defer l.Unlock()
+	l.cfg = cfg
+	return nil
+}
+
+// chunk returns the largest read or write in direction d, so that the
+// buckets are not too deep in debt.
+func (l *Limiter) chunk(d Direction) int {
+	l.Lock()
+	defer l.Unlock()
+	n := math.MaxInt32
+	for _, lim := range []*Limit{l.cfg.PerSession.limit(d), l.cfg.Global.limit(d)} {
+		if lim.Rate > 0 && int(lim.burst()) < n {
+			n = int(lim.burst())
+		}
+	}
+	return n
+}
+
+// reserve takes n tokens in direction d from the connection's and the
+// global buckets, returning how long to wait for them.
+func (l *Limiter) reserve(session *[2]bucket, d Direction, n int) time.Duration {
+	l.Lock()
+	defer l.Unlock()
+	now := l.now()
+	delay := session[d].reserve(l.cfg.PerSession.limit(d), now, n)
+	if gd := l.global[d].reserve(l.cfg.Global.limit(d), now, n); gd > delay {
+		delay = gd
+	}
+	return delay
+}
+
+// Wrap returns conn, limited by the Limiter.
+func (l *Limiter) Wrap(conn net.Conn) *Conn {
+	c := &Conn{Conn: conn, l: l, closed: make(chan struct{})}
+	for i := range c.buckets {
+		c.buckets[i].full = true
+	}
+	return c
+}
+
+// WrapBypassed returns conn, which is only limited by the Limiter once Limit
+// is called (eg: once the transport handshake succeeds, so that the failed
+// ones do not use up the shared buckets).
+func (l *Limiter) WrapBypassed(conn net.Conn) *Conn {
+	c := l.Wrap(conn)
+	c.bypass = 1
+	return c
+}
+
+// Conn is a net.Conn, limited by a Limiter.
+type Conn struct {
+	net.Conn
+
+	l       *Limiter
+	buckets [2]bucket
+	bypass  int32
+
+	closeOnce sync.Once
+	closed    chan struct{}
+
+	throttledLock sync.Mutex
+	throttled     [2]time.Duration
+}
+
+// wait waits for n bytes worth of tokens in direction d.
+func (c *Conn) wait(d Direction, n int) error {
+	if atomic.LoadInt32(&c.bypass) != 0 {
+		return nil
+	}
+	delay := c.l.reserve(&c.buckets, d, n)
+	if delay <= 0 {
+		return nil
+	}
+	c.throttledLock.Lock()
+	c.throttled[d] += delay
+	c.throttledLock.Unlock()
+	if c.l.onThrottle != nil {
+		c.l.onThrottle(d, n, delay)
+	}
+
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-c.closed:
+		return ErrClosed
+	}
+}
+
+// Read reads, and then waits until the data read is within the limits, so
+// that a slow reader pushes back on the peer.
+func (c *Conn) Read(b []byte) (int, error) {
+	if chunk := c.l.chunk(Up); len(b) > chunk {
+		b = b[:chunk]
+	}
+	n, err := c.Conn.Read(b)
+	if n > 0 {
+		if werr := c.wait(Up, n); werr != nil && err == nil {
+			err = werr
+		}
+	}
+	return n, err
+}
+
+// Write waits until the data is within the limits, and writes it, a chunk at
+// a time.
+func (c *Conn) Write(b []byte) (int, error) {
+	var written int
+	for len(b) > 0 {
+		p := b
+		if chunk := c.l.chunk(Down); len(p) > chunk {
+			p = p[:chunk]
+		}
+		if err := c.wait(Down, len(p)); err != nil {
+			return written, err
+		}
+		n, err := c.Conn.Write(p)
+		written += n
+		if err != nil {
+			return written, err
+		}
+		b = b[n:]
+	}
+	return written, nil
+}
+
+// Limit starts limiting a connection returned by WrapBypassed.
+func (c *Conn) Limit() {
+	atomic.StoreInt32(&c.bypass, 0)
+}
+
+// Close closes the connection, interrupting any waits.
+func (c *Conn) Close() error {
+	c.closeOnce.Do(func() {
+		close(c.closed)
+	})
+	return c.Conn.Close()
+}
+
+// CloseWrite closes the write side of the wrapped connection, if it supports
+// half-closes.
+func (c *Conn) CloseWrite() error {
+	if hc, ok := c.Conn.(interface{ CloseWrite() error }); ok {
+		return hc.CloseWrite()
+	}
+	return &net.OpError{Op: "close", Net: "ratelimit", Err: errors.New("half-close not supported")}
+}
+
+// Throttled returns how long the connection was throttled, in direction d.
+func (c *Conn) Throttled(d Direction) time.Duration {
+	c.throttledLock.Lock()
+	defer c.throttledLock.Unlock()
+	return c.throttled[d]
+}
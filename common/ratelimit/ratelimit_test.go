@@ -0,0 +1,184 @@
+package ratelimit
+
+import (
+	"io"
+	"io/ioutil"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// pipe returns a wrapped connection, and its peer, which discards what it
+// reads.
+func pipe(l *Limiter) (*Conn, net.Conn) {
+	a, b := net.Pipe()
+	go func() {
+		_, _ = io.Copy(ioutil.Discard, b)
+	}()
+	return l.Wrap(a), b
+}
+
+// throttleCounter counts the throttled bytes.
+type throttleCounter struct {
+	sync.Mutex
+	n [2]int
+}
+
+func (tc *throttleCounter) throttled(d Direction, n int, delay time.Duration) {
+	tc.Lock()
+	defer tc.Unlock()
+	tc.n[d] += n
+}
+
+func (tc *throttleCounter) bytes(d Direction) int {
+	tc.Lock()
+	defer tc.Unlock()
+	return tc.n[d]
+}
+
+func TestWrite(t *testing.T) {
+	var tc throttleCounter
+	l, err := New(Config{PerSession: Limits{Down: Limit{Rate: 64 * 1024, Burst: 16 * 1024}}}, tc.throttled)
+	if err != nil {
+		t.Fatalf("New failed: %s", err)
+	}
+	c, peer := pipe(l)
+	defer peer.Close()
+	defer c.Close()
+
+	// The burst is written at once, and the rest at the rate.
+	start := time.Now()
+	if n, err := c.Write(make([]byte, 16*1024+32*1024)); err != nil || n != 48*1024 {
+		t.Fatalf("Write: %d, %v", n, err)
+	}
+	if elapsed := time.Since(start); elapsed < 400*time.Millisecond || elapsed > 2*time.Second {
+		t.Fatalf("Write took %s, expected around 500ms", elapsed)
+	}
+	if tc.bytes(Down) != 32*1024 || tc.bytes(Up) != 0 {
+		t.Fatalf("throttled %d bytes down, %d up", tc.bytes(Down), tc.bytes(Up))
+	}
+	if c.Throttled(Down) < 400*time.Millisecond || c.Throttled(Up) != 0 {
+		t.Fatalf("throttled for %s down, %s up", c.Throttled(Down), c.Throttled(Up))
+	}
+}
+
+func TestGlobal(t *testing.T) {
+	l, err := New(Config{Global: Limits{Up: Limit{Rate: 64 * 1024, Burst: 16 * 1024}}}, nil)
+	if err != nil {
+		t.Fatalf("New failed: %s", err)
+	}
+
+	// Two connections share the global limit, for 16 KiB at once, and
+	// another 32 KiB at the rate.
+	start := time.Now()
+	var wg sync.WaitGroup
+	for i := 0; i < 2; i++ {
+		a, b := net.Pipe()
+		c := l.Wrap(a)
+		defer c.Close()
+		go func() {
+			_, _ = b.Write(make([]byte, 24*1024))
+			b.Close()
+		}()
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if n, err := io.Copy(ioutil.Discard, c); err != nil || n != 24*1024 {
+				t.Errorf("Read: %d, %v", n, err)
+			}
+		}()
+	}
+	wg.Wait()
+	if elapsed := time.Since(start); elapsed < 400*time.Millisecond || elapsed > 2*time.Second {
+		t.Fatalf("Reads took %s, expected around 500ms", elapsed)
+	}
+}
+
+func TestUnlimited(t *testing.T) {
+	var tc throttleCounter
+	l, err := New(Config{PerSession: Limits{Up: Limit{Rate: 1}}}, tc.throttled)
+	if err != nil {
+		t.Fatalf("New failed: %s", err)
+	}
+	c, peer := pipe(l)
+	defer peer.Close()
+	defer c.Close()
+
+	for i := 0; i < 16; i++ {
+		if _, err := c.Write(make([]byte, 64*1024)); err != nil {
+			t.Fatalf("Write failed: %s", err)
+		}
+	}
+	if tc.bytes(Down) != 0 {
+		t.Fatalf("throttled %d bytes", tc.bytes(Down))
+	}
+}
+
+func TestBypassed(t *testing.T) {
+	var tc throttleCounter
+	l, err := New(Config{Global: Limits{Down: Limit{Rate: 1024, Burst: 1024}}}, tc.throttled)
+	if err != nil {
+		t.Fatalf("New failed: %s", err)
+	}
+	a, b := net.Pipe()
+	go func() {
+		_, _ = io.Copy(ioutil.Discard, b)
+	}()
+	defer b.Close()
+	c := l.WrapBypassed(a)
+	defer c.Close()
+
+	// Until Limit is called, the connection neither waits, nor takes
+	// tokens from the shared buckets.
+	if _, err = c.Write(make([]byte, 4096)); err != nil {
+		t.Fatalf("Write failed: %s", err)
+	}
+	if tc.bytes(Down) != 0 {
+		t.Fatalf("throttled %d bytes before Limit", tc.bytes(Down))
+	}
+	c.Limit()
+	if _, err = c.Write(make([]byte, 1024)); err != nil {
+		t.Fatalf("Write failed: %s", err)
+	}
+	if tc.bytes(Down) != 0 {
+		t.Fatalf("the bypassed Write took tokens from the shared bucket")
+	}
+	if _, err = c.Write(make([]byte, 16)); err != nil {
+		t.Fatalf("Write failed: %s", err)
+	}
+	if tc.bytes(Down) == 0 {
+		t.Fatalf("the Write after Limit was not throttled")
+	}
+}
+
+func TestClose(t *testing.T) {
+	l, err := New(Config{PerSession: Limits{Down: Limit{Rate: 1, Burst: 1}}}, nil)
+	if err != nil {
+		t.Fatalf("New failed: %s", err)
+	}
+	c, peer := pipe(l)
+	defer peer.Close()
+
+	// Closing interrupts the wait.
+	time.AfterFunc(100*time.Millisecond, func() { c.Close() })
+	start := time.Now()
+	if _, err := c.Write(make([]byte, 10)); err != ErrClosed {
+		t.Fatalf("Write: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Fatalf("Close took %s to interrupt the Write", elapsed)
+	}
+}
+
+func TestInvalidConfig(t *testing.T) {
+	for _, cfg := range []Config{
+		{PerSession: Limits{Up: Limit{Rate: -1}}},
+		{PerSession: Limits{Down: Limit{Burst: -1}}},
+		{Global: Limits{Up: Limit{Rate: -1}}},
+	} {
+		if _, err := New(cfg, nil); err == nil {
+			t.Errorf("%+v: accepted", cfg)
+		}
+	}
+}
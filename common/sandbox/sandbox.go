@@ -0,0 +1,83 @@
+// Package sandbox confines the process, once it has acquired the resources
+// that need privileges (eg: bound the listening sockets): dropping to an
+// unprivileged user and group, setting no_new_privs, and restricting the
+// system calls to an allowlist with seccomp.
+//
+// Notes:
+//   - It is only implemented on Linux (amd64 and arm64 for seccomp), and
+//     returns ErrUnsupported elsewhere.
+//   - The allowlist covers what the Go runtime, the pure Go resolver, and
+//     the networking and file I/O of the proxy use.  It does not allow
+//     executing programs.
+package sandbox // import "github.com/RACECAR-GU/obfsX/common/sandbox"
+
+import (
+	"errors"
+	"fmt"
+	"os/user"
+	"strconv"
+)
+
+// ErrUnsupported is returned when the sandbox is not supported on the
+// platform.
+var ErrUnsupported = errors.New("sandbox: not supported on this platform")
+
+// Action is what happens when a system call outside of the allowlist is
+// made.
+type Action int
+
+const (
+	// ActionKill kills the process (with SIGSYS).
+	ActionKill Action = iota
+
+	// ActionLog logs the system call to the kernel audit log, and allows
+	// it, to find what is missing from the allowlist.
+	ActionLog
+)
+
+func (a Action) String() string {
+	if a == ActionLog {
+		return "log"
+	}
+	return "kill"
+}
+
+// ParseAction parses an action, "kill" or "log".
+func ParseAction(s string) (Action, error) {
+	switch s {
+	case "kill":
+		return ActionKill, nil
+	case "log":
+		return ActionLog, nil
+	}
+	return 0, fmt.Errorf("sandbox: invalid action '%s'", s)
+}
+
+// LookupUser returns the user and group ids of the user (a name or a uid),
+// and group (a name or a gid), which defaults to the user's primary group.
+func LookupUser(userName, groupName string) (uid, gid int, err error) {
+	u, err := user.Lookup(userName)
+	if err != nil {
+		if u, err = user.LookupId(userName); err != nil {
+			return 0, 0, fmt.Errorf("sandbox: unknown user '%s'", userName)
+		}
+	}
+	if uid, err = strconv.Atoi(u.Uid); err != nil {
+		return 0, 0, fmt.Errorf("sandbox: invalid uid '%s'", u.Uid)
+	}
+
+	gidStr := u.Gid
+	if groupName != "" {
+		g, err := user.LookupGroup(groupName)
+		if err != nil {
+			if g, err = user.LookupGroupId(groupName); err != nil {
+				return 0, 0, fmt.Errorf("sandbox: unknown group '%s'", groupName)
+			}
+		}
+		gidStr = g.Gid
+	}
+	if gid, err = strconv.Atoi(gidStr); err != nil {
+		return 0, 0, fmt.Errorf("sandbox: invalid gid '%s'", gidStr)
+	}
+	return uid, gid, nil
+}
@@ -0,0 +1,216 @@
+package sandbox
+
+import (
+	"fmt"
+	"runtime"
+	"syscall"
+	"unsafe"
+)
+
+const (
+	prSetNoNewPrivs = 38
+	prGetNoNewPrivs = 39
+
+	seccompSetModeFilter   = 1
+	seccompFilterFlagTSync = 1
+
+	seccompRetKillProcess = 0x80000000
+	seccompRetLog         = 0x7ffc0000
+	seccompRetAllow       = 0x7fff0000
+
+	// The offsets of the fields of struct seccomp_data.
+	seccompDataNr   = 0
+	seccompDataArch = 4
+
+	// x32SyscallBit marks the x32 system calls, that share the amd64
+	// architecture, but not the numbers.
+	x32SyscallBit = 0x40000000
+)
+
+// allowlist is the system calls that the process may make.  The names that
+// an architecture does not have (eg: "open" on arm64) are skipped.
+var allowlist = []string{
+	// Memory management.
+	"brk", "mmap", "munmap", "mprotect", "madvise", "mremap",
+
+	// Threads, scheduling, time, and signals (the Go runtime, and the C
+	// library's threads if cgo is used).
+	"clone", "clone3", "exit", "exit_group", "futex", "gettid", "getpid",
+	"getppid", "tgkill", "tkill", "rt_sigaction", "rt_sigprocmask",
+	"rt_sigreturn", "sigaltstack", "sched_yield", "sched_getaffinity",
+	"nanosleep", "clock_gettime", "clock_nanosleep", "gettimeofday",
+	"restart_syscall", "set_robust_list", "rseq", "prctl", "getrandom",
+
+	// Polling.
+	"epoll_create1", "epoll_ctl", "epoll_wait", "epoll_pwait",
+	"epoll_pwait2", "eventfd2", "pipe2", "poll", "ppoll",
+
+	// Reading and writing.
+	"read", "write", "readv", "writev", "pread64", "pwrite64", "close",
+	"fcntl", "lseek", "fsync", "splice",
+
+	// Files (the state directory, the log, configuration reloads, and Unix
+	// sockets).
+	"open", "openat", "stat", "lstat", "fstat", "newfstatat", "fstatat",
+	"statx", "unlink", "unlinkat", "rename", "renameat", "renameat2",
+	"chmod", "fchmod", "fchmodat", "mkdir", "mkdirat", "getdents64",
+
+	// Networking.
+	"socket", "connect", "accept", "accept4", "bind", "listen",
+	"getsockname", "getpeername", "setsockopt", "getsockopt", "shutdown",
+	"sendto", "recvfrom", "sendmsg", "recvmsg",
+
+	// Identity.
+	"getuid", "geteuid", "getgid", "getegid",
+}
+
+// DropPrivileges sets the user and group ids (real, effective and saved) of
+// all of the process's threads to uid and gid, and clears the supplementary
+// groups.  This relies on the syscall package applying the changes to all of
+// the threads, which it does as of Go 1.16 (see go.mod).
+func DropPrivileges(uid, gid int) error {
+	if err := syscall.Setgroups([]int{}); err != nil {
+		return fmt.Errorf("sandbox: setgroups: %s", err)
+	}
+	if err := syscall.Setgid(gid); err != nil {
+		return fmt.Errorf("sandbox: setgid(%d): %s", gid, err)
+	}
+	if err := syscall.Setuid(uid); err != nil {
+		return fmt.Errorf("sandbox: setuid(%d): %s", uid, err)
+	}
+
+	// Check that the privileges can not be regained.
+	if syscall.Getuid() != uid || syscall.Geteuid() != uid || syscall.Getgid() != gid || syscall.Getegid() != gid {
+		return fmt.Errorf("sandbox: the user and group ids did not change")
+	}
+	if uid != 0 && syscall.Setuid(0) == nil {
+		return fmt.Errorf("sandbox: the privileges can be regained")
+	}
+	return nil
+}
+
+// SetNoNewPrivs sets no_new_privs on all of the process's threads, so that
+// the process and its children can not gain privileges (eg: by executing
+// setuid programs).
+func SetNoNewPrivs() error {
+	_, _, errno := syscall.AllThreadsSyscall(syscall.SYS_PRCTL, prSetNoNewPrivs, 1, 0)
+	switch errno {
+	case 0:
+		return nil
+	case syscall.ENOTSUP:
+		// With cgo, the C library's threads are not known to the Go
+		// runtime.  Synchronizing a filter that allows everything sets
+		// no_new_privs on all of them as well.
+		if auditArch == 0 {
+			return ErrUnsupported
+		}
+		return setFilter([]syscall.SockFilter{{Code: syscall.BPF_RET | syscall.BPF_K, K: seccompRetAllow}})
+	default:
+		return fmt.Errorf("sandbox: prctl(PR_SET_NO_NEW_PRIVS): %s", errno)
+	}
+}
+
+// setThreadNoNewPrivs sets no_new_privs on the calling thread only.
+func setThreadNoNewPrivs() error {
+	if _, _, errno := syscall.RawSyscall(syscall.SYS_PRCTL, prSetNoNewPrivs, 1, 0); errno != 0 {
+		return fmt.Errorf("sandbox: prctl(PR_SET_NO_NEW_PRIVS): %s", errno)
+	}
+	return nil
+}
+
+// NoNewPrivs returns if no_new_privs is set on the calling thread.
+func NoNewPrivs() (bool, error) {
+	r, _, errno := syscall.RawSyscall(syscall.SYS_PRCTL, prGetNoNewPrivs, 0, 0)
+	if errno != 0 {
+		return false, fmt.Errorf("sandbox: prctl(PR_GET_NO_NEW_PRIVS): %s", errno)
+	}
+	return r == 1, nil
+}
+
+// Seccomp sets no_new_privs, and restricts the system calls of all of the
+// process's threads to the allowlist, taking action on the others.  It can
+// not be undone.
+func Seccomp(action Action) error {
+	if auditArch == 0 {
+		return ErrUnsupported
+	}
+	filter, err := buildFilter(action)
+	if err != nil {
+		return err
+	}
+	return setFilter(filter)
+}
+
+// setFilter sets no_new_privs, and the seccomp filter, on the calling thread,
+// and synchronizes both to the other threads (including any C threads).
+func setFilter(filter []syscall.SockFilter) error {
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+	if err := setThreadNoNewPrivs(); err != nil {
+		return err
+	}
+	prog := syscall.SockFprog{
+		Len:    uint16(len(filter)),
+		Filter: &filter[0],
+	}
+	r, _, errno := syscall.RawSyscall(sysSeccomp, seccompSetModeFilter, seccompFilterFlagTSync, uintptr(unsafe.Pointer(&prog)))
+	runtime.KeepAlive(filter)
+	if errno != 0 {
+		return fmt.Errorf("sandbox: seccomp: %s", errno)
+	}
+	if r != 0 {
+		return fmt.Errorf("sandbox: seccomp: thread %d can not be synchronized", r)
+	}
+	return nil
+}
+
+// allowedSyscalls returns the numbers of the allowlist's system calls on
+// this architecture.
+func allowedSyscalls() []uint32 {
+	var nrs []uint32
+	for _, name := range allowlist {
+		if nr, ok := syscallNumbers[name]; ok {
+			nrs = append(nrs, nr)
+		}
+	}
+	return nrs
+}
+
+// buildFilter returns the BPF program that allows the allowlist's system
+// calls, and takes action on the others.
+func buildFilter(action Action) ([]syscall.SockFilter, error) {
+	ret := uint32(seccompRetKillProcess)
+	if action == ActionLog {
+		ret = seccompRetLog
+	}
+	stmt := func(code uint16, k uint32) syscall.SockFilter {
+		return syscall.SockFilter{Code: code, K: k}
+	}
+	jump := func(code uint16, k uint32, jt, jf uint8) syscall.SockFilter {
+		return syscall.SockFilter{Code: code, Jt: jt, Jf: jf, K: k}
+	}
+
+	nrs := allowedSyscalls()
+	if len(nrs) > 255 {
+		return nil, fmt.Errorf("sandbox: the allowlist is too long")
+	}
+
+	// System calls of other architectures always kill the process, as
+	// their numbers mean something else.
+	filter := []syscall.SockFilter{
+		stmt(syscall.BPF_LD|syscall.BPF_W|syscall.BPF_ABS, seccompDataArch),
+		jump(syscall.BPF_JMP|syscall.BPF_JEQ|syscall.BPF_K, auditArch, 1, 0),
+		stmt(syscall.BPF_RET|syscall.BPF_K, seccompRetKillProcess),
+		stmt(syscall.BPF_LD|syscall.BPF_W|syscall.BPF_ABS, seccompDataNr),
+		jump(syscall.BPF_JMP|syscall.BPF_JGE|syscall.BPF_K, x32SyscallBit, uint8(len(nrs)), 0),
+	}
+	for i, nr := range nrs {
+		// Jump over the remaining comparisons, and the action.
+		filter = append(filter, jump(syscall.BPF_JMP|syscall.BPF_JEQ|syscall.BPF_K, nr, uint8(len(nrs)-i), 0))
+	}
+	filter = append(filter,
+		stmt(syscall.BPF_RET|syscall.BPF_K, ret),
+		stmt(syscall.BPF_RET|syscall.BPF_K, seccompRetAllow),
+	)
+	return filter, nil
+}
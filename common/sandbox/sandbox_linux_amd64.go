@@ -0,0 +1,99 @@
+package sandbox
+
+import "syscall"
+
+const (
+	auditArch  = 0xc000003e // AUDIT_ARCH_X86_64
+	sysSeccomp = 317
+)
+
+var syscallNumbers = map[string]uint32{
+	"brk":               syscall.SYS_BRK,
+	"mmap":              syscall.SYS_MMAP,
+	"munmap":            syscall.SYS_MUNMAP,
+	"mprotect":          syscall.SYS_MPROTECT,
+	"madvise":           syscall.SYS_MADVISE,
+	"mremap":            syscall.SYS_MREMAP,
+	"clone":             syscall.SYS_CLONE,
+	"clone3":            435,
+	"exit":              syscall.SYS_EXIT,
+	"exit_group":        syscall.SYS_EXIT_GROUP,
+	"futex":             syscall.SYS_FUTEX,
+	"gettid":            syscall.SYS_GETTID,
+	"getpid":            syscall.SYS_GETPID,
+	"getppid":           syscall.SYS_GETPPID,
+	"tgkill":            syscall.SYS_TGKILL,
+	"tkill":             syscall.SYS_TKILL,
+	"rt_sigaction":      syscall.SYS_RT_SIGACTION,
+	"rt_sigprocmask":    syscall.SYS_RT_SIGPROCMASK,
+	"rt_sigreturn":      syscall.SYS_RT_SIGRETURN,
+	"sigaltstack":       syscall.SYS_SIGALTSTACK,
+	"sched_yield":       syscall.SYS_SCHED_YIELD,
+	"sched_getaffinity": syscall.SYS_SCHED_GETAFFINITY,
+	"nanosleep":         syscall.SYS_NANOSLEEP,
+	"clock_gettime":     syscall.SYS_CLOCK_GETTIME,
+	"clock_nanosleep":   syscall.SYS_CLOCK_NANOSLEEP,
+	"gettimeofday":      syscall.SYS_GETTIMEOFDAY,
+	"restart_syscall":   syscall.SYS_RESTART_SYSCALL,
+	"set_robust_list":   syscall.SYS_SET_ROBUST_LIST,
+	"rseq":              334,
+	"prctl":             syscall.SYS_PRCTL,
+	"getrandom":         318,
+	"epoll_create1":     syscall.SYS_EPOLL_CREATE1,
+	"epoll_ctl":         syscall.SYS_EPOLL_CTL,
+	"epoll_wait":        syscall.SYS_EPOLL_WAIT,
+	"epoll_pwait":       syscall.SYS_EPOLL_PWAIT,
+	"epoll_pwait2":      441,
+	"eventfd2":          syscall.SYS_EVENTFD2,
+	"pipe2":             syscall.SYS_PIPE2,
+	"poll":              syscall.SYS_POLL,
+	"ppoll":             syscall.SYS_PPOLL,
+	"read":              syscall.SYS_READ,
+	"write":             syscall.SYS_WRITE,
+	"readv":             syscall.SYS_READV,
+	"writev":            syscall.SYS_WRITEV,
+	"pread64":           syscall.SYS_PREAD64,
+	"pwrite64":          syscall.SYS_PWRITE64,
+	"close":             syscall.SYS_CLOSE,
+	"fcntl":             syscall.SYS_FCNTL,
+	"lseek":             syscall.SYS_LSEEK,
+	"fsync":             syscall.SYS_FSYNC,
+	"splice":            syscall.SYS_SPLICE,
+	"open":              syscall.SYS_OPEN,
+	"openat":            syscall.SYS_OPENAT,
+	"stat":              syscall.SYS_STAT,
+	"lstat":             syscall.SYS_LSTAT,
+	"fstat":             syscall.SYS_FSTAT,
+	"newfstatat":        syscall.SYS_NEWFSTATAT,
+	"statx":             332,
+	"unlink":            syscall.SYS_UNLINK,
+	"unlinkat":          syscall.SYS_UNLINKAT,
+	"rename":            syscall.SYS_RENAME,
+	"renameat":          syscall.SYS_RENAMEAT,
+	"renameat2":         316,
+	"chmod":             syscall.SYS_CHMOD,
+	"fchmod":            syscall.SYS_FCHMOD,
+	"fchmodat":          syscall.SYS_FCHMODAT,
+	"mkdir":             syscall.SYS_MKDIR,
+	"mkdirat":           syscall.SYS_MKDIRAT,
+	"getdents64":        syscall.SYS_GETDENTS64,
+	"socket":            syscall.SYS_SOCKET,
+	"connect":           syscall.SYS_CONNECT,
+	"accept":            syscall.SYS_ACCEPT,
+	"accept4":           syscall.SYS_ACCEPT4,
+	"bind":              syscall.SYS_BIND,
+	"listen":            syscall.SYS_LISTEN,
+	"getsockname":       syscall.SYS_GETSOCKNAME,
+	"getpeername":       syscall.SYS_GETPEERNAME,
+	"setsockopt":        syscall.SYS_SETSOCKOPT,
+	"getsockopt":        syscall.SYS_GETSOCKOPT,
+	"shutdown":          syscall.SYS_SHUTDOWN,
+	"sendto":            syscall.SYS_SENDTO,
+	"recvfrom":          syscall.SYS_RECVFROM,
+	"sendmsg":           syscall.SYS_SENDMSG,
+	"recvmsg":           syscall.SYS_RECVMSG,
+	"getuid":            syscall.SYS_GETUID,
+	"geteuid":           syscall.SYS_GETEUID,
+	"getgid":            syscall.SYS_GETGID,
+	"getegid":           syscall.SYS_GETEGID,
+}
@@ -0,0 +1,12 @@
+//go:build linux && !amd64 && !arm64
+// +build linux,!amd64,!arm64
+
+package sandbox
+
+// Seccomp is not supported on the other architectures.
+const (
+	auditArch  = 0
+	sysSeccomp = 0
+)
+
+var syscallNumbers = map[string]uint32{}
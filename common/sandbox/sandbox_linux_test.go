@@ -0,0 +1,347 @@
+package sandbox
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+)
+
+// runFilter runs the filter on a system call, like the kernel does.
+func runFilter(t *testing.T, filter []syscall.SockFilter, arch, nr uint32) uint32 {
+	var acc uint32
+	for pc := 0; pc < len(filter); pc++ {
+		ins := filter[pc]
+		switch ins.Code {
+		case syscall.BPF_LD | syscall.BPF_W | syscall.BPF_ABS:
+			switch ins.K {
+			case seccompDataNr:
+				acc = nr
+			case seccompDataArch:
+				acc = arch
+			default:
+				t.Fatalf("load of offset %d", ins.K)
+			}
+		case syscall.BPF_JMP | syscall.BPF_JEQ | syscall.BPF_K:
+			if acc == ins.K {
+				pc += int(ins.Jt)
+			} else {
+				pc += int(ins.Jf)
+			}
+		case syscall.BPF_JMP | syscall.BPF_JGE | syscall.BPF_K:
+			if acc >= ins.K {
+				pc += int(ins.Jt)
+			} else {
+				pc += int(ins.Jf)
+			}
+		case syscall.BPF_RET | syscall.BPF_K:
+			return ins.K
+		default:
+			t.Fatalf("unexpected instruction %+v", ins)
+		}
+	}
+	t.Fatalf("the filter did not return")
+	return 0
+}
+
+func TestFilter(t *testing.T) {
+	if auditArch == 0 {
+		t.Skip("seccomp is not supported on " + runtime.GOARCH)
+	}
+	for _, action := range []Action{ActionKill, ActionLog} {
+		filter, err := buildFilter(action)
+		if err != nil {
+			t.Fatalf("buildFilter failed: %s", err)
+		}
+		ret := uint32(seccompRetKillProcess)
+		if action == ActionLog {
+			ret = seccompRetLog
+		}
+		for _, nr := range allowedSyscalls() {
+			if got := runFilter(t, filter, auditArch, nr); got != seccompRetAllow {
+				t.Fatalf("%s: syscall %d: %#x, expected allow", action, nr, got)
+			}
+		}
+		for _, nr := range []uint32{syscall.SYS_EXECVE, syscall.SYS_PTRACE, syscall.SYS_GETPGID, x32SyscallBit | syscall.SYS_READ} {
+			if got := runFilter(t, filter, auditArch, nr); got != ret {
+				t.Fatalf("%s: syscall %d: %#x, expected %#x", action, nr, got, ret)
+			}
+		}
+		if got := runFilter(t, filter, auditArch+1, syscall.SYS_READ); got != seccompRetKillProcess {
+			t.Fatalf("%s: other architecture: %#x, expected kill", action, got)
+		}
+	}
+}
+
+func TestAllowlist(t *testing.T) {
+	seen := make(map[uint32]string)
+	for name, nr := range syscallNumbers {
+		found := false
+		for _, v := range allowlist {
+			found = found || v == name
+		}
+		if !found {
+			t.Errorf("'%s' is not in the allowlist", name)
+		}
+		if other, ok := seen[nr]; ok {
+			t.Errorf("'%s' and '%s' are both %d", name, other, nr)
+		}
+		seen[nr] = name
+	}
+}
+
+func TestParseAction(t *testing.T) {
+	for s, expected := range map[string]Action{"kill": ActionKill, "log": ActionLog} {
+		if a, err := ParseAction(s); err != nil || a != expected || a.String() != s {
+			t.Errorf("ParseAction(%s): %v, %v", s, a, err)
+		}
+	}
+	if _, err := ParseAction("allow"); err == nil {
+		t.Errorf("ParseAction accepted 'allow'")
+	}
+}
+
+func TestLookupUser(t *testing.T) {
+	for _, name := range []string{"root", "0"} {
+		uid, gid, err := LookupUser(name, "")
+		if err != nil || uid != 0 || gid != 0 {
+			t.Errorf("LookupUser(%s): %d, %d, %v", name, uid, gid, err)
+		}
+	}
+	if _, _, err := LookupUser("obfs4proxy-no-such-user", ""); err == nil {
+		t.Errorf("LookupUser accepted an unknown user")
+	}
+	if _, _, err := LookupUser("root", "obfs4proxy-no-such-group"); err == nil {
+		t.Errorf("LookupUser accepted an unknown group")
+	}
+}
+
+// runHelper runs TestHelperProcess in a child process, as the sandbox can
+// not be undone.
+func runHelper(t *testing.T, helper string) (string, error) {
+	cmd := exec.Command(os.Args[0], "-test.run=TestHelperProcess")
+	cmd.Env = append(os.Environ(), "SANDBOX_TEST_HELPER="+helper)
+	out, err := cmd.CombinedOutput()
+	return string(out), err
+}
+
+// exercise does what the proxy does: new threads, TCP and Unix sockets,
+// copying, and files.
+func exercise() error {
+	dir, err := ioutil.TempDir("", "sandbox")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			runtime.LockOSThread()
+			runtime.Gosched()
+		}()
+	}
+	wg.Wait()
+	runtime.GC()
+
+	for _, network := range []string{"tcp", "unix"} {
+		addr := "127.0.0.1:0"
+		if network == "unix" {
+			addr = filepath.Join(dir, "sock")
+		}
+		ln, err := net.Listen(network, addr)
+		if err != nil {
+			return err
+		}
+		if network == "unix" {
+			if err = os.Chmod(addr, 0600); err != nil {
+				return err
+			}
+		}
+		go func() {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+			_, _ = io.Copy(conn, conn)
+		}()
+		conn, err := net.Dial(network, ln.Addr().String())
+		if err != nil {
+			return err
+		}
+		payload := bytes.Repeat([]byte("obfs4"), 64*1024)
+		go func() {
+			_, _ = conn.Write(payload)
+		}()
+		echoed := make([]byte, len(payload))
+		if _, err = io.ReadFull(conn, echoed); err != nil {
+			return err
+		}
+		conn.Close()
+		ln.Close()
+	}
+
+	path := filepath.Join(dir, "state.json")
+	if err = ioutil.WriteFile(path, []byte("{}"), 0600); err != nil {
+		return err
+	}
+	if _, err = ioutil.ReadFile(path); err != nil {
+		return err
+	}
+	return os.Rename(path, path+".old")
+}
+
+// TestHelperProcess is run in a child process by the sandbox tests.
+func TestHelperProcess(t *testing.T) {
+	helper := os.Getenv("SANDBOX_TEST_HELPER")
+	if helper == "" {
+		t.Skip("only run by the sandbox tests")
+	}
+	fail := func(err error) {
+		fmt.Printf("error %s\n", err)
+		os.Exit(1)
+	}
+
+	switch helper {
+	case "kill", "log":
+		action, _ := ParseAction(helper)
+		if err := Seccomp(action); err != nil {
+			fail(err)
+		}
+		if err := exercise(); err != nil {
+			fail(err)
+		}
+		fmt.Printf("sandboxed\n")
+		os.Stdout.Sync()
+
+		// getpgid is not in the allowlist.
+		syscall.Getpgid(0)
+		fmt.Printf("survived\n")
+	case "privileges":
+		if err := DropPrivileges(65534, 65534); err != nil {
+			fail(err)
+		}
+		if err := exercise(); err != nil {
+			fail(err)
+		}
+	case "nonewprivs":
+		if err := exercise(); err != nil {
+			fail(err)
+		}
+		if err := SetNoNewPrivs(); err != nil {
+			fail(err)
+		}
+	}
+
+	// Report the state of all of the threads.
+	tasks, err := ioutil.ReadDir("/proc/self/task")
+	if err != nil {
+		fail(err)
+	}
+	for _, task := range tasks {
+		status, err := ioutil.ReadFile(filepath.Join("/proc/self/task", task.Name(), "status"))
+		if os.IsNotExist(err) {
+			// The thread exited since the directory was read.
+			continue
+		} else if err != nil {
+			fail(err)
+		}
+		for _, line := range strings.Split(string(status), "\n") {
+			for _, field := range []string{"Uid:", "Gid:", "Groups:", "NoNewPrivs:", "Seccomp:"} {
+				if strings.HasPrefix(line, field) {
+					fmt.Printf("%s\n", strings.Join(strings.Fields(line), " "))
+				}
+			}
+		}
+	}
+	os.Exit(0)
+}
+
+// signaled returns if err is the exit of a process killed by sig.
+func signaled(err error, sig syscall.Signal) bool {
+	if ee, ok := err.(*exec.ExitError); ok {
+		if ws, ok := ee.Sys().(syscall.WaitStatus); ok {
+			return ws.Signaled() && ws.Signal() == sig
+		}
+	}
+	return false
+}
+
+func TestSeccompKill(t *testing.T) {
+	if auditArch == 0 {
+		t.Skip("seccomp is not supported on " + runtime.GOARCH)
+	}
+	out, err := runHelper(t, "kill")
+	if !strings.Contains(out, "sandboxed\n") {
+		t.Fatalf("the sandboxed process failed: %v\n%s", err, out)
+	}
+	if strings.Contains(out, "survived") || !signaled(err, syscall.SIGSYS) {
+		t.Fatalf("the process was not killed: %v\n%s", err, out)
+	}
+}
+
+func TestSeccompLog(t *testing.T) {
+	if auditArch == 0 {
+		t.Skip("seccomp is not supported on " + runtime.GOARCH)
+	}
+	out, err := runHelper(t, "log")
+	if err != nil {
+		if strings.Contains(out, "invalid argument") {
+			t.Skip("the kernel does not support SECCOMP_RET_LOG")
+		}
+		t.Fatalf("the sandboxed process failed: %v\n%s", err, out)
+	}
+	if !strings.Contains(out, "survived\n") {
+		t.Fatalf("the process did not survive:\n%s", out)
+	}
+
+	// The filter and no_new_privs apply to every thread.
+	for _, line := range strings.Split(out, "\n") {
+		if (strings.HasPrefix(line, "NoNewPrivs:") && line != "NoNewPrivs: 1") ||
+			(strings.HasPrefix(line, "Seccomp:") && line != "Seccomp: 2") {
+			t.Fatalf("a thread is not sandboxed: %s\n%s", line, out)
+		}
+	}
+}
+
+func TestSetNoNewPrivs(t *testing.T) {
+	out, err := runHelper(t, "nonewprivs")
+	if err != nil {
+		t.Fatalf("the helper process failed: %v\n%s", err, out)
+	}
+	for _, line := range strings.Split(out, "\n") {
+		if strings.HasPrefix(line, "NoNewPrivs:") && line != "NoNewPrivs: 1" {
+			t.Fatalf("a thread does not have no_new_privs: %s\n%s", line, out)
+		}
+	}
+}
+
+func TestDropPrivileges(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skip("dropping privileges requires root")
+	}
+	out, err := runHelper(t, "privileges")
+	if err != nil {
+		t.Fatalf("the unprivileged process failed: %v\n%s", err, out)
+	}
+	for _, line := range strings.Split(out, "\n") {
+		switch {
+		case strings.HasPrefix(line, "Uid:") && line != "Uid: 65534 65534 65534 65534",
+			strings.HasPrefix(line, "Gid:") && line != "Gid: 65534 65534 65534 65534",
+			strings.HasPrefix(line, "Groups:") && line != "Groups:":
+			t.Fatalf("a thread kept privileges: %s\n%s", line, out)
+		}
+	}
+}
@@ -0,0 +1,24 @@
+//go:build !linux
+// +build !linux
+
+package sandbox
+
+// DropPrivileges is not supported.
+func DropPrivileges(uid, gid int) error {
+	return ErrUnsupported
+}
+
+// SetNoNewPrivs is not supported.
+func SetNoNewPrivs() error {
+	return ErrUnsupported
+}
+
+// NoNewPrivs is not supported.
+func NoNewPrivs() (bool, error) {
+	return false, ErrUnsupported
+}
+
+// Seccomp is not supported.
+func Seccomp(action Action) error {
+	return ErrUnsupported
+}
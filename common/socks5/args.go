@@ -32,6 +32,13 @@ import (
 	"git.torproject.org/pluggable-transports/goptlib.git"
 )
 
+// ParseClientParameters parses the pluggable transport arguments that a
+// client passes in the (combined) username and password of its request, for
+// the other proxy protocols that pass them the same way.
+func ParseClientParameters(argStr string) (pt.Args, error) {
+	return parseClientParameters(argStr)
+}
+
 // parseClientParameters takes a client parameter string formatted according to
 // "Passing PT-specific parameters to a client PT" in the pluggable transport
 // specification, and returns it as a goptlib Args structure.
@@ -40,6 +40,7 @@ package socks5 // import "github.com/RACECAR-GU/obfsX/common/socks5"
 import (
 	"bufio"
 	"bytes"
+	"context"
 	"fmt"
 	"io"
 	"net"
@@ -89,6 +90,10 @@ func Version() string {
 
 // ErrorToReplyCode converts an error to the "best" reply code.
 func ErrorToReplyCode(err error) ReplyCode {
+	if err == context.DeadlineExceeded {
+		return ReplyTTLExpired
+	}
+
 	opErr, ok := err.(*net.OpError)
 	if !ok {
 		return ReplyGeneralFailure
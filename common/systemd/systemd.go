@@ -0,0 +1,144 @@
+// Package systemd implements the parts of the systemd service manager
+// interfaces that a daemon uses: receiving the listening sockets with socket
+// activation (the LISTEN_FDS protocol), and sending state notifications and
+// watchdog pings (sd_notify).
+//
+// Notes:
+//   - None of it requires systemd, or libsystemd, the interfaces are just
+//     environment variables, file descriptors and a datagram socket.  If the
+//     process was not started by a service manager, the routines do nothing.
+package systemd // import "github.com/RACECAR-GU/obfsX/common/systemd"
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// listenFDsStart is the first file descriptor passed with socket
+// activation (SD_LISTEN_FDS_START).
+const listenFDsStart = 3
+
+const (
+	// Ready tells the service manager that the startup is finished.
+	Ready = "READY=1"
+
+	// Reloading tells the service manager that the configuration is being
+	// reloaded, and Ready is sent once it is done.
+	Reloading = "RELOADING=1"
+
+	// Stopping tells the service manager that the shutdown started.
+	Stopping = "STOPPING=1"
+
+	// Watchdog is the watchdog ping.
+	Watchdog = "WATCHDOG=1"
+)
+
+// Listener is a listening socket passed by the service manager.
+type Listener struct {
+	net.Listener
+
+	// Name is the socket's name (FileDescriptorName= in the socket unit,
+	// which defaults to the unit's name).
+	Name string
+}
+
+// Listeners returns the listening sockets passed by the service manager
+// with socket activation, and unsets the environment variables, so that
+// child processes do not inherit them.  It returns none if the process was
+// not socket activated.
+func Listeners() ([]Listener, error) {
+	defer func() {
+		os.Unsetenv("LISTEN_PID")
+		os.Unsetenv("LISTEN_FDS")
+		os.Unsetenv("LISTEN_FDNAMES")
+	}()
+
+	// The sockets are only for the process that the service manager
+	// started, not a child that inherited the environment.
+	if pid, err := strconv.Atoi(os.Getenv("LISTEN_PID")); err != nil || pid != os.Getpid() {
+		return nil, nil
+	}
+	n, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || n < 0 {
+		return nil, fmt.Errorf("systemd: invalid LISTEN_FDS '%s'", os.Getenv("LISTEN_FDS"))
+	}
+	var names []string
+	if s := os.Getenv("LISTEN_FDNAMES"); s != "" {
+		names = strings.Split(s, ":")
+	}
+
+	var lns []Listener
+	var lnErr error
+	for i := 0; i < n; i++ {
+		name := "unknown"
+		if i < len(names) {
+			name = names[i]
+		}
+
+		// FileListener makes a (close on exec) copy of the descriptor,
+		// so the original is always closed.
+		fd := listenFDsStart + i
+		f := os.NewFile(uintptr(fd), name)
+		ln, err := net.FileListener(f)
+		f.Close()
+		if err != nil {
+			if lnErr == nil {
+				lnErr = fmt.Errorf("systemd: socket %d (%s): %s", fd, name, err)
+			}
+			continue
+		}
+		lns = append(lns, Listener{Listener: ln, Name: name})
+	}
+	if lnErr != nil {
+		for _, ln := range lns {
+			ln.Close()
+		}
+		return nil, lnErr
+	}
+	return lns, nil
+}
+
+// Notify sends the state (eg: Ready) to the service manager.  It returns
+// false if the service manager is not listening for notifications
+// (NOTIFY_SOCKET is not set).
+func Notify(state string) (bool, error) {
+	socketPath := os.Getenv("NOTIFY_SOCKET")
+	if socketPath == "" {
+		return false, nil
+	}
+
+	// An abstract socket's name starts with "@", which net handles.
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: socketPath, Net: "unixgram"})
+	if err != nil {
+		return false, err
+	}
+	defer conn.Close()
+	if _, err = conn.Write([]byte(state)); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// WatchdogInterval returns the service manager's watchdog timeout, within
+// which the process must send a Watchdog ping, or 0 if the watchdog is not
+// enabled for the process.
+func WatchdogInterval() (time.Duration, error) {
+	s := os.Getenv("WATCHDOG_USEC")
+	if s == "" {
+		return 0, nil
+	}
+	if pidStr := os.Getenv("WATCHDOG_PID"); pidStr != "" {
+		if pid, err := strconv.Atoi(pidStr); err != nil || pid != os.Getpid() {
+			return 0, nil
+		}
+	}
+	usec, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || usec <= 0 {
+		return 0, fmt.Errorf("systemd: invalid WATCHDOG_USEC '%s'", s)
+	}
+	return time.Duration(usec) * time.Microsecond, nil
+}
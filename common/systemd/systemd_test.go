@@ -0,0 +1,146 @@
+package systemd
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestListenersHelper is run in a child process by TestListeners, with a
+// fake socket activation environment.
+func TestListenersHelper(t *testing.T) {
+	if os.Getenv("SYSTEMD_TEST_HELPER") != "1" {
+		t.Skip("only run by TestListeners")
+	}
+	lns, err := Listeners()
+	if err != nil {
+		fmt.Printf("error %s\n", err)
+		return
+	}
+	for _, ln := range lns {
+		fmt.Printf("listener %s %s\n", ln.Name, ln.Addr())
+		ln.Close()
+	}
+	if os.Getenv("LISTEN_FDS") == "" {
+		fmt.Printf("unset\n")
+	}
+}
+
+func TestListeners(t *testing.T) {
+	if _, err := os.Stat("/bin/sh"); err != nil {
+		t.Skip("no /bin/sh")
+	}
+
+	var files []*os.File
+	var expected []string
+	for _, name := range []string{"obfs4", "obfs5"} {
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatalf("Listen failed: %s", err)
+		}
+		defer ln.Close()
+		f, err := ln.(*net.TCPListener).File()
+		if err != nil {
+			t.Fatalf("File failed: %s", err)
+		}
+		defer f.Close()
+		files = append(files, f)
+		expected = append(expected, fmt.Sprintf("listener %s %s", name, ln.Addr()))
+	}
+
+	// The shell sets LISTEN_PID to its pid, which exec keeps, like the
+	// service manager does after forking.
+	cmd := exec.Command("/bin/sh", "-c", `LISTEN_PID=$$ exec "$0" -test.run=TestListenersHelper`, os.Args[0])
+	cmd.Env = append(os.Environ(), "SYSTEMD_TEST_HELPER=1", "LISTEN_FDS=2", "LISTEN_FDNAMES=obfs4:obfs5")
+	cmd.ExtraFiles = files
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		t.Fatalf("helper failed: %s\n%s", err, out)
+	}
+	got := string(out)
+	for _, line := range append(expected, "unset") {
+		if !strings.Contains(got, line+"\n") {
+			t.Fatalf("expected %q, got:\n%s", line, got)
+		}
+	}
+}
+
+func TestListenersOtherProcess(t *testing.T) {
+	defer os.Unsetenv("LISTEN_FDS")
+	os.Setenv("LISTEN_PID", strconv.Itoa(os.Getpid()+1))
+	os.Setenv("LISTEN_FDS", "2")
+	lns, err := Listeners()
+	if err != nil || len(lns) != 0 {
+		t.Fatalf("Listeners: %v, %v", lns, err)
+	}
+	if os.Getenv("LISTEN_PID") != "" {
+		t.Fatalf("the environment was not unset")
+	}
+}
+
+func TestNotify(t *testing.T) {
+	dir, err := ioutil.TempDir("", "systemd")
+	if err != nil {
+		t.Fatalf("TempDir failed: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	defer os.Unsetenv("NOTIFY_SOCKET")
+	os.Unsetenv("NOTIFY_SOCKET")
+	if sent, err := Notify(Ready); sent || err != nil {
+		t.Fatalf("Notify without a socket: %v, %v", sent, err)
+	}
+
+	socketPath := filepath.Join(dir, "notify")
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: socketPath, Net: "unixgram"})
+	if err != nil {
+		t.Fatalf("ListenUnixgram failed: %s", err)
+	}
+	defer conn.Close()
+	os.Setenv("NOTIFY_SOCKET", socketPath)
+	for _, state := range []string{Ready, Watchdog, Stopping} {
+		if sent, err := Notify(state); !sent || err != nil {
+			t.Fatalf("Notify: %v, %v", sent, err)
+		}
+		var buf [64]byte
+		_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		n, err := conn.Read(buf[:])
+		if err != nil {
+			t.Fatalf("Read failed: %s", err)
+		}
+		if string(buf[:n]) != state {
+			t.Fatalf("received '%s', expected '%s'", buf[:n], state)
+		}
+	}
+}
+
+func TestWatchdogInterval(t *testing.T) {
+	defer os.Unsetenv("WATCHDOG_USEC")
+	defer os.Unsetenv("WATCHDOG_PID")
+	for _, v := range []struct {
+		usec, pid string
+		interval  time.Duration
+		ok        bool
+	}{
+		{"", "", 0, true},
+		{"2000000", "", 2 * time.Second, true},
+		{"2000000", strconv.Itoa(os.Getpid()), 2 * time.Second, true},
+		{"2000000", strconv.Itoa(os.Getpid() + 1), 0, true},
+		{"invalid", "", 0, false},
+		{"0", "", 0, false},
+	} {
+		os.Setenv("WATCHDOG_USEC", v.usec)
+		os.Setenv("WATCHDOG_PID", v.pid)
+		interval, err := WatchdogInterval()
+		if (err == nil) != v.ok || interval != v.interval {
+			t.Errorf("WATCHDOG_USEC=%s WATCHDOG_PID=%s: %s, %v", v.usec, v.pid, interval, err)
+		}
+	}
+}
@@ -0,0 +1,168 @@
+// Package workerpool implements a bounded pool of workers, that runs jobs
+// from a bounded queue, abandoning the jobs that wait too long.
+package workerpool // import "github.com/RACECAR-GU/obfsX/common/workerpool"
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	// ErrQueueFull is returned when the queue is full.
+	ErrQueueFull = errors.New("workerpool: queue full")
+
+	// ErrTimeout is returned when a job is not started before its deadline.
+	ErrTimeout = errors.New("workerpool: queue wait timed out")
+)
+
+const (
+	jobQueued int32 = iota
+	jobRunning
+	jobAbandoned
+)
+
+type job struct {
+	fn    func()
+	state int32
+	done  chan struct{}
+}
+
+// Stats are the statistics of a Pool.
+type Stats struct {
+	// Workers is the number of workers, and QueueLen the size of the
+	// queue.
+	Workers  int
+	QueueLen int
+
+	// Queued is the number of jobs waiting for a worker (the queue depth),
+	// and Running the number being run.  Abandoned jobs are not counted,
+	// although they hold their queue slot until a worker skips them.
+	Queued  int
+	Running int
+
+	// Completed, TimedOut and Rejected are the number of jobs that were
+	// run, abandoned as they waited too long, and rejected as the queue was
+	// full.
+	Completed uint64
+	TimedOut  uint64
+	Rejected  uint64
+}
+
+// Pool is a bounded pool of workers.  It is safe for concurrent use.
+type Pool struct {
+	workers      int
+	maxQueueWait time.Duration
+	jobs         chan *job
+
+	queued, running               int32
+	completed, timedOut, rejected uint64
+
+	closeOnce sync.Once
+}
+
+// New creates a Pool with the number of workers, that queues up to queueLen
+// jobs (when all of the workers are busy) for at most maxQueueWait (0 waits
+// until the job's deadline).
+func New(workers, queueLen int, maxQueueWait time.Duration) *Pool {
+	if workers < 1 {
+		workers = 1
+	}
+	if queueLen < 0 {
+		queueLen = 0
+	}
+	p := &Pool{
+		workers:      workers,
+		maxQueueWait: maxQueueWait,
+		jobs:         make(chan *job, queueLen),
+	}
+	for i := 0; i < workers; i++ {
+		go p.worker()
+	}
+	return p
+}
+
+func (p *Pool) worker() {
+	for j := range p.jobs {
+		if !atomic.CompareAndSwapInt32(&j.state, jobQueued, jobRunning) {
+			// The submitter gave up waiting, and already took the job
+			// off the queue depth.
+			continue
+		}
+		atomic.AddInt32(&p.queued, -1)
+		atomic.AddInt32(&p.running, 1)
+		j.fn()
+		atomic.AddInt32(&p.running, -1)
+		atomic.AddUint64(&p.completed, 1)
+		close(j.done)
+	}
+}
+
+// Do runs fn on a worker, and waits for it to complete.  If fn can not start
+// before the deadline (or the maximum queue wait), it is abandoned, and
+// ErrTimeout returned.  A zero deadline only applies the maximum queue wait.
+func (p *Pool) Do(deadline time.Time, fn func()) error {
+	now := time.Now()
+	if p.maxQueueWait > 0 {
+		if maxDeadline := now.Add(p.maxQueueWait); deadline.IsZero() || maxDeadline.Before(deadline) {
+			deadline = maxDeadline
+		}
+	}
+	if !deadline.IsZero() && !now.Before(deadline) {
+		atomic.AddUint64(&p.timedOut, 1)
+		return ErrTimeout
+	}
+
+	j := &job{fn: fn, done: make(chan struct{})}
+	atomic.AddInt32(&p.queued, 1)
+	select {
+	case p.jobs <- j:
+	default:
+		atomic.AddInt32(&p.queued, -1)
+		atomic.AddUint64(&p.rejected, 1)
+		return ErrQueueFull
+	}
+
+	if deadline.IsZero() {
+		<-j.done
+		return nil
+	}
+	timer := time.NewTimer(deadline.Sub(now))
+	defer timer.Stop()
+	select {
+	case <-j.done:
+		return nil
+	case <-timer.C:
+	}
+	if atomic.CompareAndSwapInt32(&j.state, jobQueued, jobAbandoned) {
+		atomic.AddInt32(&p.queued, -1)
+		atomic.AddUint64(&p.timedOut, 1)
+		return ErrTimeout
+	}
+
+	// A worker started the job just in time.
+	<-j.done
+	return nil
+}
+
+// Stats returns the statistics of the pool.
+func (p *Pool) Stats() Stats {
+	return Stats{
+		Workers:   p.workers,
+		QueueLen:  cap(p.jobs),
+		Queued:    int(atomic.LoadInt32(&p.queued)),
+		Running:   int(atomic.LoadInt32(&p.running)),
+		Completed: atomic.LoadUint64(&p.completed),
+		TimedOut:  atomic.LoadUint64(&p.timedOut),
+		Rejected:  atomic.LoadUint64(&p.rejected),
+	}
+}
+
+// Close stops the workers, once the queued jobs are done.  Do MUST NOT be
+// called after Close.
+func (p *Pool) Close() {
+	p.closeOnce.Do(func() {
+		close(p.jobs)
+	})
+}
@@ -0,0 +1,106 @@
+package workerpool
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// blockWorker occupies the pool's only worker until the returned function
+// is called.
+func blockWorker(t *testing.T, p *Pool) func() {
+	started := make(chan struct{})
+	unblock := make(chan struct{})
+	go func() {
+		_ = p.Do(time.Time{}, func() {
+			close(started)
+			<-unblock
+		})
+	}()
+	select {
+	case <-started:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("blocking job did not start")
+	}
+	return func() { close(unblock) }
+}
+
+func TestDo(t *testing.T) {
+	p := New(2, 4, 0)
+	defer p.Close()
+
+	var n int32
+	for i := 0; i < 10; i++ {
+		if err := p.Do(time.Now().Add(time.Minute), func() { atomic.AddInt32(&n, 1) }); err != nil {
+			t.Fatalf("Do failed: %s", err)
+		}
+	}
+	if n != 10 {
+		t.Fatalf("ran %d jobs", n)
+	}
+	if st := p.Stats(); st.Workers != 2 || st.QueueLen != 4 || st.Completed != 10 || st.Queued != 0 || st.Running != 0 {
+		t.Fatalf("unexpected stats: %+v", st)
+	}
+}
+
+func TestQueue(t *testing.T) {
+	p := New(1, 1, 0)
+	defer p.Close()
+	unblock := blockWorker(t, p)
+
+	queuedDone := make(chan error, 1)
+	go func() {
+		queuedDone <- p.Do(time.Time{}, func() {})
+	}()
+	for p.Stats().Queued != 1 {
+		time.Sleep(time.Millisecond)
+	}
+	if err := p.Do(time.Time{}, func() {}); err != ErrQueueFull {
+		t.Fatalf("Do with a full queue: %v", err)
+	}
+	if st := p.Stats(); st.Running != 1 || st.Rejected != 1 {
+		t.Fatalf("unexpected stats: %+v", st)
+	}
+
+	unblock()
+	if err := <-queuedDone; err != nil {
+		t.Fatalf("queued job failed: %s", err)
+	}
+}
+
+func TestTimeout(t *testing.T) {
+	p := New(1, 4, 50*time.Millisecond)
+	defer p.Close()
+	unblock := blockWorker(t, p)
+
+	// Abandoned jobs are not run, whether the deadline or the maximum
+	// queue wait passes first.
+	var ran int32
+	for _, deadline := range []time.Time{
+		time.Now().Add(10 * time.Millisecond),
+		time.Now().Add(time.Minute),
+		time.Now().Add(-time.Second),
+	} {
+		start := time.Now()
+		if err := p.Do(deadline, func() { atomic.StoreInt32(&ran, 1) }); err != ErrTimeout {
+			t.Fatalf("Do with a busy worker: %v", err)
+		}
+		if waited := time.Since(start); waited > time.Second {
+			t.Fatalf("waited %s", waited)
+		}
+	}
+	if st := p.Stats(); st.Queued != 0 {
+		t.Fatalf("%d abandoned jobs are counted as queued", st.Queued)
+	}
+
+	unblock()
+	if err := p.Do(time.Now().Add(time.Minute), func() {}); err != nil {
+		t.Fatalf("Do failed: %s", err)
+	}
+	if atomic.LoadInt32(&ran) != 0 {
+		t.Fatalf("abandoned job was run")
+	}
+	if st := p.Stats(); st.TimedOut != 3 || st.Completed != 2 {
+		t.Fatalf("unexpected stats: %+v", st)
+	}
+}
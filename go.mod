@@ -10,4 +10,4 @@ require (
 	gonum.org/v1/gonum v0.0.0-20191009222026-5d5638e6749a
 )
 
-go 1.13
+go 1.16
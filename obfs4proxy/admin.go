@@ -0,0 +1,312 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/RACECAR-GU/obfsX/common/log"
+	"github.com/RACECAR-GU/obfsX/transports/base"
+)
+
+// This file contains the admin control socket, and the "ctl" subcommand that
+// is its client.  The protocol is a single command line, answered with "OK"
+// and the output, or "ERROR <reason>", after which the server closes the
+// connection.
+
+const (
+	adminCtlCommand = "ctl"
+
+	adminTimeout    = 10 * time.Second
+	adminMaxRequest = 1024
+
+	adminReplyOK    = "OK"
+	adminReplyError = "ERROR"
+)
+
+type adminCommand struct {
+	usage string
+	help  string
+	run   func(w io.Writer, args []string) error
+}
+
+var adminCommands map[string]*adminCommand
+
+func init() {
+	// Initialized here, as "help" refers to the table.
+	adminCommands = map[string]*adminCommand{
+		"help":      {"help", "List the commands.", adminHelp},
+		"sessions":  {"sessions", "List the active sessions.", adminSessions},
+		"close":     {"close <session>", "Close a session.", adminClose},
+		"loglevel":  {"loglevel [ERROR|WARN|INFO|DEBUG]", "Show or set the log level.", adminLogLevel},
+		"listeners": {"listeners", "List the listeners.", adminListeners},
+		"enable":    {"enable <listener>", "Enable a listener.", adminEnable(true)},
+		"disable":   {"disable <listener>", "Disable a listener, leaving its sessions open.", adminEnable(false)},
+		"params":    {"params [listener]", "Show the derived transport parameters.", adminParams},
+	}
+}
+
+// adminListen serves the admin control interface on the Unix socket at
+// socketPath, which only the user can connect to.
+func adminListen(socketPath string) (net.Listener, error) {
+	ln, err := listenUnix(socketPath, 0600)
+	if err != nil {
+		return nil, err
+	}
+
+	go func() {
+		var delay time.Duration
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				if e, ok := err.(net.Error); ok && !e.Temporary() {
+					return
+				}
+				delay = base.AcceptDelay(delay)
+				time.Sleep(delay)
+				continue
+			}
+			delay = 0
+			go adminHandler(conn)
+		}
+	}()
+	return ln, nil
+}
+
+func adminHandler(conn net.Conn) {
+	defer conn.Close()
+	if err := conn.SetDeadline(time.Now().Add(adminTimeout)); err != nil {
+		return
+	}
+
+	line, err := bufio.NewReader(io.LimitReader(conn, adminMaxRequest)).ReadString('\n')
+	if err != nil {
+		return
+	}
+	fields := strings.Fields(line)
+	if len(fields) == 0 {
+		fields = []string{"help"}
+	}
+
+	var buf bytes.Buffer
+	cmd := adminCommands[fields[0]]
+	if cmd == nil {
+		err = fmt.Errorf("unknown command '%s'", fields[0])
+	} else {
+		log.Infof("admin - %s", strings.Join(fields, " "))
+		err = cmd.run(&buf, fields[1:])
+	}
+	if err != nil {
+		_, _ = fmt.Fprintf(conn, "%s %s\n", adminReplyError, err)
+		return
+	}
+	_, _ = fmt.Fprintf(conn, "%s\n%s", adminReplyOK, buf.Bytes())
+}
+
+func adminHelp(w io.Writer, args []string) error {
+	names := make([]string, 0, len(adminCommands))
+	for name := range adminCommands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	for _, name := range names {
+		fmt.Fprintf(tw, "%s\t%s\n", adminCommands[name].usage, adminCommands[name].help)
+	}
+	return tw.Flush()
+}
+
+func adminSessions(w io.Writer, args []string) error {
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "ID\tTRANSPORT\tROLE\tPEER\tAGE\tRECEIVED\tSENT\tWIRE RECEIVED\tWIRE SENT")
+	now := time.Now()
+	for _, s := range sessions() {
+		payloadRead, payloadWritten, wireRead, wireWritten := s.counts()
+		fmt.Fprintf(tw, "%d\t%s\t%s\t%s\t%s\t%d\t%d\t%d\t%d\n", s.id, s.transport, s.role,
+			log.ElideAddr(s.peerAddr()), now.Sub(s.start).Truncate(time.Second),
+			payloadRead, payloadWritten, wireRead, wireWritten)
+	}
+	return tw.Flush()
+}
+
+func adminClose(w io.Writer, args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("usage: %s", adminCommands["close"].usage)
+	}
+	id, err := strconv.ParseUint(args[0], 10, 64)
+	if err != nil {
+		return fmt.Errorf("invalid session '%s'", args[0])
+	}
+	s := lookupSession(id)
+	if s == nil {
+		return fmt.Errorf("no session %d", id)
+	}
+	_ = s.close()
+	fmt.Fprintf(w, "closed session %d\n", id)
+	return nil
+}
+
+func adminLogLevel(w io.Writer, args []string) error {
+	switch len(args) {
+	case 0:
+	case 1:
+		if err := log.SetLogLevel(args[0]); err != nil {
+			return err
+		}
+		log.Noticef("admin - log level set to %s", log.LevelName())
+	default:
+		return fmt.Errorf("usage: %s", adminCommands["loglevel"].usage)
+	}
+	fmt.Fprintln(w, log.LevelName())
+	return nil
+}
+
+func adminListeners(w io.Writer, args []string) error {
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "ID\tTRANSPORT\tROLE\tADDRESS\tSTATE")
+	for _, l := range proxyListeners() {
+		state := "disabled"
+		switch {
+		case l.isClosed():
+			state = "closed"
+		case l.enabled():
+			state = "enabled"
+		}
+		fmt.Fprintf(tw, "%d\t%s\t%s\t%s\t%s\n", l.id, l.transport, l.role, l.addr, state)
+	}
+	return tw.Flush()
+}
+
+func adminEnable(enable bool) func(w io.Writer, args []string) error {
+	return func(w io.Writer, args []string) error {
+		l, err := adminLookupListener(args)
+		if err != nil {
+			return err
+		}
+		if err = l.setEnabled(enable); err != nil {
+			return err
+		}
+		if enable {
+			fmt.Fprintf(w, "enabled listener %d\n", l.id)
+		} else {
+			fmt.Fprintf(w, "disabled listener %d\n", l.id)
+		}
+		return nil
+	}
+}
+
+func adminParams(w io.Writer, args []string) error {
+	listeners := proxyListeners()
+	if len(args) > 0 {
+		l, err := adminLookupListener(args)
+		if err != nil {
+			return err
+		}
+		listeners = []*proxyListener{l}
+	}
+
+	for _, l := range listeners {
+		fmt.Fprintf(w, "listener %d (%s %s %s):\n", l.id, l.transport, l.role, l.addr)
+		describer := l.currentHandler().params
+		if describer == nil {
+			fmt.Fprintln(w, "  no derived parameters")
+			continue
+		}
+		params, err := describer.DescribeParams()
+		if err != nil {
+			fmt.Fprintf(w, "  failed: %s\n", err)
+			continue
+		}
+		keys := make([]string, 0, len(params))
+		for k := range params {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			fmt.Fprintf(w, "  %s=%s\n", k, params[k])
+		}
+	}
+	return nil
+}
+
+func adminLookupListener(args []string) (*proxyListener, error) {
+	if len(args) != 1 {
+		return nil, fmt.Errorf("a listener ID is required")
+	}
+	id, err := strconv.Atoi(args[0])
+	if err != nil {
+		return nil, fmt.Errorf("invalid listener '%s'", args[0])
+	}
+	l := lookupListener(id)
+	if l == nil {
+		return nil, fmt.Errorf("no listener %d", id)
+	}
+	return l, nil
+}
+
+// adminCtl is the "ctl" subcommand, that sends a command to the admin control
+// socket and prints the output to stdout, and errors to stderr.  It returns
+// the exit status.
+func adminCtl(execName string, argv []string, stdout, stderr io.Writer) int {
+	fs := flag.NewFlagSet(execName+" "+adminCtlCommand, flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	socketPath := fs.String("socket", "", "The admin control socket (-adminSocket)")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s %s -socket <path> <command> [args...]\n", execName, adminCtlCommand)
+		fs.PrintDefaults()
+		fmt.Fprintf(fs.Output(), "Run the \"help\" command to list the commands.\n")
+	}
+	if err := fs.Parse(argv); err != nil {
+		return 2
+	}
+	if *socketPath == "" || fs.NArg() == 0 {
+		fs.Usage()
+		return 2
+	}
+
+	conn, err := net.DialTimeout("unix", *socketPath, adminTimeout)
+	if err != nil {
+		fmt.Fprintf(stderr, "%s: %s\n", execName, err)
+		return 1
+	}
+	defer conn.Close()
+	if err = conn.SetDeadline(time.Now().Add(adminTimeout)); err != nil {
+		fmt.Fprintf(stderr, "%s: %s\n", execName, err)
+		return 1
+	}
+
+	if _, err = fmt.Fprintf(conn, "%s\n", strings.Join(fs.Args(), " ")); err != nil {
+		fmt.Fprintf(stderr, "%s: %s\n", execName, err)
+		return 1
+	}
+	resp, err := ioutil.ReadAll(conn)
+	if err != nil {
+		fmt.Fprintf(stderr, "%s: %s\n", execName, err)
+		return 1
+	}
+
+	status, body := string(resp), ""
+	if idx := strings.IndexByte(status, '\n'); idx >= 0 {
+		status, body = status[:idx], status[idx+1:]
+	}
+	switch {
+	case status == adminReplyOK:
+		fmt.Fprint(stdout, body)
+		return 0
+	case strings.HasPrefix(status, adminReplyError+" "):
+		fmt.Fprintf(stderr, "%s: %s\n", execName, strings.TrimPrefix(status, adminReplyError+" "))
+	default:
+		fmt.Fprintf(stderr, "%s: malformed reply\n", execName)
+	}
+	return 1
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/RACECAR-GU/obfsX/common/log"
+)
+
+type testParams map[string]string
+
+func (p testParams) DescribeParams() (map[string]string, error) { return p, nil }
+
+// adminRequest sends the command line to adminHandler, and returns the reply.
+func adminRequest(t *testing.T, line string) string {
+	c, s := net.Pipe()
+	defer c.Close()
+	go adminHandler(s)
+
+	if _, err := c.Write([]byte(line + "\n")); err != nil {
+		t.Fatalf("%q: Write failed: %s", line, err)
+	}
+	resp, err := ioutil.ReadAll(c)
+	if err != nil {
+		t.Fatalf("%q: ReadAll failed: %s", line, err)
+	}
+	return string(resp)
+}
+
+func expectReply(t *testing.T, line, prefix string, contains ...string) {
+	resp := adminRequest(t, line)
+	if !strings.HasPrefix(resp, prefix) {
+		t.Errorf("%q: %q, expected a %q reply", line, resp, prefix)
+		return
+	}
+	for _, s := range contains {
+		if !strings.Contains(resp, s) {
+			t.Errorf("%q: %q, expected it to contain %q", line, resp, s)
+		}
+	}
+}
+
+func TestAdminHandler(t *testing.T) {
+	defer log.SetLogLevel(log.LevelName())
+
+	expectReply(t, "help", "OK\n", "sessions", "loglevel [ERROR|WARN|INFO|DEBUG]")
+	expectReply(t, "", "OK\n", "close <session>")
+	expectReply(t, "bogus", "ERROR unknown command 'bogus'\n")
+
+	if err := log.SetLogLevel("ERROR"); err != nil {
+		t.Fatalf("SetLogLevel failed: %s", err)
+	}
+	expectReply(t, "loglevel", "OK\nERROR\n")
+	expectReply(t, "loglevel DEBUG", "OK\nDEBUG\n")
+	if level := log.LevelName(); level != "DEBUG" {
+		t.Errorf("the log level is %s, expected DEBUG", level)
+	}
+	expectReply(t, "loglevel LOUD", "ERROR ")
+	expectReply(t, "loglevel INFO WARN", "ERROR usage:")
+	if level := log.LevelName(); level != "DEBUG" {
+		t.Errorf("an invalid loglevel changed the log level to %s", level)
+	}
+
+	// Sessions are listed, and can be closed.
+	c, s := net.Pipe()
+	defer c.Close()
+	sess := newSession("obfs4", roleServer, "192.0.2.1:1234", s)
+	defer sess.done()
+	sessID := strconv.FormatUint(sess.id, 10)
+	expectReply(t, "sessions", "OK\nID", "obfs4", roleServer)
+	expectReply(t, "close", "ERROR usage:")
+	expectReply(t, "close x", "ERROR invalid session 'x'\n")
+	expectReply(t, "close 0", "ERROR no session 0\n")
+	expectReply(t, "close "+sessID, "OK\nclosed session "+sessID+"\n")
+	if _, err := c.Write([]byte("x")); err == nil {
+		t.Errorf("closing the session left its connection open")
+	}
+
+	// Listeners can be disabled and enabled again.
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %s", err)
+	}
+	h := &listenerHandler{
+		handle: func(conn net.Conn) { conn.Close() },
+		params: testParams{"k": "v"},
+	}
+	l := newProxyListener("obfs4", roleServer, "127.0.0.1:0", ln, h, nil)
+	defer l.close()
+	id := strconv.Itoa(l.id)
+	addr := l.addr
+
+	expectReply(t, "listeners", "OK\nID", addr+"  enabled")
+	expectReply(t, "params "+id, "OK\nlistener "+id, "  k=v\n")
+	expectReply(t, "params 1000", "ERROR no listener 1000\n")
+	expectReply(t, "disable", "ERROR a listener ID is required\n")
+	expectReply(t, "disable x", "ERROR invalid listener 'x'\n")
+	expectReply(t, "disable "+id, "OK\ndisabled listener "+id+"\n")
+	if l.enabled() {
+		t.Errorf("disable left the listener enabled")
+	}
+	if conn, err := net.Dial("tcp", addr); err == nil {
+		conn.Close()
+		t.Errorf("the disabled listener accepted a connection")
+	}
+	expectReply(t, "listeners", "OK\nID", addr+"  disabled")
+	expectReply(t, "enable "+id, "OK\nenabled listener "+id+"\n")
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("the enabled listener refused a connection: %s", err)
+	}
+	conn.Close()
+
+	l.close()
+	expectReply(t, "listeners", "OK\nID", addr+"  closed")
+	expectReply(t, "enable "+id, "ERROR listener "+id+" is closed\n")
+}
+
+func TestAdminCtl(t *testing.T) {
+	dir, err := ioutil.TempDir("", "obfs4proxy")
+	if err != nil {
+		t.Fatalf("TempDir failed: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	socketPath := filepath.Join(dir, "admin.sock")
+	ln, err := adminListen(socketPath)
+	if err != nil {
+		t.Fatalf("adminListen failed: %s", err)
+	}
+	defer ln.Close()
+	if fi, err := os.Stat(socketPath); err != nil {
+		t.Fatalf("Stat failed: %s", err)
+	} else if mode := fi.Mode().Perm(); mode != 0600 {
+		t.Errorf("the socket mode is %o, expected 600", mode)
+	}
+
+	for _, v := range []struct {
+		argv           []string
+		status         int
+		stdout, stderr string
+	}{
+		{[]string{"-socket", socketPath, "help"}, 0, "close <session>", ""},
+		{[]string{"-socket", socketPath, "bogus", "arg"}, 1, "", "ctl: unknown command 'bogus'\n"},
+		{[]string{"-socket", filepath.Join(dir, "missing"), "help"}, 1, "", "ctl: "},
+		{[]string{"-socket", socketPath}, 2, "", "Usage:"},
+		{[]string{"help"}, 2, "", "Usage:"},
+		{[]string{"-bogus"}, 2, "", "flag provided but not defined"},
+	} {
+		var stdout, stderr bytes.Buffer
+		status := adminCtl("ctl", v.argv, &stdout, &stderr)
+		if status != v.status {
+			t.Errorf("%v: status %d, expected %d (%q)", v.argv, status, v.status, stderr.String())
+		}
+		if !strings.Contains(stdout.String(), v.stdout) || (v.stdout == "" && stdout.Len() != 0) {
+			t.Errorf("%v: stdout %q, expected %q", v.argv, stdout.String(), v.stdout)
+		}
+		if !strings.Contains(stderr.String(), v.stderr) || (v.stderr == "" && stderr.Len() != 0) {
+			t.Errorf("%v: stderr %q, expected %q", v.argv, stderr.String(), v.stderr)
+		}
+	}
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/RACECAR-GU/obfsX/common/log"
+)
+
+const backendDialTimeout = 10 * time.Second
+
+// backend is a TCP service that an unmanaged server forwards sessions to.
+type backend struct {
+	addr    string
+	healthy bool
+}
+
+// backendPool selects backends round-robin, skipping the ones that failed
+// the last health check or dial.
+type backendPool struct {
+	sync.Mutex
+
+	backends []*backend
+	next     int
+	closed   chan struct{}
+}
+
+func newBackendPool(addrs []string) (*backendPool, error) {
+	if len(addrs) == 0 {
+		return nil, fmt.Errorf("no backends specified")
+	}
+	p := &backendPool{closed: make(chan struct{})}
+	for _, addr := range addrs {
+		if _, _, err := net.SplitHostPort(addr); err != nil {
+			return nil, fmt.Errorf("invalid backend '%s': %s", addr, err)
+		}
+		p.backends = append(p.backends, &backend{addr: addr, healthy: true})
+	}
+	return p, nil
+}
+
+// candidates returns the backends to try, in order, starting at the next one
+// in the rotation.  Unhealthy backends are only tried after the healthy ones,
+// as the health check may be stale.
+func (p *backendPool) candidates() []*backend {
+	p.Lock()
+	defer p.Unlock()
+
+	n := len(p.backends)
+	var healthy, unhealthy []*backend
+	for i := 0; i < n; i++ {
+		b := p.backends[(p.next+i)%n]
+		if b.healthy {
+			healthy = append(healthy, b)
+		} else {
+			unhealthy = append(unhealthy, b)
+		}
+	}
+	p.next = (p.next + 1) % n
+	return append(healthy, unhealthy...)
+}
+
+func (p *backendPool) setHealthy(b *backend, healthy bool) {
+	p.Lock()
+	defer p.Unlock()
+
+	if b.healthy != healthy {
+		if healthy {
+			log.Noticef("backend %s is up", b.addr)
+		} else {
+			log.Warnf("backend %s is down", b.addr)
+		}
+	}
+	b.healthy = healthy
+}
+
+// dial connects to a backend, trying each of them in turn.
+func (p *backendPool) dial() (net.Conn, error) {
+	var err error
+	for _, b := range p.candidates() {
+		var conn net.Conn
+		if conn, err = net.DialTimeout("tcp", b.addr, backendDialTimeout); err == nil {
+			p.setHealthy(b, true)
+			return conn, nil
+		}
+		p.setHealthy(b, false)
+	}
+	return nil, err
+}
+
+// healthCheck periodically checks that each backend accepts connections,
+// until the pool is closed.
+func (p *backendPool) healthCheck(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-p.closed:
+			return
+		case <-ticker.C:
+		}
+
+		p.Lock()
+		backends := append([]*backend(nil), p.backends...)
+		p.Unlock()
+
+		for _, b := range backends {
+			conn, err := net.DialTimeout("tcp", b.addr, backendDialTimeout)
+			if err == nil {
+				conn.Close()
+			}
+			p.setHealthy(b, err == nil)
+		}
+	}
+}
+
+func (p *backendPool) close() {
+	close(p.closed)
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"net"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// listenBackend listens on addr (eg: "127.0.0.1:0"), accepting and closing
+// connections until the listener is closed.
+func listenBackend(t *testing.T, addr string) net.Listener {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		t.Fatalf("failed to listen on %s: %s", addr, err)
+	}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+	return ln
+}
+
+func candidateAddrs(p *backendPool) []string {
+	var addrs []string
+	for _, b := range p.candidates() {
+		addrs = append(addrs, b.addr)
+	}
+	return addrs
+}
+
+func TestBackendPoolOrder(t *testing.T) {
+	for _, addrs := range [][]string{nil, {"127.0.0.1"}, {"127.0.0.1:1", "bogus"}} {
+		if _, err := newBackendPool(addrs); err == nil {
+			t.Errorf("newBackendPool(%v) succeeded", addrs)
+		}
+	}
+
+	p, err := newBackendPool([]string{"192.0.2.1:1", "192.0.2.2:2", "192.0.2.3:3"})
+	if err != nil {
+		t.Fatalf("newBackendPool failed: %s", err)
+	}
+	expected := [][]string{
+		{"192.0.2.1:1", "192.0.2.2:2", "192.0.2.3:3"},
+		{"192.0.2.2:2", "192.0.2.3:3", "192.0.2.1:1"},
+
+		// The unhealthy backend is tried last.
+		{"192.0.2.3:3", "192.0.2.1:1", "192.0.2.2:2"},
+		{"192.0.2.1:1", "192.0.2.3:3", "192.0.2.2:2"},
+	}
+	for i, v := range expected {
+		if i == 2 {
+			p.setHealthy(p.backends[1], false)
+		}
+		if got := candidateAddrs(p); !reflect.DeepEqual(got, v) {
+			t.Fatalf("candidates %d: %v, expected %v", i, got, v)
+		}
+	}
+}
+
+func TestBackendPoolHealth(t *testing.T) {
+	up := listenBackend(t, "127.0.0.1:0")
+	defer up.Close()
+	down := listenBackend(t, "127.0.0.1:0")
+	downAddr := down.Addr().String()
+	down.Close()
+
+	p, err := newBackendPool([]string{downAddr, up.Addr().String()})
+	if err != nil {
+		t.Fatalf("newBackendPool failed: %s", err)
+	}
+
+	// The dial falls through to the backend that is up, and the other one
+	// is marked down.
+	conn, err := p.dial()
+	if err != nil {
+		t.Fatalf("dial failed: %s", err)
+	}
+	conn.Close()
+	if p.backends[0].healthy || !p.backends[1].healthy {
+		t.Fatalf("dial did not update the health")
+	}
+
+	// The health check notices the backends going up and down, and stops
+	// once the pool is closed.
+	done := make(chan struct{})
+	go func() {
+		p.healthCheck(10 * time.Millisecond)
+		close(done)
+	}()
+	down = listenBackend(t, downAddr)
+	defer down.Close()
+	up.Close()
+	waitFor(t, "the health check", func() bool {
+		p.Lock()
+		defer p.Unlock()
+		return p.backends[0].healthy && !p.backends[1].healthy
+	})
+	p.close()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("the health check did not stop")
+	}
+}
+
+func TestBackendPoolReplace(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %s", err)
+	}
+	p, err := newBackendPool([]string{"127.0.0.1:1"})
+	if err != nil {
+		t.Fatalf("newBackendPool failed: %s", err)
+	}
+	done := make(chan struct{})
+	go func() {
+		p.healthCheck(time.Hour)
+		close(done)
+	}()
+
+	// The pool of a handler that is replaced (eg: by a reload) is closed.
+	l := newProxyListener("obfs4", roleServer, "127.0.0.1:0", ln, &listenerHandler{onClose: p.close}, nil)
+	defer l.close()
+	l.replace(&listenerHandler{})
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("the replaced handler's health check did not stop")
+	}
+}
+
+// waitFor polls cond until it is true, failing the test after a while.
+func waitFor(t *testing.T, what string, cond func() bool) {
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
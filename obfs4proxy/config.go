@@ -0,0 +1,630 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"runtime"
+	"strings"
+	"time"
+
+	"git.torproject.org/pluggable-transports/goptlib.git"
+	"github.com/RACECAR-GU/obfsX/common/connlimit"
+	"github.com/RACECAR-GU/obfsX/common/log"
+	"github.com/RACECAR-GU/obfsX/common/ratelimit"
+	"github.com/RACECAR-GU/obfsX/common/sandbox"
+	"github.com/RACECAR-GU/obfsX/common/workerpool"
+	"github.com/RACECAR-GU/obfsX/transports"
+)
+
+// This file contains the JSON configuration file.  Settings are taken from,
+// in decreasing order of precedence: tor (managed mode), the command line
+// flags, the configuration file, and the defaults.
+
+// config is the obfs4proxy configuration.
+type config struct {
+	// Log is the logging configuration.
+	Log logConfig `json:"log"`
+
+	// MetricsAddr is the address to serve the Prometheus metrics on, or
+	// empty.  It must be a loopback address, unless MetricsPublic is set.
+	MetricsAddr string `json:"metricsAddr"`
+
+	// MetricsPublic allows MetricsAddr to be a non-loopback address.
+	MetricsPublic bool `json:"metricsPublic"`
+
+	// AdminSocket is the path of the admin control socket, or empty.
+	AdminSocket string `json:"adminSocket"`
+
+	// Handshakes is the server handshake worker pool.
+	Handshakes handshakesConfig `json:"handshakes"`
+
+	// Hardening is the server sandbox, applied once the listeners are set
+	// up.
+	Hardening hardeningConfig `json:"hardening"`
+
+	// DrainTimeout is how long the sessions may continue after the first
+	// SIGINT, before being closed.  0 waits for them indefinitely.  A reload
+	// (SIGHUP) leaves the sessions open.
+	DrainTimeout duration `json:"drainTimeout"`
+
+	// StateDir is the unmanaged mode state directory.  A managed
+	// obfs4proxy always uses the one that tor provides.
+	StateDir string `json:"stateDir"`
+
+	// Transports are the per-transport settings, keyed by transport name.
+	Transports map[string]*transportConfig `json:"transports"`
+
+	// Mode is "client" or "server" to run unmanaged, or empty.
+	Mode string `json:"mode"`
+
+	// Clients are the unmanaged client listeners.
+	Clients []*clientConfig `json:"clients"`
+
+	// Servers are the unmanaged server listeners.
+	Servers []*serverConfig `json:"servers"`
+}
+
+type logConfig struct {
+	// Enable enables logging to obfs4proxy.log in the state directory.
+	Enable bool `json:"enable"`
+
+	// Level is the log level (ERROR/WARN/INFO/DEBUG).
+	Level string `json:"level"`
+
+	// Unsafe disables the address scrubber.
+	Unsafe bool `json:"unsafe"`
+}
+
+// handshakesConfig is the server handshake worker pool, which bounds the CPU
+// that the handshakes use (see obfs4.SetHandshakePool).  The zero values are
+// the defaults.
+type handshakesConfig struct {
+	// Workers is the number of handshakes run at once (default: half of
+	// the CPUs).
+	Workers int `json:"workers"`
+
+	// Queue is the number of handshakes that can wait for a worker
+	// (default: 64 per worker).
+	Queue int `json:"queue"`
+
+	// MaxQueueWait is the longest a handshake waits for a worker (default:
+	// 5s), within the handshake timeout.
+	MaxQueueWait duration `json:"maxQueueWait"`
+}
+
+// hardeningConfig is the sandbox (see the sandbox package), applied once the
+// listeners are set up.  The zero value does not confine the process.
+type hardeningConfig struct {
+	// User is the user (a name or a uid) to run as, or empty to keep the
+	// current one.
+	User string `json:"user"`
+
+	// Group is the group (a name or a gid) to run as (default: the user's
+	// primary group).
+	Group string `json:"group"`
+
+	// Seccomp is what happens on a system call outside of the allowlist,
+	// "kill" or "log", or empty to not restrict the system calls.
+	Seccomp string `json:"seccomp"`
+}
+
+func (hc *hardeningConfig) validate() error {
+	if hc.Group != "" && hc.User == "" {
+		return fmt.Errorf("group requires a user")
+	}
+	if hc.Seccomp != "" {
+		if _, err := sandbox.ParseAction(hc.Seccomp); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+const defaultHandshakeMaxQueueWait = 5 * time.Second
+
+func (hc *handshakesConfig) validate() error {
+	if hc.Workers < 0 {
+		return fmt.Errorf("invalid number of workers %d", hc.Workers)
+	}
+	if hc.Queue < 0 {
+		return fmt.Errorf("invalid queue length %d", hc.Queue)
+	}
+	if hc.MaxQueueWait.Duration < 0 {
+		return fmt.Errorf("invalid maximum queue wait '%s'", hc.MaxQueueWait)
+	}
+	return nil
+}
+
+// newPool returns the worker pool.
+func (hc *handshakesConfig) newPool() *workerpool.Pool {
+	workers, queue, maxQueueWait := hc.Workers, hc.Queue, hc.MaxQueueWait.Duration
+	if workers == 0 {
+		if workers = runtime.NumCPU() / 2; workers < 1 {
+			workers = 1
+		}
+	}
+	if queue == 0 {
+		queue = 64 * workers
+	}
+	if maxQueueWait == 0 {
+		maxQueueWait = defaultHandshakeMaxQueueWait
+	}
+	return workerpool.New(workers, queue, maxQueueWait)
+}
+
+// transportConfig are the per-transport defaults.
+type transportConfig struct {
+	// DistBias enables ScrambleSuit style probability distributions (the
+	// "<transport>-distBias" flag).
+	DistBias *bool `json:"distBias"`
+
+	// ClientArgs are the default bridge line arguments, which the bridge
+	// line (or the SOCKS request from tor) overrides.
+	ClientArgs map[string]string `json:"clientArgs"`
+
+	// ServerOptions are the default server transport options, which the
+	// listener's options (or tor's ServerTransportOptions) override.
+	ServerOptions map[string]string `json:"serverOptions"`
+
+	// Limits are the default connection limits of the server listeners.
+	Limits *connlimit.Config `json:"limits"`
+
+	// Bandwidth are the default bandwidth limits of the listeners.
+	Bandwidth *ratelimit.Config `json:"bandwidth"`
+}
+
+// clientConfig is an unmanaged client listener.
+type clientConfig struct {
+	// Transport is the name of the transport, which may be omitted if the
+	// bridge line includes it.
+	Transport string `json:"transport"`
+
+	// Bridge is the bridge line that the listener connects to.  If empty,
+	// each request picks the bridge, passing its arguments as the
+	// credentials (like tor does).
+	Bridge string `json:"bridge"`
+
+	// Bridges are bridge lines (for the same transport) that the listener
+	// fails over between, instead of Bridge, preferring the healthy ones.
+	Bridges []string `json:"bridges"`
+
+	// FailoverDelay is how long a connection attempt to one of the Bridges
+	// runs before the next one is raced (default: 2s).
+	FailoverDelay duration `json:"failoverDelay"`
+
+	// ListenAddr is the local address to listen on, or "unix:" and the
+	// path of a Unix socket.
+	ListenAddr string `json:"listenAddr"`
+
+	// SocketMode is the octal file mode of a Unix socket (default 0600),
+	// which controls which local users can use the listener.
+	SocketMode string `json:"socketMode"`
+
+	// Protocol is the proxy protocol of the listener, "socks5" (the
+	// default) or "http" (HTTP CONNECT).
+	Protocol string `json:"protocol"`
+
+	// Forward relays connections to the bridge without a SOCKS5 handshake.
+	Forward bool `json:"forward"`
+
+	// Exit is set if the bridge is an exit server, that is sent the SOCKS5
+	// destination, or ExitTarget if forwarding.  ExitSecret is the secret
+	// shared with the server, or ExitSecretFile the file that holds it.
+	Exit           bool   `json:"exit"`
+	ExitSecret     string `json:"exitSecret"`
+	ExitSecretFile string `json:"exitSecretFile"`
+	ExitTarget     string `json:"exitTarget"`
+
+	// Bandwidth are the bandwidth limits, which override the transport's.
+	Bandwidth *ratelimit.Config `json:"bandwidth"`
+}
+
+// serverConfig is an unmanaged server listener.
+type serverConfig struct {
+	// Transport is the name of the transport.
+	Transport string `json:"transport"`
+
+	// ListenAddr is the address to listen on.
+	ListenAddr string `json:"listenAddr"`
+
+	// Options are the transport options (like a torrc
+	// ServerTransportOptions).
+	Options map[string]string `json:"options"`
+
+	// Backends are the addresses that sessions are forwarded to,
+	// round-robin.
+	Backends []string `json:"backends"`
+
+	// HealthInterval is the interval between backend health checks, 0
+	// disables them.
+	HealthInterval *duration `json:"healthInterval"`
+
+	// Exit is set if the server connects to the destinations chosen by the
+	// clients, subject to ExitPolicy, instead of Backends.  ExitSecret is the
+	// secret that authenticates the clients, or ExitSecretFile the file that
+	// holds it.
+	Exit           bool     `json:"exit"`
+	ExitSecret     string   `json:"exitSecret"`
+	ExitSecretFile string   `json:"exitSecretFile"`
+	ExitPolicy     []string `json:"exitPolicy"`
+
+	// Limits are the connection limits, which override the transport's.
+	Limits *connlimit.Config `json:"limits"`
+
+	// Bandwidth are the bandwidth limits, which override the transport's.
+	Bandwidth *ratelimit.Config `json:"bandwidth"`
+}
+
+// duration is a time.Duration that is a string ("30s") in JSON.
+type duration struct {
+	time.Duration
+}
+
+func (d *duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return fmt.Errorf("duration must be a string (eg: \"30s\")")
+	}
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	d.Duration = v
+	return nil
+}
+
+func (d duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(d.String())
+}
+
+// loadConfig loads the configuration file.  Unknown fields are errors, so
+// that typos are not silently ignored.
+func loadConfig(path string) (*config, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	cfg := new(config)
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.DisallowUnknownFields()
+	if err = dec.Decode(cfg); err != nil {
+		return nil, fmt.Errorf("%s: %s", path, describeJSONError(b, err))
+	}
+	if _, err = dec.Token(); err != io.EOF {
+		return nil, fmt.Errorf("%s: trailing data after the configuration", path)
+	}
+	return cfg, nil
+}
+
+// describeJSONError adds the line number to JSON decoding errors.
+func describeJSONError(b []byte, err error) string {
+	var offset int64
+	switch e := err.(type) {
+	case *json.SyntaxError:
+		offset = e.Offset
+	case *json.UnmarshalTypeError:
+		offset = e.Offset
+	default:
+		return err.Error()
+	}
+	line := 1 + bytes.Count(b[:offset], []byte("\n"))
+	return fmt.Sprintf("line %d: %s", line, err)
+}
+
+// applyFlags overrides the configuration with the command line flags that
+// were explicitly set.  The unmanaged listener flags apply to the first
+// listener of the mode, which is created if needed.
+func (cfg *config) applyFlags(fs *flag.FlagSet, f *cmdlineFlags) error {
+	set := make(map[string]bool)
+	fs.Visit(func(fl *flag.Flag) {
+		set[fl.Name] = true
+	})
+
+	if set["enableLogging"] {
+		cfg.Log.Enable = f.enableLogging
+	}
+	if set["logLevel"] || cfg.Log.Level == "" {
+		cfg.Log.Level = f.logLevel
+	}
+	if set["unsafeLogging"] {
+		cfg.Log.Unsafe = f.unsafeLogging
+	}
+	if set["metricsAddr"] {
+		cfg.MetricsAddr = f.metricsAddr
+	}
+	if set["metricsPublic"] {
+		cfg.MetricsPublic = f.metricsPublic
+	}
+	if set["adminSocket"] {
+		cfg.AdminSocket = f.adminSocket
+	}
+	if set["drainTimeout"] {
+		cfg.DrainTimeout = duration{f.drainTimeout}
+	}
+	if set["stateDir"] {
+		cfg.StateDir = f.stateDir
+	}
+	if set["mode"] {
+		cfg.Mode = f.mode
+	}
+
+	anySet := func(names ...string) bool {
+		for _, name := range names {
+			if set[name] {
+				return true
+			}
+		}
+		return false
+	}
+	switch cfg.Mode {
+	case "":
+		if anySet("transport", "bridge", "listenAddr", "socketMode", "protocol", "forward", "options", "backends", "healthInterval", "exit", "exitSecretFile", "exitTarget", "exitPolicy", "stateDir") {
+			return fmt.Errorf("the unmanaged mode flags require a mode")
+		}
+	case modeClient, modeStdio:
+		if !anySet("transport", "bridge", "listenAddr", "socketMode", "protocol", "forward", "exit", "exitSecretFile", "exitTarget") {
+			break
+		}
+		if len(cfg.Clients) == 0 {
+			cfg.Clients = append(cfg.Clients, new(clientConfig))
+		}
+		c := cfg.Clients[0]
+		if set["transport"] {
+			c.Transport = f.transport
+		}
+		if set["bridge"] {
+			c.Bridge, c.Bridges = f.bridge, nil
+		}
+		if set["listenAddr"] {
+			c.ListenAddr = f.listenAddr
+		}
+		if set["socketMode"] {
+			c.SocketMode = f.socketMode
+		}
+		if set["protocol"] {
+			c.Protocol = f.protocol
+		}
+		if set["forward"] {
+			c.Forward = f.forward
+		}
+		if set["exit"] {
+			c.Exit = f.exit
+		}
+		if set["exitSecretFile"] {
+			c.ExitSecret, c.ExitSecretFile = "", f.exitSecretFile
+		}
+		if set["exitTarget"] {
+			c.ExitTarget = f.exitTarget
+		}
+	case modeServer:
+		if !anySet("transport", "listenAddr", "options", "backends", "healthInterval", "exit", "exitSecretFile", "exitPolicy") {
+			break
+		}
+		if len(cfg.Servers) == 0 {
+			cfg.Servers = append(cfg.Servers, new(serverConfig))
+		}
+		s := cfg.Servers[0]
+		if set["transport"] {
+			s.Transport = f.transport
+		}
+		if set["listenAddr"] {
+			s.ListenAddr = f.listenAddr
+		}
+		if set["options"] {
+			opts, err := parseOptions(f.options)
+			if err != nil {
+				return fmt.Errorf("-options: %s", err)
+			}
+			s.Options = opts
+		}
+		if set["backends"] {
+			s.Backends = splitList(f.backends)
+		}
+		if set["healthInterval"] {
+			s.HealthInterval = &duration{f.healthInterval}
+		}
+		if set["exit"] {
+			s.Exit = f.exit
+		}
+		if set["exitSecretFile"] {
+			s.ExitSecret, s.ExitSecretFile = "", f.exitSecretFile
+		}
+		if set["exitPolicy"] {
+			s.ExitPolicy = splitList(f.exitPolicy)
+		}
+	}
+	return nil
+}
+
+// splitList splits a comma separated list, ignoring empty entries.
+func splitList(s string) []string {
+	var l []string
+	for _, v := range strings.Split(s, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			l = append(l, v)
+		}
+	}
+	return l
+}
+
+// validate checks the configuration, and fills in the defaults.  The
+// transports must be initialized.
+func (cfg *config) validate() error {
+	if err := log.SetLogLevel(cfg.Log.Level); err != nil {
+		return fmt.Errorf("log: %s", err)
+	}
+	if cfg.MetricsAddr != "" {
+		host, _, err := net.SplitHostPort(cfg.MetricsAddr)
+		if err != nil {
+			return fmt.Errorf("metricsAddr: %s", err)
+		}
+		if ip := net.ParseIP(host); !cfg.MetricsPublic && host != "localhost" && (ip == nil || !ip.IsLoopback()) {
+			return fmt.Errorf("metricsAddr: '%s' is not a loopback address, and metricsPublic is not set", cfg.MetricsAddr)
+		}
+	}
+	if err := cfg.Handshakes.validate(); err != nil {
+		return fmt.Errorf("handshakes: %s", err)
+	}
+	if err := cfg.Hardening.validate(); err != nil {
+		return fmt.Errorf("hardening: %s", err)
+	}
+	if cfg.Hardening != (hardeningConfig{}) && (cfg.Mode == modeClient || cfg.Mode == modeStdio) {
+		return fmt.Errorf("hardening: only supported by servers")
+	}
+	if cfg.DrainTimeout.Duration < 0 {
+		return fmt.Errorf("drainTimeout: invalid duration '%s'", cfg.DrainTimeout)
+	}
+
+	for name, tc := range cfg.Transports {
+		if transports.Get(name) == nil {
+			return fmt.Errorf("transports: '%s' is not supported", name)
+		}
+		if tc == nil {
+			return fmt.Errorf("transports.%s: no settings", name)
+		}
+		if tc.DistBias != nil && flag.Lookup(name+"-distBias") == nil {
+			return fmt.Errorf("transports.%s: distBias is not supported", name)
+		}
+		if tc.Limits != nil {
+			if err := tc.Limits.Validate(); err != nil {
+				return fmt.Errorf("transports.%s.limits: %s", name, err)
+			}
+		}
+		if tc.Bandwidth != nil {
+			if err := tc.Bandwidth.Validate(); err != nil {
+				return fmt.Errorf("transports.%s.bandwidth: %s", name, err)
+			}
+		}
+	}
+
+	switch cfg.Mode {
+	case "":
+		if len(cfg.Clients) > 0 || len(cfg.Servers) > 0 {
+			return fmt.Errorf("listeners are only used with an unmanaged mode")
+		}
+		return nil
+	case modeClient:
+		if len(cfg.Clients) == 0 {
+			return fmt.Errorf("no client listeners configured")
+		}
+		if len(cfg.Servers) > 0 {
+			return fmt.Errorf("server listeners configured in client mode")
+		}
+		for i, c := range cfg.Clients {
+			if err := c.validate(); err != nil {
+				return fmt.Errorf("clients[%d]: %s", i, err)
+			}
+			if err := c.validateListen(); err != nil {
+				return fmt.Errorf("clients[%d]: %s", i, err)
+			}
+		}
+	case modeStdio:
+		if len(cfg.Clients) != 1 {
+			return fmt.Errorf("stdio mode requires exactly one client")
+		}
+		if len(cfg.Servers) > 0 {
+			return fmt.Errorf("server listeners configured in stdio mode")
+		}
+		if err := cfg.Clients[0].validateStdio(); err != nil {
+			return fmt.Errorf("clients[0]: %s", err)
+		}
+	case modeServer:
+		if len(cfg.Servers) == 0 {
+			return fmt.Errorf("no server listeners configured")
+		}
+		if len(cfg.Clients) > 0 {
+			return fmt.Errorf("client listeners configured in server mode")
+		}
+		for i, s := range cfg.Servers {
+			if err := s.validate(); err != nil {
+				return fmt.Errorf("servers[%d]: %s", i, err)
+			}
+		}
+	default:
+		return fmt.Errorf("invalid mode '%s'", cfg.Mode)
+	}
+
+	if cfg.StateDir == "" {
+		return fmt.Errorf("no state directory specified")
+	}
+	return nil
+}
+
+// applyTransports applies the per-transport settings that are global flags,
+// unless they were explicitly set on the command line.
+func (cfg *config) applyTransports(fs *flag.FlagSet) error {
+	set := make(map[string]bool)
+	fs.Visit(func(fl *flag.Flag) {
+		set[fl.Name] = true
+	})
+	for name, tc := range cfg.Transports {
+		if flagName := name + "-distBias"; tc.DistBias != nil && !set[flagName] {
+			if err := fs.Set(flagName, fmt.Sprintf("%v", *tc.DistBias)); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// clientArgs returns the default bridge line arguments for the transport.
+func (cfg *config) clientArgs(name string) pt.Args {
+	return mapToArgs(cfg.transport(name).ClientArgs)
+}
+
+// serverOptions returns the server transport options for the transport,
+// with opts overriding the defaults.
+func (cfg *config) serverOptions(name string, opts pt.Args) pt.Args {
+	return mergeArgs(mapToArgs(cfg.transport(name).ServerOptions), opts)
+}
+
+// serverLimits returns the connection limits of a server listener for the
+// transport, or nil.  s is nil for managed listeners.
+func (cfg *config) serverLimits(name string, s *serverConfig) *connlimit.Config {
+	if s != nil && s.Limits != nil {
+		return s.Limits
+	}
+	return cfg.transport(name).Limits
+}
+
+// bandwidth returns the bandwidth limits of a listener for the transport, or
+// nil.  override is the listener's own limits, if any.
+func (cfg *config) bandwidth(name string, override *ratelimit.Config) *ratelimit.Config {
+	if override != nil {
+		return override
+	}
+	return cfg.transport(name).Bandwidth
+}
+
+func (cfg *config) transport(name string) *transportConfig {
+	if tc := cfg.Transports[name]; tc != nil {
+		return tc
+	}
+	return new(transportConfig)
+}
+
+func mapToArgs(m map[string]string) pt.Args {
+	args := make(pt.Args)
+	for k, v := range m {
+		args.Add(k, v)
+	}
+	return args
+}
+
+// mergeArgs returns a copy of defaults, with args overriding them.
+func mergeArgs(defaults, args pt.Args) pt.Args {
+	merged := make(pt.Args)
+	for k, v := range defaults {
+		merged[k] = v
+	}
+	for k, v := range args {
+		merged[k] = v
+	}
+	return merged
+}
@@ -0,0 +1,232 @@
+package main
+
+import (
+	"flag"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"git.torproject.org/pluggable-transports/goptlib.git"
+)
+
+var testBridge = "obfs4 192.0.2.1:443 cert=" + testCert + " iat-mode=0"
+
+func TestLoadConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "obfs4proxy")
+	if err != nil {
+		t.Fatalf("TempDir failed: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	for _, v := range []struct {
+		name    string
+		content string
+		err     string
+	}{
+		{"valid", "{\n  \"mode\": \"server\",\n  \"servers\": [{\"healthInterval\": \"30s\"}]\n}\n", ""},
+		{"unknown field", "{\n  \"mode\": \"client\",\n  \"moed\": \"server\"\n}", "unknown field \"moed\""},
+		{"syntax error", "{\n  \"mode\": \"client\"\n  \"stateDir\": \"/tmp\"\n}", "line 3"},
+		{"type error", "{\n  \"log\": {\n    \"enable\": \"yes\"\n  }\n}", "line 3"},
+		{"duration", "{\n  \"servers\": [{\"healthInterval\": 30}]\n}", "duration must be a string"},
+		{"trailing data", "{\"mode\": \"client\"}\n{}", "trailing data"},
+	} {
+		path := filepath.Join(dir, "config.json")
+		if err = ioutil.WriteFile(path, []byte(v.content), 0600); err != nil {
+			t.Fatalf("WriteFile failed: %s", err)
+		}
+		cfg, err := loadConfig(path)
+		if v.err == "" {
+			if err != nil {
+				t.Errorf("%s: loadConfig failed: %s", v.name, err)
+			} else if cfg.Mode != modeServer || len(cfg.Servers) != 1 || cfg.Servers[0].HealthInterval.Duration != 30*time.Second {
+				t.Errorf("%s: loadConfig returned %+v", v.name, cfg)
+			}
+			continue
+		}
+		if err == nil || !strings.Contains(err.Error(), v.err) {
+			t.Errorf("%s: loadConfig: %v, expected an error with '%s'", v.name, err, v.err)
+		}
+	}
+
+	if _, err = loadConfig(filepath.Join(dir, "missing.json")); err == nil {
+		t.Errorf("loadConfig of a missing file succeeded")
+	}
+}
+
+// applyTestFlags parses args, and applies them over cfg.
+func applyTestFlags(cfg *config, args ...string) error {
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	var f cmdlineFlags
+	f.register(fs)
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	return cfg.applyFlags(fs, &f)
+}
+
+func TestApplyFlags(t *testing.T) {
+	// The flags override the file, which overrides the defaults.
+	cfg := &config{
+		Log:      logConfig{Level: "DEBUG"},
+		StateDir: "/var/lib/file",
+		Mode:     modeClient,
+		Clients: []*clientConfig{
+			{Bridge: testBridge, ListenAddr: "127.0.0.1:1080", ExitSecret: "from the file"},
+			{Bridge: testBridge, ListenAddr: "127.0.0.1:1081"},
+		},
+	}
+	if err := applyTestFlags(cfg, "-stateDir", "/var/lib/flags", "-listenAddr", "127.0.0.1:2080", "-exitSecretFile", "/etc/secret"); err != nil {
+		t.Fatalf("applyFlags failed: %s", err)
+	}
+	c := cfg.Clients[0]
+	switch {
+	case cfg.StateDir != "/var/lib/flags":
+		t.Errorf("stateDir: '%s'", cfg.StateDir)
+	case cfg.Log.Level != "DEBUG":
+		t.Errorf("log level: '%s'", cfg.Log.Level)
+	case c.ListenAddr != "127.0.0.1:2080" || c.Bridge != testBridge:
+		t.Errorf("clients[0]: %+v", c)
+	case c.ExitSecret != "" || c.ExitSecretFile != "/etc/secret":
+		t.Errorf("clients[0] exit secret: '%s', '%s'", c.ExitSecret, c.ExitSecretFile)
+	case cfg.Clients[1].ListenAddr != "127.0.0.1:1081":
+		t.Errorf("clients[1]: %+v", cfg.Clients[1])
+	}
+
+	// Without a configuration file, the flags create the listener.
+	cfg = new(config)
+	if err := applyTestFlags(cfg, "-mode", "server", "-transport", "obfs4", "-backends", "127.0.0.1:22, 127.0.0.1:23", "-options", "iat-mode=1"); err != nil {
+		t.Fatalf("applyFlags failed: %s", err)
+	}
+	if cfg.Log.Level != "ERROR" {
+		t.Errorf("default log level: '%s'", cfg.Log.Level)
+	}
+	if len(cfg.Servers) != 1 {
+		t.Fatalf("servers: %+v", cfg.Servers)
+	}
+	s := cfg.Servers[0]
+	if s.Transport != "obfs4" || len(s.Backends) != 2 || s.Backends[1] != "127.0.0.1:23" || s.Options["iat-mode"] != "1" {
+		t.Errorf("servers[0]: %+v", s)
+	}
+
+	// The listener flags require a mode.
+	if err := applyTestFlags(new(config), "-transport", "obfs4"); err == nil {
+		t.Errorf("applyFlags accepted listener flags without a mode")
+	}
+	if err := applyTestFlags(&config{Mode: modeServer}, "-options", "iat-mode"); err == nil {
+		t.Errorf("applyFlags accepted invalid options")
+	}
+}
+
+func TestConfigValidate(t *testing.T) {
+	client := func(c *clientConfig) *config {
+		return &config{Mode: modeClient, StateDir: "/tmp", Clients: []*clientConfig{c}}
+	}
+	server := func(s *serverConfig) *config {
+		return &config{Mode: modeServer, StateDir: "/tmp", Servers: []*serverConfig{s}}
+	}
+	for _, v := range []struct {
+		name string
+		cfg  *config
+		err  string
+	}{
+		{"managed", &config{}, ""},
+		{"client", client(&clientConfig{Bridge: testBridge}), ""},
+		{"server", server(&serverConfig{Transport: "obfs4", ListenAddr: "0.0.0.0:443", Backends: []string{"127.0.0.1:22"}}), ""},
+		{"log level", &config{Log: logConfig{Level: "LOUD"}}, "log: invalid log level"},
+		{"metrics address", &config{MetricsAddr: "9100"}, "metricsAddr:"},
+		{"loopback metrics", &config{MetricsAddr: "127.0.0.1:9100"}, ""},
+		{"localhost metrics", &config{MetricsAddr: "localhost:9100"}, ""},
+		{"public metrics", &config{MetricsAddr: "0.0.0.0:9100"}, "not a loopback address"},
+		{"unspecified metrics", &config{MetricsAddr: ":9100"}, "not a loopback address"},
+		{"public metrics opt-in", &config{MetricsAddr: "192.0.2.1:9100", MetricsPublic: true}, ""},
+		{"drain timeout", &config{DrainTimeout: duration{-time.Second}}, "drainTimeout:"},
+		{"hardening group", &config{Hardening: hardeningConfig{Group: "nogroup"}}, "hardening: group requires a user"},
+		{"hardening client", &config{Mode: modeClient, Hardening: hardeningConfig{User: "nobody"}}, "only supported by servers"},
+		{"unknown transport", &config{Transports: map[string]*transportConfig{"obfs9": {}}}, "transports: 'obfs9' is not supported"},
+		{"no transport settings", &config{Transports: map[string]*transportConfig{"obfs4": nil}}, "transports.obfs4: no settings"},
+		{"listeners without a mode", &config{Clients: []*clientConfig{{}}}, "only used with an unmanaged mode"},
+		{"invalid mode", &config{Mode: "relay"}, "invalid mode 'relay'"},
+		{"no clients", &config{Mode: modeClient}, "no client listeners"},
+		{"no servers", &config{Mode: modeServer}, "no server listeners"},
+		{"no state directory", &config{Mode: modeClient, Clients: []*clientConfig{{Bridge: testBridge}}}, "no state directory"},
+		{"bridge and bridges", client(&clientConfig{Bridge: testBridge, Bridges: []string{testBridge}}), "clients[0]: bridge and bridges are mutually exclusive"},
+		{"bad bridge", client(&clientConfig{Bridge: "obfs9 192.0.2.1:443"}), "clients[0]: invalid bridge line"},
+		{"no bridge or transport", client(&clientConfig{}), "no bridge line or transport"},
+		{"forward without a bridge", client(&clientConfig{Transport: "obfs4", Forward: true}), "require a bridge line"},
+		{"protocol", client(&clientConfig{Bridge: testBridge, Protocol: "socks4"}), "invalid protocol"},
+		{"socket mode", client(&clientConfig{Bridge: testBridge, ListenAddr: "unix:/tmp/s", SocketMode: "0999"}), "invalid socket mode"},
+		{"socket mode over TCP", client(&clientConfig{Bridge: testBridge, SocketMode: "0600"}), "requires a Unix socket"},
+		{"exit target without exit", client(&clientConfig{Bridge: testBridge, ExitTarget: "192.0.2.2:80"}), "requires exit and forward"},
+		{"stdio without a bridge", &config{Mode: modeStdio, StateDir: "/tmp", Clients: []*clientConfig{{Transport: "obfs4"}}}, "no bridge line"},
+		{"stdio listening", &config{Mode: modeStdio, StateDir: "/tmp", Clients: []*clientConfig{{Bridge: testBridge, ListenAddr: "127.0.0.1:1080"}}}, "does not listen"},
+		{"client only server transport", server(&serverConfig{Transport: "auto", ListenAddr: "0.0.0.0:443", Backends: []string{"127.0.0.1:22"}}), "client only transport"},
+		{"server listen address", server(&serverConfig{Transport: "obfs4", ListenAddr: "443"}), "invalid listen address"},
+		{"no backends", server(&serverConfig{Transport: "obfs4", ListenAddr: "0.0.0.0:443"}), "no backends"},
+		{"exit and backends", server(&serverConfig{Transport: "obfs4", ListenAddr: "0.0.0.0:443", Exit: true, Backends: []string{"127.0.0.1:22"}}), "mutually exclusive"},
+		{"exit policy without exit", server(&serverConfig{Transport: "obfs4", ListenAddr: "0.0.0.0:443", Backends: []string{"127.0.0.1:22"}, ExitPolicy: []string{"allow *:*"}}), "exit settings without exit"},
+		{"health interval", server(&serverConfig{Transport: "obfs4", ListenAddr: "0.0.0.0:443", Backends: []string{"127.0.0.1:22"}, HealthInterval: &duration{-time.Second}}), "invalid health check interval"},
+	} {
+		if v.cfg.Log.Level == "" {
+			v.cfg.Log.Level = "ERROR"
+		}
+		err := v.cfg.validate()
+		if v.err == "" {
+			if err != nil {
+				t.Errorf("%s: validate failed: %s", v.name, err)
+			}
+			continue
+		}
+		if err == nil || !strings.Contains(err.Error(), v.err) {
+			t.Errorf("%s: validate: %v, expected an error with '%s'", v.name, err, v.err)
+		}
+	}
+
+	// The defaults are filled in.
+	cfg := &config{Log: logConfig{Level: "ERROR"}, Mode: modeServer, StateDir: "/tmp", Servers: []*serverConfig{{Transport: "obfs4", ListenAddr: "0.0.0.0:443", Backends: []string{"127.0.0.1:22"}}}}
+	if err := cfg.validate(); err != nil {
+		t.Fatalf("validate failed: %s", err)
+	}
+	if hi := cfg.Servers[0].HealthInterval; hi == nil || hi.Duration != defaultHealthInterval {
+		t.Errorf("the default health interval was not set: %v", hi)
+	}
+	cfg = &config{Log: logConfig{Level: "ERROR"}, Mode: modeClient, StateDir: "/tmp", Clients: []*clientConfig{{Bridge: testBridge}}}
+	if err := cfg.validate(); err != nil {
+		t.Fatalf("validate failed: %s", err)
+	}
+	if cfg.Clients[0].ListenAddr != defaultClientListenAddr {
+		t.Errorf("the default listen address was not set: '%s'", cfg.Clients[0].ListenAddr)
+	}
+}
+
+func TestTransportArgs(t *testing.T) {
+	cfg := &config{Transports: map[string]*transportConfig{
+		"obfs4": {
+			ClientArgs:    map[string]string{"iat-mode": "1", "cert": "file"},
+			ServerOptions: map[string]string{"iat-mode": "1", "node-id": "file"},
+		},
+	}}
+
+	// Tor's (or the listener's) arguments override the file's.
+	torArgs := pt.Args{}
+	torArgs.Add("iat-mode", "2")
+	options := cfg.serverOptions("obfs4", torArgs)
+	if v, _ := options.Get("iat-mode"); v != "2" {
+		t.Errorf("server iat-mode: '%s'", v)
+	}
+	if v, _ := options.Get("node-id"); v != "file" {
+		t.Errorf("server node-id: '%s'", v)
+	}
+	args := mergeArgs(cfg.clientArgs("obfs4"), torArgs)
+	if v, _ := args.Get("iat-mode"); v != "2" {
+		t.Errorf("client iat-mode: '%s'", v)
+	}
+	if v, _ := args.Get("cert"); v != "file" {
+		t.Errorf("client cert: '%s'", v)
+	}
+	if len(cfg.clientArgs("obfs5")) != 0 {
+		t.Errorf("obfs5 has the obfs4 client arguments")
+	}
+}
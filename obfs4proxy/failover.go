@@ -0,0 +1,43 @@
+package main
+
+import (
+	"path"
+	"sync"
+
+	"github.com/RACECAR-GU/obfsX/common/failover"
+	"github.com/RACECAR-GU/obfsX/common/log"
+)
+
+const bridgeScoresFile = "bridge_scores.json"
+
+// bridgeScores are the health scores of the unmanaged clients' fixed bridges,
+// shared by the listeners (across reloads), and saved in the state directory.
+var bridgeScores struct {
+	sync.Mutex
+	scores *failover.Scores
+}
+
+// loadBridgeScores returns the bridge scores, loading them the first time.
+func loadBridgeScores() *failover.Scores {
+	bridgeScores.Lock()
+	defer bridgeScores.Unlock()
+	if bridgeScores.scores == nil {
+		var err error
+		if bridgeScores.scores, err = failover.LoadScores(path.Join(stateDir, bridgeScoresFile)); err != nil {
+			log.Warnf("failed to load the bridge scores, starting afresh: %s", err)
+		}
+	}
+	return bridgeScores.scores
+}
+
+// saveBridgeScores saves the bridge scores, if they were loaded.
+func saveBridgeScores() {
+	bridgeScores.Lock()
+	defer bridgeScores.Unlock()
+	if bridgeScores.scores == nil {
+		return
+	}
+	if err := bridgeScores.scores.Save(); err != nil {
+		log.Warnf("failed to save the bridge scores: %s", err)
+	}
+}
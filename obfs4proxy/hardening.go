@@ -0,0 +1,69 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+
+	"github.com/RACECAR-GU/obfsX/common/log"
+	"github.com/RACECAR-GU/obfsX/common/sandbox"
+)
+
+// harden confines the server once it has bound its listeners: dropping to
+// the configured user and group, setting no_new_privs, and restricting the
+// system calls with seccomp.  The state directory is given to the user, as
+// the transports write to it, and reloads read it.
+func harden(execName, stateDir string, hc *hardeningConfig) error {
+	if hc.User != "" {
+		uid, gid, err := sandbox.LookupUser(hc.User, hc.Group)
+		if err != nil {
+			return err
+		}
+		if err = chownStateDir(stateDir, uid, gid); err != nil {
+			return err
+		}
+		if err = sandbox.DropPrivileges(uid, gid); err != nil {
+			return err
+		}
+		log.Infof("%s - running as uid %d, gid %d", execName, uid, gid)
+	} else if os.Geteuid() == 0 {
+		log.Warnf("%s - running as root, consider setting hardening.user", execName)
+	}
+
+	if hc.Seccomp == "" {
+		return sandbox.SetNoNewPrivs()
+	}
+	action, err := sandbox.ParseAction(hc.Seccomp)
+	if err != nil {
+		return err
+	}
+
+	// The cgo resolver may make system calls outside of the allowlist.
+	net.DefaultResolver.PreferGo = true
+	if err = sandbox.Seccomp(action); err != nil {
+		return fmt.Errorf("failed to apply the seccomp filter: %s", err)
+	}
+	log.Infof("%s - restricted the system calls (action: %s)", execName, action)
+	return nil
+}
+
+// chownStateDir changes the owner of the state directory, and of the files
+// in it, to uid and gid.
+func chownStateDir(stateDir string, uid, gid int) error {
+	paths := []string{stateDir}
+	entries, err := ioutil.ReadDir(stateDir)
+	if err != nil {
+		return err
+	}
+	for _, fi := range entries {
+		paths = append(paths, filepath.Join(stateDir, fi.Name()))
+	}
+	for _, p := range paths {
+		if err = os.Lchown(p, uid, gid); err != nil {
+			return fmt.Errorf("failed to give the state directory to the user: %s", err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"io"
+	"io/ioutil"
+	"net"
+	"sync/atomic"
+	"time"
+)
+
+// maxRejecting bounds the connections over the limits that are being turned
+// away with the transport's reject (a goroutine and a read buffer each),
+// across the listeners.  Past it, they are held open by a timer instead, for
+// as long, and only drained once it fires.  This looks the same on the wire,
+// unless the peer sends more than the socket's receive buffer in the meantime.
+const maxRejecting = 4096
+
+// holdDrainTime bounds how long a held connection is drained for, before
+// being closed.
+const holdDrainTime = 10 * time.Millisecond
+
+var rejecting int32
+
+// rejectConn turns away a connection that is over the listener's limits,
+// the same way as one that failed the handshake if the transport can, so
+// that the limits are not a distinguisher.
+func rejectConn(h *listenerHandler, conn net.Conn, st *transportMetrics) {
+	if h.reject == nil {
+		conn.Close()
+		return
+	}
+	if atomic.AddInt32(&rejecting, 1) > maxRejecting {
+		atomic.AddInt32(&rejecting, -1)
+		st.held.Inc()
+		holdConn(conn, h.rejectDelay)
+		return
+	}
+	defer atomic.AddInt32(&rejecting, -1)
+	h.reject(conn)
+}
+
+// holdConn closes conn once delay passes, after discarding what the peer
+// sent, so that the close does not reset the connection.
+func holdConn(conn net.Conn, delay time.Duration) {
+	time.AfterFunc(delay, func() {
+		defer conn.Close()
+		if err := conn.SetReadDeadline(time.Now().Add(holdDrainTime)); err != nil {
+			return
+		}
+		_, _ = io.Copy(ioutil.Discard, conn)
+	})
+}
+
+// remoteIP returns the IP address of the peer of conn, or nil.
+func remoteIP(conn net.Conn) net.IP {
+	if addr, ok := conn.RemoteAddr().(*net.TCPAddr); ok {
+		return addr.IP
+	}
+	return nil
+}
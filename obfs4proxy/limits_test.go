@@ -0,0 +1,42 @@
+package main
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestHoldConn(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %s", err)
+	}
+	defer ln.Close()
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatalf("Dial failed: %s", err)
+	}
+	defer conn.Close()
+	held, err := ln.Accept()
+	if err != nil {
+		t.Fatalf("Accept failed: %s", err)
+	}
+
+	// The peer's data is left unread until the delay passes, and then
+	// discarded, so that the connection is closed and not reset.
+	start := time.Now()
+	holdConn(held, 100*time.Millisecond)
+	if _, err = conn.Write(make([]byte, 4096)); err != nil {
+		t.Fatalf("Write failed: %s", err)
+	}
+	if err = conn.SetReadDeadline(time.Now().Add(5 * time.Second)); err != nil {
+		t.Fatalf("SetReadDeadline failed: %s", err)
+	}
+	if _, err = conn.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("Read: %v, expected EOF", err)
+	}
+	if elapsed := time.Since(start); elapsed < 100*time.Millisecond {
+		t.Errorf("the connection was closed after %s", elapsed)
+	}
+}
@@ -0,0 +1,407 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/RACECAR-GU/obfsX/common/connlimit"
+	"github.com/RACECAR-GU/obfsX/common/log"
+	"github.com/RACECAR-GU/obfsX/common/ratelimit"
+	"github.com/RACECAR-GU/obfsX/transports/base"
+)
+
+const (
+	roleClient = "client"
+	roleServer = "server"
+
+	// unixAddrPrefix marks a listen address that is a Unix socket path.
+	unixAddrPrefix = "unix:"
+
+	defaultSocketMode os.FileMode = 0600
+
+	// unixProbeTimeout bounds the check for a listener on an existing Unix
+	// socket.
+	unixProbeTimeout = time.Second
+)
+
+// listenerHandler is how a listener handles the connections that it
+// accepts.  A reload replaces it, while the sessions that the previous one
+// started continue.
+type listenerHandler struct {
+	// handle handles an accepted connection.
+	handle func(conn net.Conn)
+
+	// params describes the transport parameters, if the factory can.
+	params base.ParamsDescriber
+
+	// onClose, if set, is called once the handler is replaced, or the
+	// listener is closed for good.
+	onClose func()
+
+	// limits, if set, are the connection limits.  Connections over them
+	// are turned away with reject, if set, otherwise closed.  rejectDelay
+	// is how long reject holds them open.
+	limits      *connlimit.Config
+	reject      func(conn net.Conn)
+	rejectDelay time.Duration
+
+	// bandwidth, if set, are the bandwidth limits of the accepted
+	// connections (on the wire for servers, the application's connections
+	// for clients).
+	bandwidth *ratelimit.Config
+
+	// socketMode is the file mode of a Unix socket listener.
+	socketMode os.FileMode
+}
+
+// listen listens on addr, which is either a TCP address, or a Unix socket
+// path prefixed with unixAddrPrefix, created with socketMode.
+func listen(addr string, socketMode os.FileMode) (net.Listener, error) {
+	if strings.HasPrefix(addr, unixAddrPrefix) {
+		return listenUnix(strings.TrimPrefix(addr, unixAddrPrefix), socketMode)
+	}
+	return net.Listen("tcp", addr)
+}
+
+// listenUnix listens on the Unix socket at socketPath, which only the users
+// that socketMode allows can connect to.
+func listenUnix(socketPath string, socketMode os.FileMode) (net.Listener, error) {
+	// Remove a stale socket left by an instance that did not exit cleanly,
+	// unless something still answers on it.
+	if fi, err := os.Lstat(socketPath); err == nil && fi.Mode()&os.ModeSocket != 0 {
+		if conn, err := net.DialTimeout("unix", socketPath, unixProbeTimeout); err == nil {
+			conn.Close()
+			return nil, fmt.Errorf("%s is in use", socketPath)
+		}
+		if err = os.Remove(socketPath); err != nil {
+			return nil, err
+		}
+	}
+
+	// The socket is created without access for the others, before its mode
+	// is set.
+	restore := restrictUmask()
+	ln, err := net.Listen("unix", socketPath)
+	restore()
+	if err != nil {
+		return nil, err
+	}
+	if err = os.Chmod(socketPath, socketMode); err != nil {
+		ln.Close()
+		return nil, err
+	}
+	return ln, nil
+}
+
+// listenerAddr returns the address of ln, in the form that listen takes.
+func listenerAddr(ln net.Listener) string {
+	if addr, ok := ln.Addr().(*net.UnixAddr); ok {
+		return unixAddrPrefix + addr.Name
+	}
+	return ln.Addr().String()
+}
+
+// proxyListener is a transport listener, that can be disabled (closing the
+// socket, while the sessions continue) and enabled again on the same address
+// at runtime.
+type proxyListener struct {
+	sync.Mutex
+
+	id        int
+	transport string
+	role      string
+	addr      string
+
+	// bindAddr is the address that the listener was configured with, which
+	// identifies it across reloads.
+	bindAddr string
+
+	ln      net.Listener
+	closed  bool
+	handler *listenerHandler
+
+	// limiter and bandwidth enforce the handler's limits.  They outlive the
+	// handlers, so that the sessions count towards the limits across
+	// reloads.
+	limiter   *connlimit.Limiter
+	bandwidth *ratelimit.Limiter
+
+	// rebuild, if set, returns the handler for the reloaded configuration.
+	// Managed listeners are rebuilt in place, as tor chose them.
+	rebuild func(cfg *config) (*listenerHandler, error)
+}
+
+var listenerTable struct {
+	sync.Mutex
+	l []*proxyListener
+
+	// hold is set while new listeners only bind their sockets, and held
+	// are the listeners that wait for releaseListeners.
+	hold bool
+	held []*proxyListener
+}
+
+// holdListeners has the new listeners bind their sockets, but not accept
+// connections until releaseListeners is called (eg: once the server is
+// confined).
+func holdListeners() {
+	listenerTable.Lock()
+	defer listenerTable.Unlock()
+	listenerTable.hold = true
+}
+
+// releaseListeners starts accepting connections on the listeners that were
+// held, and on the new ones from now on.
+func releaseListeners() {
+	listenerTable.Lock()
+	held := listenerTable.held
+	listenerTable.hold, listenerTable.held = false, nil
+	listenerTable.Unlock()
+
+	for _, l := range held {
+		l.Lock()
+		ln := l.ln
+		l.Unlock()
+		if ln != nil {
+			go l.acceptLoop(ln)
+		}
+	}
+}
+
+// newProxyListener registers the listener, and starts serving on ln, unless
+// the listeners are held.  rebuild may be nil.
+func newProxyListener(transport, role, bindAddr string, ln net.Listener, h *listenerHandler, rebuild func(*config) (*listenerHandler, error)) *proxyListener {
+	l := &proxyListener{
+		transport: transport,
+		role:      role,
+		addr:      listenerAddr(ln),
+		bindAddr:  bindAddr,
+		ln:        ln,
+		handler:   h,
+		rebuild:   rebuild,
+	}
+	l.setLimits(h)
+
+	listenerTable.Lock()
+	listenerTable.l = append(listenerTable.l, l)
+	l.id = len(listenerTable.l)
+	hold := listenerTable.hold
+	if hold {
+		listenerTable.held = append(listenerTable.held, l)
+	}
+	listenerTable.Unlock()
+
+	if !hold {
+		go l.acceptLoop(ln)
+	}
+	return l
+}
+
+// acceptLoop accepts connections until ln is closed, handing each to the
+// current handler.
+func (l *proxyListener) acceptLoop(ln net.Listener) {
+	defer ln.Close()
+	st := transportStats(l.transport)
+	var delay time.Duration
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			if e, ok := err.(net.Error); ok && !e.Temporary() {
+				return
+			}
+			delay = base.AcceptDelay(delay)
+			time.Sleep(delay)
+			continue
+		}
+		delay = 0
+		st.accepted.Inc()
+
+		h, limiter, bandwidth := l.current()
+		release := func() {}
+		if limiter != nil {
+			if release, err = limiter.Admit(remoteIP(conn)); err != nil {
+				st.connectionLimited(err)
+				log.Debugf("%s(%s) - turned away: %s", l.transport, log.ElideAddr(conn.RemoteAddr().String()), err)
+				go rejectConn(h, conn, st)
+				continue
+			}
+		}
+		if bandwidth != nil {
+			if l.role == roleServer {
+				// serverHandler starts limiting once the handshake
+				// succeeds, so that the delayed closes of the failed
+				// ones do not use up the shared buckets.
+				conn = bandwidth.WrapBypassed(conn)
+			} else {
+				conn = bandwidth.Wrap(conn)
+			}
+		}
+		go func(conn net.Conn) {
+			defer release()
+			h.handle(conn)
+		}(conn)
+	}
+}
+
+// current returns the listener's handler, and limiters.
+func (l *proxyListener) current() (*listenerHandler, *connlimit.Limiter, *ratelimit.Limiter) {
+	l.Lock()
+	defer l.Unlock()
+	return l.handler, l.limiter, l.bandwidth
+}
+
+// currentHandler returns the listener's handler.
+func (l *proxyListener) currentHandler() *listenerHandler {
+	h, _, _ := l.current()
+	return h
+}
+
+// setLimits applies the handler's connection and bandwidth limits, with the
+// lock held.
+func (l *proxyListener) setLimits(h *listenerHandler) {
+	var err error
+	switch {
+	case h.limits == nil:
+		l.limiter = nil
+	case l.limiter == nil:
+		l.limiter, err = connlimit.New(*h.limits)
+	default:
+		err = l.limiter.SetConfig(*h.limits)
+	}
+	if err != nil {
+		// The configuration was validated, so this is unexpected.
+		log.Errorf("%s - invalid connection limits: %s", l.transport, err)
+	}
+
+	// Keep the bandwidth limiter if the limits are removed, as the
+	// sessions that it wrapped share its global buckets.
+	switch {
+	case h.bandwidth == nil && l.bandwidth != nil:
+		err = l.bandwidth.SetConfig(ratelimit.Config{})
+	case h.bandwidth == nil:
+	case l.bandwidth == nil:
+		l.bandwidth, err = ratelimit.New(*h.bandwidth, transportStats(l.transport).throttled)
+	default:
+		err = l.bandwidth.SetConfig(*h.bandwidth)
+	}
+	if err != nil {
+		log.Errorf("%s - invalid bandwidth limits: %s", l.transport, err)
+	}
+}
+
+// replace makes the listener hand the connections that it accepts from now
+// on to h.
+func (l *proxyListener) replace(h *listenerHandler) {
+	l.Lock()
+	old := l.handler
+	l.handler = h
+	l.setLimits(h)
+	if l.ln != nil && h.socketMode != old.socketMode && strings.HasPrefix(l.addr, unixAddrPrefix) {
+		if err := os.Chmod(strings.TrimPrefix(l.addr, unixAddrPrefix), h.socketMode); err != nil {
+			log.Errorf("%s - failed to change the socket mode: %s", l.transport, err)
+		}
+	}
+	l.Unlock()
+
+	if old.onClose != nil {
+		old.onClose()
+	}
+}
+
+// logAddr returns the listener's address, for logging.
+func (l *proxyListener) logAddr() string {
+	if l.role == roleServer {
+		return log.ElideAddr(l.addr)
+	}
+	return l.addr
+}
+
+// enabled returns if the listener is accepting connections.
+func (l *proxyListener) enabled() bool {
+	l.Lock()
+	defer l.Unlock()
+	return l.ln != nil
+}
+
+// setEnabled enables or disables the listener.
+func (l *proxyListener) setEnabled(enable bool) error {
+	l.Lock()
+	defer l.Unlock()
+
+	if l.closed {
+		return fmt.Errorf("listener %d is closed", l.id)
+	}
+	if enable == (l.ln != nil) {
+		return nil
+	}
+
+	if !enable {
+		err := l.ln.Close()
+		l.ln = nil
+		log.Noticef("%s - disabled listener: %s", l.transport, l.logAddr())
+		return err
+	}
+
+	ln, err := listen(l.addr, l.handler.socketMode)
+	if err != nil {
+		return err
+	}
+	l.ln = ln
+	go l.acceptLoop(ln)
+	log.Noticef("%s - enabled listener: %s", l.transport, l.logAddr())
+	return nil
+}
+
+// isClosed returns if the listener is closed for good.
+func (l *proxyListener) isClosed() bool {
+	l.Lock()
+	defer l.Unlock()
+	return l.closed
+}
+
+// close closes the listener for good.
+func (l *proxyListener) close() {
+	l.Lock()
+	defer l.Unlock()
+
+	if l.closed {
+		return
+	}
+	l.closed = true
+	if l.ln != nil {
+		l.ln.Close()
+		l.ln = nil
+	}
+	if l.handler.onClose != nil {
+		l.handler.onClose()
+	}
+}
+
+// closeListeners closes the listeners, eg: on error during setup.
+func closeListeners(listeners []*proxyListener) {
+	for _, l := range listeners {
+		l.close()
+	}
+}
+
+// proxyListeners returns all of the listeners, including the closed ones,
+// in the order they were created.
+func proxyListeners() []*proxyListener {
+	listenerTable.Lock()
+	defer listenerTable.Unlock()
+	return append([]*proxyListener(nil), listenerTable.l...)
+}
+
+// lookupListener returns the listener with the id, or nil.
+func lookupListener(id int) *proxyListener {
+	listenerTable.Lock()
+	defer listenerTable.Unlock()
+	if id < 1 || id > len(listenerTable.l) {
+		return nil
+	}
+	return listenerTable.l[id-1]
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestListenUnix(t *testing.T) {
+	dir, err := ioutil.TempDir("", "obfs4proxy")
+	if err != nil {
+		t.Fatalf("TempDir failed: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	socketPath := filepath.Join(dir, "socks.sock")
+
+	for _, mode := range []os.FileMode{0600, 0660} {
+		ln, err := listenUnix(socketPath, mode)
+		if err != nil {
+			t.Fatalf("listenUnix(%o) failed: %s", mode, err)
+		}
+		fi, err := os.Stat(socketPath)
+		if err != nil {
+			t.Fatalf("Stat failed: %s", err)
+		}
+		if fi.Mode().Perm() != mode {
+			t.Errorf("the socket mode is %o, expected %o", fi.Mode().Perm(), mode)
+		}
+
+		// A socket that is in use is not replaced.
+		if ln2, err := listenUnix(socketPath, mode); err == nil {
+			ln2.Close()
+			t.Fatalf("listenUnix replaced a socket that is in use")
+		}
+		if conn, err := net.Dial("unix", socketPath); err != nil {
+			t.Fatalf("the socket in use was removed: %s", err)
+		} else {
+			conn.Close()
+		}
+
+		// A stale socket is.
+		ln.(*net.UnixListener).SetUnlinkOnClose(false)
+		ln.Close()
+		if _, err = os.Lstat(socketPath); err != nil {
+			t.Fatalf("no stale socket: %s", err)
+		}
+	}
+	ln, err := listenUnix(socketPath, 0600)
+	if err != nil {
+		t.Fatalf("listenUnix did not replace the stale socket: %s", err)
+	}
+	ln.Close()
+
+	// Other files are left alone.
+	if err = ioutil.WriteFile(socketPath, nil, 0600); err != nil {
+		t.Fatalf("WriteFile failed: %s", err)
+	}
+	if ln, err = listenUnix(socketPath, 0600); err == nil {
+		ln.Close()
+		t.Errorf("listenUnix replaced a file")
+	}
+}
+
+func TestHoldListeners(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %s", err)
+	}
+	handled := make(chan struct{}, 1)
+	h := &listenerHandler{handle: func(conn net.Conn) {
+		conn.Close()
+		handled <- struct{}{}
+	}}
+
+	// A held listener is bound, but only accepts connections once
+	// released.
+	holdListeners()
+	l := newProxyListener("obfs4", roleServer, "127.0.0.1:0", ln, h, nil)
+	defer l.close()
+	conn, err := net.Dial("tcp", l.addr)
+	if err != nil {
+		releaseListeners()
+		t.Fatalf("Dial failed: %s", err)
+	}
+	defer conn.Close()
+	select {
+	case <-handled:
+		releaseListeners()
+		t.Fatalf("the held listener accepted a connection")
+	case <-time.After(50 * time.Millisecond):
+	}
+	releaseListeners()
+	select {
+	case <-handled:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("the released listener did not accept the connection")
+	}
+}
@@ -0,0 +1,18 @@
+package main
+
+import (
+	"os"
+	"testing"
+
+	"github.com/RACECAR-GU/obfsX/transports"
+)
+
+// testCert is a valid obfs4 bridge line cert.
+const testCert = "znrSgOuHUdrd+wUtg6qQpcKixRjmL44YsfSxPGRHQPIQ1KfrObZXClBiiGMfJLht1x8OMg"
+
+func TestMain(m *testing.M) {
+	if err := transports.Init(); err != nil {
+		panic(err)
+	}
+	os.Exit(m.Run())
+}
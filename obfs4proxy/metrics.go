@@ -0,0 +1,208 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/RACECAR-GU/obfsX/common/connlimit"
+	"github.com/RACECAR-GU/obfsX/common/metrics"
+	"github.com/RACECAR-GU/obfsX/common/ratelimit"
+	"github.com/RACECAR-GU/obfsX/common/workerpool"
+	"github.com/RACECAR-GU/obfsX/transports/obfs4"
+)
+
+// metricsRegistry holds the obfs4proxy metrics, which are served over HTTP
+// if a metrics address is configured.
+var metricsRegistry = metrics.NewRegistry()
+
+// The handshake failure reasons.
+const (
+	handshakeReplayed   = "replayed"
+	handshakeInvalid    = "invalid"
+	handshakeInvalidMAC = "invalid_mac"
+	handshakePuzzle     = "puzzle"
+	handshakeTimeout    = "timeout"
+	handshakeOverloaded = "overloaded"
+	handshakeOther      = "other"
+)
+
+var handshakeFailureReasons = []string{
+	handshakeReplayed,
+	handshakeInvalid,
+	handshakeInvalidMAC,
+	handshakePuzzle,
+	handshakeTimeout,
+	handshakeOverloaded,
+	handshakeOther,
+}
+
+// transportMetrics are the metrics of a transport.  Bytes read and written
+// are from the point of view of obfs4proxy's end of the transport
+// connections ("received" and "sent").
+type transportMetrics struct {
+	// throttledNanos is first, for alignment on 32 bit platforms.
+	throttledNanos [2]uint64
+
+	name string
+
+	accepted          *metrics.Counter
+	held              *metrics.Counter
+	handshakes        *metrics.Counter
+	handshakeFailures map[string]*metrics.Counter
+	active            *metrics.Gauge
+
+	payloadRead, payloadWritten *metrics.Counter
+	wireRead, wireWritten       *metrics.Counter
+	paddingRead, paddingWritten *metrics.Counter
+
+	// throttledBytes and throttledNanos account for the traffic that the
+	// bandwidth limits delayed, by ratelimit.Direction.
+	throttledBytes [2]*metrics.Counter
+}
+
+var transportMetricsCache struct {
+	sync.Mutex
+	m map[string]*transportMetrics
+}
+
+// transportStats returns the metrics of the named transport.
+func transportStats(name string) *transportMetrics {
+	transportMetricsCache.Lock()
+	defer transportMetricsCache.Unlock()
+
+	if st := transportMetricsCache.m[name]; st != nil {
+		return st
+	}
+
+	r := metricsRegistry
+	byteCounters := func(metric, help string) (read, written *metrics.Counter) {
+		read = r.Counter(metric, help, "transport", name, "direction", "received")
+		written = r.Counter(metric, help, "transport", name, "direction", "sent")
+		return
+	}
+	st := &transportMetrics{
+		name:              name,
+		accepted:          r.Counter("obfs4proxy_connections_accepted_total", "Connections accepted by the listeners.", "transport", name),
+		held:              r.Counter("obfs4proxy_connections_held_total", "Connections over the limits that were held open and closed by a timer, as too many were being turned away.", "transport", name),
+		handshakes:        r.Counter("obfs4proxy_handshake_successes_total", "Transport handshakes that succeeded.", "transport", name),
+		handshakeFailures: make(map[string]*metrics.Counter),
+		active:            r.Gauge("obfs4proxy_active_sessions", "Sessions being handled.", "transport", name),
+	}
+	st.payloadRead, st.payloadWritten = byteCounters("obfs4proxy_payload_bytes_total",
+		"Payload bytes relayed over the transport connections.")
+	st.wireRead, st.wireWritten = byteCounters("obfs4proxy_wire_bytes_total",
+		"Bytes on the wire of the transport connections, including the handshakes.")
+	st.paddingRead, st.paddingWritten = byteCounters("obfs4proxy_padding_overhead_bytes_total",
+		"Wire bytes in excess of the payload and framing (handshakes, padding and dummy traffic), accounted when the sessions close.")
+	for _, reason := range handshakeFailureReasons {
+		st.handshakeFailures[reason] = r.Counter("obfs4proxy_handshake_failures_total", "Transport handshakes that failed, by reason.", "transport", name, "reason", reason)
+	}
+	for _, d := range []ratelimit.Direction{ratelimit.Up, ratelimit.Down} {
+		d := d
+		st.throttledBytes[d] = r.Counter("obfs4proxy_throttled_bytes_total", "Bytes delayed by the bandwidth limits, by direction (up being from the clients).",
+			"transport", name, "direction", d.String())
+		r.CounterFunc("obfs4proxy_throttled_seconds_total", "Time that the bandwidth limits delayed the sessions for, by direction.",
+			func() float64 { return time.Duration(atomic.LoadUint64(&st.throttledNanos[d])).Seconds() }, "transport", name, "direction", d.String())
+	}
+
+	if transportMetricsCache.m == nil {
+		transportMetricsCache.m = make(map[string]*transportMetrics)
+	}
+	transportMetricsCache.m[name] = st
+	return st
+}
+
+// handshakeFailed counts a failed handshake, classified by err.
+func (st *transportMetrics) handshakeFailed(err error) {
+	st.handshakeFailures[handshakeFailureReason(err)].Inc()
+}
+
+func handshakeFailureReason(err error) string {
+	var macErr *obfs4.InvalidMacError
+	var netErr net.Error
+	switch {
+	case errors.Is(err, obfs4.ErrReplayedHandshake):
+		return handshakeReplayed
+	case errors.Is(err, obfs4.ErrInvalidHandshake):
+		return handshakeInvalid
+	case errors.As(err, &macErr):
+		return handshakeInvalidMAC
+	case errors.Is(err, obfs4.ErrPuzzleFailed):
+		return handshakePuzzle
+	case errors.Is(err, workerpool.ErrTimeout), errors.Is(err, workerpool.ErrQueueFull):
+		return handshakeOverloaded
+	case errors.Is(err, context.DeadlineExceeded), errors.As(err, &netErr) && netErr.Timeout():
+		return handshakeTimeout
+	}
+	return handshakeOther
+}
+
+// handshakePoolStats exports the statistics of the server handshake worker
+// pool.
+func handshakePoolStats(p *workerpool.Pool) {
+	r := metricsRegistry
+	r.GaugeFunc("obfs4proxy_handshake_workers", "Server handshake workers.",
+		func() float64 { return float64(p.Stats().Workers) })
+	r.GaugeFunc("obfs4proxy_handshake_workers_busy", "Server handshake workers that are busy.",
+		func() float64 { return float64(p.Stats().Running) })
+	r.GaugeFunc("obfs4proxy_handshake_queue_depth", "Server handshake steps waiting for a worker.",
+		func() float64 { return float64(p.Stats().Queued) })
+	for result, fn := range map[string]func(workerpool.Stats) uint64{
+		"completed":  func(st workerpool.Stats) uint64 { return st.Completed },
+		"timeout":    func(st workerpool.Stats) uint64 { return st.TimedOut },
+		"queue_full": func(st workerpool.Stats) uint64 { return st.Rejected },
+	} {
+		fn := fn
+		r.CounterFunc("obfs4proxy_handshake_pool_jobs_total", "Server handshake steps, by result (run, or given up after waiting too long or with the queue full).",
+			func() float64 { return float64(fn(p.Stats())) }, "result", result)
+	}
+}
+
+// connectionLimited counts a connection that was over the limits.
+func (st *transportMetrics) connectionLimited(err error) {
+	scope, limit := connlimit.ScopeGlobal, "rate"
+	if e, ok := err.(*connlimit.LimitError); ok {
+		scope = e.Scope
+		if e.Concurrency {
+			limit = "concurrency"
+		}
+	}
+	metricsRegistry.Counter("obfs4proxy_connections_limited_total", "Connections turned away by the connection limits, by scope and limit.",
+		"transport", st.name, "scope", scope, "limit", limit).Inc()
+}
+
+// throttled counts n bytes that the bandwidth limits delayed.
+func (st *transportMetrics) throttled(d ratelimit.Direction, n int, delay time.Duration) {
+	st.throttledBytes[d].Add(uint64(n))
+	atomic.AddUint64(&st.throttledNanos[d], uint64(delay))
+}
+
+// wrapWire wraps a connection to the peer, to count the bytes on the wire.
+func (st *transportMetrics) wrapWire(conn net.Conn) *metrics.Conn {
+	return metrics.NewConn(conn, st.wireRead, st.wireWritten)
+}
+
+// wrapPayload wraps an established transport connection, to count the
+// payload.
+func (st *transportMetrics) wrapPayload(conn net.Conn) *metrics.Conn {
+	return metrics.NewConn(conn, st.payloadRead, st.payloadWritten)
+}
+
+// sessionDone accounts for the padding overhead of a session, given its wire
+// and payload connections, and the transport's framing overhead.
+func (st *transportMetrics) sessionDone(wire, payload *metrics.Conn, framingOverhead float64) {
+	st.paddingRead.Add(paddingOverhead(wire.BytesRead(), payload.BytesRead(), framingOverhead))
+	st.paddingWritten.Add(paddingOverhead(wire.BytesWritten(), payload.BytesWritten(), framingOverhead))
+}
+
+func paddingOverhead(wire, payload uint64, framingOverhead float64) uint64 {
+	framed := uint64(float64(payload) * (1 + framingOverhead))
+	if wire <= framed {
+		return 0
+	}
+	return wire - framed
+}
@@ -25,11 +25,12 @@
  * POSSIBILITY OF SUCH DAMAGE.
  */
 
-// Go language Tor Pluggable Transport suite.  Works only as a managed
-// client/server.
+// Go language Tor Pluggable Transport suite.  Works as a managed
+// client/server, or unmanaged (see -mode).
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
 	"io"
@@ -38,14 +39,23 @@ import (
 	"net/url"
 	"os"
 	"path"
+	"reflect"
 	"sync"
 	"syscall"
+	"time"
 
 	"git.torproject.org/pluggable-transports/goptlib.git"
+	"github.com/RACECAR-GU/obfsX/common/connlimit"
+	"github.com/RACECAR-GU/obfsX/common/exitproxy"
+	"github.com/RACECAR-GU/obfsX/common/failover"
 	"github.com/RACECAR-GU/obfsX/common/log"
+	"github.com/RACECAR-GU/obfsX/common/metrics"
+	"github.com/RACECAR-GU/obfsX/common/ratelimit"
 	"github.com/RACECAR-GU/obfsX/common/socks5"
+	"github.com/RACECAR-GU/obfsX/common/systemd"
 	"github.com/RACECAR-GU/obfsX/transports"
 	"github.com/RACECAR-GU/obfsX/transports/base"
+	"github.com/RACECAR-GU/obfsX/transports/obfs4"
 )
 
 const (
@@ -57,8 +67,8 @@ const (
 var stateDir string
 var termMon *termMonitor
 
-func clientSetup() (launched bool, listeners []net.Listener) {
-	ptClientInfo, err := pt.ClientSetup(transports.Transports())
+func clientSetup(cfg *config) (launched bool, listeners []*proxyListener) {
+	ptClientInfo, err := pt.ClientSetup(transports.ClientTransports())
 	if err != nil {
 		golog.Fatal(err)
 	}
@@ -72,13 +82,24 @@ func clientSetup() (launched bool, listeners []net.Listener) {
 
 	// Launch each of the client listeners.
 	for _, name := range ptClientInfo.MethodNames {
+		name := name // Captured by newHandler.
 		t := transports.Get(name)
 		if t == nil {
 			_ = pt.CmethodError(name, "no such transport is supported")
 			continue
 		}
 
-		f, err := t.ClientFactory(stateDir)
+		newHandler := func(cfg *config) (*listenerHandler, error) {
+			f, err := t.ClientFactory(stateDir)
+			if err != nil {
+				return nil, err
+			}
+			cl := &clientListener{args: cfg.clientArgs(name)}
+			h := newClientHandler(f, ptClientProxy, cl)
+			h.bandwidth = cfg.bandwidth(name, nil)
+			return h, nil
+		}
+		h, err := newHandler(cfg)
 		if err != nil {
 			_ = pt.CmethodError(name, "failed to get ClientFactory")
 			continue
@@ -90,14 +111,15 @@ func clientSetup() (launched bool, listeners []net.Listener) {
 			continue
 		}
 
-		go func() {
-			_ = clientAcceptLoop(f, ln, ptClientProxy)
-		}()
+		l := newProxyListener(name, roleClient, socksAddr, ln, h, newHandler)
 		pt.Cmethod(name, socks5.Version(), ln.Addr())
 
 		log.Infof("%s - registered listener: %s", name, ln.Addr())
+		if ptClientProxy != nil && base.GetCapabilities(t).SocketControl {
+			log.Warnf("%s - socket options will be applied to the upstream proxy connection", name)
+		}
 
-		listeners = append(listeners, ln)
+		listeners = append(listeners, l)
 		launched = true
 	}
 	pt.CmethodsDone()
@@ -105,66 +127,166 @@ func clientSetup() (launched bool, listeners []net.Listener) {
 	return
 }
 
-func clientAcceptLoop(f base.ClientFactory, ln net.Listener, proxyURI *url.URL) error {
-	defer ln.Close()
-	for {
-		conn, err := ln.Accept()
-		if err != nil {
-			if e, ok := err.(net.Error); ok && !e.Temporary() {
-				return err
-			}
-			continue
-		}
-		go clientHandler(f, conn, proxyURI)
+// newClientHandler returns the handler of a client listener.
+func newClientHandler(f base.ClientFactory, proxyURI *url.URL, cl *clientListener) *listenerHandler {
+	return &listenerHandler{
+		handle: func(conn net.Conn) {
+			_ = clientHandler(f, conn, proxyURI, cl)
+		},
 	}
 }
 
-func clientHandler(f base.ClientFactory, conn net.Conn, proxyURI *url.URL) {
+// clientHandler relays conn through the transport, returning why the session
+// could not be set up, if it could not.  The errors are also logged.
+func clientHandler(f base.ClientFactory, conn net.Conn, proxyURI *url.URL, cl *clientListener) error {
 	defer conn.Close()
-	termMon.onHandlerStart()
-	defer termMon.onHandlerFinish()
-
 	name := f.Transport().Name()
+	termMon.onHandlerStart(name)
+	defer termMon.onHandlerFinish(name)
+
+	// Read the client's SOCKS (or HTTP CONNECT) request, unless the
+	// unmanaged listener forwards to a fixed bridge.
+	var req *proxyRequest
+	reply := func(code socks5.ReplyCode) error {
+		if req == nil {
+			return nil
+		}
+		return req.reply(code)
+	}
+	if !cl.forward {
+		var err error
+		if req, err = readProxyRequest(conn, cl.protocol); err != nil {
+			log.Errorf("%s - client failed %s handshake: %s", name, protocolName(cl.protocol), err)
+			return fmt.Errorf("client failed %s handshake: %s", protocolName(cl.protocol), err)
+		}
+	}
 
-	// Read the client's SOCKS handshake.
-	socksReq, err := socks5.Handshake(conn)
-	if err != nil {
-		log.Errorf("%s - client failed socks handshake: %s", name, err)
-		return
+	// The unmanaged client connects to the configured bridges, if any.
+	bridges := cl.bridges
+	if len(bridges) == 0 {
+		bridges = []clientBridge{{addr: req.target, args: mergeArgs(cl.args, req.args)}}
 	}
-	addrStr := log.ElideAddr(socksReq.Target)
+	addrStr := log.ElideAddr(bridges[0].addr)
+	sess := newSession(name, roleClient, bridges[0].addr, conn)
+	defer sess.done()
 
 	// Deal with arguments.
-	args, err := f.ParseArgs(&socksReq.Args)
-	if err != nil {
-		log.Errorf("%s(%s) - invalid arguments: %s", name, addrStr, err)
-		_ = socksReq.Reply(socks5.ReplyGeneralFailure)
-		return
+	args := make([]interface{}, len(bridges))
+	for i := range bridges {
+		var err error
+		ptArgs := bridges[i].args
+		if args[i], err = f.ParseArgs(&ptArgs); err != nil {
+			log.Errorf("%s(%s) - invalid arguments: %s", name, log.ElideAddr(bridges[i].addr), err)
+			_ = reply(socks5.ReplyGeneralFailure)
+			return fmt.Errorf("invalid arguments: %s", err)
+		}
 	}
 
-	// Obtain the proxy dialer if any, and create the outgoing TCP connection.
-	var dialer net.Dialer
-	remote, err := f.Dial("tcp", socksReq.Target, dialer, args)
+	// Create the outgoing TCP connection, via the upstream proxy if any.  The
+	// dial is abandoned if the application gives up and closes the SOCKS
+	// connection before it completes.
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	stopWatching := cancelOnClose(conn, cancel)
+	st := transportStats(name)
+	wires := make([]*metrics.Conn, len(bridges))
+	dial := func(ctx context.Context, i int) (net.Conn, error) {
+		dialer := base.Dialer{ProxyURI: proxyURI, WrapConn: func(c net.Conn) net.Conn {
+			wires[i] = st.wrapWire(c)
+			return wires[i]
+		}}
+		remote, err := f.DialContext(ctx, "tcp", bridges[i].addr, dialer, args[i])
+		if err != nil && ctx.Err() != context.Canceled {
+			// Only count handshakes that got as far as connecting, and
+			// that were not abandoned.
+			if wires[i] != nil {
+				st.handshakeFailed(err)
+			}
+			if len(bridges) > 1 {
+				log.Warnf("%s(%s) - bridge failed: %s", name, log.ElideAddr(bridges[i].addr), log.ElideError(err))
+			}
+		}
+		return remote, err
+	}
+	var remote net.Conn
+	var err error
+	idx := 0
+	if cl.scores == nil {
+		remote, err = dial(ctx, 0)
+	} else {
+		// Race the fixed bridges, preferring the healthy ones.  Only
+		// the bridges' failures count against them, as the attempts
+		// that the application abandons are canceled.
+		d := &failover.Dialer{
+			Scores:       cl.scores,
+			AttemptDelay: cl.failoverDelay,
+			Dial:         dial,
+		}
+		for _, b := range bridges {
+			d.Keys = append(d.Keys, b.key)
+		}
+		if remote, idx, err = d.DialContext(ctx); err == nil && idx != 0 {
+			addrStr = log.ElideAddr(bridges[idx].addr)
+			sess.setPeer(bridges[idx].addr)
+		}
+	}
+	early, werr := stopWatching()
+	if req != nil && len(req.buffered) > 0 {
+		early = append(append([]byte(nil), req.buffered...), early...)
+	}
 	if err != nil {
 		log.Errorf("%s(%s) - outgoing connection failed: %s", name, addrStr, log.ElideError(err))
-		_ = socksReq.Reply(socks5.ErrorToReplyCode(err))
-		return
+		_ = reply(socks5.ErrorToReplyCode(err))
+		return fmt.Errorf("outgoing connection failed: %s", log.ElideError(err))
 	}
+	wire := wires[idx]
+	st.handshakes.Inc()
+	payload := st.wrapPayload(remote)
+	remote = payload
 	defer remote.Close()
-	err = socksReq.Reply(socks5.ReplySucceeded)
+	sess.established(wire, payload)
+	if werr != nil {
+		log.Errorf("%s(%s) - SOCKS connection failed: %s", name, addrStr, log.ElideError(werr))
+		return fmt.Errorf("SOCKS connection failed: %s", log.ElideError(werr))
+	}
+	if cl.exit {
+		// Have the exit server connect to the destination.
+		dest := cl.exitTarget
+		if req != nil {
+			dest = req.target
+		}
+		if code, err := exitproxy.ClientHandshake(remote, cl.exitSecret, dest); err != nil {
+			log.Errorf("%s(%s) - exit to %s failed: %s", name, addrStr, log.ElideAddr(dest), log.ElideError(err))
+			_ = reply(code)
+			return fmt.Errorf("exit to %s failed: %s", log.ElideAddr(dest), log.ElideError(err))
+		}
+	}
+	err = reply(socks5.ReplySucceeded)
 	if err != nil {
 		log.Errorf("%s(%s) - SOCKS reply failed: %s", name, addrStr, log.ElideError(err))
-		return
+		return fmt.Errorf("SOCKS reply failed: %s", log.ElideError(err))
+	}
+	if len(early) > 0 {
+		if _, err = remote.Write(early); err != nil {
+			log.Errorf("%s(%s) - outgoing write failed: %s", name, addrStr, log.ElideError(err))
+			return fmt.Errorf("outgoing write failed: %s", log.ElideError(err))
+		}
 	}
 
-	if err = copyLoop(conn, remote); err != nil {
+	caps := base.GetCapabilities(f.Transport())
+	err = copyLoop(conn, remote, caps)
+	if wire != nil {
+		st.sessionDone(wire, payload, caps.WireOverhead)
+	}
+	if err != nil {
 		log.Warnf("%s(%s) - closed connection: %s", name, addrStr, log.ElideError(err))
 	} else {
 		log.Infof("%s(%s) - closed connection", name, addrStr)
 	}
+	return nil
 }
 
-func serverSetup() (launched bool, listeners []net.Listener) {
+func serverSetup(cfg *config) (launched bool, listeners []*proxyListener) {
 	ptServerInfo, err := pt.ServerSetup(transports.Transports())
 	if err != nil {
 		golog.Fatal(err)
@@ -178,30 +300,53 @@ func serverSetup() (launched bool, listeners []net.Listener) {
 			continue
 		}
 
-		f, err := t.ServerFactory(stateDir, &bindaddr.Options)
+		// Options from tor override the configuration file's.
+		torOptions := bindaddr.Options
+		newFactory := func(cfg *config) (base.ServerFactory, error) {
+			options := cfg.serverOptions(name, torOptions)
+			return t.ServerFactory(stateDir, &options)
+		}
+		f, err := newFactory(cfg)
 		if err != nil {
 			_ = pt.SmethodError(name, err.Error())
 			continue
 		}
 
-		ln, err := net.ListenTCP("tcp", bindaddr.Addr)
+		ln, err := listenTCP(name, bindaddr.Addr.String())
 		if err != nil {
 			_ = pt.SmethodError(name, err.Error())
 			continue
 		}
 
-		go func() {
-			_ = serverAcceptLoop(f, ln, &ptServerInfo)
-		}()
-		if args := f.Args(); args != nil {
-			pt.SmethodArgs(name, ln.Addr(), *args)
+		// The bridge line is only published at startup, so changes to the
+		// server state on reload are not seen until tor restarts.
+		upstream := dialOrUpstream(&ptServerInfo)
+		published := f.Args()
+		newHandler := func(cfg *config, f base.ServerFactory) *listenerHandler {
+			h := newServerHandler(f, upstream, cfg.serverLimits(name, nil))
+			h.bandwidth = cfg.bandwidth(name, nil)
+			return h
+		}
+		rebuild := func(cfg *config) (*listenerHandler, error) {
+			f, err := newFactory(cfg)
+			if err != nil {
+				return nil, err
+			}
+			if !reflect.DeepEqual(f.Args(), published) {
+				log.Warnf("%s - the bridge line changed, restart tor to publish it", name)
+			}
+			return newHandler(cfg, f), nil
+		}
+		l := newProxyListener(name, roleServer, bindaddr.Addr.String(), ln, newHandler(cfg, f), rebuild)
+		if published != nil {
+			pt.SmethodArgs(name, ln.Addr(), *published)
 		} else {
 			pt.SmethodArgs(name, ln.Addr(), nil)
 		}
 
 		log.Infof("%s - registered listener: %s", name, log.ElideAddr(ln.Addr().String()))
 
-		listeners = append(listeners, ln)
+		listeners = append(listeners, l)
 		launched = true
 	}
 	pt.SmethodsDone()
@@ -209,70 +354,148 @@ func serverSetup() (launched bool, listeners []net.Listener) {
 	return
 }
 
-func serverAcceptLoop(f base.ServerFactory, ln net.Listener, info *pt.ServerInfo) error {
-	defer ln.Close()
-	for {
-		conn, err := ln.Accept()
-		if err != nil {
-			if e, ok := err.(net.Error); ok && !e.Temporary() {
-				return err
-			}
-			continue
-		}
-		go serverHandler(f, conn, info)
+// serverUpstream connects the session with the client at clientAddr to where
+// its traffic goes (eg: the ORPort).  remote is the established transport
+// connection.
+type serverUpstream func(remote net.Conn, clientAddr, name string) (net.Conn, error)
+
+func dialOrUpstream(info *pt.ServerInfo) serverUpstream {
+	return func(remote net.Conn, clientAddr, name string) (net.Conn, error) {
+		return pt.DialOr(info, clientAddr, name)
 	}
 }
 
-func serverHandler(f base.ServerFactory, conn net.Conn, info *pt.ServerInfo) {
-	defer conn.Close()
-	termMon.onHandlerStart()
-	defer termMon.onHandlerFinish()
+// newServerHandler returns the handler of a server listener, with the
+// connection limits (which may be nil).
+func newServerHandler(f base.ServerFactory, upstream serverUpstream, limits *connlimit.Config) *listenerHandler {
+	h := &listenerHandler{
+		handle: func(conn net.Conn) {
+			serverHandler(f, conn, upstream)
+		},
+		limits: limits,
+	}
+	h.params, _ = f.(base.ParamsDescriber)
+	if r, ok := f.(base.Rejecter); ok {
+		h.reject, h.rejectDelay = r.Reject, r.RejectDelay()
+	}
+	return h
+}
 
+func serverHandler(f base.ServerFactory, conn net.Conn, upstream serverUpstream) {
+	defer conn.Close()
 	name := f.Transport().Name()
+	termMon.onHandlerStart(name)
+	defer termMon.onHandlerFinish(name)
+
 	addrStr := log.ElideAddr(conn.RemoteAddr().String())
 	log.Infof("%s(%s) - new connection", name, addrStr)
+	sess := newSession(name, roleServer, conn.RemoteAddr().String(), conn)
+	defer sess.done()
 
 	// Instantiate the server transport method and handshake.
-	remote, err := f.WrapConn(conn)
+	st := transportStats(name)
+	wire := st.wrapWire(conn)
+	remote, err := f.WrapConn(wire)
 	if err != nil {
+		st.handshakeFailed(err)
 		log.Warnf("%s(%s) - handshake failed: %s", name, addrStr, log.ElideError(err))
 		return
 	}
+	st.handshakes.Inc()
+	if rc, ok := conn.(*ratelimit.Conn); ok {
+		rc.Limit()
+	}
+	payload := st.wrapPayload(remote)
+	remote = payload
+	sess.established(wire, payload)
 
-	// Connect to the orport.
-	orConn, err := pt.DialOr(info, conn.RemoteAddr().String(), name)
+	// Connect to the orport, or the unmanaged server's backend.
+	orConn, err := upstream(remote, conn.RemoteAddr().String(), name)
 	if err != nil {
-		log.Errorf("%s(%s) - failed to connect to ORPort: %s", name, addrStr, log.ElideError(err))
+		log.Errorf("%s(%s) - failed to connect upstream: %s", name, addrStr, log.ElideError(err))
 		return
 	}
 	defer orConn.Close()
 
-	if err = copyLoop(orConn, remote); err != nil {
+	caps := base.GetCapabilities(f.Transport())
+	err = copyLoop(orConn, remote, caps)
+	st.sessionDone(wire, payload, caps.WireOverhead)
+	if err != nil {
 		log.Warnf("%s(%s) - closed connection: %s", name, addrStr, log.ElideError(err))
 	} else {
 		log.Infof("%s(%s) - closed connection", name, addrStr)
 	}
 }
 
-func copyLoop(a net.Conn, b net.Conn) error {
+// cancelOnClose calls cancel if the peer closes conn before the returned stop
+// function is called.  stop returns any data that was read from conn while
+// watching, which must be relayed before anything else.
+func cancelOnClose(conn net.Conn, cancel context.CancelFunc) (stop func() ([]byte, error)) {
+	var buf [1]byte
+	var n int
+	var err error
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		n, err = conn.Read(buf[:])
+		if n == 0 && err != nil {
+			cancel()
+		}
+	}()
+
+	return func() ([]byte, error) {
+		// Unblock the pending Read, and restore the deadline.
+		if serr := conn.SetReadDeadline(time.Now()); serr != nil {
+			return nil, serr
+		}
+		<-done
+		if serr := conn.SetReadDeadline(time.Time{}); serr != nil {
+			return nil, serr
+		}
+		if n > 0 {
+			return buf[:n], nil
+		}
+		if e, ok := err.(net.Error); ok && e.Timeout() {
+			return nil, nil
+		}
+		return nil, err
+	}
+}
+
+func copyLoop(a net.Conn, b net.Conn, caps base.Capabilities) error {
 	// Note: b is always the pt connection.  a is the SOCKS/ORPort connection.
 	errChan := make(chan error, 2)
 
+	// If the transport conveys half-closes, a clean EOF in one direction
+	// only closes the write side of the other connection, otherwise
+	// either side terminating closes both.
+	closeWrite := func(dst net.Conn, err error) bool {
+		if err != nil || !caps.HalfClose {
+			return false
+		}
+		hc, ok := dst.(base.HalfCloser)
+		return ok && hc.CloseWrite() == nil
+	}
+
 	var wg sync.WaitGroup
 	wg.Add(2)
 
 	go func() {
 		defer wg.Done()
-		defer b.Close()
-		defer a.Close()
 		_, err := io.Copy(b, a)
+		if !closeWrite(b, err) {
+			b.Close()
+			a.Close()
+		}
 		errChan <- err
 	}()
 	go func() {
 		defer wg.Done()
-		defer a.Close()
-		defer b.Close()
 		_, err := io.Copy(a, b)
+		if !closeWrite(a, err) {
+			a.Close()
+			b.Close()
+		}
 		errChan <- err
 	}()
 
@@ -281,6 +504,8 @@ func copyLoop(a net.Conn, b net.Conn) error {
 	// something like EINVAL (though io.Copy() will swallow EOF), so only the
 	// first error is returned.
 	wg.Wait()
+	a.Close()
+	b.Close()
 	if len(errChan) > 0 {
 		return <-errChan
 	}
@@ -292,53 +517,212 @@ func getVersion() string {
 	return fmt.Sprintf("obfs4proxy-%s", obfs4proxyVersion)
 }
 
-func main() {
-	// Initialize the termination state monitor as soon as possible.
-	termMon = newTermMonitor()
+// cmdlineFlags are the command line flags that the configuration file can
+// also set.
+type cmdlineFlags struct {
+	logLevel      string
+	enableLogging bool
+	unsafeLogging bool
+	metricsAddr   string
+	metricsPublic bool
+	adminSocket   string
+	drainTimeout  time.Duration
+
+	mode           string
+	transport      string
+	bridge         string
+	listenAddr     string
+	socketMode     string
+	protocol       string
+	forward        bool
+	options        string
+	backends       string
+	healthInterval time.Duration
+	exit           bool
+	exitSecretFile string
+	exitTarget     string
+	exitPolicy     string
+	stateDir       string
+}
+
+// register defines the flags on fs.
+func (f *cmdlineFlags) register(fs *flag.FlagSet) {
+	fs.StringVar(&f.logLevel, "logLevel", "ERROR", "Log level (ERROR/WARN/INFO/DEBUG)")
+	fs.BoolVar(&f.enableLogging, "enableLogging", false, "Log to TOR_PT_STATE_LOCATION/"+obfs4proxyLogFile)
+	fs.BoolVar(&f.unsafeLogging, "unsafeLogging", false, "Disable the address scrubber")
+	fs.StringVar(&f.adminSocket, "adminSocket", "", "Serve the admin control interface on this Unix socket (see \""+adminCtlCommand+"\")")
+	fs.DurationVar(&f.drainTimeout, "drainTimeout", 0, "Close the sessions still open this long after the first SIGINT (0 waits indefinitely)")
+	fs.StringVar(&f.metricsAddr, "metricsAddr", "", "Serve Prometheus metrics over HTTP on this address (eg: 127.0.0.1:9100)")
+	fs.BoolVar(&f.metricsPublic, "metricsPublic", false, "Allow -metricsAddr to be a non-loopback address")
+	fs.StringVar(&f.mode, "mode", "", "Run unmanaged (without Tor) as a \"client\" or \"server\", or relay stdin/stdout to the bridge (\"stdio\")")
+	fs.StringVar(&f.transport, "transport", "", "Unmanaged mode transport, if not in the bridge line")
+	fs.StringVar(&f.bridge, "bridge", "", "Unmanaged client bridge line (\"<transport> <host:port> [key=value ...]\")")
+	fs.StringVar(&f.listenAddr, "listenAddr", "", "Unmanaged mode listen address, or \""+unixAddrPrefix+"<path>\" for a client Unix socket (client default: "+defaultClientListenAddr+")")
+	fs.StringVar(&f.socketMode, "socketMode", "", "Unmanaged client Unix socket file mode (default: 0600)")
+	fs.StringVar(&f.options, "options", "", "Unmanaged server transport options (\"key=value ...\")")
+	fs.StringVar(&f.backends, "backends", "", "Unmanaged server backend addresses (\"host:port,...\")")
+	fs.BoolVar(&f.exit, "exit", false, "Unmanaged server connects to the destinations chosen by the clients (an exit), or the client uses such a server")
+	fs.StringVar(&f.exitSecretFile, "exitSecretFile", "", "Unmanaged exit mode file holding the secret shared by the server and the clients")
+	fs.StringVar(&f.exitTarget, "exitTarget", "", "Unmanaged forwarding exit client destination (\"host:port\")")
+	fs.StringVar(&f.exitPolicy, "exitPolicy", "", "Unmanaged exit server destination policy (\"allow|deny <address>:<ports>,...\")")
+	fs.DurationVar(&f.healthInterval, "healthInterval", defaultHealthInterval, "Unmanaged server backend health check interval (0 disables)")
+	fs.StringVar(&f.protocol, "protocol", "", "Unmanaged client listener protocol (\""+protocolSOCKS5+"\" or \""+protocolHTTP+"\" for HTTP CONNECT)")
+	fs.BoolVar(&f.forward, "forward", false, "Unmanaged client relays connections to the bridge without SOCKS5")
+	fs.StringVar(&f.stateDir, "stateDir", "", "Unmanaged mode state directory")
+}
 
+func main() {
 	// Handle the command line arguments.
 	_, execName := path.Split(os.Args[0])
+	if len(os.Args) > 1 && os.Args[1] == adminCtlCommand {
+		os.Exit(adminCtl(execName, os.Args[2:], os.Stdout, os.Stderr))
+	}
+	var f cmdlineFlags
 	showVer := flag.Bool("version", false, "Print version and exit")
-	logLevelStr := flag.String("logLevel", "ERROR", "Log level (ERROR/WARN/INFO/DEBUG)")
-	enableLogging := flag.Bool("enableLogging", false, "Log to TOR_PT_STATE_LOCATION/"+obfs4proxyLogFile)
-	unsafeLogging := flag.Bool("unsafeLogging", false, "Disable the address scrubber")
+	configFile := flag.String("config", "", "Load the JSON configuration file (flags override it)")
+	f.register(flag.CommandLine)
 	flag.Parse()
 
 	if *showVer {
 		fmt.Printf("%s\n", getVersion())
 		os.Exit(0)
 	}
-	if err := log.SetLogLevel(*logLevelStr); err != nil {
-		golog.Fatalf("[ERROR]: %s - failed to set log level: %s", execName, err)
+
+	// Load the configuration, and apply the flags over it.  The transports
+	// are needed to validate it.
+	cfg := new(config)
+	var err error
+	if *configFile != "" {
+		if cfg, err = loadConfig(*configFile); err != nil {
+			golog.Fatalf("[ERROR]: %s - failed to load the configuration: %s", execName, err)
+		}
+	}
+	if err = cfg.applyFlags(flag.CommandLine, &f); err != nil {
+		golog.Fatalf("[ERROR]: %s - %s", execName, err)
+	}
+	if err = transports.Init(); err != nil {
+		golog.Fatalf("[ERROR]: %s - failed to initialize transports: %s", execName, err)
+	}
+	if err = cfg.validate(); err != nil {
+		golog.Fatalf("[ERROR]: %s - invalid configuration: %s", execName, err)
+	}
+	if err = cfg.applyTransports(flag.CommandLine); err != nil {
+		golog.Fatalf("[ERROR]: %s - invalid configuration: %s", execName, err)
 	}
 
+	// Initialize the termination state monitor as soon as possible.  Tor
+	// is the parent of a managed transport, and exiting with it is
+	// expected.
+	isManaged := cfg.Mode == ""
+	termMon = newTermMonitor(isManaged)
+
 	// Determine if this is a client or server, initialize the common state.
-	var ptListeners []net.Listener
 	var launched bool
-	isClient, err := ptIsClient()
-	if err != nil {
-		golog.Fatalf("[ERROR]: %s - must be run as a managed transport", execName)
-	}
-	if stateDir, err = pt.MakeStateDir(); err != nil {
-		golog.Fatalf("[ERROR]: %s - No state directory: %s", execName, err)
+	var isClient bool
+	if isManaged {
+		if isClient, err = ptIsClient(); err != nil {
+			golog.Fatalf("[ERROR]: %s - must be run as a managed transport, or with -mode", execName)
+		}
+		if stateDir, err = pt.MakeStateDir(); err != nil {
+			golog.Fatalf("[ERROR]: %s - No state directory: %s", execName, err)
+		}
+	} else {
+		isClient = cfg.Mode != modeServer
+		if stateDir, err = standaloneStateDir(cfg.StateDir); err != nil {
+			golog.Fatalf("[ERROR]: %s - No state directory: %s", execName, err)
+		}
 	}
-	if err = log.Init(*enableLogging, path.Join(stateDir, obfs4proxyLogFile), *unsafeLogging); err != nil {
+	if err = log.Init(cfg.Log.Enable, path.Join(stateDir, obfs4proxyLogFile), cfg.Log.Unsafe); err != nil {
 		golog.Fatalf("[ERROR]: %s - failed to initialize logging", execName)
 	}
-	if err = transports.Init(); err != nil {
-		log.Errorf("%s - failed to initialize transports: %s", execName, err)
+
+	log.Noticef("%s - launched", getVersion())
+	if isManaged {
+		if ver := ptNegotiateVersion(); ver != "" {
+			log.Infof("%s - using managed transport protocol version %s", execName, ver)
+		}
+	}
+
+	// Take the listening sockets passed by the service manager before the
+	// listeners are set up.
+	if err = initActivation(); err != nil {
+		log.Errorf("%s - %s", execName, err)
+		fmt.Fprintf(os.Stderr, "[ERROR]: %s - %s\n", execName, err)
 		os.Exit(-1)
 	}
 
-	log.Noticef("%s - launched", getVersion())
+	if cfg.MetricsAddr != "" {
+		ln, err := metricsRegistry.ListenAndServe(cfg.MetricsAddr)
+		if err != nil {
+			log.Errorf("%s - failed to serve metrics: %s", execName, err)
+			fmt.Fprintf(os.Stderr, "[ERROR]: %s - failed to serve metrics: %s\n", execName, err)
+			os.Exit(-1)
+		}
+		defer ln.Close()
+		log.Infof("%s - serving metrics on http://%s%s", execName, ln.Addr(), metrics.Path)
+	}
+	if cfg.AdminSocket != "" {
+		ln, err := adminListen(cfg.AdminSocket)
+		if err != nil {
+			log.Errorf("%s - failed to serve the admin socket: %s", execName, err)
+			fmt.Fprintf(os.Stderr, "[ERROR]: %s - failed to serve the admin socket: %s\n", execName, err)
+			os.Exit(-1)
+		}
+		defer ln.Close()
+		log.Infof("%s - serving the admin socket on %s", execName, cfg.AdminSocket)
+	}
+
+	// Bound the CPU that the server handshakes use.
+	if !isClient {
+		pool := cfg.Handshakes.newPool()
+		obfs4.SetHandshakePool(pool)
+		handshakePoolStats(pool)
+		log.Infof("%s - running the server handshakes on %d workers", execName, pool.Stats().Workers)
+	}
+
+	// The stdio mode relays a single session, and exits with it (or on a
+	// signal, including SIGHUP as the parent hangs up).
+	if cfg.Mode == modeStdio {
+		go func() {
+			if err := stdioClient(cfg, os.Stdin, os.Stdout); err != nil {
+				saveBridgeScores()
+				log.Errorf("%s - %s", execName, err)
+				fmt.Fprintf(os.Stderr, "[ERROR]: %s - %s\n", execName, err)
+				os.Exit(-1)
+			}
+			termMon.sigChan <- syscall.SIGTERM
+		}()
+		termMon.wait(false)
+		saveBridgeScores()
+		log.Noticef("%s - terminated", execName)
+		return
+	}
 
-	// Do the managed pluggable transport protocol configuration.
-	if isClient {
+	// Do the managed pluggable transport protocol configuration, or the
+	// unmanaged equivalent.  The listeners only accept connections once
+	// the server is confined.
+	holdListeners()
+	if !isManaged {
+		log.Infof("%s - initializing unmanaged %s listeners", execName, cfg.Mode)
+		if isClient {
+			_, err = standaloneClientSetup(cfg)
+		} else {
+			_, err = standaloneServerSetup(cfg)
+		}
+		if err != nil {
+			// Logging may be disabled, and there is no parent to
+			// report to, so tell the user directly.
+			log.Errorf("%s - %s", execName, err)
+			fmt.Fprintf(os.Stderr, "[ERROR]: %s - %s\n", execName, err)
+			os.Exit(-1)
+		}
+		launched = true
+	} else if isClient {
 		log.Infof("%s - initializing client transport listeners", execName)
-		launched, ptListeners = clientSetup()
+		launched, _ = clientSetup(cfg)
 	} else {
 		log.Infof("%s - initializing server transport listeners", execName)
-		launched, ptListeners = serverSetup()
+		launched, _ = serverSetup(cfg)
 	}
 	if !launched {
 		// Initialization failed, the client or server setup routines should
@@ -346,24 +730,51 @@ func main() {
 		os.Exit(-1)
 	}
 
+	closeUnclaimed()
+
+	// Confine the server, now that the listeners are bound.
+	if cfg.Hardening != (hardeningConfig{}) {
+		if isClient {
+			log.Warnf("%s - hardening is only supported by servers", execName)
+		} else if err = harden(execName, stateDir, &cfg.Hardening); err != nil {
+			log.Errorf("%s - hardening: %s", execName, err)
+			fmt.Fprintf(os.Stderr, "[ERROR]: %s - hardening: %s\n", execName, err)
+			os.Exit(-1)
+		}
+	}
+	releaseListeners()
+
 	log.Infof("%s - accepting connections", execName)
+	sdNotify(systemd.Ready)
+	termMon.startWatchdog()
 	defer func() {
+		saveBridgeScores()
 		log.Noticef("%s - terminated", execName)
 	}()
 
 	// At this point, the pt config protocol is finished, and incoming
 	// connections will be processed.  Wait till the parent dies
 	// (immediate exit), a SIGTERM is received (immediate exit),
-	// or a SIGINT is received.
+	// or a SIGINT is received.  A SIGHUP reloads the configuration.
+	rl := &reloader{
+		execName:   execName,
+		configFile: *configFile,
+		flags:      &f,
+		managed:    isManaged,
+		cfg:        cfg,
+	}
+	termMon.onReload = rl.reload
 	if sig := termMon.wait(false); sig == syscall.SIGTERM {
 		return
 	}
 
 	// Ok, it was the first SIGINT, close all listeners, and wait till,
-	// the parent dies, all the current connections are closed, or either
-	// a SIGINT/SIGTERM is received, and exit.
-	for _, ln := range ptListeners {
-		ln.Close()
-	}
+	// the parent dies, all the current connections are closed (or the
+	// drain deadline closes them), or either a SIGINT/SIGTERM is received,
+	// and exit.
+	rl.stop()
+	log.Noticef("%s - closing the listeners", execName)
+	closeListeners(proxyListeners())
+	drainSessions(rl.config().DrainTimeout.Duration)
 	termMon.wait(true)
 }
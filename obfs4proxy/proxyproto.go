@@ -0,0 +1,55 @@
+package main
+
+import (
+	"net"
+
+	"git.torproject.org/pluggable-transports/goptlib.git"
+	"github.com/RACECAR-GU/obfsX/common/httpconnect"
+	"github.com/RACECAR-GU/obfsX/common/socks5"
+)
+
+const (
+	protocolSOCKS5 = "socks5"
+	protocolHTTP   = "http"
+)
+
+// protocolName returns the name of the proxy protocol for the logs.
+func protocolName(protocol string) string {
+	if protocol == protocolHTTP {
+		return "HTTP CONNECT"
+	}
+	return "SOCKS5"
+}
+
+// proxyRequest is a client request, read with either of the proxy protocols.
+type proxyRequest struct {
+	target string
+	args   pt.Args
+
+	// buffered is the data that the client sent after the request.
+	buffered []byte
+
+	reply func(socks5.ReplyCode) error
+}
+
+// readProxyRequest reads the client request of the protocol from conn.
+func readProxyRequest(conn net.Conn, protocol string) (*proxyRequest, error) {
+	if protocol == protocolHTTP {
+		req, err := httpconnect.Handshake(conn)
+		if err != nil {
+			return nil, err
+		}
+		return &proxyRequest{
+			target:   req.Target,
+			args:     req.Args,
+			buffered: req.Buffered(),
+			reply:    req.Reply,
+		}, nil
+	}
+
+	req, err := socks5.Handshake(conn)
+	if err != nil {
+		return nil, err
+	}
+	return &proxyRequest{target: req.Target, args: req.Args, reply: req.Reply}, nil
+}
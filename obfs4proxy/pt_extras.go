@@ -28,12 +28,15 @@
 package main
 
 import (
+	"bytes"
 	"errors"
 	"fmt"
+	"io"
 	"net"
 	"net/url"
 	"os"
 	"strconv"
+	"strings"
 
 	"git.torproject.org/pluggable-transports/goptlib.git"
 )
@@ -164,3 +167,48 @@ func resolveAddrStr(addrStr string) (*net.TCPAddr, error) {
 func ptShouldExitOnStdinClose() bool {
 	return os.Getenv("TOR_PT_EXIT_ON_STDIN_CLOSE") == "1"
 }
+
+// The PT 2.x specification keeps the managed mode environment variables, but
+// the parent process may only offer the 2.x versions in
+// TOR_PT_MANAGED_TRANSPORT_VER, which goptlib rejects.  The configuration
+// protocol is otherwise identical for our purposes, so pick the version here,
+// and fix up the VERSION line that goptlib emits.
+var ptVersions = []string{"1", "2.1", "2.0"}
+
+const ptVersionEnv = "TOR_PT_MANAGED_TRANSPORT_VER"
+
+func ptNegotiateVersion() string {
+	offered := strings.Split(os.Getenv(ptVersionEnv), ",")
+	for _, ver := range ptVersions {
+		for _, v := range offered {
+			if strings.TrimSpace(v) != ver {
+				continue
+			}
+			if ver != "1" {
+				_ = os.Setenv(ptVersionEnv, "1")
+				pt.Stdout = &ptVersionWriter{w: pt.Stdout, version: ver}
+			}
+			return ver
+		}
+	}
+
+	// Let goptlib emit the VERSION-ERROR.
+	return ""
+}
+
+type ptVersionWriter struct {
+	w       io.Writer
+	version string
+	done    bool
+}
+
+func (w *ptVersionWriter) Write(p []byte) (int, error) {
+	if !w.done && bytes.Equal(p, []byte("VERSION 1\n")) {
+		w.done = true
+		if _, err := fmt.Fprintf(w.w, "VERSION %s\n", w.version); err != nil {
+			return 0, err
+		}
+		return len(p), nil
+	}
+	return w.w.Write(p)
+}
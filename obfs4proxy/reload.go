@@ -0,0 +1,144 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"sync"
+
+	"github.com/RACECAR-GU/obfsX/common/log"
+)
+
+// reloader reloads the configuration file and the transports' server state
+// (eg: obfs4_state.json) on SIGHUP.  New connections use the new settings,
+// while the existing sessions continue (see drainSessions).
+type reloader struct {
+	sync.Mutex
+
+	execName   string
+	configFile string
+	flags      *cmdlineFlags
+	managed    bool
+
+	cfg     *config
+	stopped bool
+}
+
+// config returns the current configuration.
+func (r *reloader) config() *config {
+	r.Lock()
+	defer r.Unlock()
+	return r.cfg
+}
+
+// stop prevents further reloads, once obfs4proxy is shutting down.
+func (r *reloader) stop() {
+	r.Lock()
+	defer r.Unlock()
+	r.stopped = true
+}
+
+func (r *reloader) reload() {
+	r.Lock()
+	defer r.Unlock()
+	if r.stopped {
+		return
+	}
+
+	log.Noticef("%s - reloading the configuration", r.execName)
+	cfg, err := r.load()
+	if err == nil {
+		err = r.apply(cfg)
+	}
+	if err != nil {
+		log.Errorf("%s - reload failed, keeping the current configuration: %s", r.execName, err)
+		return
+	}
+	r.cfg = cfg
+	log.Noticef("%s - reloaded the configuration", r.execName)
+
+	// The sessions of the previous configuration continue for as long as
+	// they last, the drain deadline only applies once shutting down, so
+	// that frequent reloads do not cut them short.
+	drainSessions(0)
+}
+
+// load loads and validates the configuration, the same way main does.
+func (r *reloader) load() (*config, error) {
+	cfg := new(config)
+	var err error
+	if r.configFile != "" {
+		if cfg, err = loadConfig(r.configFile); err != nil {
+			return nil, err
+		}
+	}
+	if err = cfg.applyFlags(flag.CommandLine, r.flags); err != nil {
+		return nil, err
+	}
+
+	// Validating sets the log level, which stays as it was if the
+	// configuration is invalid.
+	level := log.LevelName()
+	if err = cfg.validate(); err != nil {
+		_ = log.SetLogLevel(level)
+		return nil, fmt.Errorf("invalid configuration: %s", err)
+	}
+	if err = cfg.applyTransports(flag.CommandLine); err != nil {
+		_ = log.SetLogLevel(level)
+		return nil, fmt.Errorf("invalid configuration: %s", err)
+	}
+	return cfg, nil
+}
+
+// apply applies cfg to the listeners.
+func (r *reloader) apply(cfg *config) error {
+	old := r.cfg
+	if cfg.Mode != old.Mode {
+		return fmt.Errorf("a reload can not change the mode")
+	}
+	for _, v := range []struct {
+		name    string
+		changed bool
+	}{
+		{"log.enable", cfg.Log.Enable != old.Log.Enable},
+		{"log.unsafe", cfg.Log.Unsafe != old.Log.Unsafe},
+		{"metricsAddr", cfg.MetricsAddr != old.MetricsAddr},
+		{"metricsPublic", cfg.MetricsPublic != old.MetricsPublic},
+		{"adminSocket", cfg.AdminSocket != old.AdminSocket},
+		{"handshakes", cfg.Handshakes != old.Handshakes},
+		{"hardening", cfg.Hardening != old.Hardening},
+		{"stateDir", !r.managed && cfg.StateDir != old.StateDir},
+	} {
+		if v.changed {
+			log.Warnf("%s - changing %s requires a restart", r.execName, v.name)
+		}
+	}
+
+	if !r.managed {
+		return standaloneReload(cfg)
+	}
+
+	// Tor chose the managed listeners, so only their handlers change.
+	type reloaded struct {
+		l *proxyListener
+		h *listenerHandler
+	}
+	var updates []reloaded
+	for _, l := range proxyListeners() {
+		if l.isClosed() || l.rebuild == nil {
+			continue
+		}
+		h, err := l.rebuild(cfg)
+		if err != nil {
+			for _, u := range updates {
+				closeHandler(u.h)
+			}
+			return fmt.Errorf("%s - %s", l.transport, err)
+		}
+		updates = append(updates, reloaded{l, h})
+	}
+	for _, u := range updates {
+		u.l.replace(u.h)
+		log.Infof("%s - reloaded listener: %s", u.l.transport, u.l.logAddr())
+	}
+	return nil
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// freeAddr returns a TCP address that nothing is listening on.
+func freeAddr(t *testing.T) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %s", err)
+	}
+	defer ln.Close()
+	return ln.Addr().String()
+}
+
+func TestStandaloneReloadRollback(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %s", err)
+	}
+	h := &listenerHandler{handle: func(conn net.Conn) { conn.Close() }}
+	l := newProxyListener("obfs4", roleClient, ln.Addr().String(), ln, h, nil)
+	defer l.close()
+	busy := listenBackend(t, "127.0.0.1:0")
+	defer busy.Close()
+	newAddr := freeAddr(t)
+
+	// Listening on the busy address fails after the other listeners were
+	// set up, which leaves the listeners as they were.
+	cfg := &config{
+		Mode: modeClient,
+		Clients: []*clientConfig{
+			{Bridge: testBridge, ListenAddr: l.bindAddr},
+			{Bridge: testBridge, ListenAddr: newAddr},
+			{Bridge: testBridge, ListenAddr: busy.Addr().String()},
+		},
+	}
+	before := len(proxyListeners())
+	if err = standaloneReload(cfg); err == nil || !strings.Contains(err.Error(), "clients[2]") {
+		t.Fatalf("standaloneReload: %v, expected clients[2] to fail", err)
+	}
+	if l.currentHandler() != h || !l.enabled() {
+		t.Errorf("the failed reload changed the listener")
+	}
+	if n := len(proxyListeners()); n != before {
+		t.Errorf("the failed reload registered %d listeners", n-before)
+	}
+	if ln, err := net.Listen("tcp", newAddr); err != nil {
+		t.Errorf("the failed reload left %s open: %s", newAddr, err)
+	} else {
+		ln.Close()
+	}
+
+	// A transport change is refused the same way.
+	cfg.Clients = []*clientConfig{
+		{Bridge: testBridge, ListenAddr: newAddr},
+		{Bridge: "obfs5" + strings.TrimPrefix(testBridge, "obfs4"), ListenAddr: l.bindAddr},
+	}
+	if err = standaloneReload(cfg); err == nil || !strings.Contains(err.Error(), "can not change the transport") {
+		t.Fatalf("standaloneReload: %v, expected the transport change to fail", err)
+	}
+	if l.currentHandler() != h || len(proxyListeners()) != before {
+		t.Errorf("the failed reload changed the listeners")
+	}
+
+	// Once it succeeds, the kept listener has a new handler, and the new
+	// one is registered.
+	cfg.Clients = cfg.Clients[:1]
+	cfg.Clients = append(cfg.Clients, &clientConfig{Bridge: testBridge, ListenAddr: l.bindAddr})
+	if err = standaloneReload(cfg); err != nil {
+		t.Fatalf("standaloneReload failed: %s", err)
+	}
+	added := proxyListeners()[before:]
+	defer closeListeners(added)
+	if l.currentHandler() == h || !l.enabled() {
+		t.Errorf("the reload did not replace the handler")
+	}
+	if len(added) != 1 || added[0].bindAddr != newAddr {
+		t.Errorf("the reload registered %d listeners, expected one on %s", len(added), newAddr)
+	}
+}
+
+// testSession starts a session, returning the client end of its connection.
+func testSession() (*session, net.Conn) {
+	c, s := net.Pipe()
+	return newSession("obfs4", roleServer, "192.0.2.1:1234", s), c
+}
+
+// sessionClosed returns if the session's connection was closed.
+func sessionClosed(c net.Conn) bool {
+	if err := c.SetWriteDeadline(time.Now().Add(time.Millisecond)); err != nil {
+		return true
+	}
+	_, err := c.Write([]byte("x"))
+	if e, ok := err.(net.Error); ok && e.Timeout() {
+		return false
+	}
+	return err != nil
+}
+
+func draining() int {
+	sessionTable.Lock()
+	defer sessionTable.Unlock()
+	return sessionTable.draining
+}
+
+func TestDrainSessions(t *testing.T) {
+	// A new generation leaves the previous ones' sessions open without a
+	// deadline.
+	s1, c1 := testSession()
+	defer c1.Close()
+	drainSessions(0)
+	s2, c2 := testSession()
+	defer c2.Close()
+	if s1.generation >= s2.generation {
+		t.Fatalf("the generations are %d and %d", s1.generation, s2.generation)
+	}
+	if n := draining(); n != 1 {
+		t.Fatalf("%d sessions are draining, expected 1", n)
+	}
+
+	// With a deadline, only the sessions started before it are closed.
+	drainSessions(20 * time.Millisecond)
+	s3, c3 := testSession()
+	defer c3.Close()
+	defer s3.done()
+	if n := draining(); n != 2 {
+		t.Fatalf("%d sessions are draining, expected 2", n)
+	}
+	waitFor(t, "the drain deadline", func() bool { return sessionClosed(c1) && sessionClosed(c2) })
+	time.Sleep(20 * time.Millisecond)
+	if sessionClosed(c3) {
+		t.Errorf("the drain deadline closed a session of the new generation")
+	}
+	s1.done()
+	s2.done()
+	if n := draining(); n != 0 {
+		t.Errorf("%d sessions are draining, expected 0", n)
+	}
+}
+
+func TestReloadKeepsSessions(t *testing.T) {
+	dir, err := ioutil.TempDir("", "obfs4proxy")
+	if err != nil {
+		t.Fatalf("TempDir failed: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	configFile := filepath.Join(dir, "config.json")
+	content := fmt.Sprintf(`{
+  "mode": "client",
+  "log": {"level": "ERROR"},
+  "stateDir": %q,
+  "drainTimeout": "10ms",
+  "clients": [{"bridge": %q, "listenAddr": "127.0.0.1:0"}]
+}`, dir, testBridge)
+	if err = ioutil.WriteFile(configFile, []byte(content), 0600); err != nil {
+		t.Fatalf("WriteFile failed: %s", err)
+	}
+	cfg, err := loadConfig(configFile)
+	if err != nil {
+		t.Fatalf("loadConfig failed: %s", err)
+	}
+
+	// The drain deadline does not apply to reloads.
+	s, c := testSession()
+	defer c.Close()
+	defer s.done()
+	r := &reloader{execName: "test", configFile: configFile, flags: new(cmdlineFlags), cfg: cfg}
+	before := len(proxyListeners())
+	r.reload()
+	defer func() { closeListeners(proxyListeners()[before:]) }()
+	if r.config() == cfg {
+		t.Fatalf("the configuration was not reloaded")
+	}
+	sessionTable.Lock()
+	generation := sessionTable.generation
+	sessionTable.Unlock()
+	if s.generation >= generation {
+		t.Errorf("the reload did not start a new generation")
+	}
+	time.Sleep(50 * time.Millisecond)
+	if sessionClosed(c) {
+		t.Errorf("the reload closed a session")
+	}
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"net"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/RACECAR-GU/obfsX/common/log"
+	"github.com/RACECAR-GU/obfsX/common/metrics"
+)
+
+// session is a connection being handled by clientHandler or serverHandler.
+type session struct {
+	sync.Mutex
+
+	id        uint64
+	transport string
+	role      string
+	peer      string
+	start     time.Time
+
+	// generation is the configuration generation that the session
+	// started under, see drainSessions.
+	generation uint64
+
+	// conn is the accepted connection, closing it ends the session.
+	conn net.Conn
+
+	// wire and payload are the transport connection's counters, once it
+	// is established.
+	wire, payload *metrics.Conn
+}
+
+var sessionTable struct {
+	sync.Mutex
+	nextID     uint64
+	m          map[uint64]*session
+	generation uint64
+
+	// draining is the number of sessions of previous generations.
+	draining int
+}
+
+// newSession registers a session, with the peer being the bridge (client) or
+// the client (server) address.  done MUST be called once it is finished.
+func newSession(transport, role, peer string, conn net.Conn) *session {
+	s := &session{
+		transport: transport,
+		role:      role,
+		peer:      peer,
+		start:     time.Now(),
+		conn:      conn,
+	}
+
+	sessionTable.Lock()
+	defer sessionTable.Unlock()
+	if sessionTable.m == nil {
+		sessionTable.m = make(map[uint64]*session)
+	}
+	sessionTable.nextID++
+	s.id = sessionTable.nextID
+	s.generation = sessionTable.generation
+	sessionTable.m[s.id] = s
+	return s
+}
+
+// established records the connections of an established session.
+func (s *session) established(wire, payload *metrics.Conn) {
+	s.Lock()
+	defer s.Unlock()
+	s.wire, s.payload = wire, payload
+}
+
+// setPeer changes the peer, once the client has picked one of its bridges.
+func (s *session) setPeer(peer string) {
+	s.Lock()
+	defer s.Unlock()
+	s.peer = peer
+}
+
+// peerAddr returns the peer.
+func (s *session) peerAddr() string {
+	s.Lock()
+	defer s.Unlock()
+	return s.peer
+}
+
+// counts returns the payload and wire bytes received and sent.
+func (s *session) counts() (payloadRead, payloadWritten, wireRead, wireWritten uint64) {
+	s.Lock()
+	defer s.Unlock()
+	if s.payload != nil {
+		payloadRead, payloadWritten = s.payload.BytesRead(), s.payload.BytesWritten()
+	}
+	if s.wire != nil {
+		wireRead, wireWritten = s.wire.BytesRead(), s.wire.BytesWritten()
+	}
+	return
+}
+
+// close ends the session, the handler cleans up.
+func (s *session) close() error {
+	s.Lock()
+	defer s.Unlock()
+	if s.payload != nil {
+		s.payload.Close()
+	}
+	return s.conn.Close()
+}
+
+func (s *session) done() {
+	sessionTable.Lock()
+	defer sessionTable.Unlock()
+	delete(sessionTable.m, s.id)
+	if s.generation < sessionTable.generation {
+		sessionTable.draining--
+		if sessionTable.draining == 0 {
+			log.Noticef("drain - the draining sessions have finished")
+		}
+	}
+}
+
+// drainSessions starts a new session generation (on reload or shutdown),
+// after which the sessions of the previous generations are draining.  If
+// timeout is non-zero (on shutdown), those still open once it passes are
+// closed.
+func drainSessions(timeout time.Duration) {
+	sessionTable.Lock()
+	sessionTable.generation++
+	gen := sessionTable.generation
+	sessionTable.draining = len(sessionTable.m)
+	n := sessionTable.draining
+	sessionTable.Unlock()
+
+	if n == 0 {
+		return
+	}
+	if timeout == 0 {
+		log.Noticef("drain - %d sessions are draining, without a deadline", n)
+		return
+	}
+	log.Noticef("drain - %d sessions are draining, with a deadline of %s", n, timeout)
+	time.AfterFunc(timeout, func() {
+		var l []*session
+		for _, s := range sessions() {
+			if s.generation < gen {
+				l = append(l, s)
+			}
+		}
+		if len(l) == 0 {
+			return
+		}
+		log.Noticef("drain - the deadline passed, closing %d sessions", len(l))
+		for _, s := range l {
+			_ = s.close()
+		}
+	})
+}
+
+// sessions returns the active sessions, oldest first.
+func sessions() []*session {
+	sessionTable.Lock()
+	l := make([]*session, 0, len(sessionTable.m))
+	for _, s := range sessionTable.m {
+		l = append(l, s)
+	}
+	sessionTable.Unlock()
+
+	sort.Slice(l, func(i, j int) bool { return l[i].id < l[j].id })
+	return l
+}
+
+// lookupSession returns the active session with the id, or nil.
+func lookupSession(id uint64) *session {
+	sessionTable.Lock()
+	defer sessionTable.Unlock()
+	return sessionTable.m[id]
+}
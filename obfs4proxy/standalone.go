@@ -0,0 +1,719 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"git.torproject.org/pluggable-transports/goptlib.git"
+	"github.com/RACECAR-GU/obfsX/common/exitproxy"
+	"github.com/RACECAR-GU/obfsX/common/failover"
+	"github.com/RACECAR-GU/obfsX/common/log"
+	"github.com/RACECAR-GU/obfsX/common/socks5"
+	"github.com/RACECAR-GU/obfsX/obfsx"
+	"github.com/RACECAR-GU/obfsX/transports"
+	"github.com/RACECAR-GU/obfsX/transports/base"
+)
+
+// This file contains the unmanaged (standalone) mode, where obfs4proxy is
+// configured from the command line or the configuration file instead of by
+// tor.
+
+const (
+	modeClient = "client"
+	modeServer = "server"
+	modeStdio  = "stdio"
+
+	defaultClientListenAddr = "127.0.0.1:1080"
+	defaultHealthInterval   = 30 * time.Second
+
+	standaloneBridgeFile = "standalone_bridgeline.txt"
+
+	exitDialTimeout = 30 * time.Second
+
+	// minExitSecretLength is the minimum length of an exit secret, which
+	// is all that keeps those who know the bridge line from using the exit.
+	minExitSecretLength = 16
+)
+
+// clientListener is the configuration that a client listener hands to each
+// clientHandler.
+type clientListener struct {
+	// args are the transport arguments.  For managed listeners these are
+	// defaults that the SOCKS request's arguments override.
+	args pt.Args
+
+	// bridges are the fixed bridges of an unmanaged listener, or empty if
+	// the SOCKS request picks the bridge.
+	bridges []clientBridge
+
+	// scores are the fixed bridges' health scores, and failoverDelay is
+	// how long a connection attempt runs before the next bridge is raced.
+	scores        *failover.Scores
+	failoverDelay time.Duration
+
+	// protocol is the proxy protocol (protocolSOCKS5 if empty).
+	protocol string
+
+	// forward is set if connections are relayed without a SOCKS5
+	// handshake.
+	forward bool
+
+	// exit is set if the bridge is an exit server, which is sent the SOCKS
+	// target, or exitTarget if forwarding.
+	exit       bool
+	exitSecret []byte
+	exitTarget string
+}
+
+// clientBridge is a fixed bridge of an unmanaged client listener.
+type clientBridge struct {
+	// key identifies the bridge in the scores.
+	key string
+
+	addr string
+	args pt.Args
+}
+
+func (c *clientConfig) validate() error {
+	if c.Bridge != "" && len(c.Bridges) > 0 {
+		return fmt.Errorf("bridge and bridges are mutually exclusive")
+	}
+	if c.FailoverDelay.Duration < 0 {
+		return fmt.Errorf("invalid failover delay '%s'", c.FailoverDelay)
+	}
+	if c.hasBridges() {
+		if _, err := c.parseBridges(); err != nil {
+			return err
+		}
+	} else {
+		// The requests pick the bridge.
+		if c.Transport == "" {
+			return fmt.Errorf("no bridge line or transport specified")
+		}
+		if transports.Get(c.Transport) == nil {
+			return fmt.Errorf("'%s' is not supported", c.Transport)
+		}
+		if c.Forward || c.Exit {
+			return fmt.Errorf("forward and exit require a bridge line")
+		}
+	}
+	switch c.Protocol {
+	case "", protocolSOCKS5:
+	case protocolHTTP:
+		if c.Forward {
+			return fmt.Errorf("forward and the %s protocol are mutually exclusive", c.Protocol)
+		}
+	default:
+		return fmt.Errorf("invalid protocol '%s'", c.Protocol)
+	}
+	if c.Exit {
+		secret, err := loadExitSecret(c.ExitSecret, c.ExitSecretFile)
+		if err != nil {
+			return err
+		}
+		c.ExitSecret, c.ExitSecretFile = secret, ""
+	} else if c.ExitSecret != "" || c.ExitSecretFile != "" {
+		return fmt.Errorf("an exit secret requires exit")
+	}
+	if c.ExitTarget != "" && !(c.Exit && c.Forward) {
+		return fmt.Errorf("an exit target requires exit and forward")
+	}
+	if c.Exit && c.Forward && c.ExitTarget == "" {
+		return fmt.Errorf("no exit target specified")
+	}
+	if c.ExitTarget != "" {
+		if _, _, err := net.SplitHostPort(c.ExitTarget); err != nil || len(c.ExitTarget) > exitproxy.MaxTargetLength {
+			return fmt.Errorf("invalid exit target '%s'", c.ExitTarget)
+		}
+	}
+	if c.Bandwidth != nil {
+		if err := c.Bandwidth.Validate(); err != nil {
+			return fmt.Errorf("bandwidth: %s", err)
+		}
+	}
+	return nil
+}
+
+// validateListen checks the listener settings of a client that listens
+// (not in stdio mode).
+func (c *clientConfig) validateListen() error {
+	if c.ListenAddr == "" {
+		c.ListenAddr = defaultClientListenAddr
+	}
+	if strings.HasPrefix(c.ListenAddr, unixAddrPrefix) {
+		if c.ListenAddr == unixAddrPrefix {
+			return fmt.Errorf("invalid listen address: no socket path")
+		}
+	} else {
+		if _, err := resolveAddrStr(c.ListenAddr); err != nil {
+			return fmt.Errorf("invalid listen address: %s", err)
+		}
+		if c.SocketMode != "" {
+			return fmt.Errorf("a socket mode requires a Unix socket listen address")
+		}
+	}
+	if _, err := c.socketMode(); err != nil {
+		return err
+	}
+	return nil
+}
+
+// validateStdio checks the settings of the stdio mode client, which relays
+// stdin and stdout to a fixed bridge.
+func (c *clientConfig) validateStdio() error {
+	if !c.hasBridges() {
+		return fmt.Errorf("no bridge line specified")
+	}
+	if c.ListenAddr != "" || c.SocketMode != "" || c.Protocol != "" {
+		return fmt.Errorf("stdio mode does not listen")
+	}
+	c.Forward = true
+	return c.validate()
+}
+
+// socketMode returns the file mode of a Unix socket listener.
+func (c *clientConfig) socketMode() (os.FileMode, error) {
+	if c.SocketMode == "" {
+		return defaultSocketMode, nil
+	}
+	mode, err := strconv.ParseUint(c.SocketMode, 8, 32)
+	if err != nil || mode > 0777 {
+		return 0, fmt.Errorf("invalid socket mode '%s'", c.SocketMode)
+	}
+	return os.FileMode(mode), nil
+}
+
+// hasBridges returns if the listener connects to fixed bridges.
+func (c *clientConfig) hasBridges() bool {
+	return c.Bridge != "" || len(c.Bridges) > 0
+}
+
+// parseBridges parses the bridge lines, which may omit the transport if it
+// was given separately, and must all be for the same transport.
+func (c *clientConfig) parseBridges() ([]*obfsx.Bridge, error) {
+	lines := c.Bridges
+	if c.Bridge != "" {
+		lines = []string{c.Bridge}
+	}
+	transport := c.Transport
+	var bridges []*obfsx.Bridge
+	for _, line := range lines {
+		if fields := strings.Fields(line); transport != "" && len(fields) > 0 && strings.Contains(fields[0], ":") {
+			line = transport + " " + line
+		}
+		b, err := obfsx.ParseBridgeLine(line)
+		if err != nil {
+			return nil, fmt.Errorf("invalid bridge line: %s", err)
+		}
+		if transport != "" && b.Transport != transport {
+			return nil, fmt.Errorf("invalid bridge line: bridge line is for '%s', not '%s'", b.Transport, transport)
+		}
+		if transports.Get(b.Transport) == nil {
+			return nil, fmt.Errorf("invalid bridge line: '%s' is not supported", b.Transport)
+		}
+		transport = b.Transport
+		bridges = append(bridges, b)
+	}
+	return bridges, nil
+}
+
+// isServerTransport returns if the named transport has a server side (eg:
+// not "auto").
+func isServerTransport(name string) bool {
+	for _, v := range transports.Transports() {
+		if v == name {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *serverConfig) validate() error {
+	if s.Transport == "" {
+		return fmt.Errorf("no transport specified")
+	}
+	if transports.Get(s.Transport) == nil {
+		return fmt.Errorf("'%s' is not supported", s.Transport)
+	}
+	if !isServerTransport(s.Transport) {
+		return fmt.Errorf("'%s' is a client only transport", s.Transport)
+	}
+	if s.ListenAddr == "" {
+		return fmt.Errorf("no listen address specified")
+	}
+	if _, err := resolveAddrStr(s.ListenAddr); err != nil {
+		return fmt.Errorf("invalid listen address: %s", err)
+	}
+	if s.Limits != nil {
+		if err := s.Limits.Validate(); err != nil {
+			return fmt.Errorf("limits: %s", err)
+		}
+	}
+	if s.Bandwidth != nil {
+		if err := s.Bandwidth.Validate(); err != nil {
+			return fmt.Errorf("bandwidth: %s", err)
+		}
+	}
+	if s.Exit {
+		if len(s.Backends) > 0 || s.HealthInterval != nil {
+			return fmt.Errorf("backends and exit are mutually exclusive")
+		}
+		if _, err := exitproxy.ParsePolicy(s.ExitPolicy); err != nil {
+			return err
+		}
+		secret, err := loadExitSecret(s.ExitSecret, s.ExitSecretFile)
+		if err != nil {
+			return err
+		}
+		s.ExitSecret, s.ExitSecretFile = secret, ""
+		return nil
+	}
+	if s.ExitSecret != "" || s.ExitSecretFile != "" || len(s.ExitPolicy) > 0 {
+		return fmt.Errorf("exit settings without exit")
+	}
+	if _, err := newBackendPool(s.Backends); err != nil {
+		return err
+	}
+	if s.HealthInterval == nil {
+		s.HealthInterval = &duration{defaultHealthInterval}
+	} else if s.HealthInterval.Duration < 0 {
+		return fmt.Errorf("invalid health check interval '%s'", s.HealthInterval)
+	}
+	return nil
+}
+
+// loadExitSecret returns the exit secret, either given in the configuration
+// file, or read from secretFile (so that it does not show on the command
+// line), without the trailing newline.
+func loadExitSecret(secret, secretFile string) (string, error) {
+	if secretFile != "" {
+		if secret != "" {
+			return "", fmt.Errorf("exitSecret and exitSecretFile are mutually exclusive")
+		}
+		b, err := ioutil.ReadFile(secretFile)
+		if err != nil {
+			return "", fmt.Errorf("failed to read the exit secret: %s", err)
+		}
+		secret = strings.TrimRight(string(b), "\r\n")
+	}
+	if len(secret) < minExitSecretLength {
+		return "", fmt.Errorf("the exit secret must be at least %d bytes long", minExitSecretLength)
+	}
+	return secret, nil
+}
+
+// standaloneStateDir creates the state directory, like pt.MakeStateDir does
+// for the managed mode.
+func standaloneStateDir(dir string) (string, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return "", err
+	}
+	return dir, nil
+}
+
+func standaloneClientSetup(cfg *config) (listeners []*proxyListener, err error) {
+	defer func() {
+		if err != nil {
+			closeListeners(listeners)
+			listeners = nil
+		}
+	}()
+
+	for _, c := range cfg.Clients {
+		var l *proxyListener
+		if l, err = standaloneClientListen(cfg, c); err != nil {
+			return
+		}
+		listeners = append(listeners, l)
+	}
+	return
+}
+
+func standaloneClientListen(cfg *config, c *clientConfig) (*proxyListener, error) {
+	name, h, err := standaloneClientHandler(cfg, c)
+	if err != nil {
+		return nil, err
+	}
+	ln, err := listen(c.ListenAddr, h.socketMode)
+	if err != nil {
+		return nil, fmt.Errorf("%s - failed to listen: %s", name, err)
+	}
+	l := newProxyListener(name, roleClient, c.ListenAddr, ln, h, nil)
+
+	if c.Forward {
+		log.Infof("%s - registered forwarding listener: %s", name, ln.Addr())
+	} else {
+		log.Infof("%s - registered %s listener: %s", name, protocolName(c.Protocol), ln.Addr())
+	}
+
+	return l, nil
+}
+
+// standaloneClientHandler returns the transport and handler of an unmanaged
+// client listener.
+func standaloneClientHandler(cfg *config, c *clientConfig) (string, *listenerHandler, error) {
+	name, f, cl, err := standaloneClient(cfg, c)
+	if err != nil {
+		return "", nil, err
+	}
+	h := newClientHandler(f, nil, cl)
+	h.bandwidth = cfg.bandwidth(name, c.Bandwidth)
+	if h.socketMode, err = c.socketMode(); err != nil {
+		return "", nil, err
+	}
+	return name, h, nil
+}
+
+// standaloneClient returns the transport, factory and settings of an
+// unmanaged client.
+func standaloneClient(cfg *config, c *clientConfig) (string, base.ClientFactory, *clientListener, error) {
+	bridges, err := c.parseBridges()
+	if err != nil {
+		return "", nil, nil, err
+	}
+	name := c.Transport
+	if len(bridges) > 0 {
+		name = bridges[0].Transport
+	}
+	f, err := transports.Get(name).ClientFactory(stateDir)
+	if err != nil {
+		return "", nil, nil, fmt.Errorf("%s - failed to get ClientFactory: %s", name, err)
+	}
+
+	cl := &clientListener{
+		args:          cfg.clientArgs(name),
+		failoverDelay: c.FailoverDelay.Duration,
+		protocol:      c.Protocol,
+		forward:       c.Forward,
+		exit:          c.Exit,
+		exitSecret:    []byte(c.ExitSecret),
+		exitTarget:    c.ExitTarget,
+	}
+
+	// Catch invalid bridge arguments now, instead of on every connection,
+	// unless the requests pass the rest of them.
+	for _, b := range bridges {
+		args := mergeArgs(cl.args, b.Args)
+		if _, err = f.ParseArgs(&args); err != nil {
+			return "", nil, nil, fmt.Errorf("%s - invalid bridge arguments: %s", name, err)
+		}
+		cl.bridges = append(cl.bridges, clientBridge{
+			key:  name + " " + b.Address,
+			addr: b.Address,
+			args: args,
+		})
+	}
+	if len(cl.bridges) > 0 {
+		cl.scores = loadBridgeScores()
+	}
+	return name, f, cl, nil
+}
+
+// parseOptions parses server transport options, as "key=value" pairs
+// separated by spaces (like a torrc ServerTransportOptions).
+func parseOptions(s string) (map[string]string, error) {
+	opts := make(map[string]string)
+	for _, kv := range strings.Fields(s) {
+		idx := strings.IndexByte(kv, '=')
+		if idx <= 0 {
+			return nil, fmt.Errorf("malformed option '%s'", kv)
+		}
+		opts[kv[:idx]] = kv[idx+1:]
+	}
+	return opts, nil
+}
+
+// backendUpstream forwards sessions to the pool's backends.
+func backendUpstream(pool *backendPool) serverUpstream {
+	return func(remote net.Conn, clientAddr, name string) (net.Conn, error) {
+		return pool.dial()
+	}
+}
+
+// exitUpstream connects sessions to the destinations that the clients ask
+// for, if the policy allows them.
+func exitUpstream(policy *exitproxy.Policy, secret []byte) serverUpstream {
+	return func(remote net.Conn, clientAddr, name string) (net.Conn, error) {
+		req, err := exitproxy.ServerHandshake(remote, secret)
+		if err != nil {
+			return nil, err
+		}
+		targetStr := log.ElideAddr(req.Target)
+
+		ctx, cancel := context.WithTimeout(context.Background(), exitDialTimeout)
+		defer cancel()
+		addrs, err := policy.Resolve(ctx, req.Target)
+		if err != nil {
+			code := socks5.ReplyHostUnreachable
+			if err == exitproxy.ErrNotAllowed {
+				code = socks5.ReplyConnectionNotAllowed
+			}
+			_ = req.Reply(code)
+			return nil, fmt.Errorf("exit to %s: %s", targetStr, err)
+		}
+
+		var d net.Dialer
+		var conn net.Conn
+		for _, addr := range addrs {
+			if conn, err = d.DialContext(ctx, "tcp", addr); err == nil {
+				break
+			}
+		}
+		if err != nil {
+			_ = req.Reply(socks5.ErrorToReplyCode(err))
+			return nil, fmt.Errorf("exit to %s: %s", targetStr, err)
+		}
+		if err = req.Reply(socks5.ReplySucceeded); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		log.Debugf("%s(%s) - exit to %s", name, log.ElideAddr(clientAddr), targetStr)
+		return conn, nil
+	}
+}
+
+// bridgeLine returns the bridge line that clients need to connect to the
+// listener at addr.
+func bridgeLine(f base.ServerFactory, addr string) (string, error) {
+	b := obfsx.Bridge{Transport: f.Transport().Name(), Args: make(pt.Args)}
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return "", err
+	}
+	if ip := net.ParseIP(host); ip == nil || ip.IsUnspecified() {
+		host = "<IP ADDRESS>"
+	}
+	b.Address = net.JoinHostPort(host, port)
+	if args := f.Args(); args != nil {
+		b.Args = *args
+	}
+	return b.String(), nil
+}
+
+// writeStandaloneBridgeFile writes the bridge lines that clients need, the
+// same way the obfs4 server state writes obfs4_bridgeline.txt.
+func writeStandaloneBridgeFile(lines []string) error {
+	const prefix = "# obfs4proxy unmanaged client bridge lines\n" +
+		"#\n" +
+		"# This file is automatically generated based on the current\n" +
+		"# obfs4proxy configuration, with a bridge line per listener.\n" +
+		"# EDITING IT WILL HAVE NO EFFECT.\n" +
+		"#\n" +
+		"# Before distributing a bridge line, edit the placeholder\n" +
+		"# fields to contain the actual values:\n" +
+		"#  <IP ADDRESS>  - The public IP address of your server.\n\n"
+
+	tmp := []byte(prefix + strings.Join(lines, "\n") + "\n")
+	return ioutil.WriteFile(path.Join(stateDir, standaloneBridgeFile), tmp, 0600)
+}
+
+func standaloneServerSetup(cfg *config) (listeners []*proxyListener, err error) {
+	defer func() {
+		if err != nil {
+			closeListeners(listeners)
+			listeners = nil
+		}
+	}()
+
+	var lines []string
+	for _, s := range cfg.Servers {
+		var l *proxyListener
+		var line string
+		if l, line, err = standaloneServerListen(cfg, s); err != nil {
+			return
+		}
+		listeners = append(listeners, l)
+		lines = append(lines, line)
+	}
+	if err = writeStandaloneBridgeFile(lines); err != nil {
+		err = fmt.Errorf("failed to write the bridge lines: %s", err)
+	}
+	return
+}
+
+func standaloneServerListen(cfg *config, s *serverConfig) (*proxyListener, string, error) {
+	f, h, err := standaloneServerHandler(cfg, s)
+	if err != nil {
+		return nil, "", err
+	}
+	name := s.Transport
+	ln, err := listenTCP(name, s.ListenAddr)
+	if err != nil {
+		closeHandler(h)
+		return nil, "", fmt.Errorf("%s - failed to listen: %s", name, err)
+	}
+	line, err := bridgeLine(f, ln.Addr().String())
+	if err != nil {
+		closeHandler(h)
+		ln.Close()
+		return nil, "", fmt.Errorf("%s - %s", name, err)
+	}
+	l := newProxyListener(name, roleServer, s.ListenAddr, ln, h, nil)
+
+	log.Infof("%s - registered listener: %s", name, log.ElideAddr(ln.Addr().String()))
+
+	return l, line, nil
+}
+
+// standaloneServerHandler returns the factory and handler of an unmanaged
+// server listener.  The backend health checks are started, and stop when
+// the handler is closed.
+func standaloneServerHandler(cfg *config, s *serverConfig) (base.ServerFactory, *listenerHandler, error) {
+	name := s.Transport
+	options := cfg.serverOptions(name, mapToArgs(s.Options))
+	f, err := transports.Get(name).ServerFactory(stateDir, &options)
+	if err != nil {
+		return nil, nil, fmt.Errorf("%s - failed to get ServerFactory: %s", name, err)
+	}
+
+	var upstream serverUpstream
+	var pool *backendPool
+	if s.Exit {
+		rules := exitproxy.DefaultPolicy
+		if len(s.ExitPolicy) > 0 {
+			rules = s.ExitPolicy
+		}
+		policy, err := exitproxy.ParsePolicy(rules)
+		if err != nil {
+			return nil, nil, fmt.Errorf("%s - %s", name, err)
+		}
+		upstream = exitUpstream(policy, []byte(s.ExitSecret))
+	} else {
+		if pool, err = newBackendPool(s.Backends); err != nil {
+			return nil, nil, fmt.Errorf("%s - %s", name, err)
+		}
+		upstream = backendUpstream(pool)
+	}
+
+	h := newServerHandler(f, upstream, cfg.serverLimits(name, s))
+	h.bandwidth = cfg.bandwidth(name, s.Bandwidth)
+	if pool != nil {
+		if s.HealthInterval.Duration > 0 {
+			go pool.healthCheck(s.HealthInterval.Duration)
+		}
+		h.onClose = pool.close
+	}
+	return f, h, nil
+}
+
+// closeHandler cleans up after a handler that is not used.
+func closeHandler(h *listenerHandler) {
+	if h.onClose != nil {
+		h.onClose()
+	}
+}
+
+// standaloneReload applies a reloaded configuration to the unmanaged
+// listeners.  Listeners that are still configured keep their sockets, and
+// hand new connections to the new settings, the others are closed.  Every
+// listener is set up before any is changed, so that a failed reload leaves
+// them as they were.
+func standaloneReload(cfg *config) (err error) {
+	type reloaded struct {
+		transport string
+		role      string
+		bindAddr  string
+		h         *listenerHandler
+
+		// l is the listener being kept, or ln the new listener's socket.
+		l  *proxyListener
+		ln net.Listener
+	}
+	var updates []*reloaded
+	defer func() {
+		if err == nil {
+			return
+		}
+		for _, u := range updates {
+			closeHandler(u.h)
+			if u.ln != nil {
+				u.ln.Close()
+			}
+		}
+	}()
+
+	previous := proxyListeners()
+	current := make(map[string]*proxyListener)
+	for _, l := range previous {
+		if !l.isClosed() {
+			current[l.bindAddr] = l
+		}
+	}
+	prepare := func(transport, role, bindAddr string, h *listenerHandler) (*reloaded, error) {
+		u := &reloaded{transport: transport, role: role, bindAddr: bindAddr, h: h, l: current[bindAddr]}
+		updates = append(updates, u)
+		if u.l != nil {
+			if u.l.transport != transport {
+				return nil, fmt.Errorf("%s - a reload can not change the transport on %s", transport, bindAddr)
+			}
+			delete(current, bindAddr)
+			return u, nil
+		}
+		var err error
+		if u.ln, err = listen(bindAddr, h.socketMode); err != nil {
+			return nil, fmt.Errorf("%s - failed to listen: %s", transport, err)
+		}
+		return u, nil
+	}
+
+	for i, c := range cfg.Clients {
+		name, h, err := standaloneClientHandler(cfg, c)
+		if err == nil {
+			_, err = prepare(name, roleClient, c.ListenAddr, h)
+		}
+		if err != nil {
+			return fmt.Errorf("clients[%d]: %s", i, err)
+		}
+	}
+	var lines []string
+	for i, s := range cfg.Servers {
+		f, h, err := standaloneServerHandler(cfg, s)
+		var u *reloaded
+		if err == nil {
+			u, err = prepare(s.Transport, roleServer, s.ListenAddr, h)
+		}
+		if err == nil {
+			var addr string
+			if u.l != nil {
+				addr = u.l.addr
+			} else {
+				addr = u.ln.Addr().String()
+			}
+			var line string
+			line, err = bridgeLine(f, addr)
+			lines = append(lines, line)
+		}
+		if err != nil {
+			return fmt.Errorf("servers[%d]: %s", i, err)
+		}
+	}
+
+	for _, u := range updates {
+		if u.l != nil {
+			u.l.replace(u.h)
+			log.Infof("%s - reloaded listener: %s", u.transport, u.l.logAddr())
+			continue
+		}
+		l := newProxyListener(u.transport, u.role, u.bindAddr, u.ln, u.h, nil)
+		log.Infof("%s - registered listener: %s", u.transport, l.logAddr())
+	}
+	for _, l := range previous {
+		if current[l.bindAddr] == l {
+			l.close()
+			log.Infof("%s - closed listener: %s", l.transport, l.logAddr())
+		}
+	}
+	if len(lines) > 0 {
+		if werr := writeStandaloneBridgeFile(lines); werr != nil {
+			log.Errorf("failed to write the bridge lines: %s", werr)
+		}
+	}
+	return nil
+}
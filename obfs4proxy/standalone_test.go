@@ -0,0 +1,70 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestExitSecret(t *testing.T) {
+	dir, err := ioutil.TempDir("", "obfs4proxy")
+	if err != nil {
+		t.Fatalf("TempDir failed: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	secretFile := filepath.Join(dir, "secret")
+	if err = ioutil.WriteFile(secretFile, []byte("0123456789abcdef\n"), 0600); err != nil {
+		t.Fatalf("WriteFile failed: %s", err)
+	}
+	shortFile := filepath.Join(dir, "short")
+	if err = ioutil.WriteFile(shortFile, []byte("0123456789\n"), 0600); err != nil {
+		t.Fatalf("WriteFile failed: %s", err)
+	}
+
+	for _, v := range []struct {
+		secret, file string
+		ok           bool
+	}{
+		{"0123456789abcdef", "", true},
+		{"", secretFile, true},
+		{"", "", false},
+		{"0123456789", "", false},
+		{"", shortFile, false},
+		{"", filepath.Join(dir, "missing"), false},
+		{"0123456789abcdef", secretFile, false},
+	} {
+		secret, err := loadExitSecret(v.secret, v.file)
+		if !v.ok {
+			if err == nil {
+				t.Errorf("loadExitSecret(%q, %q) succeeded", v.secret, v.file)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("loadExitSecret(%q, %q) failed: %s", v.secret, v.file, err)
+		} else if secret != "0123456789abcdef" {
+			t.Errorf("loadExitSecret(%q, %q) = %q", v.secret, v.file, secret)
+		}
+	}
+
+	// Exit servers and clients require a secret.
+	s := &serverConfig{Transport: "obfs4", ListenAddr: "127.0.0.1:0", Exit: true}
+	if err = s.validate(); err == nil {
+		t.Errorf("an exit server without a secret is valid")
+	}
+	s.ExitSecretFile = secretFile
+	if err = s.validate(); err != nil {
+		t.Errorf("an exit server with a secret file is invalid: %s", err)
+	} else if s.ExitSecret != "0123456789abcdef" {
+		t.Errorf("the exit server secret was not loaded")
+	}
+	c := &clientConfig{Bridge: "obfs4 192.0.2.1:443 cert=" + testCert + " iat-mode=0", Exit: true}
+	if err = c.validate(); err == nil {
+		t.Errorf("an exit client without a secret is valid")
+	}
+	c.ExitSecret = "0123456789abcdef"
+	if err = c.validate(); err != nil {
+		t.Errorf("an exit client with a secret is invalid: %s", err)
+	}
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"time"
+
+	"github.com/RACECAR-GU/obfsX/common/ratelimit"
+)
+
+// The stdio mode relays stdin and stdout to a fixed bridge, for a single
+// session, so that obfs4proxy can be used as eg: an SSH ProxyCommand.
+
+// stdioAddr is the address of both ends of a stdioConn.
+type stdioAddr struct{}
+
+func (stdioAddr) Network() string { return "stdio" }
+func (stdioAddr) String() string  { return "stdio" }
+
+// stdioConn is a net.Conn over a pair of streams.  The streams are relayed
+// through pipes, which provide the deadlines and half-closes that the
+// handlers rely on.
+type stdioConn struct {
+	r net.Conn
+	w net.Conn
+}
+
+// newStdioConn returns a net.Conn that reads from in, and writes to out.
+// out is closed when the write side is.
+func newStdioConn(in io.Reader, out io.WriteCloser) net.Conn {
+	r, inPipe := net.Pipe()
+	w, outPipe := net.Pipe()
+	go func() {
+		_, _ = io.Copy(inPipe, in)
+		inPipe.Close()
+	}()
+	go func() {
+		_, _ = io.Copy(out, outPipe)
+		outPipe.Close()
+		out.Close()
+	}()
+	return &stdioConn{r: r, w: w}
+}
+
+func (c *stdioConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+func (c *stdioConn) Write(b []byte) (int, error) {
+	return c.w.Write(b)
+}
+
+// CloseWrite closes out, once everything written was copied to it.
+func (c *stdioConn) CloseWrite() error {
+	return c.w.Close()
+}
+
+func (c *stdioConn) Close() error {
+	c.r.Close()
+	return c.w.Close()
+}
+
+func (c *stdioConn) LocalAddr() net.Addr {
+	return stdioAddr{}
+}
+
+func (c *stdioConn) RemoteAddr() net.Addr {
+	return stdioAddr{}
+}
+
+func (c *stdioConn) SetDeadline(t time.Time) error {
+	if err := c.SetReadDeadline(t); err != nil {
+		return err
+	}
+	return c.SetWriteDeadline(t)
+}
+
+func (c *stdioConn) SetReadDeadline(t time.Time) error {
+	return pipeDeadlineError(c.r.SetReadDeadline(t))
+}
+
+func (c *stdioConn) SetWriteDeadline(t time.Time) error {
+	return pipeDeadlineError(c.w.SetWriteDeadline(t))
+}
+
+// pipeDeadlineError ignores the error of setting the deadline of a pipe that
+// was closed at either end (eg: at EOF), unlike a half-closed socket's.
+func pipeDeadlineError(err error) error {
+	if err == io.ErrClosedPipe {
+		return nil
+	}
+	return err
+}
+
+// stdioClient relays in and out (stdin and stdout) to the bridge of the stdio
+// mode client, returning once the session is closed, or the error if it could
+// not be set up (eg: the bridge can not be reached).
+func stdioClient(cfg *config, in io.Reader, out io.WriteCloser) error {
+	c := cfg.Clients[0]
+	name, f, cl, err := standaloneClient(cfg, c)
+	if err != nil {
+		return err
+	}
+
+	conn := newStdioConn(in, out)
+	if bandwidth := cfg.bandwidth(name, c.Bandwidth); bandwidth != nil {
+		l, err := ratelimit.New(*bandwidth, transportStats(name).throttled)
+		if err != nil {
+			return fmt.Errorf("%s - invalid bandwidth limits: %s", name, err)
+		}
+		conn = l.Wrap(conn)
+	}
+	if err = clientHandler(f, conn, nil, cl); err != nil {
+		return fmt.Errorf("%s - %s", name, err)
+	}
+	return nil
+}
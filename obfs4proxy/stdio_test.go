@@ -0,0 +1,82 @@
+package main
+
+import (
+	"io"
+	"io/ioutil"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestStdioConn(t *testing.T) {
+	stdinR, stdinW := io.Pipe()
+	stdoutR, stdoutW := io.Pipe()
+	conn := newStdioConn(stdinR, stdoutW)
+	defer conn.Close()
+
+	// stdin is read from the connection, until EOF.
+	go func() {
+		_, _ = stdinW.Write([]byte("request"))
+		stdinW.Close()
+	}()
+	b, err := ioutil.ReadAll(conn)
+	if err != nil {
+		t.Fatalf("ReadAll failed: %s", err)
+	}
+	if string(b) != "request" {
+		t.Fatalf("read %q, expected %q", b, "request")
+	}
+
+	// Writes go to stdout, which CloseWrite closes once they were copied,
+	// while the connection can still be used.
+	done := make(chan []byte)
+	go func() {
+		b, _ := ioutil.ReadAll(stdoutR)
+		done <- b
+	}()
+	if _, err = conn.Write([]byte("response")); err != nil {
+		t.Fatalf("Write failed: %s", err)
+	}
+	if err = conn.(interface{ CloseWrite() error }).CloseWrite(); err != nil {
+		t.Fatalf("CloseWrite failed: %s", err)
+	}
+	select {
+	case b = <-done:
+		if string(b) != "response" {
+			t.Fatalf("wrote %q, expected %q", b, "response")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("CloseWrite did not close stdout")
+	}
+	if _, err = conn.Write([]byte("x")); err == nil {
+		t.Errorf("Write after CloseWrite succeeded")
+	}
+
+	// The deadlines can still be set once half-closed, like a socket's.
+	if err = conn.SetDeadline(time.Now().Add(time.Second)); err != nil {
+		t.Errorf("SetDeadline failed: %s", err)
+	}
+	if addr := conn.RemoteAddr().String(); addr != "stdio" {
+		t.Errorf("RemoteAddr is %s", addr)
+	}
+}
+
+func TestStdioClientError(t *testing.T) {
+	stdinR, stdinW := io.Pipe()
+	defer stdinW.Close()
+	_, stdoutW := io.Pipe()
+
+	saved := termMon
+	defer func() { termMon = saved }()
+	termMon = &termMonitor{handlerChan: make(chan int, 2)}
+
+	// A bridge that can not be reached fails the session.
+	addr := freeAddr(t)
+	cfg := &config{
+		Mode:    modeStdio,
+		Clients: []*clientConfig{{Bridge: strings.Replace(testBridge, "192.0.2.1:443", addr, 1), Forward: true}},
+	}
+	if err := stdioClient(cfg, stdinR, stdoutW); err == nil || !strings.Contains(err.Error(), "outgoing connection failed") {
+		t.Fatalf("stdioClient: %v, expected the connection to fail", err)
+	}
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"net"
+	"sync"
+
+	"github.com/RACECAR-GU/obfsX/common/log"
+	"github.com/RACECAR-GU/obfsX/common/systemd"
+)
+
+// activated holds the listening sockets passed by the service manager (eg:
+// a systemd socket unit), until the server listeners claim them.
+var activated struct {
+	sync.Mutex
+	lns []systemd.Listener
+}
+
+// initActivation takes the sockets passed by the service manager, if any.
+func initActivation() error {
+	lns, err := systemd.Listeners()
+	if err != nil {
+		return err
+	}
+	for _, ln := range lns {
+		log.Infof("received socket '%s' from the service manager: %s", ln.Name, log.ElideAddr(ln.Addr().String()))
+	}
+
+	activated.Lock()
+	defer activated.Unlock()
+	activated.lns = lns
+	return nil
+}
+
+// listenTCP returns the activated socket for the transport's listener on
+// addr, matching the address, or failing that, named after the transport.
+// Otherwise it listens on addr.
+func listenTCP(name, addr string) (net.Listener, error) {
+	activated.Lock()
+	defer activated.Unlock()
+
+	want, err := net.ResolveTCPAddr("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	claim := func(match func(ln systemd.Listener) bool) net.Listener {
+		for i, ln := range activated.lns {
+			if match(ln) {
+				activated.lns = append(activated.lns[:i], activated.lns[i+1:]...)
+				log.Infof("%s - using the socket '%s' from the service manager", name, ln.Name)
+				return ln.Listener
+			}
+		}
+		return nil
+	}
+	if ln := claim(func(ln systemd.Listener) bool { return sameTCPAddr(ln.Addr(), want) }); ln != nil {
+		return ln, nil
+	}
+	if ln := claim(func(ln systemd.Listener) bool { return ln.Name == name }); ln != nil {
+		return ln, nil
+	}
+	return net.Listen("tcp", addr)
+}
+
+// sameTCPAddr returns if the listener address a is b.  The IPv4 and IPv6
+// wildcard addresses are the same, as systemd binds the latter to listen on
+// both.
+func sameTCPAddr(a net.Addr, b *net.TCPAddr) bool {
+	ta, ok := a.(*net.TCPAddr)
+	if !ok || ta.Port != b.Port {
+		return false
+	}
+	return ta.IP.Equal(b.IP) || (ta.IP.IsUnspecified() && (b.IP == nil || b.IP.IsUnspecified()))
+}
+
+// closeUnclaimed closes the activated sockets that no listener claimed.
+func closeUnclaimed() {
+	activated.Lock()
+	defer activated.Unlock()
+	for _, ln := range activated.lns {
+		log.Warnf("closing the unused socket '%s' from the service manager: %s", ln.Name, log.ElideAddr(ln.Addr().String()))
+		ln.Close()
+	}
+	activated.lns = nil
+}
+
+// sdNotify sends the state to the service manager, if it is listening for
+// notifications.
+func sdNotify(state string) {
+	if _, err := systemd.Notify(state); err != nil {
+		log.Warnf("failed to notify the service manager: %s", err)
+	}
+}
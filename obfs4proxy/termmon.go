@@ -37,6 +37,7 @@ import (
 	"time"
 
 	"github.com/RACECAR-GU/obfsX/common/log"
+	"github.com/RACECAR-GU/obfsX/common/systemd"
 )
 
 var termMonitorOSInit func(*termMonitor) error
@@ -45,33 +46,79 @@ type termMonitor struct {
 	sigChan     chan os.Signal
 	handlerChan chan int
 	numHandlers int
+
+	// onReload, if set, is called (in a new goroutine) on SIGHUP.
+	onReload func()
+
+	// watchdog ticks when the service manager's watchdog is due a ping,
+	// and stopping is set once the service manager was told of the
+	// shutdown.
+	watchdog <-chan time.Time
+	stopping bool
 }
 
-func (m *termMonitor) onHandlerStart() {
+func (m *termMonitor) onHandlerStart(name string) {
+	transportStats(name).active.Add(1)
 	m.handlerChan <- 1
 }
 
-func (m *termMonitor) onHandlerFinish() {
+func (m *termMonitor) onHandlerFinish(name string) {
+	transportStats(name).active.Add(-1)
 	m.handlerChan <- -1
 }
 
 func (m *termMonitor) wait(termOnNoHandlers bool) os.Signal {
 	// Block until a signal has been received, or (optionally) the
 	// number of pending handlers has hit 0.  In the case of the
-	// latter, treat it as if a SIGTERM has been received.
+	// latter, treat it as if a SIGTERM has been received.  SIGHUP
+	// reloads the configuration, without returning, if there is a
+	// reload handler.
 	for {
+		if termOnNoHandlers && m.numHandlers == 0 {
+			m.notifyStopping()
+			return syscall.SIGTERM
+		}
 		select {
 		case n := <-m.handlerChan:
 			m.numHandlers += n
+		case <-m.watchdog:
+			sdNotify(systemd.Watchdog)
 		case sig := <-m.sigChan:
-			return sig
-		}
-		if termOnNoHandlers && m.numHandlers == 0 {
-			return syscall.SIGTERM
+			if sig != syscall.SIGHUP || m.onReload == nil {
+				m.notifyStopping()
+				return sig
+			}
+			sdNotify(systemd.Reloading)
+			go func() {
+				m.onReload()
+				sdNotify(systemd.Ready)
+			}()
 		}
 	}
 }
 
+// notifyStopping tells the service manager that the shutdown started, once.
+func (m *termMonitor) notifyStopping() {
+	if !m.stopping {
+		m.stopping = true
+		sdNotify(systemd.Stopping)
+	}
+}
+
+// startWatchdog starts pinging the service manager's watchdog, if it is
+// enabled, from wait, so that the pings stop if it is stuck.
+func (m *termMonitor) startWatchdog() {
+	interval, err := systemd.WatchdogInterval()
+	if err != nil {
+		log.Warnf("failed to get the watchdog interval: %s", err)
+		return
+	}
+	if interval > 0 {
+		m.watchdog = time.NewTicker(interval / 2).C
+		log.Infof("pinging the service manager's watchdog every %s", interval/2)
+	}
+}
+
 func (m *termMonitor) termOnStdinClose() {
 	_, err := io.Copy(ioutil.Discard, os.Stdin)
 
@@ -103,12 +150,16 @@ func (m *termMonitor) termOnPPIDChange(ppid int) {
 	m.sigChan <- syscall.SIGTERM
 }
 
-func newTermMonitor() (m *termMonitor) {
+func newTermMonitor(isManaged bool) (m *termMonitor) {
 	ppid := os.Getppid()
 	m = new(termMonitor)
 	m.sigChan = make(chan os.Signal)
 	m.handlerChan = make(chan int)
-	signal.Notify(m.sigChan, syscall.SIGINT, syscall.SIGTERM)
+	signal.Notify(m.sigChan, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
+	if !isManaged {
+		// Unmanaged instances are not tied to their parent.
+		return
+	}
 
 	// If tor supports feature #15435, we can use Stdin being closed as an
 	// indication that tor has died, or wants the PT to shutdown for any
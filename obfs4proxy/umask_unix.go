@@ -0,0 +1,23 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"sync"
+	"syscall"
+)
+
+var umaskLock sync.Mutex
+
+// restrictUmask makes the files created until the returned function is
+// called only accessible by the user, so that a Unix socket is not
+// accessible by the others until its mode is set.
+func restrictUmask() func() {
+	umaskLock.Lock()
+	old := syscall.Umask(0177)
+	return func() {
+		syscall.Umask(old)
+		umaskLock.Unlock()
+	}
+}
@@ -0,0 +1,6 @@
+package main
+
+// restrictUmask does nothing, as Windows does not have a umask.
+func restrictUmask() func() {
+	return func() {}
+}
@@ -0,0 +1,104 @@
+package obfsx
+
+import (
+	"encoding/hex"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+
+	"git.torproject.org/pluggable-transports/goptlib.git"
+)
+
+const (
+	bridgeKeyword     = "Bridge"
+	fingerprintLength = 40
+)
+
+// Bridge is a parsed bridge line, as found in a torrc or a server's
+// obfs4_bridgeline.txt:
+//
+//	[Bridge] <transport> <host:port> [fingerprint] [key=value ...]
+type Bridge struct {
+	// Transport is the name of the pluggable transport (eg: "obfs4").
+	Transport string
+
+	// Address is the host:port of the bridge.
+	Address string
+
+	// Fingerprint is the optional Tor relay fingerprint of the bridge.  It is
+	// not used by the transports, but is preserved for round-tripping.
+	Fingerprint string
+
+	// Args are the transport specific arguments (eg: "cert", "iat-mode").
+	Args pt.Args
+}
+
+// ParseBridgeLine parses a bridge line.  The leading "Bridge" keyword is
+// optional, as is the fingerprint.
+func ParseBridgeLine(line string) (*Bridge, error) {
+	fields := strings.Fields(line)
+	if len(fields) > 0 && strings.EqualFold(fields[0], bridgeKeyword) {
+		fields = fields[1:]
+	}
+	if len(fields) < 2 {
+		return nil, fmt.Errorf("bridge line is missing the transport or address")
+	}
+
+	b := &Bridge{
+		Transport: fields[0],
+		Address:   fields[1],
+		Args:      make(pt.Args),
+	}
+	if strings.Contains(b.Transport, "=") {
+		return nil, fmt.Errorf("bridge line is missing the transport")
+	}
+	if _, _, err := net.SplitHostPort(b.Address); err != nil {
+		return nil, fmt.Errorf("bridge line has an invalid address: %s", err)
+	}
+	fields = fields[2:]
+
+	if len(fields) > 0 && !strings.Contains(fields[0], "=") {
+		fp := strings.TrimPrefix(fields[0], "$")
+		if len(fp) != fingerprintLength {
+			return nil, fmt.Errorf("bridge line has an invalid fingerprint '%s'", fields[0])
+		}
+		if _, err := hex.DecodeString(fp); err != nil {
+			return nil, fmt.Errorf("bridge line has an invalid fingerprint '%s'", fields[0])
+		}
+		b.Fingerprint = strings.ToUpper(fp)
+		fields = fields[1:]
+	}
+
+	for _, kv := range fields {
+		idx := strings.IndexByte(kv, '=')
+		if idx <= 0 {
+			return nil, fmt.Errorf("bridge line has a malformed argument '%s'", kv)
+		}
+		b.Args.Add(kv[:idx], kv[idx+1:])
+	}
+
+	return b, nil
+}
+
+// String returns the bridge line representation of the Bridge, without the
+// leading "Bridge" keyword.
+func (b *Bridge) String() string {
+	parts := []string{b.Transport, b.Address}
+	if b.Fingerprint != "" {
+		parts = append(parts, b.Fingerprint)
+	}
+
+	keys := make([]string, 0, len(b.Args))
+	for k := range b.Args {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		for _, v := range b.Args[k] {
+			parts = append(parts, k+"="+v)
+		}
+	}
+
+	return strings.Join(parts, " ")
+}
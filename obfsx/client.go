@@ -0,0 +1,92 @@
+package obfsx
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/url"
+
+	"github.com/RACECAR-GU/obfsX/transports/base"
+)
+
+// ClientConfig is the configuration for a Dialer.
+type ClientConfig struct {
+	// Bridge is the bridge to connect to.
+	Bridge Bridge
+
+	// StateDir is the directory used by transports that persist client
+	// state.  It MAY be empty for the integrated transports.
+	StateDir string
+
+	// ProxyURL is the optional upstream proxy to connect to the bridge
+	// through, with the "http", "socks4a" or "socks5" scheme.
+	ProxyURL *url.URL
+
+	// NetDialer is the template for the dialer used to reach the bridge (or
+	// upstream proxy), and can be used to set timeouts, the local address and
+	// the like.  Transports MAY install their own Control hook.
+	NetDialer net.Dialer
+}
+
+// Dialer establishes obfuscated connections to a single bridge.  It is safe
+// for concurrent use.
+type Dialer struct {
+	cfg     ClientConfig
+	factory base.ClientFactory
+}
+
+// NewDialer returns a Dialer for the provided configuration.  The bridge
+// arguments are validated here, so that configuration errors are caught
+// before the first connection attempt.
+func NewDialer(cfg *ClientConfig) (*Dialer, error) {
+	t, err := getTransport(cfg.Bridge.Transport)
+	if err != nil {
+		return nil, err
+	}
+	if cfg.Bridge.Address == "" {
+		return nil, fmt.Errorf("obfsx: no bridge address specified")
+	}
+	f, err := t.ClientFactory(cfg.StateDir)
+	if err != nil {
+		return nil, err
+	}
+	if _, err = f.ParseArgs(&cfg.Bridge.Args); err != nil {
+		return nil, fmt.Errorf("obfsx: invalid %s bridge arguments: %s", t.Name(), err)
+	}
+
+	return &Dialer{cfg: *cfg, factory: f}, nil
+}
+
+// NewDialerFromBridgeLine returns a Dialer for the bridge line, with the
+// default configuration for everything else.
+func NewDialerFromBridgeLine(line string) (*Dialer, error) {
+	b, err := ParseBridgeLine(line)
+	if err != nil {
+		return nil, err
+	}
+	return NewDialer(&ClientConfig{Bridge: *b})
+}
+
+// Bridge returns the bridge that the Dialer connects to.
+func (d *Dialer) Bridge() Bridge {
+	return d.cfg.Bridge
+}
+
+// Dial connects to the bridge, and completes the transport handshake.
+func (d *Dialer) Dial() (net.Conn, error) {
+	return d.DialContext(context.Background())
+}
+
+// DialContext connects to the bridge, and completes the transport handshake,
+// using the provided context.  The context bounds the connection setup, but
+// not the lifetime of the returned net.Conn.
+func (d *Dialer) DialContext(ctx context.Context) (net.Conn, error) {
+	// The arguments are parsed per connection, as the transports generate
+	// session keys here.
+	args, err := d.factory.ParseArgs(&d.cfg.Bridge.Args)
+	if err != nil {
+		return nil, err
+	}
+	dialer := base.Dialer{Dialer: d.cfg.NetDialer, ProxyURI: d.cfg.ProxyURL}
+	return d.factory.DialContext(ctx, "tcp", d.cfg.Bridge.Address, dialer, args)
+}
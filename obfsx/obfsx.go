@@ -0,0 +1,59 @@
+// Package obfsx provides a Go API for embedding the obfsX pluggable
+// transports (obfs4, obfs5) in applications, without going through the Tor
+// managed transport protocol or obfs4proxy.
+//
+// A client only needs the bridge line that the server wrote to its state
+// directory:
+//
+//	d, err := obfsx.NewDialerFromBridgeLine("obfs5 192.0.2.1:443 cert=... iat-mode=0")
+//	if err != nil {
+//		// Handle the invalid bridge line.
+//	}
+//	conn, err := d.Dial()
+//
+// A server listens with a persistent state directory, and hands out the
+// resulting bridge line:
+//
+//	ln, err := obfsx.Listen(&obfsx.ServerConfig{
+//		Transport:     "obfs5",
+//		ListenAddress: "0.0.0.0:443",
+//		StateDir:      "/var/lib/obfsx",
+//	})
+//	if err != nil {
+//		// Handle the error.
+//	}
+//	log.Printf("bridge line: %s", ln.Bridge().String())
+//	for {
+//		conn, err := ln.Accept()
+//		...
+//	}
+//
+// Hosts written against the Pluggable Transports 2.1 Go API can use
+// NewClientTransport and NewServerTransport instead.
+package obfsx // import "github.com/RACECAR-GU/obfsX/obfsx"
+
+import (
+	"fmt"
+
+	"github.com/RACECAR-GU/obfsX/transports"
+	"github.com/RACECAR-GU/obfsX/transports/base"
+)
+
+// Transports returns the names of the supported transports.
+func Transports() []string {
+	if err := transports.Init(); err != nil {
+		return nil
+	}
+	return transports.Transports()
+}
+
+func getTransport(name string) (base.Transport, error) {
+	if err := transports.Init(); err != nil {
+		return nil, err
+	}
+	t := transports.Get(name)
+	if t == nil {
+		return nil, fmt.Errorf("obfsx: no such transport is supported: '%s'", name)
+	}
+	return t, nil
+}
@@ -0,0 +1,177 @@
+package obfsx
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestParseBridgeLine(t *testing.T) {
+	const cert = "ssH+9rP8dG2NLDN2XuFw63hIO/9MNNinLmxQDpVa+7kTOa9/m+tGWT1SmSYpQ9uTBGa6Hw"
+	const fp = "0123456789ABCDEF0123456789ABCDEF01234567"
+
+	vectors := []struct {
+		line  string
+		valid bool
+		fp    string
+	}{
+		{"Bridge obfs4 192.0.2.1:443 " + fp + " cert=" + cert + " iat-mode=0", true, fp},
+		{"obfs4 192.0.2.1:443 cert=" + cert + " iat-mode=0", true, ""},
+		{"obfs5 [2001:db8::1]:443 $" + fp + " cert=" + cert + " iat-mode=1", true, fp},
+		{"obfs4 192.0.2.1 cert=" + cert, false, ""},
+		{"obfs4", false, ""},
+		{"cert=" + cert + " 192.0.2.1:443", false, ""},
+		{"obfs4 192.0.2.1:443 DEADBEEF cert=" + cert, false, ""},
+		{"obfs4 192.0.2.1:443 cert=" + cert + " =0", false, ""},
+	}
+
+	for _, v := range vectors {
+		b, err := ParseBridgeLine(v.line)
+		if !v.valid {
+			if err == nil {
+				t.Errorf("ParseBridgeLine(%q) succeeded for an invalid line", v.line)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("ParseBridgeLine(%q) failed: %s", v.line, err)
+			continue
+		}
+		if b.Fingerprint != v.fp {
+			t.Errorf("ParseBridgeLine(%q) fingerprint: %q != %q", v.line, b.Fingerprint, v.fp)
+		}
+		if c, _ := b.Args.Get("cert"); c != cert {
+			t.Errorf("ParseBridgeLine(%q) cert: %q != %q", v.line, c, cert)
+		}
+
+		// Round trip.
+		b2, err := ParseBridgeLine(b.String())
+		if err != nil {
+			t.Errorf("ParseBridgeLine(%q) failed to round trip: %s", b.String(), err)
+		} else if b2.String() != b.String() {
+			t.Errorf("round trip mismatch: %q != %q", b2.String(), b.String())
+		}
+	}
+}
+
+func TestDialListen(t *testing.T) {
+	for _, name := range Transports() {
+		stateDir, err := ioutil.TempDir("", "obfsx-"+name)
+		if err != nil {
+			t.Fatalf("failed to create state dir: %s", err)
+		}
+		defer os.RemoveAll(stateDir)
+
+		ln, err := Listen(&ServerConfig{
+			Transport:     name,
+			ListenAddress: "127.0.0.1:0",
+			StateDir:      stateDir,
+		})
+		if err != nil {
+			t.Fatalf("%s: Listen() failed: %s", name, err)
+		}
+		defer ln.Close()
+		go func() {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+			_, _ = io.Copy(conn, conn)
+		}()
+
+		bridge := ln.Bridge()
+		d, err := NewDialerFromBridgeLine("Bridge " + bridge.String())
+		if err != nil {
+			t.Fatalf("%s: NewDialerFromBridgeLine() failed: %s", name, err)
+		}
+		conn, err := d.Dial()
+		if err != nil {
+			t.Fatalf("%s: Dial() failed: %s", name, err)
+		}
+		msg := []byte("Hello, world!")
+		if _, err = conn.Write(msg); err != nil {
+			t.Fatalf("%s: Write() failed: %s", name, err)
+		}
+		buf := make([]byte, len(msg))
+		if _, err = io.ReadFull(conn, buf); err != nil {
+			t.Fatalf("%s: Read() failed: %s", name, err)
+		}
+		conn.Close()
+		if !bytes.Equal(buf, msg) {
+			t.Fatalf("%s: echo mismatch: %q != %q", name, buf, msg)
+		}
+	}
+
+	if _, err := NewDialerFromBridgeLine("obfs4 192.0.2.1:443 iat-mode=0"); err == nil {
+		t.Fatalf("NewDialerFromBridgeLine() accepted a bridge line without a cert")
+	}
+	if _, err := NewDialerFromBridgeLine("bogus 192.0.2.1:443"); err == nil {
+		t.Fatalf("NewDialerFromBridgeLine() accepted an unknown transport")
+	}
+}
+
+func TestPT2Transport(t *testing.T) {
+	stateDir, err := ioutil.TempDir("", "obfsx-pt2")
+	if err != nil {
+		t.Fatalf("failed to create state dir: %s", err)
+	}
+	defer os.RemoveAll(stateDir)
+
+	st, err := NewServerTransport("obfs4", "127.0.0.1:0", stateDir, map[string]interface{}{"iat-mode": 0})
+	if err != nil {
+		t.Fatalf("NewServerTransport() failed: %s", err)
+	}
+	if _, err = st.Dial(); err == nil {
+		t.Fatalf("server Transport Dial() succeeded")
+	}
+	ln, err := st.Listen()
+	if err != nil {
+		t.Fatalf("Listen() failed: %s", err)
+	}
+	defer ln.Close()
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		_, _ = io.Copy(conn, conn)
+	}()
+
+	// Options as decoded from JSON.
+	bridge := ln.(*Listener).Bridge()
+	cert, _ := bridge.Args.Get("cert")
+	ct, err := NewClientTransport("obfs4", ln.Addr().String(), map[string]interface{}{
+		"cert":     cert,
+		"iat-mode": float64(0),
+	})
+	if err != nil {
+		t.Fatalf("NewClientTransport() failed: %s", err)
+	}
+	if _, err = ct.Listen(); err == nil {
+		t.Fatalf("client Transport Listen() succeeded")
+	}
+	conn, err := ct.Dial()
+	if err != nil {
+		t.Fatalf("Dial() failed: %s", err)
+	}
+	defer conn.Close()
+	msg := []byte("Hello, world!")
+	if _, err = conn.Write(msg); err != nil {
+		t.Fatalf("Write() failed: %s", err)
+	}
+	buf := make([]byte, len(msg))
+	if _, err = io.ReadFull(conn, buf); err != nil {
+		t.Fatalf("Read() failed: %s", err)
+	}
+	if !bytes.Equal(buf, msg) {
+		t.Fatalf("echo mismatch: %q != %q", buf, msg)
+	}
+
+	if _, err = NewClientTransport("obfs4", "127.0.0.1:1", map[string]interface{}{"cert": []int{1}}); err == nil {
+		t.Fatalf("NewClientTransport() accepted an unsupported option type")
+	}
+}
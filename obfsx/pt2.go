@@ -0,0 +1,144 @@
+package obfsx
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+
+	"git.torproject.org/pluggable-transports/goptlib.git"
+)
+
+// Transport is the transport interface from the Pluggable Transports 2.1 Go
+// API.  A client Transport only supports Dial, and a server Transport only
+// supports Listen.
+type Transport interface {
+	// Dial connects to the transport server, and returns the connection
+	// after the transport handshake has completed.
+	Dial() (net.Conn, error)
+
+	// Listen returns a net.Listener that accepts transport connections.
+	Listen() (net.Listener, error)
+}
+
+var (
+	errClientListen = errors.New("obfsx: client transports can not listen")
+	errServerDial   = errors.New("obfsx: server transports can not dial")
+)
+
+type clientTransport struct {
+	d *Dialer
+}
+
+func (t *clientTransport) Dial() (net.Conn, error) {
+	return t.d.Dial()
+}
+
+func (t *clientTransport) Listen() (net.Listener, error) {
+	return nil, errClientListen
+}
+
+type serverTransport struct {
+	cfg ServerConfig
+}
+
+func (t *serverTransport) Dial() (net.Conn, error) {
+	return nil, errServerDial
+}
+
+func (t *serverTransport) Listen() (net.Listener, error) {
+	return Listen(&t.cfg)
+}
+
+// NewClientTransport returns a PT 2.1 client Transport for the named transport
+// that connects to the server at address.  The options are the transport
+// specific bridge arguments (eg: "cert", "iat-mode").
+func NewClientTransport(transport, address string, options map[string]interface{}) (Transport, error) {
+	args, err := optionsToArgs(options)
+	if err != nil {
+		return nil, err
+	}
+	d, err := NewDialer(&ClientConfig{
+		Bridge: Bridge{
+			Transport: transport,
+			Address:   address,
+			Args:      args,
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &clientTransport{d: d}, nil
+}
+
+// NewServerTransport returns a PT 2.1 server Transport for the named transport
+// that listens on address, with the persistent state in stateDir.  The options
+// are the transport specific server options (eg: "iat-mode").
+func NewServerTransport(transport, address, stateDir string, options map[string]interface{}) (Transport, error) {
+	args, err := optionsToArgs(options)
+	if err != nil {
+		return nil, err
+	}
+	if _, err = getTransport(transport); err != nil {
+		return nil, err
+	}
+	return &serverTransport{
+		cfg: ServerConfig{
+			Transport:     transport,
+			ListenAddress: address,
+			StateDir:      stateDir,
+			Args:          args,
+		},
+	}, nil
+}
+
+// optionsToArgs converts a PT 2.x options map, as decoded from JSON or built
+// by the host application, to the pt.Args the transports expect.
+func optionsToArgs(options map[string]interface{}) (pt.Args, error) {
+	args := make(pt.Args)
+	for k, v := range options {
+		switch vv := v.(type) {
+		case []string:
+			for _, s := range vv {
+				args.Add(k, s)
+			}
+		case []interface{}:
+			for _, e := range vv {
+				s, err := optionToString(k, e)
+				if err != nil {
+					return nil, err
+				}
+				args.Add(k, s)
+			}
+		default:
+			s, err := optionToString(k, v)
+			if err != nil {
+				return nil, err
+			}
+			args.Add(k, s)
+		}
+	}
+	return args, nil
+}
+
+func optionToString(k string, v interface{}) (string, error) {
+	switch vv := v.(type) {
+	case string:
+		return vv, nil
+	case bool:
+		return strconv.FormatBool(vv), nil
+	case int:
+		return strconv.Itoa(vv), nil
+	case int64:
+		return strconv.FormatInt(vv, 10), nil
+	case uint64:
+		return strconv.FormatUint(vv, 10), nil
+	case float64:
+		// JSON numbers decode to float64.
+		return strconv.FormatFloat(vv, 'f', -1, 64), nil
+	case fmt.Stringer:
+		return vv.String(), nil
+	default:
+		return "", fmt.Errorf("obfsx: option '%s' has unsupported type %T", k, v)
+	}
+}
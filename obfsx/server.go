@@ -0,0 +1,79 @@
+package obfsx
+
+import (
+	"fmt"
+	"net"
+
+	"git.torproject.org/pluggable-transports/goptlib.git"
+	"github.com/RACECAR-GU/obfsX/transports/base"
+)
+
+// ServerConfig is the configuration for a Listener.
+type ServerConfig struct {
+	// Transport is the name of the pluggable transport (eg: "obfs4").
+	Transport string
+
+	// ListenAddress is the local host:port to listen on.
+	ListenAddress string
+
+	// StateDir is the directory where the server's identity keys are
+	// persisted (eg: obfs4_state.json), and the bridge line is written.  The
+	// directory must exist, and is required as clients must be able to
+	// reconnect after a restart.
+	StateDir string
+
+	// Args are the optional transport specific server options, equivalent
+	// to tor's ServerTransportOptions (eg: "iat-mode").
+	Args pt.Args
+}
+
+// Listener is a net.Listener that only returns connections that have
+// completed the transport handshake.
+type Listener struct {
+	*base.Listener
+
+	bridge Bridge
+}
+
+// Listen creates a Listener for the provided configuration.
+func Listen(cfg *ServerConfig) (*Listener, error) {
+	t, err := getTransport(cfg.Transport)
+	if err != nil {
+		return nil, err
+	}
+	if cfg.StateDir == "" {
+		return nil, fmt.Errorf("obfsx: no state directory specified")
+	}
+	args := cfg.Args
+	if args == nil {
+		args = make(pt.Args)
+	}
+	f, err := t.ServerFactory(cfg.StateDir, &args)
+	if err != nil {
+		return nil, err
+	}
+
+	ln, err := net.Listen("tcp", cfg.ListenAddress)
+	if err != nil {
+		return nil, err
+	}
+
+	l := &Listener{Listener: base.NewListener(f, ln)}
+	l.bridge.Transport = t.Name()
+	l.bridge.Address = ln.Addr().String()
+	l.bridge.Args = make(pt.Args)
+	if fArgs := f.Args(); fArgs != nil {
+		for k, v := range *fArgs {
+			l.bridge.Args[k] = append([]string(nil), v...)
+		}
+	}
+
+	return l, nil
+}
+
+// Bridge returns the Bridge that clients should use to connect to the
+// Listener.  The Address is the local listen address, and will need to be
+// replaced with the public address if they differ.
+func (l *Listener) Bridge() Bridge {
+	return l.bridge
+}
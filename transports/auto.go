@@ -0,0 +1,363 @@
+package transports
+
+import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"git.torproject.org/pluggable-transports/goptlib.git"
+	"github.com/RACECAR-GU/obfsX/transports/base"
+)
+
+const (
+	autoTransportName = "auto"
+	autoStateFile     = "auto_state.json"
+
+	// The auto specific bridge line arguments: the transports to try, most
+	// preferred first, the address of a transport if it differs from the
+	// bridge line's (eg: "obfs4-addr=192.0.2.1:8443"), how often the
+	// preferred transport is retried once another one is remembered, and
+	// how long an attempt runs before falling back.
+	autoTransportsArg = "transports"
+	autoAddrArgSuffix = "-addr"
+	autoRetryArg      = "retry"
+	autoTimeoutArg    = "timeout"
+
+	defaultAutoRetry   = 30 * time.Minute
+	defaultAutoTimeout = 15 * time.Second
+)
+
+// defaultAutoOrder are the transports that auto tries by default, which are
+// also the ones it can try, as they share the identity keys.
+var defaultAutoOrder = []string{"obfs5", "obfs4"}
+
+// autoTransport is the client only "auto" meta-transport, that tries a list
+// of transports (by default obfs5, then obfs4) against the same bridge
+// identity (cert or node-id and public-key), remembers the one that worked
+// per bridge in the state directory, and periodically retries the preferred
+// one.
+type autoTransport struct{}
+
+// Name returns the name of the auto transport.
+func (t *autoTransport) Name() string {
+	return autoTransportName
+}
+
+// Capabilities returns the capabilities common to the transports that auto
+// can try, as a connection may use any of them.
+func (t *autoTransport) Capabilities() base.Capabilities {
+	var caps base.Capabilities
+	for i, name := range defaultAutoOrder {
+		c := base.GetCapabilities(Get(name))
+		if i == 0 {
+			caps = c
+			continue
+		}
+		caps.DummyTraffic = caps.DummyTraffic && c.DummyTraffic
+		caps.IAT = caps.IAT && c.IAT
+		caps.HalfClose = caps.HalfClose && c.HalfClose
+		caps.SocketControl = caps.SocketControl || c.SocketControl
+		if c.WireOverhead > caps.WireOverhead {
+			caps.WireOverhead = c.WireOverhead
+		}
+	}
+	return caps
+}
+
+// ClientFactory returns a new ClientFactory instance.
+func (t *autoTransport) ClientFactory(stateDir string) (base.ClientFactory, error) {
+	cf := &autoClientFactory{t: t, factories: make(map[string]CoreClientFactory)}
+	for _, name := range defaultAutoOrder {
+		tr := Get(name)
+		if tr == nil {
+			return nil, fmt.Errorf("%s: '%s' is not registered", autoTransportName, name)
+		}
+		f, err := tr.ClientFactory(stateDir)
+		if err != nil {
+			return nil, err
+		}
+		core, ok := f.(CoreClientFactory)
+		if !ok {
+			return nil, fmt.Errorf("%s: '%s' does not expose its identity", autoTransportName, name)
+		}
+		cf.factories[name] = core
+	}
+	if stateDir != "" {
+		cf.state = loadAutoState(path.Join(stateDir, autoStateFile))
+	}
+	return cf, nil
+}
+
+// ServerFactory fails, as auto only has a client.  Servers run the transports
+// that it tries instead.
+func (t *autoTransport) ServerFactory(stateDir string, args *pt.Args) (base.ServerFactory, error) {
+	return nil, fmt.Errorf("%s is a client only transport", autoTransportName)
+}
+
+type autoClientFactory struct {
+	t         *autoTransport
+	factories map[string]CoreClientFactory
+	state     *autoState
+}
+
+// autoArgs are the parsed auto bridge line arguments.
+type autoArgs struct {
+	// order are the transports to try, most preferred first, with their
+	// addresses (empty for the bridge line's) and parsed arguments.
+	order []string
+	addrs map[string]string
+	args  map[string]interface{}
+
+	identity string
+	retry    time.Duration
+	timeout  time.Duration
+}
+
+func (cf *autoClientFactory) Transport() base.Transport {
+	return cf.t
+}
+
+// ParseArgs parses the auto arguments, and the rest as the arguments of each
+// of the transports to try.
+func (cf *autoClientFactory) ParseArgs(args *pt.Args) (interface{}, error) {
+	a := &autoArgs{
+		order:   defaultAutoOrder,
+		addrs:   make(map[string]string),
+		args:    make(map[string]interface{}),
+		retry:   defaultAutoRetry,
+		timeout: defaultAutoTimeout,
+	}
+	subArgs := make(pt.Args)
+	for k, v := range *args {
+		subArgs[k] = v
+	}
+	delete(subArgs, autoTransportsArg)
+	delete(subArgs, autoRetryArg)
+	delete(subArgs, autoTimeoutArg)
+
+	if s, ok := args.Get(autoTransportsArg); ok {
+		a.order = nil
+		seen := make(map[string]bool)
+		for _, name := range strings.Split(s, ",") {
+			if cf.factories[name] == nil {
+				return nil, fmt.Errorf("'%s' can not be tried by %s", name, autoTransportName)
+			}
+			if seen[name] {
+				return nil, fmt.Errorf("'%s' is listed more than once", name)
+			}
+			seen[name] = true
+			a.order = append(a.order, name)
+		}
+	}
+	for _, v := range []struct {
+		arg string
+		d   *time.Duration
+	}{
+		{autoRetryArg, &a.retry},
+		{autoTimeoutArg, &a.timeout},
+	} {
+		if s, ok := args.Get(v.arg); ok {
+			d, err := time.ParseDuration(s)
+			if err != nil || d <= 0 {
+				return nil, fmt.Errorf("malformed %s '%s'", v.arg, s)
+			}
+			*v.d = d
+		}
+	}
+	for name := range cf.factories {
+		if s, ok := args.Get(name + autoAddrArgSuffix); ok {
+			if _, _, err := net.SplitHostPort(s); err != nil {
+				return nil, fmt.Errorf("malformed %s%s '%s'", name, autoAddrArgSuffix, s)
+			}
+			a.addrs[name] = s
+			delete(subArgs, name+autoAddrArgSuffix)
+		}
+	}
+
+	for _, name := range a.order {
+		ta := make(pt.Args)
+		for k, v := range subArgs {
+			ta[k] = v
+		}
+		parsed, err := cf.factories[name].ParseArgs(&ta)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s", name, err)
+		}
+		a.args[name] = parsed
+		if a.identity == "" {
+			id, err := cf.factories[name].Identity(parsed)
+			if err != nil {
+				return nil, err
+			}
+			a.identity = hex.EncodeToString(id)
+		}
+	}
+	return a, nil
+}
+
+func (cf *autoClientFactory) Dial(network, addr string, dialer base.Dialer, args interface{}) (net.Conn, error) {
+	return cf.DialContext(context.Background(), network, addr, dialer, args)
+}
+
+// DialContext tries the transports in turn, starting with the one that last
+// worked for the bridge, or the preferred one if it is time to retry it.
+// Attempts other than the last are limited to the timeout.  If all of them
+// fail, the first error is returned.
+func (cf *autoClientFactory) DialContext(ctx context.Context, network, addr string, dialer base.Dialer, args interface{}) (net.Conn, error) {
+	a, ok := args.(*autoArgs)
+	if !ok {
+		return nil, fmt.Errorf("invalid argument type for args")
+	}
+	key := addr + " " + a.identity
+	order := cf.state.order(key, a.order, a.retry)
+
+	var firstErr error
+	for i, name := range order {
+		target := addr
+		if s := a.addrs[name]; s != "" {
+			target = s
+		}
+		attemptCtx, cancel := ctx, context.CancelFunc(func() {})
+		if i < len(order)-1 {
+			attemptCtx, cancel = context.WithTimeout(ctx, a.timeout)
+		}
+		conn, err := cf.factories[name].DialContext(attemptCtx, network, target, dialer, a.args[name])
+		cancel()
+		if err == nil {
+			cf.state.success(key, name)
+			return conn, nil
+		}
+		if ctx.Err() != nil {
+			// Abandoned, which says nothing about the transports.
+			return nil, err
+		}
+		if name == a.order[0] {
+			cf.state.preferredFailed(key)
+		}
+		if firstErr == nil {
+			firstErr = err
+		}
+	}
+	return nil, firstErr
+}
+
+// autoBridge is what auto remembers about a bridge.
+type autoBridge struct {
+	// Transport is the transport that last connected.
+	Transport string `json:"transport"`
+
+	// PreferredFailed is when the preferred transport last failed.
+	PreferredFailed time.Time `json:"preferredFailed"`
+}
+
+// autoState is what auto remembers about the bridges, keyed by the bridge
+// address and identity, saved to a file in the state directory.  It is shared
+// by the client factories of the same state directory.
+type autoState struct {
+	sync.Mutex
+
+	path    string
+	bridges map[string]*autoBridge
+}
+
+var autoStates struct {
+	sync.Mutex
+	m map[string]*autoState
+}
+
+func loadAutoState(path string) *autoState {
+	autoStates.Lock()
+	defer autoStates.Unlock()
+	if s := autoStates.m[path]; s != nil {
+		return s
+	}
+	s := &autoState{path: path, bridges: make(map[string]*autoBridge)}
+	if b, err := ioutil.ReadFile(path); err == nil {
+		// An invalid file is replaced once something worked.
+		if err = json.Unmarshal(b, &s.bridges); err != nil {
+			s.bridges = make(map[string]*autoBridge)
+		}
+	}
+	if autoStates.m == nil {
+		autoStates.m = make(map[string]*autoState)
+	}
+	autoStates.m[path] = s
+	return s
+}
+
+// order returns the transports to try for the bridge: the one that last
+// worked first, unless it is time to retry the preferred one.
+func (s *autoState) order(key string, order []string, retry time.Duration) []string {
+	if s == nil {
+		return order
+	}
+	s.Lock()
+	defer s.Unlock()
+	b := s.bridges[key]
+	if b == nil || b.Transport == order[0] || time.Since(b.PreferredFailed) >= retry {
+		return order
+	}
+	ret := []string{b.Transport}
+	found := false
+	for _, name := range order {
+		if name == b.Transport {
+			found = true
+		} else {
+			ret = append(ret, name)
+		}
+	}
+	if !found {
+		return order
+	}
+	return ret
+}
+
+func (s *autoState) success(key, transport string) {
+	s.update(key, func(b *autoBridge) bool {
+		if b.Transport == transport {
+			return false
+		}
+		b.Transport = transport
+		return true
+	})
+}
+
+func (s *autoState) preferredFailed(key string) {
+	s.update(key, func(b *autoBridge) bool {
+		b.PreferredFailed = time.Now()
+		return true
+	})
+}
+
+// update changes the bridge's entry, and saves the state if fn changed it.
+func (s *autoState) update(key string, fn func(b *autoBridge) bool) {
+	if s == nil {
+		return
+	}
+	s.Lock()
+	defer s.Unlock()
+	b := s.bridges[key]
+	if b == nil {
+		b = new(autoBridge)
+		s.bridges[key] = b
+	}
+	if !fn(b) {
+		return
+	}
+	buf, err := json.MarshalIndent(s.bridges, "", "  ")
+	if err != nil {
+		return
+	}
+	tmp := s.path + ".tmp"
+	if err = ioutil.WriteFile(tmp, buf, 0600); err == nil {
+		_ = os.Rename(tmp, s.path)
+	}
+}
@@ -30,10 +30,69 @@
 package base // import "github.com/RACECAR-GU/obfsX/transports/base"
 
 import (
-	"git.torproject.org/pluggable-transports/goptlib.git"
+	"context"
 	"net"
+	"net/url"
+
+	"git.torproject.org/pluggable-transports/goptlib.git"
+	_ "github.com/RACECAR-GU/obfsX/common/proxydialer" // Register http/socks4a.
+	"golang.org/x/net/proxy"
 )
 
+// Dialer is the dialer used by ClientFactory instances to create the outgoing
+// connection.  Transports MAY adjust the embedded net.Dialer (eg: to install a
+// socket Control hook) before dialing.  If ProxyURI is set, the connection is
+// tunneled through the specified upstream proxy, with the net.Dialer used to
+// reach the proxy itself.
+type Dialer struct {
+	net.Dialer
+
+	// ProxyURI is the optional upstream proxy (TOR_PT_PROXY), one of the
+	// "http", "socks4a" or "socks5" schemes.
+	ProxyURI *url.URL
+
+	// WrapConn, if set, wraps the established connection before the
+	// transport uses it (eg: to count the bytes on the wire).
+	WrapConn func(net.Conn) net.Conn
+}
+
+// Dial connects to the address on the named network, via the upstream proxy
+// if one is configured.
+func (d *Dialer) Dial(network, address string) (net.Conn, error) {
+	return d.DialContext(context.Background(), network, address)
+}
+
+// DialContext connects to the address on the named network using the provided
+// context, via the upstream proxy if one is configured.
+func (d *Dialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	conn, err := d.dialContext(ctx, network, address)
+	if err != nil || d.WrapConn == nil {
+		return conn, err
+	}
+	return d.WrapConn(conn), nil
+}
+
+func (d *Dialer) dialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	if d.ProxyURI == nil {
+		return d.Dialer.DialContext(ctx, network, address)
+	}
+
+	proxyDialer, err := proxy.FromURL(d.ProxyURI, &d.Dialer)
+	if err != nil {
+		return nil, err
+	}
+	if cd, ok := proxyDialer.(proxy.ContextDialer); ok {
+		return cd.DialContext(ctx, network, address)
+	}
+
+	// All of the supported proxy types implement proxy.ContextDialer, so
+	// this should never happen.
+	if err = ctx.Err(); err != nil {
+		return nil, err
+	}
+	return proxyDialer.Dial(network, address)
+}
+
 // ClientFactory is the interface that defines the factory for creating
 // pluggable transport protocol client instances.
 type ClientFactory interface {
@@ -47,10 +106,17 @@ type ClientFactory interface {
 	// generation) to be hidden from third parties.
 	ParseArgs(args *pt.Args) (interface{}, error)
 
-	// Dial creates an outbound net.Conn, and does whatever is required
-	// (eg: handshaking) to get the connection to the point where it is
-	// ready to relay data.
-	Dial(network, address string, dialer net.Dialer, args interface{}) (net.Conn, error)
+	// Dial creates an outbound net.Conn via the provided Dialer, and does
+	// whatever is required (eg: handshaking) to get the connection to the
+	// point where it is ready to relay data.  It is equivalent to DialContext
+	// with context.Background().
+	Dial(network, address string, dialer Dialer, args interface{}) (net.Conn, error)
+
+	// DialContext is Dial with a context.  The context bounds the entire
+	// process of establishing the connection, including any upstream proxy
+	// and transport handshakes, but not the lifetime of the returned
+	// net.Conn.
+	DialContext(ctx context.Context, network, address string, dialer Dialer, args interface{}) (net.Conn, error)
 }
 
 // ServerFactory is the interface that defines the factory for creating
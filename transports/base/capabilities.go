@@ -0,0 +1,107 @@
+package base
+
+import (
+	"net"
+	"time"
+)
+
+// Capabilities describes the optional features of a transport protocol, so
+// that callers (obfs4proxy, wrappers such as sharknado) can query them instead
+// of type asserting on the concrete transport types.
+type Capabilities struct {
+	// DummyTraffic is set if the connections implement DummyTrafficConn.
+	DummyTraffic bool
+
+	// IAT is set if the transport supports inter-arrival time obfuscation
+	// (the "iat-mode" argument).
+	IAT bool
+
+	// HalfClose is set if the connections implement HalfCloser, and closing
+	// the write side is conveyed to the peer.
+	HalfClose bool
+
+	// SocketControl is set if the ClientFactory installs a Control hook on
+	// the Dialer (eg: to set socket options), and thus needs the first hop
+	// to be a real socket.
+	SocketControl bool
+
+	// WireOverhead is the number of additional bytes sent on the wire per
+	// payload byte for bulk data, excluding padding and dummy traffic.
+	WireOverhead float64
+}
+
+// CapabilityTransport is implemented by Transports that describe their
+// Capabilities.
+type CapabilityTransport interface {
+	Transport
+
+	// Capabilities returns the capabilities of the transport protocol.
+	Capabilities() Capabilities
+}
+
+// GetCapabilities returns the Capabilities of t.  Transports that do not
+// implement CapabilityTransport are assumed to support none of the optional
+// features.
+func GetCapabilities(t Transport) Capabilities {
+	if ct, ok := t.(CapabilityTransport); ok {
+		return ct.Capabilities()
+	}
+	return Capabilities{}
+}
+
+// ParamsDescriber is implemented by ServerFactories that can describe the
+// parameters derived from their arguments and state (eg: for diagnostics).
+type ParamsDescriber interface {
+	// DescribeParams returns the derived parameters as key/value pairs.
+	DescribeParams() (map[string]string, error)
+}
+
+// Rejecter is implemented by ServerFactories that can turn a connection away
+// (eg: when over a rate limit) the same way as one that failed the
+// handshake, so that the two are not distinguishable.
+type Rejecter interface {
+	// Reject closes conn as if the handshake had failed, which may take
+	// as long as a handshake could.
+	Reject(conn net.Conn)
+
+	// RejectDelay returns how long Reject holds a connection open, for
+	// callers that can not afford to call Reject (eg: under load).
+	RejectDelay() time.Duration
+}
+
+// DelayedCloser is implemented by ServerFactories that close the connections
+// that fail the handshake after a delay (eg: obfs4), so that callers that
+// bound the number of concurrent handshakes (eg: Listener) can stop counting
+// a connection as soon as its handshake fails.
+type DelayedCloser interface {
+	// WrapConnDelayed is WrapConn, except that if the handshake fails, the
+	// returned function MUST be called to close conn the way WrapConn
+	// would have, which may take as long as a handshake could.
+	WrapConnDelayed(conn net.Conn) (net.Conn, func(), error)
+}
+
+// DummyTrafficFunc takes as input the number of desired dummy traffic bytes
+// and returns a []byte slice that is ready to be written to the wire.
+type DummyTrafficFunc func(n int) ([]byte, error)
+
+// DummyTrafficConn is implemented by the connections of transports that
+// support dummy traffic.
+type DummyTrafficConn interface {
+	net.Conn
+
+	// GetDummyTraffic returns n bytes of dummy traffic, that is ready to be
+	// written to the wire.  It fails if the connection is not established.
+	// As generating dummy traffic advances the connection state, the caller
+	// is responsible for serializing this with Write.
+	GetDummyTraffic(n int) ([]byte, error)
+
+	// WriteDummyTraffic writes n bytes of dummy traffic to the wire,
+	// serialized with Write.  It fails if the connection is not established.
+	WriteDummyTraffic(n int) (int, error)
+}
+
+// HalfCloser is implemented by connections that support closing the write
+// side, while continuing to read (eg: *net.TCPConn).
+type HalfCloser interface {
+	CloseWrite() error
+}
@@ -0,0 +1,136 @@
+package base
+
+import (
+	"fmt"
+	"net"
+	"syscall"
+
+	"git.torproject.org/pluggable-transports/goptlib.git"
+	"github.com/RACECAR-GU/obfsX/common/drbg"
+)
+
+// LayerConfig is the per-connection configuration that a composed transport
+// hands to each of its layers.
+type LayerConfig struct {
+	// IsServer is set for server connections.
+	IsServer bool
+
+	// Seed is the layer's seed, derived from the server's identity, so that
+	// both sides (and all clients of a server) agree on it, but no two
+	// layers share it.
+	Seed *drbg.Seed
+
+	// Args are the layer's arguments, as returned by ParseArgs.
+	Args interface{}
+}
+
+// Layer is the interface that defines a connection wrapper that can be
+// stacked under the core transport (the one that handshakes and encrypts,
+// eg: obfs4) by the composer in the transports package.
+type Layer interface {
+	// Name returns the name of the layer.  The layer's bridge line and server
+	// arguments are prefixed with the name and a '-'.
+	Name() string
+
+	// ParseArgs parses the layer's arguments (with the prefix stripped) into
+	// an internal representation for use with WrapConn.
+	ParseArgs(args *pt.Args) (interface{}, error)
+
+	// WrapConn wraps conn, the connection closer to the wire, before the
+	// core transport handshakes.
+	WrapConn(conn net.Conn, cfg *LayerConfig) (net.Conn, error)
+
+	// Capabilities returns the capabilities of the stack with this layer
+	// added, given the capabilities of the stack without it.
+	Capabilities(caps Capabilities) Capabilities
+}
+
+// ControlLayer is implemented by layers that need a socket Control hook on
+// the client's Dialer (eg: to set TCP_MAXSEG).
+type ControlLayer interface {
+	Layer
+
+	// Control returns the Control hook for the client connection.
+	Control(cfg *LayerConfig) (func(network, address string, c syscall.RawConn) error, error)
+}
+
+// DummyTrafficLayer is implemented by layers that inject dummy traffic
+// generated by the core transport (eg: sharknado).  These are listed after
+// the core, and are handed the established core connection after the
+// handshake.
+type DummyTrafficLayer interface {
+	Layer
+
+	// SetDummyTraffic sets the dummy traffic source of conn, the connection
+	// returned by WrapConn, to the core connection.
+	SetDummyTraffic(conn net.Conn, core DummyTrafficConn) error
+}
+
+// Stack is a stack of layers under a core transport, listed from the wire
+// upwards.
+type Stack []Layer
+
+// Control returns the socket Control hook that calls ctrl (if any), then
+// those of the ControlLayers, or nil if there are none.
+func (s Stack) Control(ctrl func(network, address string, c syscall.RawConn) error, cfgs []*LayerConfig) (func(network, address string, c syscall.RawConn) error, error) {
+	var controls []func(string, string, syscall.RawConn) error
+	if ctrl != nil {
+		controls = append(controls, ctrl)
+	}
+	for i, l := range s {
+		if cl, ok := l.(ControlLayer); ok {
+			c, err := cl.Control(cfgs[i])
+			if err != nil {
+				return nil, err
+			}
+			controls = append(controls, c)
+		}
+	}
+	switch len(controls) {
+	case 0:
+		return nil, nil
+	case 1:
+		return controls[0], nil
+	}
+	return func(network, address string, c syscall.RawConn) error {
+		for _, ctrl := range controls {
+			if err := ctrl(network, address, c); err != nil {
+				return err
+			}
+		}
+		return nil
+	}, nil
+}
+
+// Wrap wraps conn with each of the layers, returning the per-layer
+// connections, the last of which is the one to handshake over.
+func (s Stack) Wrap(conn net.Conn, cfgs []*LayerConfig) ([]net.Conn, error) {
+	conns := make([]net.Conn, len(s))
+	for i, l := range s {
+		var err error
+		if conn, err = l.WrapConn(conn, cfgs[i]); err != nil {
+			return nil, fmt.Errorf("%s: %s", l.Name(), err)
+		}
+		conns[i] = conn
+	}
+	return conns, nil
+}
+
+// Attach hands the established core connection's dummy traffic source to the
+// DummyTrafficLayers, given the per-layer connections returned by Wrap.
+func (s Stack) Attach(conns []net.Conn, core net.Conn) error {
+	for i, l := range s {
+		dl, ok := l.(DummyTrafficLayer)
+		if !ok {
+			continue
+		}
+		dt, ok := core.(DummyTrafficConn)
+		if !ok {
+			return fmt.Errorf("%s: connection does not provide dummy traffic", l.Name())
+		}
+		if err := dl.SetDummyTraffic(conns[i], dt); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,231 @@
+package base
+
+import (
+	"io"
+	"io/ioutil"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	// maxPendingHandshakes is the maximum number of connections that a
+	// Listener will handshake concurrently.  Once hit, the Listener stops
+	// accepting new connections until a handshake completes, so that the
+	// excess is left in the kernel's accept queue.
+	maxPendingHandshakes = 1024
+
+	// maxDelayedCloses is the maximum number of failed handshakes that a
+	// Listener will close with the DelayedCloser's delayed close at once (a
+	// goroutine and a read buffer each).  Past it, they are held open by a
+	// timer instead, for the ServerFactory's RejectDelay if it is a Rejecter,
+	// and only drained once it fires.
+	maxDelayedCloses = 4096
+
+	// holdDrainTime bounds how long a held connection is drained for, before
+	// being closed.
+	holdDrainTime = 10 * time.Millisecond
+
+	// maxAcceptDelay is the maximum time that a Listener will back off for
+	// after a temporary Accept() failure (eg: EMFILE).
+	maxAcceptDelay = 1 * time.Second
+)
+
+// Listener is a net.Listener that wraps each accepted connection with a
+// ServerFactory, and only returns connections that have completed the
+// transport handshake from Accept.  Handshakes are done concurrently in the
+// background, and connections that fail to handshake are dealt with entirely
+// by the ServerFactory (eg: obfs4's delayed close), and never returned.  If
+// the ServerFactory is a DelayedCloser, the delayed close does not count
+// against the concurrent handshakes, but is bounded separately.
+type Listener struct {
+	ln net.Listener
+	f  ServerFactory
+
+	conns     chan net.Conn
+	closed    chan struct{}
+	closeOnce sync.Once
+	pending   chan struct{}
+	closing   chan struct{}
+
+	errLock sync.Mutex
+	err     error
+}
+
+// NewListener returns a Listener that accepts connections from ln, and wraps
+// them with f.  Closing the Listener closes ln.
+func NewListener(f ServerFactory, ln net.Listener) *Listener {
+	return newListener(f, ln, maxPendingHandshakes, maxDelayedCloses)
+}
+
+func newListener(f ServerFactory, ln net.Listener, maxPending, maxClosing int) *Listener {
+	l := &Listener{
+		ln:      ln,
+		f:       f,
+		conns:   make(chan net.Conn),
+		closed:  make(chan struct{}),
+		pending: make(chan struct{}, maxPending),
+		closing: make(chan struct{}, maxClosing),
+	}
+	go l.acceptLoop()
+	return l
+}
+
+// Listen announces on the local network address, and returns a Listener that
+// wraps accepted connections with f.
+func Listen(f ServerFactory, network, address string) (*Listener, error) {
+	ln, err := net.Listen(network, address)
+	if err != nil {
+		return nil, err
+	}
+	return NewListener(f, ln), nil
+}
+
+// Accept waits for and returns the next connection that has completed the
+// transport handshake.
+func (l *Listener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.closed:
+		l.errLock.Lock()
+		defer l.errLock.Unlock()
+		return nil, l.err
+	}
+}
+
+// Close closes the listener.  Connections that are still handshaking will be
+// closed once the handshake completes.
+func (l *Listener) Close() error {
+	err := l.ln.Close()
+	l.shutdown(&net.OpError{Op: "accept", Net: l.ln.Addr().Network(), Addr: l.ln.Addr(), Err: errListenerClosed})
+	return err
+}
+
+// Addr returns the listener's network address.
+func (l *Listener) Addr() net.Addr {
+	return l.ln.Addr()
+}
+
+// ServerFactory returns the ServerFactory used to wrap connections.
+func (l *Listener) ServerFactory() ServerFactory {
+	return l.f
+}
+
+func (l *Listener) shutdown(err error) {
+	l.closeOnce.Do(func() {
+		l.errLock.Lock()
+		l.err = err
+		l.errLock.Unlock()
+		close(l.closed)
+	})
+}
+
+func (l *Listener) acceptLoop() {
+	var delay time.Duration
+	for {
+		// Wait for a handshake slot before accepting.
+		select {
+		case l.pending <- struct{}{}:
+		case <-l.closed:
+			return
+		}
+
+		conn, err := l.ln.Accept()
+		if err != nil {
+			<-l.pending
+			if e, ok := err.(net.Error); ok && e.Temporary() {
+				delay = AcceptDelay(delay)
+				time.Sleep(delay)
+				continue
+			}
+			l.shutdown(err)
+			return
+		}
+		delay = 0
+
+		go l.handshake(conn)
+	}
+}
+
+// AcceptDelay returns how long to back off for after a temporary Accept()
+// failure, given the previous delay (0 after a successful Accept()).  It
+// starts at 5 ms, and doubles up to maxAcceptDelay.
+func AcceptDelay(delay time.Duration) time.Duration {
+	if delay == 0 {
+		return 5 * time.Millisecond
+	}
+	if delay *= 2; delay > maxAcceptDelay {
+		delay = maxAcceptDelay
+	}
+	return delay
+}
+
+func (l *Listener) handshake(conn net.Conn) {
+	var remote net.Conn
+	var closeFailed func()
+	var err error
+	if dc, ok := l.f.(DelayedCloser); ok {
+		remote, closeFailed, err = dc.WrapConnDelayed(conn)
+	} else {
+		remote, err = l.f.WrapConn(conn)
+	}
+	<-l.pending
+	if err != nil {
+		// Any delayed close behavior is done by WrapConn before it returns,
+		// or by closeFailed once the handshake slot is released, so that
+		// failed handshakes (eg: probes) do not hold up new ones.
+		if closeFailed != nil {
+			l.closeDelayed(conn, closeFailed)
+			return
+		}
+		conn.Close()
+		return
+	}
+
+	select {
+	case l.conns <- remote:
+	case <-l.closed:
+		remote.Close()
+	}
+}
+
+// closeDelayed closes a connection that failed the handshake with closeFailed,
+// unless too many are already being closed that way, in which case it is held
+// open by a timer instead.
+func (l *Listener) closeDelayed(conn net.Conn, closeFailed func()) {
+	select {
+	case l.closing <- struct{}{}:
+		closeFailed()
+		<-l.closing
+		conn.Close()
+	default:
+		var delay time.Duration
+		if r, ok := l.f.(Rejecter); ok {
+			delay = r.RejectDelay()
+		}
+		holdConn(conn, delay)
+	}
+}
+
+// holdConn closes conn once delay passes, after discarding what the peer
+// sent, so that the close does not reset the connection.
+func holdConn(conn net.Conn, delay time.Duration) {
+	time.AfterFunc(delay, func() {
+		defer conn.Close()
+		if err := conn.SetReadDeadline(time.Now().Add(holdDrainTime)); err != nil {
+			return
+		}
+		_, _ = io.Copy(ioutil.Discard, conn)
+	})
+}
+
+type listenerClosedError struct{}
+
+func (listenerClosedError) Error() string   { return "use of closed transport listener" }
+func (listenerClosedError) Timeout() bool   { return false }
+func (listenerClosedError) Temporary() bool { return false }
+
+var errListenerClosed net.Error = listenerClosedError{}
+
+var _ net.Listener = (*Listener)(nil)
@@ -0,0 +1,144 @@
+package base
+
+import (
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"git.torproject.org/pluggable-transports/goptlib.git"
+)
+
+// delayedFactory accepts connections that send "g", and closes the others
+// once release is closed.
+type delayedFactory struct {
+	release chan struct{}
+	delay   time.Duration
+}
+
+func (f *delayedFactory) Transport() Transport { return nil }
+func (f *delayedFactory) Args() *pt.Args       { return &pt.Args{} }
+
+func (f *delayedFactory) WrapConn(conn net.Conn) (net.Conn, error) {
+	c, closeFailed, err := f.WrapConnDelayed(conn)
+	if err != nil {
+		closeFailed()
+		return nil, err
+	}
+	return c, nil
+}
+
+func (f *delayedFactory) Reject(conn net.Conn)       { <-f.release }
+func (f *delayedFactory) RejectDelay() time.Duration { return f.delay }
+
+func (f *delayedFactory) WrapConnDelayed(conn net.Conn) (net.Conn, func(), error) {
+	var b [1]byte
+	if _, err := io.ReadFull(conn, b[:]); err != nil || b[0] != 'g' {
+		return nil, func() { <-f.release }, errors.New("bad handshake")
+	}
+	return conn, nil, nil
+}
+
+func TestListenerDelayedClose(t *testing.T) {
+	f := &delayedFactory{release: make(chan struct{})}
+	defer close(f.release)
+	tcpLn, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen failed: %s", err)
+	}
+	ln := newListener(f, tcpLn, 2, maxDelayedCloses)
+	defer ln.Close()
+
+	// More failed handshakes than there are slots, which are all still
+	// being closed.
+	for i := 0; i < 4; i++ {
+		probe, err := net.Dial("tcp", ln.Addr().String())
+		if err != nil {
+			t.Fatalf("probe Dial failed: %s", err)
+		}
+		defer probe.Close()
+		if _, err = probe.Write([]byte("x")); err != nil {
+			t.Fatalf("probe Write failed: %s", err)
+		}
+	}
+
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatalf("Dial failed: %s", err)
+	}
+	defer conn.Close()
+	if _, err = conn.Write([]byte("g")); err != nil {
+		t.Fatalf("Write failed: %s", err)
+	}
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		if c, err := ln.Accept(); err == nil {
+			accepted <- c
+		}
+	}()
+	select {
+	case c := <-accepted:
+		c.Close()
+	case <-time.After(5 * time.Second):
+		t.Fatalf("the delayed closes held up the handshake")
+	}
+}
+
+func TestListenerHeldClose(t *testing.T) {
+	f := &delayedFactory{release: make(chan struct{}), delay: 50 * time.Millisecond}
+	defer close(f.release)
+	tcpLn, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen failed: %s", err)
+	}
+	ln := newListener(f, tcpLn, 2, 1)
+	defer ln.Close()
+
+	// The first failed handshake takes the only delayed close, so the
+	// second is held for the RejectDelay, and then closed.
+	var probes [2]net.Conn
+	for i := range probes {
+		if probes[i], err = net.Dial("tcp", ln.Addr().String()); err != nil {
+			t.Fatalf("probe Dial failed: %s", err)
+		}
+		defer probes[i].Close()
+		if _, err = probes[i].Write([]byte("x")); err != nil {
+			t.Fatalf("probe Write failed: %s", err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if err = probes[1].SetReadDeadline(time.Now().Add(5 * time.Second)); err != nil {
+		t.Fatalf("SetReadDeadline failed: %s", err)
+	}
+	var b [1]byte
+	if _, err = probes[1].Read(b[:]); err != io.EOF {
+		t.Fatalf("the held probe Read: %v, expected EOF", err)
+	}
+	if err = probes[0].SetReadDeadline(time.Now().Add(10 * time.Millisecond)); err != nil {
+		t.Fatalf("SetReadDeadline failed: %s", err)
+	}
+	if _, err = probes[0].Read(b[:]); err == io.EOF {
+		t.Errorf("the delayed close was not delayed")
+	}
+}
+
+func TestAcceptDelay(t *testing.T) {
+	var delay time.Duration
+	for _, expected := range []time.Duration{
+		5 * time.Millisecond,
+		10 * time.Millisecond,
+		20 * time.Millisecond,
+	} {
+		if delay = AcceptDelay(delay); delay != expected {
+			t.Fatalf("AcceptDelay() = %s, expected %s", delay, expected)
+		}
+	}
+	for i := 0; i < 10; i++ {
+		delay = AcceptDelay(delay)
+	}
+	if delay != maxAcceptDelay {
+		t.Fatalf("AcceptDelay() = %s, expected it capped at %s", delay, maxAcceptDelay)
+	}
+}
@@ -0,0 +1,433 @@
+package transports
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"git.torproject.org/pluggable-transports/goptlib.git"
+	"github.com/RACECAR-GU/obfsX/common/drbg"
+	"github.com/RACECAR-GU/obfsX/transports/base"
+)
+
+const layerSeedPrefix = "obfsX layer seed:"
+
+var layerMap = make(map[string]base.Layer)
+
+// CoreClientFactory is implemented by the ClientFactory of transports that
+// can be the core of a composed transport.
+type CoreClientFactory interface {
+	base.ClientFactory
+
+	// Identity returns the server's identity (eg: the public key) from the
+	// parsed args, which the layer seeds are derived from.
+	Identity(args interface{}) ([]byte, error)
+
+	// Handshake does the client handshake over an established connection.
+	Handshake(ctx context.Context, conn net.Conn, args interface{}) (net.Conn, error)
+}
+
+// CoreServerFactory is implemented by the ServerFactory of transports that
+// can be the core of a composed transport.
+type CoreServerFactory interface {
+	base.ServerFactory
+
+	// Identity returns the server's identity, which MUST match what
+	// CoreClientFactory.Identity returns for the server's Args.
+	Identity() []byte
+}
+
+// RegisterLayer registers a layer for use with Compose.
+func RegisterLayer(layer base.Layer) error {
+	transportMapLock.Lock()
+	defer transportMapLock.Unlock()
+
+	name := layer.Name()
+	if _, registered := layerMap[name]; registered {
+		return fmt.Errorf("layer '%s' already registered", name)
+	}
+	layerMap[name] = layer
+
+	return nil
+}
+
+// GetLayer returns a layer by name.
+func GetLayer(name string) base.Layer {
+	transportMapLock.Lock()
+	defer transportMapLock.Unlock()
+
+	return layerMap[name]
+}
+
+// Compose returns a transport named name, built from the named layers, listed
+// from the wire upwards (eg: "riverrun", "obfs4", "sharknado").  Exactly one
+// of them must be a registered transport that can be a core (eg: "obfs4"), the
+// rest must be registered layers.  Layers listed before the core wrap the wire
+// connection in order, layers listed after it must be base.DummyTrafficLayers,
+// and are stacked directly under the core, which supplies their dummy traffic.
+//
+// The returned transport is not registered, see RegisterComposed.  Layer
+// arguments are passed in the bridge line and server options prefixed with the
+// layer name and a '-' (eg: "riverrun-foo=bar"), and each layer's seed is
+// derived from the server's identity, the transport name and the layer name.
+func Compose(name string, layers ...string) (base.Transport, error) {
+	t := &composedTransport{name: name}
+
+	seen := make(map[string]bool)
+	var dummyLayers []base.Layer
+	for _, v := range layers {
+		if seen[v] {
+			return nil, fmt.Errorf("%s: layer '%s' specified more than once", name, v)
+		}
+		seen[v] = true
+
+		if l := GetLayer(v); l != nil {
+			if t.core == nil {
+				t.stack = append(t.stack, l)
+				continue
+			}
+			if _, ok := l.(base.DummyTrafficLayer); !ok {
+				return nil, fmt.Errorf("%s: layer '%s' can not be above the core", name, v)
+			}
+			dummyLayers = append(dummyLayers, l)
+			continue
+		}
+
+		core := Get(v)
+		if core == nil {
+			return nil, fmt.Errorf("%s: no such layer or transport: '%s'", name, v)
+		}
+		if t.core != nil {
+			return nil, fmt.Errorf("%s: more than one core transport ('%s', '%s')", name, t.core.Name(), v)
+		}
+		cf, err := core.ClientFactory("")
+		if err != nil {
+			return nil, err
+		}
+		if _, ok := cf.(CoreClientFactory); !ok {
+			return nil, fmt.Errorf("%s: '%s' can not be a core transport", name, v)
+		}
+		if base.GetCapabilities(core).SocketControl {
+			return nil, fmt.Errorf("%s: '%s' needs socket control, and can not be a core transport", name, v)
+		}
+		t.core = core
+	}
+	if t.core == nil {
+		return nil, fmt.Errorf("%s: no core transport specified", name)
+	}
+	if len(dummyLayers) > 0 && !base.GetCapabilities(t.core).DummyTraffic {
+		return nil, fmt.Errorf("%s: '%s' does not support dummy traffic", name, t.core.Name())
+	}
+	t.stack = append(t.stack, dummyLayers...)
+
+	return t, nil
+}
+
+// RegisterComposed builds a transport with Compose, and registers it.
+func RegisterComposed(name string, layers ...string) (base.Transport, error) {
+	t, err := Compose(name, layers...)
+	if err != nil {
+		return nil, err
+	}
+	if err = Register(t); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+type composedTransport struct {
+	name string
+	core base.Transport
+
+	// stack is the layers under the core, from the wire upwards.
+	stack base.Stack
+}
+
+// Name returns the name of the composed transport.
+func (t *composedTransport) Name() string {
+	return t.name
+}
+
+// Capabilities returns the capabilities of the core, as adjusted by each of
+// the layers.
+func (t *composedTransport) Capabilities() base.Capabilities {
+	caps := base.GetCapabilities(t.core)
+	for i := len(t.stack) - 1; i >= 0; i-- {
+		caps = t.stack[i].Capabilities(caps)
+	}
+	return caps
+}
+
+// ClientFactory returns a new ClientFactory instance.
+func (t *composedTransport) ClientFactory(stateDir string) (base.ClientFactory, error) {
+	cf, err := t.core.ClientFactory(stateDir)
+	if err != nil {
+		return nil, err
+	}
+	core, ok := cf.(CoreClientFactory)
+	if !ok {
+		return nil, fmt.Errorf("'%s' can not be a core transport", t.core.Name())
+	}
+	return &composedClientFactory{t, core}, nil
+}
+
+// ServerFactory returns a new ServerFactory instance.
+func (t *composedTransport) ServerFactory(stateDir string, args *pt.Args) (base.ServerFactory, error) {
+	coreArgs, layerArgs := t.splitArgs(args)
+	sf, err := t.core.ServerFactory(stateDir, coreArgs)
+	if err != nil {
+		return nil, err
+	}
+	core, ok := sf.(CoreServerFactory)
+	if !ok {
+		return nil, fmt.Errorf("'%s' can not be a core transport", t.core.Name())
+	}
+	parsed, err := t.parseLayerArgs(layerArgs)
+	if err != nil {
+		return nil, err
+	}
+
+	// The clients need the layer arguments as well.
+	ptArgs := make(pt.Args)
+	if a := core.Args(); a != nil {
+		for k, v := range *a {
+			ptArgs[k] = append([]string(nil), v...)
+		}
+	}
+	for i, l := range t.stack {
+		for k, v := range *layerArgs[i] {
+			ptArgs[l.Name()+"-"+k] = append([]string(nil), v...)
+		}
+	}
+
+	return &composedServerFactory{t, core, &ptArgs, parsed}, nil
+}
+
+// splitArgs splits args into the core's and each layer's, with the prefix
+// stripped.
+func (t *composedTransport) splitArgs(args *pt.Args) (*pt.Args, []*pt.Args) {
+	coreArgs := make(pt.Args)
+	layerArgs := make([]*pt.Args, len(t.stack))
+	for i := range layerArgs {
+		layerArgs[i] = &pt.Args{}
+	}
+	if args == nil {
+		return &coreArgs, layerArgs
+	}
+
+	for k, v := range *args {
+		isLayerArg := false
+		for i, l := range t.stack {
+			if prefix := l.Name() + "-"; strings.HasPrefix(k, prefix) {
+				(*layerArgs[i])[k[len(prefix):]] = v
+				isLayerArg = true
+				break
+			}
+		}
+		if !isLayerArg {
+			coreArgs[k] = v
+		}
+	}
+	return &coreArgs, layerArgs
+}
+
+func (t *composedTransport) parseLayerArgs(layerArgs []*pt.Args) ([]interface{}, error) {
+	parsed := make([]interface{}, len(t.stack))
+	for i, l := range t.stack {
+		var err error
+		if parsed[i], err = l.ParseArgs(layerArgs[i]); err != nil {
+			return nil, fmt.Errorf("%s: %s", l.Name(), err)
+		}
+	}
+	return parsed, nil
+}
+
+// layerConfigs returns the per-connection configuration of each layer.
+func (t *composedTransport) layerConfigs(identity []byte, isServer bool, layerArgs []interface{}) ([]*base.LayerConfig, error) {
+	cfgs := make([]*base.LayerConfig, len(t.stack))
+	for i, l := range t.stack {
+		mac := hmac.New(sha256.New, identity)
+		_, _ = mac.Write([]byte(layerSeedPrefix + t.name + ":" + l.Name()))
+		seed, err := drbg.SeedFromBytes(mac.Sum(nil))
+		if err != nil {
+			return nil, err
+		}
+		cfgs[i] = &base.LayerConfig{IsServer: isServer, Seed: seed, Args: layerArgs[i]}
+	}
+	return cfgs, nil
+}
+
+type composedArgs struct {
+	core   interface{}
+	layers []interface{}
+}
+
+type composedClientFactory struct {
+	t    *composedTransport
+	core CoreClientFactory
+}
+
+func (cf *composedClientFactory) Transport() base.Transport {
+	return cf.t
+}
+
+func (cf *composedClientFactory) ParseArgs(args *pt.Args) (interface{}, error) {
+	coreArgs, layerArgs := cf.t.splitArgs(args)
+	ca, err := cf.core.ParseArgs(coreArgs)
+	if err != nil {
+		return nil, err
+	}
+	parsed, err := cf.t.parseLayerArgs(layerArgs)
+	if err != nil {
+		return nil, err
+	}
+	return &composedArgs{ca, parsed}, nil
+}
+
+func (cf *composedClientFactory) Dial(network, addr string, dialer base.Dialer, args interface{}) (net.Conn, error) {
+	return cf.DialContext(context.Background(), network, addr, dialer, args)
+}
+
+func (cf *composedClientFactory) DialContext(ctx context.Context, network, addr string, dialer base.Dialer, args interface{}) (net.Conn, error) {
+	ca, ok := args.(*composedArgs)
+	if !ok {
+		return nil, fmt.Errorf("invalid argument type for args")
+	}
+	identity, err := cf.core.Identity(ca.core)
+	if err != nil {
+		return nil, err
+	}
+	cfgs, err := cf.t.layerConfigs(identity, false, ca.layers)
+	if err != nil {
+		return nil, err
+	}
+
+	// Chain the socket Control hooks, after any that the caller installed.
+	if dialer.Control, err = cf.t.stack.Control(dialer.Control, cfgs); err != nil {
+		return nil, err
+	}
+
+	conn, err := dialer.DialContext(ctx, network, addr)
+	if err != nil {
+		return nil, err
+	}
+	dialConn := conn
+	conns, err := cf.t.stack.Wrap(conn, cfgs)
+	if err != nil {
+		dialConn.Close()
+		return nil, err
+	}
+	if len(conns) > 0 {
+		conn = conns[len(conns)-1]
+	}
+	layerConn := conn
+	if err = ctx.Err(); err != nil {
+		layerConn.Close()
+		return nil, err
+	}
+	if conn, err = cf.core.Handshake(ctx, conn, ca.core); err != nil {
+		layerConn.Close()
+		return nil, err
+	}
+	if err = cf.t.stack.Attach(conns, conn); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+
+type composedServerFactory struct {
+	t         *composedTransport
+	core      CoreServerFactory
+	args      *pt.Args
+	layerArgs []interface{}
+}
+
+func (sf *composedServerFactory) Transport() base.Transport {
+	return sf.t
+}
+
+func (sf *composedServerFactory) Args() *pt.Args {
+	return sf.args
+}
+
+func (sf *composedServerFactory) WrapConn(conn net.Conn) (net.Conn, error) {
+	c, closeFailed, err := sf.WrapConnDelayed(conn)
+	if err != nil {
+		closeFailed()
+		return nil, err
+	}
+	return c, nil
+}
+
+// WrapConnDelayed is WrapConn, except that the delayed close of a connection
+// that failed the core's handshake (if the core has one) is left to the
+// returned function.
+func (sf *composedServerFactory) WrapConnDelayed(conn net.Conn) (net.Conn, func(), error) {
+	cfgs, err := sf.t.layerConfigs(sf.core.Identity(), true, sf.layerArgs)
+	if err != nil {
+		return nil, func() {}, err
+	}
+	conns, err := sf.t.stack.Wrap(conn, cfgs)
+	if err != nil {
+		return nil, func() {}, err
+	}
+	if len(conns) > 0 {
+		conn = conns[len(conns)-1]
+	}
+
+	// Closing the topmost layer's connection closes the rest, and stops
+	// any of the layers' goroutines.
+	layerConn := conn
+	closeFailed := func() {}
+	if dc, ok := sf.core.(base.DelayedCloser); ok {
+		conn, closeFailed, err = dc.WrapConnDelayed(conn)
+	} else {
+		conn, err = sf.core.WrapConn(conn)
+	}
+	if err != nil {
+		return nil, func() {
+			closeFailed()
+			layerConn.Close()
+		}, err
+	}
+	if err = sf.t.stack.Attach(conns, conn); err != nil {
+		conn.Close()
+		return nil, func() {}, err
+	}
+	return conn, nil, nil
+}
+
+// Reject closes conn the way the core transport does, if it can, otherwise
+// immediately.
+func (sf *composedServerFactory) Reject(conn net.Conn) {
+	if r, ok := sf.core.(base.Rejecter); ok {
+		r.Reject(conn)
+		return
+	}
+	conn.Close()
+}
+
+// RejectDelay returns the core transport's, if it can reject connections.
+func (sf *composedServerFactory) RejectDelay() time.Duration {
+	if r, ok := sf.core.(base.Rejecter); ok {
+		return r.RejectDelay()
+	}
+	return 0
+}
+
+// Listen announces on the local network address, and returns a net.Listener
+// that only returns connections that have completed the handshake.
+func (sf *composedServerFactory) Listen(network, address string) (net.Listener, error) {
+	return base.Listen(sf, network, address)
+}
+
+var _ base.CapabilityTransport = (*composedTransport)(nil)
+var _ base.ClientFactory = (*composedClientFactory)(nil)
+var _ base.ServerFactory = (*composedServerFactory)(nil)
+var _ base.Rejecter = (*composedServerFactory)(nil)
+var _ base.DelayedCloser = (*composedServerFactory)(nil)
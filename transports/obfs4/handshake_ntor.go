@@ -117,6 +117,9 @@ type clientHandshake struct {
 	padLen int
 	mac    hash.Hash
 
+	// puzzleDifficulty is the difficulty of the client puzzle to solve.
+	puzzleDifficulty int
+
 	serverRepresentative *ntor.Representative
 	serverAuth           *ntor.Auth
 	serverMark           []byte
@@ -147,12 +150,21 @@ func (hs *clientHandshake) generateHandshake() ([]byte, error) {
 	//  * MAC is HMAC-SHA256-128(serverIdentity | NodeID, X .... E)
 	//  * E is the string representation of the number of hours since the UNIX
 	//    epoch.
+	hs.epochHour = []byte(strconv.FormatInt(getEpochHour(), 10))
 
-	// Generate the padding
+	// Generate the padding, which starts with the client puzzle proof if
+	// the server requires one.
 	pad, err := makePad(hs.padLen)
 	if err != nil {
 		return nil, err
 	}
+	if hs.puzzleDifficulty > 0 {
+		nonce, err := solvePuzzle(hs.mac, hs.keypair.Representative(), hs.epochHour, hs.puzzleDifficulty)
+		if err != nil {
+			return nil, err
+		}
+		copy(pad, nonce)
+	}
 
 	// Write X, P_C, M_C.
 	buf.Write(hs.keypair.Representative().Bytes()[:])
@@ -162,7 +174,6 @@ func (hs *clientHandshake) generateHandshake() ([]byte, error) {
 	// Calculate and write the MAC.
 	hs.mac.Reset()
 	_, _ = hs.mac.Write(buf.Bytes())
-	hs.epochHour = []byte(strconv.FormatInt(getEpochHour(), 10))
 	_, _ = hs.mac.Write(hs.epochHour)
 	buf.Write(hs.mac.Sum(nil)[:macLength])
 
@@ -233,6 +244,9 @@ type serverHandshake struct {
 	padLen int
 	mac    hash.Hash
 
+	// puzzle, if set, is the client puzzle to check.
+	puzzle *serverPuzzle
+
 	clientRepresentative *ntor.Representative
 	clientMark           []byte
 }
@@ -278,6 +292,7 @@ func (hs *serverHandshake) parseClientHandshake(filter *replayfilter.ReplayFilte
 
 	// Validate the MAC.
 	macFound := false
+	macRx := resp[pos+markLength : pos+markLength+macLength]
 	for _, off := range []int64{0, -1, 1} {
 		// Allow epoch to be off by up to a hour in either direction.
 		epochHour := []byte(strconv.FormatInt(getEpochHour()+int64(off), 10))
@@ -285,16 +300,7 @@ func (hs *serverHandshake) parseClientHandshake(filter *replayfilter.ReplayFilte
 		_, _ = hs.mac.Write(resp[:pos+markLength])
 		_, _ = hs.mac.Write(epochHour)
 		macCmp := hs.mac.Sum(nil)[:macLength]
-		macRx := resp[pos+markLength : pos+markLength+macLength]
 		if hmac.Equal(macCmp, macRx) {
-			// Ensure that this handshake has not been seen previously.
-			if filter.TestAndSet(time.Now(), macRx) {
-				// The client either happened to generate exactly the same
-				// session key and padding, or someone is replaying a previous
-				// handshake.  In either case, fuck them.
-				return nil, ErrReplayedHandshake
-			}
-
 			macFound = true
 			hs.epochHour = epochHour
 
@@ -314,6 +320,27 @@ func (hs *serverHandshake) parseClientHandshake(filter *replayfilter.ReplayFilte
 		return nil, ErrInvalidHandshake
 	}
 
+	// Check the client puzzle proof, at the start of P_C, before doing the
+	// ntor handshake.
+	if hs.puzzle != nil {
+		if difficulty := hs.puzzle.required(); difficulty > 0 {
+			nonce := resp[ntor.RepresentativeLength : ntor.RepresentativeLength+puzzleNonceLength]
+			if !checkPuzzle(hs.mac, hs.clientRepresentative, nonce, hs.epochHour, difficulty) {
+				return nil, ErrPuzzleFailed
+			}
+		}
+	}
+
+	// Ensure that this handshake has not been seen previously.  This is
+	// checked last, so that handshakes without a proof of work do not
+	// fill the replay filter.
+	if filter.TestAndSet(time.Now(), macRx) {
+		// The client either happened to generate exactly the same
+		// session key and padding, or someone is replaying a previous
+		// handshake.  In either case, fuck them.
+		return nil, ErrReplayedHandshake
+	}
+
 	clientPublic := hs.clientRepresentative.ToPublic()
 	ok, seed, auth := ntor.ServerHandshake(clientPublic, hs.keypair,
 		hs.serverIdentity, hs.nodeID)
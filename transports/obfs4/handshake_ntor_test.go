@@ -246,3 +246,62 @@ func TestHandshakeNtorServer(t *testing.T) {
 		t.Fatalf("clientHandshake.parseServerHandshake() succeded (oversized)")
 	}
 }
+
+func TestHandshakePuzzle(t *testing.T) {
+	nodeID, _ := ntor.NewNodeID([]byte("\x00\x01\x02\x03\x04\x05\x06\x07\x08\x09\x0a\x0b\x0c\x0d\x0e\x0f\x10\x11\x12\x13"))
+	idKeypair, _ := ntor.NewKeypair(false)
+	serverFilter, _ := replayfilter.New(replayTTL)
+
+	parse := func(clientBlob []byte, puzzle *serverPuzzle) error {
+		serverKeypair, err := ntor.NewKeypair(true)
+		if err != nil {
+			t.Fatalf("server: ntor.NewKeypair failed: %s", err)
+		}
+		serverHs := newServerHandshake(nodeID, idKeypair, serverKeypair)
+		serverHs.puzzle = puzzle
+		_, err = serverHs.parseClientHandshake(serverFilter, clientBlob)
+		return err
+	}
+	generate := func(clientDifficulty int) []byte {
+		clientKeypair, err := ntor.NewKeypair(true)
+		if err != nil {
+			t.Fatalf("client: ntor.NewKeypair failed: %s", err)
+		}
+		clientHs := newClientHandshake(nodeID, idKeypair.Public(), clientKeypair)
+		clientHs.puzzleDifficulty = clientDifficulty
+		clientBlob, err := clientHs.generateHandshake()
+		if err != nil {
+			t.Fatalf("clientHandshake.generateHandshake() failed: %s", err)
+		}
+		return clientBlob
+	}
+	handshake := func(clientDifficulty int, puzzle *serverPuzzle) error {
+		return parse(generate(clientDifficulty), puzzle)
+	}
+
+	// A solved puzzle is accepted, at or under its difficulty.
+	if err := handshake(12, &serverPuzzle{12, puzzleModeAlways}); err != nil {
+		t.Fatalf("solved puzzle: %s", err)
+	}
+	if err := handshake(12, &serverPuzzle{4, puzzleModeAlways}); err != nil {
+		t.Fatalf("easier puzzle: %s", err)
+	}
+
+	// Random padding (2^-20 odds of passing) is not a proof, and the
+	// handshake is turned away before it enters the replay filter.
+	clientBlob := generate(0)
+	if err := parse(clientBlob, &serverPuzzle{maxPuzzleDifficulty, puzzleModeAlways}); err != ErrPuzzleFailed {
+		t.Fatalf("unsolved puzzle: %v", err)
+	}
+	if err := parse(clientBlob, &serverPuzzle{}); err != nil {
+		t.Fatalf("unsolved puzzle, without a puzzle: %s", err)
+	}
+	if err := parse(clientBlob, &serverPuzzle{}); err != ErrReplayedHandshake {
+		t.Fatalf("replayed handshake: %v", err)
+	}
+
+	// Without a loaded handshake queue, the adaptive mode requires nothing.
+	if err := handshake(0, &serverPuzzle{maxPuzzleDifficulty, puzzleModeAdaptive}); err != nil {
+		t.Fatalf("adaptive puzzle: %s", err)
+	}
+}
@@ -31,6 +31,7 @@ package obfs4 // import "github.com/RACECAR-GU/obfsX/transports/obfs4"
 
 import (
 	"bytes"
+	"context"
 	"crypto/sha256"
 	"flag"
 	"fmt"
@@ -39,16 +40,19 @@ import (
 	"math/rand"
 	"net"
 	"strconv"
+	"sync"
 	"syscall"
 	"time"
 
 	"git.torproject.org/pluggable-transports/goptlib.git"
+	"github.com/RACECAR-GU/obfsX/common/ctxconn"
 	"github.com/RACECAR-GU/obfsX/common/drbg"
 	f "github.com/RACECAR-GU/obfsX/common/framing"
 	"github.com/RACECAR-GU/obfsX/common/log"
 	"github.com/RACECAR-GU/obfsX/common/ntor"
 	"github.com/RACECAR-GU/obfsX/common/probdist"
 	"github.com/RACECAR-GU/obfsX/common/replayfilter"
+	"github.com/RACECAR-GU/obfsX/common/workerpool"
 	"github.com/RACECAR-GU/obfsX/transports/base"
 	"github.com/RACECAR-GU/obfsX/transports/obfs4/framing"
 )
@@ -85,11 +89,40 @@ const (
 // uniformly distributed.
 var biasedDist bool
 
+// handshakePool, if set, runs the CPU intensive parts of the server
+// handshakes.
+var handshakePool *workerpool.Pool
+
+// SetHandshakePool makes the server handshakes run their CPU intensive parts
+// (generating the session key, and parsing the client handshake) on p, so
+// that bursts of handshakes can not starve the established connections, or
+// inline if p is nil.  The time spent queued counts towards the handshake
+// timeout, and handshakes that can not get a worker fail like invalid ones.
+// It MUST be called before any server handshakes.
+func SetHandshakePool(p *workerpool.Pool) {
+	handshakePool = p
+}
+
+func runHandshakeJob(deadline time.Time, fn func()) error {
+	if handshakePool == nil {
+		fn()
+		return nil
+	}
+	if err := handshakePool.Do(deadline, fn); err != nil {
+		return fmt.Errorf("obfs4: server handshake not started: %w", err)
+	}
+	return nil
+}
+
 type ClientArgs struct {
 	NodeID     *ntor.NodeID
 	PublicKey  *ntor.PublicKey
 	SessionKey *ntor.Keypair
 	IatMode    int
+
+	// PuzzleDifficulty is the difficulty of the client puzzle that the
+	// server may require, 0 if none.
+	PuzzleDifficulty int
 }
 
 // Transport is the obfs4 implementation of the base.Transport interface.
@@ -100,6 +133,15 @@ func (t *Transport) Name() string {
 	return transportName
 }
 
+// Capabilities returns the capabilities of the obfs4 transport protocol.
+func (t *Transport) Capabilities() base.Capabilities {
+	return base.Capabilities{
+		DummyTraffic: true,
+		IAT:          true,
+		WireOverhead: float64(headerLength) / float64(MaxPacketPayloadLength),
+	}
+}
+
 // ClientFactory returns a new ClientFactory instance.
 func (t *Transport) ClientFactory(stateDir string) (base.ClientFactory, error) {
 	cf := &ClientFactory{Trans: t}
@@ -126,6 +168,9 @@ func NewServerFactory(t base.Transport, stateDir string, args *pt.Args) (*Server
 	ptArgs := pt.Args{}
 	ptArgs.Add(certArg, st.cert.String())
 	ptArgs.Add(iatArg, strconv.Itoa(st.iatMode))
+	if st.puzzle.difficulty > 0 {
+		ptArgs.Add(puzzleArg, strconv.Itoa(st.puzzle.difficulty))
+	}
 
 	// Initialize the replay filter.
 	filter, err := replayfilter.New(replayTTL)
@@ -140,7 +185,7 @@ func NewServerFactory(t base.Transport, stateDir string, args *pt.Args) (*Server
 	}
 	rng := rand.New(drbg)
 
-	sf := &ServerFactory{t, &ptArgs, st.nodeID, st.identityKey, st.drbgSeed, iatSeed, st.iatMode, filter, rng.Intn(maxCloseDelay)}
+	sf := &ServerFactory{t, &ptArgs, st.nodeID, st.identityKey, st.drbgSeed, iatSeed, st.iatMode, filter, rng.Intn(maxCloseDelay), st.puzzle}
 	return sf, nil
 }
 
@@ -206,6 +251,14 @@ func (cf *ClientFactory) ParseArgs(args *pt.Args) (interface{}, error) {
 		return nil, fmt.Errorf("invalid iat-mode '%d'", iatMode)
 	}
 
+	// The client puzzle is optional.
+	var puzzleDifficulty int
+	if puzzleStr, ok := args.Get(puzzleArg); ok {
+		if puzzleDifficulty, err = parsePuzzleDifficulty(puzzleStr); err != nil {
+			return nil, err
+		}
+	}
+
 	// Generate the session key pair before connectiong to hide the Elligator2
 	// rejection sampling from network observers.
 	sessionKey, err := ntor.NewKeypair(true)
@@ -213,27 +266,49 @@ func (cf *ClientFactory) ParseArgs(args *pt.Args) (interface{}, error) {
 		return nil, err
 	}
 
-	return &ClientArgs{nodeID, publicKey, sessionKey, iatMode}, nil
+	return &ClientArgs{nodeID, publicKey, sessionKey, iatMode, puzzleDifficulty}, nil
 }
 
-func (cf *ClientFactory) Dial(network, addr string, dialer net.Dialer, args interface{}) (net.Conn, error) {
+func (cf *ClientFactory) Dial(network, addr string, dialer base.Dialer, args interface{}) (net.Conn, error) {
+	return cf.DialContext(context.Background(), network, addr, dialer, args)
+}
+
+func (cf *ClientFactory) DialContext(ctx context.Context, network, addr string, dialer base.Dialer, args interface{}) (net.Conn, error) {
 	// Validate args before bothering to open connection.
 	ca, ok := args.(*ClientArgs)
 	if !ok {
 		return nil, fmt.Errorf("invalid argument type for args")
 	}
-	conn, err := dialer.Dial(network, addr)
+	conn, err := dialer.DialContext(ctx, network, addr)
 	if err != nil {
 		return nil, err
 	}
 	dialConn := conn
-	if conn, err = NewClientConn(conn, ca); err != nil {
+	if conn, err = NewClientConnContext(ctx, conn, ca); err != nil {
 		dialConn.Close()
 		return nil, err
 	}
 	return conn, nil
 }
 
+// Identity returns the server's identity public key from the parsed args.
+func (cf *ClientFactory) Identity(args interface{}) ([]byte, error) {
+	ca, ok := args.(*ClientArgs)
+	if !ok {
+		return nil, fmt.Errorf("invalid argument type for args")
+	}
+	return ca.PublicKey.Bytes()[:], nil
+}
+
+// Handshake does the client handshake over an established connection.
+func (cf *ClientFactory) Handshake(ctx context.Context, conn net.Conn, args interface{}) (net.Conn, error) {
+	ca, ok := args.(*ClientArgs)
+	if !ok {
+		return nil, fmt.Errorf("invalid argument type for args")
+	}
+	return NewClientConnContext(ctx, conn, ca)
+}
+
 type ServerFactory struct {
 	transport base.Transport
 	args      *pt.Args
@@ -246,6 +321,8 @@ type ServerFactory struct {
 	replayFilter *replayfilter.ReplayFilter
 
 	closeDelay int
+
+	puzzle serverPuzzle
 }
 
 func (sf *ServerFactory) Transport() base.Transport {
@@ -256,36 +333,93 @@ func (sf *ServerFactory) Args() *pt.Args {
 	return sf.args
 }
 
+// DescribeParams returns the IAT mode, the distribution bias, the client
+// puzzle, and the node ID.
+func (sf *ServerFactory) DescribeParams() (map[string]string, error) {
+	return map[string]string{
+		iatArg:        strconv.Itoa(sf.iatMode),
+		"dist-bias":   strconv.FormatBool(biasedDist),
+		puzzleArg:     strconv.Itoa(sf.puzzle.difficulty),
+		puzzleModeArg: sf.puzzle.mode,
+		nodeIDArg:     sf.nodeID.Hex(),
+	}, nil
+}
+
+// Identity returns the server's identity public key.
+func (sf *ServerFactory) Identity() []byte {
+	return sf.identityKey.Public().Bytes()[:]
+}
+
 func (sf *ServerFactory) WrapConn(conn net.Conn) (net.Conn, error) {
+	c, closeFailed, err := sf.WrapConnDelayed(conn)
+	if err != nil {
+		closeFailed()
+		return nil, err
+	}
+	return c, nil
+}
+
+// WrapConnDelayed is WrapConn, except that the delayed close of a connection
+// that failed the handshake is left to the returned function.
+func (sf *ServerFactory) WrapConnDelayed(conn net.Conn) (net.Conn, func(), error) {
 	// Not much point in having a separate newServerConn routine when
 	// wrapping requires using values from the factory instance.
+	startTime := time.Now()
+	deadline := startTime.Add(serverHandshakeTimeout)
 
 	// Generate the session keypair *before* consuming data from the peer, to
 	// attempt to mask the rejection sampling due to use of Elligator2.  This
 	// might be futile, but the timing differential isn't very large on modern
 	// hardware, and there are far easier statistical attacks that can be
 	// mounted as a distinguisher.
-	sessionKey, err := ntor.NewKeypair(true)
+	var sessionKey *ntor.Keypair
+	var lenDist, iatDist *probdist.WeightedDist
+	var err error
+	if perr := runHandshakeJob(deadline, func() {
+		if sessionKey, err = ntor.NewKeypair(true); err != nil {
+			return
+		}
+		lenDist = probdist.New(sf.lenSeed, 0, f.MaximumSegmentLength, biasedDist)
+		if sf.iatSeed != nil {
+			iatDist = probdist.New(sf.iatSeed, 0, maxIATDelay, biasedDist)
+		}
+	}); perr != nil {
+		return nil, func() {
+			(&Conn{Conn: conn, isServer: true}).closeAfterDelay(sf, startTime)
+		}, perr
+	}
 	if err != nil {
-		return nil, err
+		return nil, func() {}, err
 	}
 
-	lenDist := probdist.New(sf.lenSeed, 0, f.MaximumSegmentLength, biasedDist)
-	var iatDist *probdist.WeightedDist
-	if sf.iatSeed != nil {
-		iatDist = probdist.New(sf.iatSeed, 0, maxIATDelay, biasedDist)
+	c := &Conn{Conn: conn, isServer: true, lenDist: lenDist, iatDist: iatDist, iatMode: sf.iatMode}
+
+	if err = c.serverHandshake(sf, sessionKey, deadline); err != nil {
+		return nil, func() {
+			c.closeAfterDelay(sf, startTime)
+		}, err
 	}
 
-	c := &Conn{conn, true, lenDist, iatDist, sf.iatMode, nil, nil, false}
+	return c, nil, nil
+}
 
-	startTime := time.Now()
+// Reject closes conn after the same delay as a connection that failed the
+// handshake, discarding what the peer sends.
+func (sf *ServerFactory) Reject(conn net.Conn) {
+	c := &Conn{Conn: conn, isServer: true}
+	c.closeAfterDelay(sf, time.Now())
+}
 
-	if err = c.serverHandshake(sf, sessionKey); err != nil {
-		c.closeAfterDelay(sf, startTime)
-		return nil, err
-	}
+// RejectDelay returns how long a connection that failed the handshake is
+// held open.
+func (sf *ServerFactory) RejectDelay() time.Duration {
+	return time.Duration(sf.closeDelay)*time.Second + serverHandshakeTimeout
+}
 
-	return c, nil
+// Listen announces on the local network address, and returns a net.Listener
+// that only returns connections that have completed the obfs4 handshake.
+func (sf *ServerFactory) Listen(network, address string) (net.Listener, error) {
+	return base.Listen(sf, network, address)
 }
 
 type Conn struct {
@@ -301,9 +435,20 @@ type Conn struct {
 	decoder *framing.ObfsDecoder
 
 	connEstablished bool
+
+	// writeLock serializes Write with WriteDummyTraffic, as both advance
+	// the encoder state.
+	writeLock sync.Mutex
 }
 
 func NewClientConn(conn net.Conn, args *ClientArgs) (c *Conn, err error) {
+	return NewClientConnContext(context.Background(), conn, args)
+}
+
+// NewClientConnContext wraps conn and does the client handshake.  The
+// handshake is aborted if ctx is done before it completes, and is bounded by
+// the earlier of ctx's deadline and clientHandshakeTimeout.
+func NewClientConnContext(ctx context.Context, conn net.Conn, args *ClientArgs) (c *Conn, err error) {
 	// Generate the initial protocol polymorphism distribution(s).
 	var seed *drbg.Seed
 	if seed, err = drbg.NewSeed(); err != nil {
@@ -321,15 +466,17 @@ func NewClientConn(conn net.Conn, args *ClientArgs) (c *Conn, err error) {
 	}
 
 	// Allocate the client structure.
-	c = &Conn{conn, false, lenDist, iatDist, args.IatMode, nil, nil, false}
+	c = &Conn{Conn: conn, lenDist: lenDist, iatDist: iatDist, iatMode: args.IatMode}
 
 	// Start the handshake timeout.
-	deadline := time.Now().Add(clientHandshakeTimeout)
+	deadline := ctxconn.Deadline(ctx, clientHandshakeTimeout)
 	if err = conn.SetDeadline(deadline); err != nil {
 		return nil, err
 	}
 
-	if err = c.clientHandshake(args.NodeID, args.PublicKey, args.SessionKey); err != nil {
+	stop := ctxconn.Guard(ctx, conn)
+	err = c.clientHandshake(args.NodeID, args.PublicKey, args.SessionKey, args.PuzzleDifficulty)
+	if err = stop(err); err != nil {
 		return nil, err
 	}
 
@@ -341,13 +488,14 @@ func NewClientConn(conn net.Conn, args *ClientArgs) (c *Conn, err error) {
 	return
 }
 
-func (conn *Conn) clientHandshake(nodeID *ntor.NodeID, peerIdentityKey *ntor.PublicKey, sessionKey *ntor.Keypair) error {
+func (conn *Conn) clientHandshake(nodeID *ntor.NodeID, peerIdentityKey *ntor.PublicKey, sessionKey *ntor.Keypair, puzzleDifficulty int) error {
 	if conn.isServer {
 		return fmt.Errorf("clientHandshake called on server connection")
 	}
 
 	// Generate and send the client handshake.
 	hs := newClientHandshake(nodeID, peerIdentityKey, sessionKey)
+	hs.puzzleDifficulty = puzzleDifficulty
 	blob, err := hs.generateHandshake()
 	if err != nil {
 		return err
@@ -401,14 +549,15 @@ func (conn *Conn) newDecoder(key []byte) {
 	conn.decoder = decoder
 }
 
-func (conn *Conn) serverHandshake(sf *ServerFactory, sessionKey *ntor.Keypair) error {
+func (conn *Conn) serverHandshake(sf *ServerFactory, sessionKey *ntor.Keypair, deadline time.Time) error {
 	if !conn.isServer {
 		return fmt.Errorf("serverHandshake called on client connection")
 	}
 
 	// Generate the server handshake, and arm the base timeout.
 	hs := newServerHandshake(sf.nodeID, sf.identityKey, sessionKey)
-	if err := conn.Conn.SetDeadline(time.Now().Add(serverHandshakeTimeout)); err != nil {
+	hs.puzzle = &sf.puzzle
+	if err := conn.Conn.SetDeadline(deadline); err != nil {
 		return err
 	}
 
@@ -424,7 +573,12 @@ func (conn *Conn) serverHandshake(sf *ServerFactory, sessionKey *ntor.Keypair) e
 		}
 		receiveBuffer.Write(hsBuf[:n])
 
-		seed, err := hs.parseClientHandshake(sf.replayFilter, receiveBuffer.Bytes())
+		var seed []byte
+		if perr := runHandshakeJob(deadline, func() {
+			seed, err = hs.parseClientHandshake(sf.replayFilter, receiveBuffer.Bytes())
+		}); perr != nil {
+			return perr
+		}
 		if err == ErrMarkNotFoundYet {
 			continue
 		} else if err != nil {
@@ -499,6 +653,9 @@ func (conn *Conn) prngRegen(payload []byte) error {
 }
 
 func (conn *Conn) Write(b []byte) (n int, err error) {
+	conn.writeLock.Lock()
+	defer conn.writeLock.Unlock()
+
 	var frameBuf bytes.Buffer
 	frameBuf, n, err = conn.encoder.Chop(b, framing.PacketTypePayload)
 	if err != nil {
@@ -586,8 +743,7 @@ func (conn *Conn) closeAfterDelay(sf *ServerFactory, startTime time.Time) {
 	// I-it's not like I w-wanna handshake with you or anything.  B-b-baka!
 	defer conn.Conn.Close()
 
-	delay := time.Duration(sf.closeDelay)*time.Second + serverHandshakeTimeout
-	deadline := startTime.Add(delay)
+	deadline := startTime.Add(sf.RejectDelay())
 	if time.Now().After(deadline) {
 		return
 	}
@@ -630,8 +786,22 @@ func (conn *Conn) padBurst(burst *bytes.Buffer, toPadTo int) (err error) {
 	return
 }
 
-// getDummyTraffic must be of type sharknado.DummyTrafficFunc and return `n`
-// bytes of dummy traffic that's ready to be written to the wire.
+// WriteDummyTraffic implements base.DummyTrafficConn, and writes `n` bytes of
+// dummy traffic to the wire.
+func (conn *Conn) WriteDummyTraffic(n int) (int, error) {
+	conn.writeLock.Lock()
+	defer conn.writeLock.Unlock()
+
+	data, err := conn.GetDummyTraffic(n)
+	if err != nil {
+		return 0, err
+	}
+	return conn.Conn.Write(data)
+}
+
+// GetDummyTraffic implements base.DummyTrafficConn, and returns `n` bytes of
+// dummy traffic that's ready to be written to the wire.  The caller is
+// responsible for serializing this with Write.
 func (conn *Conn) GetDummyTraffic(n int) ([]byte, error) {
 	// IDEA: This would make a lot more sense as a generic
 	//			 function in sharknado.
@@ -673,5 +843,9 @@ func init() {
 
 var _ base.ClientFactory = (*ClientFactory)(nil)
 var _ base.ServerFactory = (*ServerFactory)(nil)
+var _ base.Rejecter = (*ServerFactory)(nil)
+var _ base.DelayedCloser = (*ServerFactory)(nil)
 var _ base.Transport = (*Transport)(nil)
+var _ base.CapabilityTransport = (*Transport)(nil)
 var _ net.Conn = (*Conn)(nil)
+var _ base.DummyTrafficConn = (*Conn)(nil)
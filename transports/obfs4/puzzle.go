@@ -0,0 +1,131 @@
+package obfs4
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
+	"math"
+	"math/bits"
+	"strconv"
+
+	"github.com/RACECAR-GU/obfsX/common/csrand"
+	"github.com/RACECAR-GU/obfsX/common/ntor"
+)
+
+// The client puzzle is a proof of work, that the client hides in the padding
+// of its handshake, so that a loaded server can turn away the clients that
+// did not spend the CPU time, before doing the ntor handshake.
+//
+// The proof is a nonce N, the first puzzleNonceLength bytes of P_C, such that
+// HMAC-SHA256(serverIdentity | NodeID, "obfs4-puzzle" | X | N | E) has at
+// least the puzzle difficulty of leading zero bits.  As the HMAC is keyed with
+// the bridge line secrets (like M_C), N is indistinguishable from the random
+// padding that it replaces, and as it covers X and E, a proof can not be
+// reused.
+
+const (
+	puzzleArg     = "puzzle"
+	puzzleModeArg = "puzzle-mode"
+
+	// puzzleModeAlways always requires the proof, and puzzleModeAdaptive
+	// scales the required difficulty with the depth of the handshake queue
+	// (see SetHandshakePool), to the full difficulty once it is half full.
+	// The clients can not tell how loaded the server is, so they always
+	// solve the puzzle at the difficulty of their bridge line, and the
+	// adaptive mode only lets in the clients without one (eg: with an
+	// older bridge line) while the server is not loaded.
+	puzzleModeAlways   = "always"
+	puzzleModeAdaptive = "adaptive"
+
+	// maxPuzzleDifficulty bounds the work of the clients, 2^20 HMACs being
+	// around a second.
+	maxPuzzleDifficulty = 20
+
+	puzzleNonceLength = 16
+	puzzlePrefix      = "obfs4-puzzle"
+)
+
+// ErrPuzzleFailed is the error returned when the client handshake does not
+// carry a proof of work of the required difficulty.  This error is fatal and
+// the connection MUST be dropped.
+var ErrPuzzleFailed = errors.New("handshake: client puzzle not solved")
+
+// parsePuzzleDifficulty parses the "puzzle" argument.
+func parsePuzzleDifficulty(s string) (int, error) {
+	difficulty, err := strconv.Atoi(s)
+	if err != nil || difficulty < 0 || difficulty > maxPuzzleDifficulty {
+		return 0, fmt.Errorf("invalid %s '%s'", puzzleArg, s)
+	}
+	return difficulty, nil
+}
+
+// serverPuzzle is the client puzzle that a server requires.
+type serverPuzzle struct {
+	difficulty int
+	mode       string
+}
+
+// required returns the difficulty that a client handshake must meet now.
+func (p *serverPuzzle) required() int {
+	if p.difficulty == 0 || p.mode == puzzleModeAlways {
+		return p.difficulty
+	}
+	if handshakePool == nil {
+		return 0
+	}
+	st := handshakePool.Stats()
+	if st.QueueLen == 0 {
+		if st.Running < st.Workers {
+			return 0
+		}
+		return p.difficulty
+	}
+	load := math.Min(1, 2*float64(st.Queued)/float64(st.QueueLen))
+	return int(math.Ceil(load * float64(p.difficulty)))
+}
+
+// puzzleDigest returns the digest of the proof nonce.
+func puzzleDigest(mac hash.Hash, representative *ntor.Representative, nonce, epochHour, b []byte) []byte {
+	mac.Reset()
+	_, _ = mac.Write([]byte(puzzlePrefix))
+	_, _ = mac.Write(representative.Bytes()[:])
+	_, _ = mac.Write(nonce)
+	_, _ = mac.Write(epochHour)
+	return mac.Sum(b[:0])
+}
+
+// leadingZeros returns the number of leading zero bits of b.
+func leadingZeros(b []byte) int {
+	n := 0
+	for _, v := range b {
+		if v != 0 {
+			return n + bits.LeadingZeros8(v)
+		}
+		n += 8
+	}
+	return n
+}
+
+// solvePuzzle returns a proof nonce of the difficulty.  The nonce starts out
+// random and is counted up from there, so it stays uniformly distributed.
+func solvePuzzle(mac hash.Hash, representative *ntor.Representative, epochHour []byte, difficulty int) ([]byte, error) {
+	nonce := make([]byte, puzzleNonceLength)
+	if err := csrand.Bytes(nonce); err != nil {
+		return nil, err
+	}
+	counter := nonce[puzzleNonceLength-8:]
+	var digest []byte
+	for {
+		digest = puzzleDigest(mac, representative, nonce, epochHour, digest)
+		if leadingZeros(digest) >= difficulty {
+			return nonce, nil
+		}
+		binary.BigEndian.PutUint64(counter, binary.BigEndian.Uint64(counter)+1)
+	}
+}
+
+// checkPuzzle returns if nonce is a proof of the difficulty.
+func checkPuzzle(mac hash.Hash, representative *ntor.Representative, nonce, epochHour []byte, difficulty int) bool {
+	return leadingZeros(puzzleDigest(mac, representative, nonce, epochHour, nil)) >= difficulty
+}
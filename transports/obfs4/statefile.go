@@ -57,6 +57,8 @@ type jsonServerState struct {
 	PublicKey  string `json:"public-key"`
 	DrbgSeed   string `json:"drbg-seed"`
 	IATMode    int    `json:"iat-mode"`
+	Puzzle     int    `json:"puzzle,omitempty"`
+	PuzzleMode string `json:"puzzle-mode,omitempty"`
 }
 
 type jsonClientState struct {
@@ -106,6 +108,7 @@ type obfs4ServerState struct {
 	identityKey *ntor.Keypair
 	drbgSeed    *drbg.Seed
 	iatMode     int
+	puzzle      serverPuzzle
 
 	cert *obfs4ServerCert
 }
@@ -115,7 +118,11 @@ type obfs4ClientState struct {
 }
 
 func (st *obfs4ServerState) clientString() string {
-	return fmt.Sprintf("%s=%s %s=%d", certArg, st.cert, iatArg, st.iatMode)
+	s := fmt.Sprintf("%s=%s %s=%d", certArg, st.cert, iatArg, st.iatMode)
+	if st.puzzle.difficulty > 0 {
+		s += fmt.Sprintf(" %s=%d", puzzleArg, st.puzzle.difficulty)
+	}
+	return s
 }
 
 func serverStateFromArgs(stateDir string, args *pt.Args) (*obfs4ServerState, error) {
@@ -126,6 +133,8 @@ func serverStateFromArgs(stateDir string, args *pt.Args) (*obfs4ServerState, err
 	js.PrivateKey, privKeyOk = args.Get(privateKeyArg)
 	js.DrbgSeed, seedOk = args.Get(seedArg)
 	iatStr, iatOk := args.Get(iatArg)
+	puzzleStr, puzzleOk := args.Get(puzzleArg)
+	puzzleMode, puzzleModeOk := args.Get(puzzleModeArg)
 
 	// Either a private key, node id, and seed are ALL specified, or
 	// they should be loaded from the state file.
@@ -152,6 +161,18 @@ func serverStateFromArgs(stateDir string, args *pt.Args) (*obfs4ServerState, err
 		js.IATMode = iatMode
 	}
 
+	// So should the client puzzle.
+	if puzzleOk {
+		difficulty, err := parsePuzzleDifficulty(puzzleStr)
+		if err != nil {
+			return nil, err
+		}
+		js.Puzzle = difficulty
+	}
+	if puzzleModeOk {
+		js.PuzzleMode = puzzleMode
+	}
+
 	return serverStateFromJSONServerState(stateDir, &js)
 }
 
@@ -189,6 +210,18 @@ func serverStateFromJSONServerState(stateDir string, js *jsonServerState) (*obfs
 		return nil, fmt.Errorf("invalid iat-mode '%d'", js.IATMode)
 	}
 	st.iatMode = js.IATMode
+	if js.Puzzle < 0 || js.Puzzle > maxPuzzleDifficulty {
+		return nil, fmt.Errorf("invalid %s '%d'", puzzleArg, js.Puzzle)
+	}
+	st.puzzle.difficulty = js.Puzzle
+	switch js.PuzzleMode {
+	case "":
+		st.puzzle.mode = puzzleModeAdaptive
+	case puzzleModeAlways, puzzleModeAdaptive:
+		st.puzzle.mode = js.PuzzleMode
+	default:
+		return nil, fmt.Errorf("invalid %s '%s'", puzzleModeArg, js.PuzzleMode)
+	}
 	st.cert = serverCertFromState(st)
 
 	// Generate a human readable summary of the configured endpoint.
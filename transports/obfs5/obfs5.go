@@ -30,31 +30,100 @@
 package obfs5 // import "github.com/RACECAR-GU/obfsX/transports/obfs5"
 
 import (
+	"context"
+	"crypto/sha256"
 	"flag"
 	"fmt"
 	"net"
+	"strconv"
 
 	pt "git.torproject.org/pluggable-transports/goptlib.git"
 	"github.com/RACECAR-GU/obfsX/common/drbg"
 	"github.com/RACECAR-GU/obfsX/transports/base"
 	"github.com/RACECAR-GU/obfsX/transports/obfs4"
-
-	// "github.com/RACECAR-GU/obfsX/transports/sharknado"
 	"github.com/RACECAR-GU/obfsX/transports/riverrun"
+	"github.com/RACECAR-GU/obfsX/transports/sharknado"
 )
 
 const (
 	transportName = "obfs5"
 
 	biasCmdArg = "obfs5-distBias"
+
+	// riverrunArgPrefix prefixes the riverrun parameters in the bridge line
+	// and server options (eg: "rr-bias-min").
+	riverrunArgPrefix = "rr-"
+	sharknadoArg      = "sharknado"
+
+	sharknadoSeedPrefix = "obfs5 sharknado seed:"
 )
 
 // biasedDist controls if the probability table will be ScrambleSuit style or
 // uniformly distributed.
 var biasedDist bool
 
+// ClientArgs are the parsed obfs5 bridge line arguments.
 type ClientArgs struct {
 	*obfs4.ClientArgs
+
+	// Riverrun are the riverrun shaping parameters, which default to
+	// riverrun.DefaultParams().
+	Riverrun *riverrun.Params
+
+	// Sharknado enables the sharknado dummy traffic layer.
+	Sharknado bool
+}
+
+// parseArgs parses the obfs5 specific arguments, common to the bridge line
+// and the server options.
+func parseArgs(args *pt.Args) (*riverrun.Params, bool, error) {
+	params, err := riverrun.ParseParams(args, riverrunArgPrefix)
+	if err != nil {
+		return nil, false, err
+	}
+
+	var enableSharknado bool
+	if s, ok := args.Get(sharknadoArg); ok {
+		if enableSharknado, err = strconv.ParseBool(s); err != nil {
+			return nil, false, fmt.Errorf("malformed %s '%s'", sharknadoArg, s)
+		}
+	}
+	return params, enableSharknado, nil
+}
+
+// seedsFromIdentity derives the riverrun and sharknado seeds from the server's
+// public key.  All clients that talk to the same obfs5 server should shape
+// their flows identically.
+func seedsFromIdentity(publicKey []byte) (rrSeed, snSeed *drbg.Seed, err error) {
+	if rrSeed, err = drbg.SeedFromBytes(publicKey[:drbg.SeedLength]); err != nil {
+		return nil, nil, err
+	}
+	snSrc := sha256.Sum256(append([]byte(sharknadoSeedPrefix), publicKey...))
+	if snSeed, err = drbg.SeedFromBytes(snSrc[:]); err != nil {
+		return nil, nil, err
+	}
+	return
+}
+
+// layers returns the layers under obfs4, riverrun and optionally sharknado,
+// as stacked by the transport composer, and their per-connection
+// configuration.  Unlike the composer's, their seeds are derived by
+// seedsFromIdentity.
+func layers(publicKey []byte, isServer bool, params *riverrun.Params, enableSharknado bool) (base.Stack, []*base.LayerConfig, error) {
+	if params == nil {
+		params = riverrun.DefaultParams()
+	}
+	rrSeed, snSeed, err := seedsFromIdentity(publicKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	stack := base.Stack{new(riverrun.Layer)}
+	cfgs := []*base.LayerConfig{{IsServer: isServer, Seed: rrSeed, Args: params}}
+	if enableSharknado {
+		stack = append(stack, new(sharknado.Layer))
+		cfgs = append(cfgs, &base.LayerConfig{IsServer: isServer, Seed: snSeed})
+	}
+	return stack, cfgs, nil
 }
 
 // Transport is the obfs5 implementation of the base.Transport interface.
@@ -67,6 +136,11 @@ func (t *Transport) Name() string {
 	return transportName
 }
 
+// Capabilities returns the capabilities of the obfs5 transport protocol.
+func (t *Transport) Capabilities() base.Capabilities {
+	return new(riverrun.Layer).Capabilities(t.Transport.Capabilities())
+}
+
 // ClientFactory returns a new ClientFactory instance.
 func (t *Transport) ClientFactory(stateDir string) (base.ClientFactory, error) {
 	cf := new(ClientFactory)
@@ -82,6 +156,23 @@ func (t *Transport) ServerFactory(stateDir string, args *pt.Args) (s base.Server
 		return nil, err
 	}
 	sf.ServerFactory = subsf
+	if sf.params, sf.sharknado, err = parseArgs(args); err != nil {
+		return nil, err
+	}
+
+	// Advertise the explicitly configured obfs5 arguments, the clients
+	// need to use the same ones.
+	ptArgs := make(pt.Args)
+	for k, v := range *subsf.Args() {
+		ptArgs[k] = append([]string(nil), v...)
+	}
+	for k, v := range sf.params.Args() {
+		ptArgs[k] = v
+	}
+	if s, ok := args.Get(sharknadoArg); ok {
+		ptArgs.Add(sharknadoArg, s)
+	}
+	sf.args = &ptArgs
 
 	return sf, nil
 }
@@ -90,58 +181,148 @@ type ClientFactory struct {
 	*obfs4.ClientFactory
 }
 
-func (cf *ClientFactory) Dial(network, addr string, dialer net.Dialer, args interface{}) (net.Conn, error) {
+// ParseArgs parses the obfs4 arguments, and the optional obfs5 ones.
+func (cf *ClientFactory) ParseArgs(args *pt.Args) (interface{}, error) {
+	subca, err := cf.ClientFactory.ParseArgs(args)
+	if err != nil {
+		return nil, err
+	}
+	params, enableSharknado, err := parseArgs(args)
+	if err != nil {
+		return nil, err
+	}
+	return &ClientArgs{subca.(*obfs4.ClientArgs), params, enableSharknado}, nil
+}
+
+func (cf *ClientFactory) Dial(network, addr string, dialer base.Dialer, args interface{}) (net.Conn, error) {
+	return cf.DialContext(context.Background(), network, addr, dialer, args)
+}
+
+func (cf *ClientFactory) DialContext(ctx context.Context, network, addr string, dialer base.Dialer, args interface{}) (net.Conn, error) {
 	// Validate args before bothering to open connection.
-	ca := new(ClientArgs)
-	// XXX: Just realized I messed up here - should parse to obfs5 right away
-	subca, ok := args.(*obfs4.ClientArgs)
+	ca, ok := args.(*ClientArgs)
 	if !ok {
 		return nil, fmt.Errorf("invalid argument type for args")
 	}
-	ca.ClientArgs = subca
-	serverSeed, err := drbg.SeedFromBytes(ca.PublicKey[:drbg.SeedLength])
+	stack, cfgs, err := layers(ca.PublicKey.Bytes()[:], false, ca.Riverrun, ca.Sharknado)
 	if err != nil {
 		return nil, err
 	}
-	ctrl, err := riverrun.Get_control_fn(serverSeed)
-	if err != nil {
+	// The MSS is applied to the first hop, which is the upstream proxy if
+	// one is configured.
+	if dialer.Control, err = stack.Control(dialer.Control, cfgs); err != nil {
 		return nil, err
 	}
-	dialer.Control = ctrl
-	conn, err := dialer.Dial(network, addr)
+	conn, err := dialer.DialContext(ctx, network, addr)
 	if err != nil {
 		return nil, err
 	}
 	dialConn := conn
-	if conn, err = NewClientConn(conn, ca); err != nil {
+	if conn, err = NewClientConnContext(ctx, conn, ca); err != nil {
 		dialConn.Close()
 		return nil, err
 	}
 	return conn, nil
 }
 
+// Identity returns the server's identity public key from the parsed args.
+func (cf *ClientFactory) Identity(args interface{}) ([]byte, error) {
+	ca, ok := args.(*ClientArgs)
+	if !ok {
+		return nil, fmt.Errorf("invalid argument type for args")
+	}
+	return ca.PublicKey.Bytes()[:], nil
+}
+
+// Handshake does the client handshake over an established connection.  It
+// MUST be overridden, as the embedded obfs4 implementation would bypass
+// riverrun.
+func (cf *ClientFactory) Handshake(ctx context.Context, conn net.Conn, args interface{}) (net.Conn, error) {
+	ca, ok := args.(*ClientArgs)
+	if !ok {
+		return nil, fmt.Errorf("invalid argument type for args")
+	}
+	return NewClientConnContext(ctx, conn, ca)
+}
+
 type ServerFactory struct {
 	*obfs4.ServerFactory
+
+	args      *pt.Args
+	params    *riverrun.Params
+	sharknado bool
 }
 
-func (sf *ServerFactory) WrapConn(conn net.Conn) (net.Conn, error) {
-	// Not much point in having a separate newServerConn routine when
-	// wrapping requires using values from the factory instance.
+// Args returns the obfs4 arguments, and the configured obfs5 ones.
+func (sf *ServerFactory) Args() *pt.Args {
+	return sf.args
+}
 
-	_, publicKey, err := obfs4.ParseCert(sf.Args())
+// DescribeParams returns the obfs4 parameters, and the riverrun shaping
+// parameters derived from the identity key.
+func (sf *ServerFactory) DescribeParams() (map[string]string, error) {
+	params, err := sf.ServerFactory.DescribeParams()
+	if err != nil {
+		return nil, err
+	}
+	rrSeed, _, err := seedsFromIdentity(sf.Identity())
 	if err != nil {
 		return nil, err
 	}
-	serverSeed, err := drbg.SeedFromBytes(publicKey[:drbg.SeedLength])
+	d, err := riverrun.Derive(rrSeed, sf.params)
 	if err != nil {
 		return nil, err
 	}
-	inner, err := riverrun.NewConn(conn, true, serverSeed)
+	params[riverrunArgPrefix+"bias"] = strconv.FormatFloat(d.Bias, 'f', -1, 64)
+	params[riverrunArgPrefix+"compressed-bits"] = strconv.FormatUint(d.CompressedBlockBits, 10)
+	params[riverrunArgPrefix+"expanded-bits"] = strconv.FormatUint(d.ExpandedBlockBits, 10)
+	params[riverrunArgPrefix+"mss"] = strconv.Itoa(d.MSSMax)
+	params[riverrunArgPrefix+"mss-dev"] = strconv.FormatFloat(d.MSSDev, 'f', -1, 64)
+	params[sharknadoArg] = strconv.FormatBool(sf.sharknado)
+	return params, nil
+}
+
+func (sf *ServerFactory) WrapConn(conn net.Conn) (net.Conn, error) {
+	c, closeFailed, err := sf.WrapConnDelayed(conn)
 	if err != nil {
+		closeFailed()
 		return nil, err
 	}
+	return c, nil
+}
+
+// WrapConnDelayed is WrapConn, except that the delayed close of a connection
+// that failed the handshake is left to the returned function.  This MUST be
+// overridden, as the embedded obfs4 implementation would bypass riverrun.
+func (sf *ServerFactory) WrapConnDelayed(conn net.Conn) (net.Conn, func(), error) {
+	// Not much point in having a separate newServerConn routine when
+	// wrapping requires using values from the factory instance.
+	stack, cfgs, err := layers(sf.Identity(), true, sf.params, sf.sharknado)
+	if err != nil {
+		return nil, func() {}, err
+	}
+	conns, err := stack.Wrap(conn, cfgs)
+	if err != nil {
+		return nil, func() {}, err
+	}
+
+	c, closeFailed, err := sf.ServerFactory.WrapConnDelayed(conns[len(conns)-1])
+	if err != nil {
+		return nil, closeFailed, err
+	}
+	if err = stack.Attach(conns, c); err != nil {
+		c.Close()
+		return nil, func() {}, err
+	}
+	return c, nil, nil
+}
 
-	return sf.ServerFactory.WrapConn(inner)
+// Listen announces on the local network address, and returns a net.Listener
+// that only returns connections that have completed the obfs5 handshake.
+func (sf *ServerFactory) Listen(network, address string) (net.Listener, error) {
+	// This MUST be overridden, as the embedded obfs4 implementation would
+	// bypass riverrun.
+	return base.Listen(sf, network, address)
 }
 
 type Conn struct {
@@ -149,24 +330,38 @@ type Conn struct {
 }
 
 func NewClientConn(conn net.Conn, args *ClientArgs) (c *Conn, err error) {
-	// All clients that talk to the same obfs5 server should shape their flows
-	// identically, so we derive riverrun/sharknado's seed from our obfs5 server's
-	// public key.
-	serverSeed, err := drbg.SeedFromBytes(args.PublicKey[:drbg.SeedLength])
+	return NewClientConnContext(context.Background(), conn, args)
+}
+
+// NewClientConnContext wraps conn with riverrun (and sharknado if enabled) and
+// obfs4, aborting the setup and handshake if ctx is done before they complete.
+func NewClientConnContext(ctx context.Context, conn net.Conn, args *ClientArgs) (c *Conn, err error) {
+	// Allocate the client structure.
+	stack, cfgs, err := layers(args.PublicKey.Bytes()[:], false, args.Riverrun, args.Sharknado)
 	if err != nil {
 		return nil, err
 	}
-
-	// Allocate the client structure.
-	rr, err := riverrun.NewConn(conn, false, serverSeed)
+	conns, err := stack.Wrap(conn, cfgs)
 	if err != nil {
 		return nil, err
 	}
-	outer, err := obfs4.NewClientConn(rr, args.ClientArgs)
+	lower := conns[len(conns)-1]
+
+	// Generating the riverrun tables can take a while, check that the
+	// caller still cares before handshaking.
+	if err = ctx.Err(); err != nil {
+		lower.Close()
+		return nil, err
+	}
+	outer, err := obfs4.NewClientConnContext(ctx, lower, args.ClientArgs)
 	if err != nil {
+		lower.Close()
+		return nil, err
+	}
+	if err = stack.Attach(conns, outer); err != nil {
+		outer.Close()
 		return nil, err
 	}
-	// outer.Conn = sharknado.NewConn(rr, outer.GetDummyTraffic, serverSeed)
 
 	c = new(Conn)
 	c.Conn = outer
@@ -179,5 +374,8 @@ func init() {
 
 var _ base.ClientFactory = (*ClientFactory)(nil)
 var _ base.ServerFactory = (*ServerFactory)(nil)
+var _ base.Rejecter = (*ServerFactory)(nil)
+var _ base.DelayedCloser = (*ServerFactory)(nil)
 var _ base.Transport = (*Transport)(nil)
+var _ base.CapabilityTransport = (*Transport)(nil)
 var _ net.Conn = (*Conn)(nil)
@@ -0,0 +1,56 @@
+package riverrun
+
+import (
+	"fmt"
+	"net"
+	"syscall"
+
+	"git.torproject.org/pluggable-transports/goptlib.git"
+	"github.com/RACECAR-GU/obfsX/transports/base"
+)
+
+// LayerName is the name of the riverrun layer.
+const LayerName = "riverrun"
+
+// Layer is the riverrun implementation of the base.Layer interface.
+type Layer struct{}
+
+// Name returns the name of the riverrun layer.
+func (l *Layer) Name() string {
+	return LayerName
+}
+
+// ParseArgs parses the riverrun Params (eg: "bias-min").
+func (l *Layer) ParseArgs(args *pt.Args) (interface{}, error) {
+	p, err := ParseParams(args, "")
+	if err != nil {
+		return nil, err
+	}
+	for k := range *args {
+		if _, ok := p.specified[k]; !ok {
+			return nil, fmt.Errorf("unknown argument '%s'", k)
+		}
+	}
+	return p, nil
+}
+
+// WrapConn wraps conn with riverrun.
+func (l *Layer) WrapConn(conn net.Conn, cfg *base.LayerConfig) (net.Conn, error) {
+	return NewConnWithParams(conn, cfg.IsServer, cfg.Seed, cfg.Args.(*Params))
+}
+
+// Capabilities returns the capabilities of the stack with riverrun added,
+// with the default Params.
+func (l *Layer) Capabilities(caps base.Capabilities) base.Capabilities {
+	rrOverhead := WireOverhead(CompressedBlockBits, ExpandedBlockBits)
+	caps.WireOverhead = (1+caps.WireOverhead)*(1+rrOverhead) - 1
+	caps.SocketControl = true
+	return caps
+}
+
+// Control returns the hook that sets the client's TCP_MAXSEG.
+func (l *Layer) Control(cfg *base.LayerConfig) (func(network, address string, c syscall.RawConn) error, error) {
+	return Get_control_fn_with_params(cfg.Seed, cfg.Args.(*Params))
+}
+
+var _ base.ControlLayer = (*Layer)(nil)
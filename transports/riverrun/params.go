@@ -0,0 +1,178 @@
+package riverrun
+
+import (
+	"fmt"
+	"strconv"
+
+	"git.torproject.org/pluggable-transports/goptlib.git"
+)
+
+const (
+	biasMinArg    = "bias-min"
+	biasMaxArg    = "bias-max"
+	compressedArg = "compressed-bits"
+	expandedArg   = "expanded-bits"
+	mssMinArg     = "mss-min"
+	mssMaxArg     = "mss-max"
+	mssDevArg     = "mss-dev"
+
+	// Low biases take forever to sample enough distinct expanded blocks.
+	lowestBias      = 0.1
+	highestBias     = 0.5
+	lowestMSS       = 536
+	highestMSS      = 1460
+	highestMSSDev   = 100
+	maxExpandedBits = 64
+
+	defaultBiasMin = 0.1
+	defaultBiasMax = 0.3
+	defaultMSSMin  = 600
+	defaultMSSMax  = 1400
+	defaultMSSDev  = 4
+)
+
+// Params are the ranges that a riverrun connection's shaping parameters are
+// drawn from, using the seed.  Both sides MUST use the same Params.
+type Params struct {
+	// BiasMin and BiasMax bound the probability of a set bit in the
+	// expanded blocks.
+	BiasMin float64
+	BiasMax float64
+
+	// CompressedBlockBits is the size of a plaintext block (8 or 16), and
+	// ExpandedBlockBits the size it is expanded to on the wire.
+	CompressedBlockBits uint64
+	ExpandedBlockBits   uint64
+
+	// MSSMin and MSSMax bound the TCP MSS, and the target segment size.
+	MSSMin int
+	MSSMax int
+
+	// MSSDev bounds the standard deviation of the segment sizes below the
+	// target.
+	MSSDev float64
+
+	// specified are the arguments that were explicitly set.
+	specified pt.Args
+}
+
+// DefaultParams returns the default Params.
+func DefaultParams() *Params {
+	return &Params{
+		BiasMin:             defaultBiasMin,
+		BiasMax:             defaultBiasMax,
+		CompressedBlockBits: CompressedBlockBits,
+		ExpandedBlockBits:   ExpandedBlockBits,
+		MSSMin:              defaultMSSMin,
+		MSSMax:              defaultMSSMax,
+		MSSDev:              defaultMSSDev,
+	}
+}
+
+// ParseParams parses the riverrun Params from args, where each argument name
+// is prefixed with prefix (eg: "rr-bias-min").  Absent arguments take the
+// default values.
+func ParseParams(args *pt.Args, prefix string) (*Params, error) {
+	p := DefaultParams()
+	p.specified = make(pt.Args)
+	if args == nil {
+		return p, nil
+	}
+
+	getFloat := func(name string, v *float64) error {
+		s, ok := args.Get(prefix + name)
+		if !ok {
+			return nil
+		}
+		f, err := strconv.ParseFloat(s, 64)
+		if err != nil {
+			return fmt.Errorf("malformed %s%s '%s'", prefix, name, s)
+		}
+		*v = f
+		p.specified.Add(prefix+name, s)
+		return nil
+	}
+	getInt := func(name string, v *int) error {
+		s, ok := args.Get(prefix + name)
+		if !ok {
+			return nil
+		}
+		i, err := strconv.Atoi(s)
+		if err != nil {
+			return fmt.Errorf("malformed %s%s '%s'", prefix, name, s)
+		}
+		*v = i
+		p.specified.Add(prefix+name, s)
+		return nil
+	}
+
+	compressed, expanded := int(p.CompressedBlockBits), int(p.ExpandedBlockBits)
+	for _, err := range []error{
+		getFloat(biasMinArg, &p.BiasMin),
+		getFloat(biasMaxArg, &p.BiasMax),
+		getInt(compressedArg, &compressed),
+		getInt(expandedArg, &expanded),
+		getInt(mssMinArg, &p.MSSMin),
+		getInt(mssMaxArg, &p.MSSMax),
+		getFloat(mssDevArg, &p.MSSDev),
+	} {
+		if err != nil {
+			return nil, err
+		}
+	}
+	if compressed < 0 || expanded < 0 {
+		return nil, fmt.Errorf("invalid %s%s/%s%s '%d/%d'", prefix, compressedArg, prefix, expandedArg, compressed, expanded)
+	}
+	p.CompressedBlockBits, p.ExpandedBlockBits = uint64(compressed), uint64(expanded)
+
+	if err := p.validate(prefix); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+func (p *Params) validate(prefix string) error {
+	if p.BiasMin < lowestBias || p.BiasMax > highestBias || p.BiasMin > p.BiasMax {
+		return fmt.Errorf("invalid %s%s/%s%s '%v/%v'", prefix, biasMinArg, prefix, biasMaxArg, p.BiasMin, p.BiasMax)
+	}
+
+	// The expanded block size must be a multiple of the compressed block
+	// size, and within the range that the tables support.
+	var minExpandedBits uint64
+	switch p.CompressedBlockBits {
+	case 8:
+		minExpandedBits = 24
+	case 16:
+		minExpandedBits = 32
+	}
+	if minExpandedBits == 0 || p.ExpandedBlockBits < minExpandedBits || p.ExpandedBlockBits > maxExpandedBits || p.ExpandedBlockBits%p.CompressedBlockBits != 0 {
+		return fmt.Errorf("invalid %s%s/%s%s '%d/%d'", prefix, compressedArg, prefix, expandedArg, p.CompressedBlockBits, p.ExpandedBlockBits)
+	}
+
+	if p.MSSMin < lowestMSS || p.MSSMax > highestMSS || p.MSSMin > p.MSSMax {
+		return fmt.Errorf("invalid %s%s/%s%s '%d/%d'", prefix, mssMinArg, prefix, mssMaxArg, p.MSSMin, p.MSSMax)
+	}
+	if p.MSSDev < 0 || p.MSSDev > highestMSSDev {
+		return fmt.Errorf("invalid %s%s '%v'", prefix, mssDevArg, p.MSSDev)
+	}
+	return nil
+}
+
+// bias maps r, uniformly drawn from [0, 1), to the bias range.
+func (p *Params) bias(r float64) float64 {
+	if p.BiasMin == defaultBiasMin && p.BiasMax == defaultBiasMax {
+		// Bit-for-bit what older versions compute, so that the tables match.
+		return r*.2 + .1
+	}
+	return r*(p.BiasMax-p.BiasMin) + p.BiasMin
+}
+
+// Args returns the explicitly specified arguments that Params were parsed
+// from, for advertising to clients.
+func (p *Params) Args() pt.Args {
+	args := make(pt.Args)
+	for k, v := range p.specified {
+		args[k] = append([]string(nil), v...)
+	}
+	return args
+}
@@ -21,6 +21,13 @@ const (
 	PacketTypePayload = iota
 )
 
+const (
+	// CompressedBlockBits and ExpandedBlockBits are the minimal expansion
+	// factors, which are currently always used.
+	CompressedBlockBits = 16
+	ExpandedBlockBits   = 32
+)
+
 // Implements the net.Conn interface
 type Conn struct {
 	// Embeds a net.Conn and inherits its members.
@@ -42,79 +49,139 @@ func get_rng(seed *drbg.Seed) (*rand.Rand, error) {
 	return rand.New(xdrbg), nil
 }
 
-func get_mss(seed *drbg.Seed) (int, error) {
+func get_mss(seed *drbg.Seed, params *Params) (int, error) {
 	rng, err := get_rng(seed)
 	if err != nil {
 		return 0, err
 	}
-	return int(rng.Float64()*float64(800)) + 600, nil
+	return int(rng.Float64()*float64(params.MSSMax-params.MSSMin)) + params.MSSMin, nil
 }
 
 func NewConn(conn net.Conn, isServer bool, seed *drbg.Seed) (*Conn, error) {
+	return NewConnWithParams(conn, isServer, seed, DefaultParams())
+}
+
+// Derived are the shaping parameters of riverrun connections, drawn from the
+// seed and Params.
+type Derived struct {
+	// Bias is the bias of the expanded block bits.
+	Bias float64
+
+	// CompressedBlockBits and ExpandedBlockBits are the block sizes.
+	CompressedBlockBits uint64
+	ExpandedBlockBits   uint64
 
+	// MSSMax is the TCP MSS, and the target segment size.
+	MSSMax int
+
+	// MSSDev is the standard deviation of the segment sizes below MSSMax.
+	MSSDev float64
+}
+
+// derivation is all of the values that a connection draws from the seed, in
+// the order that they are drawn.
+type derivation struct {
+	Derived
+
+	key                 []byte
+	tableIV             []byte
+	firstIV, secondIV   []byte
+	firstKey, secondKey []byte
+}
+
+func derive(seed *drbg.Seed, params *Params) (*derivation, error) {
 	rng, err := get_rng(seed)
+	if err != nil {
+		return nil, err
+	}
+
+	d := new(derivation)
+	d.key = make([]byte, 16)
+	rng.Read(d.key)
+
+	// The expansion factors are part of the parameters, and default to the
+	// minimal ones.
+	d.CompressedBlockBits = params.CompressedBlockBits
+	d.ExpandedBlockBits = params.ExpandedBlockBits
+
+	// Targeting entropy of 4-7 based on observations by default.
+	d.Bias = params.bias(rng.Float64())
+
+	d.tableIV = make([]byte, aes.BlockSize)
+	rng.Read(d.tableIV)
+	d.firstIV = make([]byte, aes.BlockSize)
+	rng.Read(d.firstIV)
+	d.secondIV = make([]byte, aes.BlockSize)
+	rng.Read(d.secondIV)
+	d.firstKey = make([]byte, drbg.SeedLength)
+	rng.Read(d.firstKey)
+	d.secondKey = make([]byte, drbg.SeedLength)
+	rng.Read(d.secondKey)
+
+	if d.MSSMax, err = get_mss(seed, params); err != nil {
+		return nil, err
+	}
+	d.MSSDev = rng.Float64() * params.MSSDev
+	return d, nil
+}
+
+// Derive returns the shaping parameters of connections with the seed and
+// params, without creating a connection (eg: for diagnostics).
+func Derive(seed *drbg.Seed, params *Params) (*Derived, error) {
+	d, err := derive(seed, params)
+	if err != nil {
+		return nil, err
+	}
+	return &d.Derived, nil
+}
 
-	key := make([]byte, 16)
-	rng.Read(key)
-	block, err := aes.NewCipher(key)
+// NewConnWithParams creates a riverrun connection, with the shaping
+// parameters drawn from params.
+func NewConnWithParams(conn net.Conn, isServer bool, seed *drbg.Seed, params *Params) (*Conn, error) {
+	d, err := derive(seed, params)
 	if err != nil {
 		return nil, err
 	}
 
-	// We select the minimal expansion factors
-	// The full range is commented out
-	compressedBlockBits := uint64(16) // uint64((rng.Intn(2) + 1) * 8)
+	block, err := aes.NewCipher(d.key)
+	if err != nil {
+		return nil, err
+	}
 
-	var expandedBlockBits uint64
+	compressedBlockBits := d.CompressedBlockBits
+	expandedBlockBits := d.ExpandedBlockBits
 	var expandedBlockBits8 uint64
 	if compressedBlockBits == 8 {
-		expandedBlockBits = uint64((rng.Intn(6) + 3) * 8)
 		expandedBlockBits8 = expandedBlockBits
 	} else {
-		expandedBlockBits = 32 // uint64((rng.Intn(3) + 2) * 16)
 		expandedBlockBits8 = expandedBlockBits / 2
 	}
 
-	bias := rng.Float64()*.2 + .1 // Targeting entropy of 4-7 based on observations
+	log.Infof("rr: Set bias to %f, compressed block bits to %d, expanded block bits to %d", d.Bias, compressedBlockBits, expandedBlockBits)
 
-	log.Infof("rr: Set bias to %f, compressed block bits to %d, expanded block bits to %d", bias, compressedBlockBits, expandedBlockBits)
-
-	iv := make([]byte, block.BlockSize())
-	rng.Read(iv)
-	table8, table16, err := getTables(expandedBlockBits8, expandedBlockBits, bias, key, block, iv)
+	table8, table16, err := getTables(compressedBlockBits, expandedBlockBits8, expandedBlockBits, d.Bias, d.key, block, d.tableIV)
 	if err != nil {
 		return nil, err
 	}
 
+	// The first stream and key are the ones the client writes with.
 	var readStream, writeStream cipher.Stream
-	rng.Read(iv)
-	stream := cipher.NewCTR(block, iv)
-	readKey := make([]byte, drbg.SeedLength)
-	writeKey := make([]byte, drbg.SeedLength)
-	log.Debugf("riverrun: r/w keys made")
-
+	var readKey, writeKey []byte
 	if isServer {
-		readStream = stream
-		rng.Read(iv)
-		writeStream = cipher.NewCTR(block, iv)
-		rng.Read(readKey)
-		rng.Read(writeKey)
+		readStream = cipher.NewCTR(block, d.firstIV)
+		writeStream = cipher.NewCTR(block, d.secondIV)
+		readKey, writeKey = d.firstKey, d.secondKey
 	} else {
-		writeStream = stream
-		rng.Read(iv)
-		readStream = cipher.NewCTR(block, iv)
-		rng.Read(writeKey)
-		rng.Read(readKey)
+		writeStream = cipher.NewCTR(block, d.firstIV)
+		readStream = cipher.NewCTR(block, d.secondIV)
+		writeKey, readKey = d.firstKey, d.secondKey
 	}
 	log.Debugf("riverrun: Loaded keys properly")
 	rr := new(Conn)
 	rr.Conn = conn
-	rr.bias = bias
-	rr.mss_max, err = get_mss(seed)
-	if err != nil {
-		return nil, err
-	}
-	rr.mss_dev = rng.Float64() * 4
+	rr.bias = d.Bias
+	rr.mss_max = d.MSSMax
+	rr.mss_dev = d.MSSDev
 	log.Infof("Set mss_max to %v, mss_dev to %v", rr.mss_max, rr.mss_dev)
 	// Encoder
 	rr.Encoder = newRiverrunEncoder(writeKey, writeStream, table8, table16, compressedBlockBits, expandedBlockBits)
@@ -125,8 +192,23 @@ func NewConn(conn net.Conn, isServer bool, seed *drbg.Seed) (*Conn, error) {
 	return rr, nil
 }
 
+// WireOverhead returns the number of additional bytes sent on the wire per
+// payload byte, for full frames with the given expansion factors.
+func WireOverhead(compressedBlockBits, expandedBlockBits uint64) float64 {
+	lengthLength := ctstretch.ExpandedNBytes(uint64(f.LengthLength), compressedBlockBits, expandedBlockBits)
+	maxPayload := ctstretch.CompressedNBytes_floor(f.MaximumSegmentLength-lengthLength, expandedBlockBits, compressedBlockBits)
+	wire := lengthLength + ctstretch.ExpandedNBytes(maxPayload, compressedBlockBits, expandedBlockBits)
+	return float64(wire)/float64(maxPayload) - 1
+}
+
 func Get_control_fn(seed *drbg.Seed) (func(string, string, syscall.RawConn) error, error) {
-	mss_max, err := get_mss(seed)
+	return Get_control_fn_with_params(seed, DefaultParams())
+}
+
+// Get_control_fn_with_params returns the hook that sets the client's
+// TCP_MAXSEG, drawn from params.
+func Get_control_fn_with_params(seed *drbg.Seed, params *Params) (func(string, string, syscall.RawConn) error, error) {
+	mss_max, err := get_mss(seed, params)
 	if err != nil {
 		return nil, err
 	}
@@ -148,7 +230,7 @@ var cache8 map[string][]uint64
 var cache16 map[string][]uint64
 var mutex = &sync.Mutex{}
 
-func getTables(expandedBlockBits8 uint64, expandedBlockBits uint64, bias float64, key []byte, block cipher.Block, iv []byte) ([]uint64, []uint64, error) {
+func getTables(compressedBlockBits, expandedBlockBits8, expandedBlockBits uint64, bias float64, key []byte, block cipher.Block, iv []byte) ([]uint64, []uint64, error) {
 
 	mutex.Lock()
 	if cache8 == nil {
@@ -159,12 +241,16 @@ func getTables(expandedBlockBits8 uint64, expandedBlockBits uint64, bias float64
 	}
 	mutex.Unlock()
 
+	// The same key is used with different parameters, so they are part of
+	// the cache key.
+	cacheKey := fmt.Sprintf("%x:%d:%d:%v", key, expandedBlockBits8, expandedBlockBits, bias)
+
 	mutex.Lock()
-	table8, ok := cache8[string(key)]
+	table8, ok := cache8[cacheKey]
 	mutex.Unlock()
 	if ok {
 		mutex.Lock()
-		table16, ok := cache16[string(key)]
+		table16, ok := cache16[cacheKey]
 		mutex.Unlock()
 		if ok {
 			log.Debugf("riverrun: using cached tables")
@@ -180,15 +266,19 @@ func getTables(expandedBlockBits8 uint64, expandedBlockBits uint64, bias float64
 		return nil, nil, err
 	}
 	log.Debugf("riverrun: table8 prepped")
-	table16, err := ctstretch.SampleBiasedStrings(expandedBlockBits, 65536, bias, stream)
-	if err != nil {
-		return nil, nil, err
+	// 8 bit blocks only use table8.
+	var table16 []uint64
+	if compressedBlockBits == 16 {
+		table16, err = ctstretch.SampleBiasedStrings(expandedBlockBits, 65536, bias, stream)
+		if err != nil {
+			return nil, nil, err
+		}
+		log.Debugf("riverrun: table16 prepped")
 	}
-	log.Debugf("riverrun: table16 prepped")
 
 	mutex.Lock()
-	cache8[string(key)] = table8
-	cache16[string(key)] = table16
+	cache8[cacheKey] = table8
+	cache16[cacheKey] = table16
 	mutex.Unlock()
 
 	return table8, table16, nil
@@ -0,0 +1,54 @@
+package sharknado
+
+import (
+	"fmt"
+	"net"
+
+	"git.torproject.org/pluggable-transports/goptlib.git"
+	"github.com/RACECAR-GU/obfsX/transports/base"
+)
+
+// LayerName is the name of the sharknado layer.
+const LayerName = "sharknado"
+
+// Layer is the sharknado implementation of the base.DummyTrafficLayer
+// interface.
+type Layer struct{}
+
+// Name returns the name of the sharknado layer.
+func (l *Layer) Name() string {
+	return LayerName
+}
+
+// ParseArgs validates the sharknado arguments, of which there are currently
+// none.
+func (l *Layer) ParseArgs(args *pt.Args) (interface{}, error) {
+	for k := range *args {
+		return nil, fmt.Errorf("unknown argument '%s'", k)
+	}
+	return nil, nil
+}
+
+// WrapConn wraps conn with sharknado.  No dummy traffic is sent until
+// SetDummyTraffic is called.
+func (l *Layer) WrapConn(conn net.Conn, cfg *base.LayerConfig) (net.Conn, error) {
+	return NewConn(conn, nil, cfg.Seed), nil
+}
+
+// Capabilities returns the capabilities of the stack with sharknado added.
+// Sharknado only adds dummy traffic, which is not counted as overhead.
+func (l *Layer) Capabilities(caps base.Capabilities) base.Capabilities {
+	return caps
+}
+
+// SetDummyTraffic sets the dummy traffic source of a sharknado connection.
+func (l *Layer) SetDummyTraffic(conn net.Conn, core base.DummyTrafficConn) error {
+	sn, ok := conn.(*Conn)
+	if !ok {
+		return fmt.Errorf("sharknado: not a sharknado connection")
+	}
+	sn.SetDummyTrafficConn(core)
+	return nil
+}
+
+var _ base.DummyTrafficLayer = (*Layer)(nil)
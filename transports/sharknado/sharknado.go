@@ -1,12 +1,16 @@
 package sharknado
 
 import (
+	"errors"
+	"fmt"
 	"math/rand"
 	"net"
+	"sync"
 	"time"
 
 	"github.com/RACECAR-GU/obfsX/common/drbg"
 	"github.com/RACECAR-GU/obfsX/common/log"
+	"github.com/RACECAR-GU/obfsX/transports/base"
 	erand "golang.org/x/exp/rand"
 	"gonum.org/v1/gonum/stat/distuv"
 )
@@ -33,7 +37,9 @@ const (
 // bytes and returns a []byte slice (and an error) that is ready to be written
 // to the wire.  Needless to say, a transport must support dummy traffic to use
 // sharknado.
-type DummyTrafficFunc func(int) ([]byte, error)
+type DummyTrafficFunc = base.DummyTrafficFunc
+
+var errNoDummyTraffic = errors.New("sharknado: no dummy traffic source")
 
 // Conn implements the net.Conn interface.
 type Conn struct {
@@ -46,6 +52,16 @@ type Conn struct {
 
 	breakAfter int
 	bytesRcvd  int
+
+	dummyLock sync.Mutex
+	dummyConn base.DummyTrafficConn
+
+	// dummy holds the size of the burst break that is waiting to be sent by
+	// dummyWriter, if any.
+	dummy chan int
+
+	closeOnce sync.Once
+	closed    chan struct{}
 }
 
 // NewConn creates a new Sharknado connection.
@@ -61,7 +77,16 @@ func NewConn(conn net.Conn, getDummyTraffic DummyTrafficFunc, seed *drbg.Seed) *
 	breakAfterDist := &distuv.Poisson{float64(minBreakAfterBytes + rng.Intn(randBreakAfterBytes)), erand.NewSource(4)}
 	numDummyDist := &distuv.Poisson{float64(minNumDummyBytes + rng.Intn(randNumDummyBytes)), erand.NewSource(4)}
 
-	sc := &Conn{conn, getDummyTraffic, breakAfterDist, numDummyDist, int(breakAfterDist.Rand()), 0}
+	sc := &Conn{
+		Conn:            conn,
+		GetDummyTraffic: getDummyTraffic,
+		breakAfterDist:  breakAfterDist,
+		numDummyDist:    numDummyDist,
+		breakAfter:      int(breakAfterDist.Rand()),
+		dummy:           make(chan int, 1),
+		closed:          make(chan struct{}),
+	}
+	go sc.dummyWriter()
 
 	// Decide if we should start a heartbeat.
 	if rng.Intn(heartbeatDenominator) == 0 {
@@ -71,12 +96,45 @@ func NewConn(conn net.Conn, getDummyTraffic DummyTrafficFunc, seed *drbg.Seed) *
 		if r < minHeartbeatInterval {
 			r = minHeartbeatInterval
 		}
-		go sc.heartbeat(r)
+		go sc.heartbeat(r, int(numDummyDist.Rand()))
 	}
 
 	return sc
 }
 
+// NewConnFor creates a new Sharknado connection under outer, a connection of
+// transport t, which writes to conn.  It fails if t does not support dummy
+// traffic.
+func NewConnFor(conn net.Conn, t base.Transport, outer net.Conn, seed *drbg.Seed) (*Conn, error) {
+	if !base.GetCapabilities(t).DummyTraffic {
+		return nil, fmt.Errorf("sharknado: %s does not support dummy traffic", t.Name())
+	}
+	dt, ok := outer.(base.DummyTrafficConn)
+	if !ok {
+		return nil, fmt.Errorf("sharknado: %s connection does not provide dummy traffic", t.Name())
+	}
+	sn := NewConn(conn, nil, seed)
+	sn.SetDummyTrafficConn(dt)
+	return sn, nil
+}
+
+// SetDummyTrafficConn sets the connection that sends the dummy traffic, for
+// connections that were created before it was available (eg: before the
+// handshake).  It takes precedence over GetDummyTraffic, and unlike it, the
+// dummy traffic is serialized with the other connection's writes.
+func (sn *Conn) SetDummyTrafficConn(dt base.DummyTrafficConn) {
+	sn.dummyLock.Lock()
+	defer sn.dummyLock.Unlock()
+	sn.dummyConn = dt
+}
+
+// hasDummyTraffic returns `true` if a dummy traffic source is available.
+func (sn *Conn) hasDummyTraffic() bool {
+	sn.dummyLock.Lock()
+	defer sn.dummyLock.Unlock()
+	return sn.dummyConn != nil || sn.GetDummyTraffic != nil
+}
+
 // resetState resets our two state variables; `breakAfter` by assigning it a
 // new random value, and `bytesRcvd` by resetting it to 0.
 func (sn *Conn) resetState() {
@@ -93,13 +151,21 @@ func (sn *Conn) shouldBreakBurst() bool {
 	return sn.bytesRcvd > sn.breakAfter
 }
 
-// sendDummyTraffic sends dummy traffic and returns the result of the Write()
-// call.
-func (sn *Conn) sendDummyTraffic() (int, error) {
+// sendDummyTraffic sends numBytes of dummy traffic and returns the result of
+// the Write() call.
+func (sn *Conn) sendDummyTraffic(numBytes int) (int, error) {
 
-	numBytes := int(sn.numDummyDist.Rand())
-	log.Debugf("Breaking burst with %d bytes of dummy traffic.", numBytes)
-	data, err := sn.GetDummyTraffic(numBytes)
+	sn.dummyLock.Lock()
+	dummyConn, getDummyTraffic := sn.dummyConn, sn.GetDummyTraffic
+	sn.dummyLock.Unlock()
+
+	if dummyConn != nil {
+		return dummyConn.WriteDummyTraffic(numBytes)
+	}
+	if getDummyTraffic == nil {
+		return 0, errNoDummyTraffic
+	}
+	data, err := getDummyTraffic(numBytes)
 	if err != nil {
 		return 0, err
 	}
@@ -108,30 +174,49 @@ func (sn *Conn) sendDummyTraffic() (int, error) {
 }
 
 // heartbeat implements a heartbeat mechanism that sends dummy traffic every
-func (sn *Conn) heartbeat(interval int) {
+func (sn *Conn) heartbeat(interval, numBytes int) {
 
 	duration := time.Second * time.Duration(interval)
-	numBytes := int(sn.numDummyDist.Rand())
 	log.Debugf("Sending %d bytes of heartbeat dummy traffic.", numBytes)
 	for {
-		time.Sleep(duration)
-		if sn.GetDummyTraffic != nil { // IDEA: Intuitively, I feel like this could be fixed...
-			// e.g. perhaps make "established" a more universal var for conns...
-			data, err := sn.GetDummyTraffic(numBytes)
-			if err != nil {
-				log.Debugf("Error while getting dummy traffic.")
-				continue
-			}
-			log.Debugf("Sending %d bytes of heartbeat data.", len(data))
-			_, err = sn.Write(data)
-			if err != nil {
-				log.Debugf("Error while writing. Stopping heartbeat.")
-				return
+		select {
+		case <-time.After(duration):
+		case <-sn.closed:
+			return
+		}
+		// IDEA: Intuitively, I feel like this could be fixed...
+		// e.g. perhaps make "established" a more universal var for conns...
+		if !sn.hasDummyTraffic() {
+			continue
+		}
+		log.Debugf("Sending %d bytes of heartbeat data.", numBytes)
+		if _, err := sn.sendDummyTraffic(numBytes); err != nil {
+			log.Debugf("Error while sending heartbeat data: %s", err)
+		}
+	}
+}
+
+// dummyWriter sends the burst breaks that Read requests, until the connection
+// is closed.
+func (sn *Conn) dummyWriter() {
+	for {
+		select {
+		case numBytes := <-sn.dummy:
+			if _, err := sn.sendDummyTraffic(numBytes); err != nil {
+				log.Debugf("Failed to send dummy traffic: %s", err)
 			}
+		case <-sn.closed:
+			return
 		}
 	}
 }
 
+// Close closes the connection, and stops the heartbeat and the dummy traffic.
+func (sn *Conn) Close() error {
+	sn.closeOnce.Do(func() { close(sn.closed) })
+	return sn.Conn.Close()
+}
+
 func (sn *Conn) Write(b []byte) (int, error) {
 
 	n, err := sn.Conn.Write(b)
@@ -145,9 +230,16 @@ func (sn *Conn) Read(b []byte) (int, error) {
 	sn.bytesRcvd += n
 	// log.Debugf("Sharknado: <- %d", n)
 
-	if sn.shouldBreakBurst() {
-		if _, err2 := sn.sendDummyTraffic(); err2 != nil {
-			log.Debugf("Failed to send dummy traffic: %s", err2)
+	if sn.hasDummyTraffic() && sn.shouldBreakBurst() {
+		// Send asynchronously, so that a blocked writer can not stall the
+		// reader.  If the previous burst break has not been sent yet, this
+		// one is dropped.
+		numBytes := int(sn.numDummyDist.Rand())
+		select {
+		case sn.dummy <- numBytes:
+			log.Debugf("Breaking burst with %d bytes of dummy traffic.", numBytes)
+		default:
+			log.Debugf("Dropping %d bytes of dummy traffic, a burst break is still pending.", numBytes)
 		}
 		sn.resetState()
 	}
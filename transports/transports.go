@@ -36,11 +36,20 @@ import (
 	"github.com/RACECAR-GU/obfsX/transports/base"
 	"github.com/RACECAR-GU/obfsX/transports/obfs4"
 	"github.com/RACECAR-GU/obfsX/transports/obfs5"
+	"github.com/RACECAR-GU/obfsX/transports/riverrun"
+	"github.com/RACECAR-GU/obfsX/transports/sharknado"
 )
 
 var transportMapLock sync.Mutex
 var transportMap map[string]base.Transport = make(map[string]base.Transport)
 
+// clientOnly are the registered transports that only have a client (eg:
+// "auto").
+var clientOnly = make(map[string]bool)
+
+var initOnce sync.Once
+var initErr error
+
 // Register registers a transport protocol.
 func Register(transport base.Transport) error {
 	transportMapLock.Lock()
@@ -56,11 +65,41 @@ func Register(transport base.Transport) error {
 	return nil
 }
 
-// Transports returns the list of registered transport protocols.
+// registerClientOnly registers a transport protocol that only has a client.
+func registerClientOnly(transport base.Transport) error {
+	if err := Register(transport); err != nil {
+		return err
+	}
+
+	transportMapLock.Lock()
+	defer transportMapLock.Unlock()
+	clientOnly[transport.Name()] = true
+
+	return nil
+}
+
+// Transports returns the list of registered transport protocols, that have
+// both a client and a server.
 func Transports() []string {
 	transportMapLock.Lock()
 	defer transportMapLock.Unlock()
 
+	var ret []string
+	for name := range transportMap {
+		if !clientOnly[name] {
+			ret = append(ret, name)
+		}
+	}
+
+	return ret
+}
+
+// ClientTransports returns the list of registered transport protocols that
+// have a client, including the client only ones (eg: "auto").
+func ClientTransports() []string {
+	transportMapLock.Lock()
+	defer transportMapLock.Unlock()
+
 	var ret []string
 	for name := range transportMap {
 		ret = append(ret, name)
@@ -79,16 +118,30 @@ func Get(name string) base.Transport {
 	return t
 }
 
-// Init initializes all of the integrated transports.
+// Init initializes all of the integrated transports and layers.  It is safe
+// to call Init more than once.
 func Init() error {
-	for _, v := range []base.Transport{
-		new(obfs4.Transport),
-		new(obfs5.Transport),
-	} {
-		if err := Register(v); err != nil {
-			return err
+	initOnce.Do(func() {
+		for _, v := range []base.Transport{
+			new(obfs4.Transport),
+			new(obfs5.Transport),
+		} {
+			if initErr = Register(v); initErr != nil {
+				return
+			}
 		}
-	}
+		if initErr = registerClientOnly(new(autoTransport)); initErr != nil {
+			return
+		}
+		for _, v := range []base.Layer{
+			new(riverrun.Layer),
+			new(sharknado.Layer),
+		} {
+			if initErr = RegisterLayer(v); initErr != nil {
+				return
+			}
+		}
+	})
 
-	return nil
+	return initErr
 }
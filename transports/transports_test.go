@@ -0,0 +1,790 @@
+package transports
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"git.torproject.org/pluggable-transports/goptlib.git"
+	"github.com/RACECAR-GU/obfsX/common/socks5"
+	"github.com/RACECAR-GU/obfsX/common/workerpool"
+	"github.com/RACECAR-GU/obfsX/transports/base"
+	"github.com/RACECAR-GU/obfsX/transports/obfs4"
+)
+
+var testStateDir string
+
+func TestMain(m *testing.M) {
+	if err := Init(); err != nil {
+		panic("transports.Init() failed: " + err.Error())
+	}
+
+	var err error
+	if testStateDir, err = ioutil.TempDir("", "obfsx-transports"); err != nil {
+		panic("failed to create state dir: " + err.Error())
+	}
+	ret := m.Run()
+	os.RemoveAll(testStateDir)
+	os.Exit(ret)
+}
+
+// standInProxy is a minimal upstream proxy that counts the connections it
+// relays, so that tests can verify that the proxy was actually used.
+type standInProxy struct {
+	ln        net.Listener
+	handshake func(conn net.Conn) (target string, reply func(bool) error, err error)
+	relayed   int32
+}
+
+func (p *standInProxy) url(scheme string) *url.URL {
+	return &url.URL{Scheme: scheme, Host: p.ln.Addr().String()}
+}
+
+func (p *standInProxy) serve() {
+	for {
+		conn, err := p.ln.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			defer conn.Close()
+			target, reply, err := p.handshake(conn)
+			if err != nil {
+				return
+			}
+			remote, err := net.Dial("tcp", target)
+			if err != nil {
+				_ = reply(false)
+				return
+			}
+			defer remote.Close()
+			if err = reply(true); err != nil {
+				return
+			}
+			atomic.AddInt32(&p.relayed, 1)
+			go func() {
+				_, _ = io.Copy(remote, conn)
+				remote.Close()
+			}()
+			_, _ = io.Copy(conn, remote)
+		}()
+	}
+}
+
+func newStandInProxy(t *testing.T, handshake func(net.Conn) (string, func(bool) error, error)) *standInProxy {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen for stand-in proxy: %s", err)
+	}
+	p := &standInProxy{ln: ln, handshake: handshake}
+	go p.serve()
+	return p
+}
+
+func httpConnectHandshake(conn net.Conn) (string, func(bool) error, error) {
+	req, err := http.ReadRequest(bufio.NewReader(conn))
+	if err != nil {
+		return "", nil, err
+	}
+	reply := func(ok bool) error {
+		status := "HTTP/1.1 502 Bad Gateway\r\n\r\n"
+		if ok {
+			status = "HTTP/1.1 200 OK\r\n\r\n"
+		}
+		_, err := conn.Write([]byte(status))
+		return err
+	}
+	if req.Method != "CONNECT" {
+		_ = reply(false)
+		return "", nil, io.ErrUnexpectedEOF
+	}
+	return req.Host, reply, nil
+}
+
+func socks4Handshake(conn net.Conn) (string, func(bool) error, error) {
+	var hdr [8]byte
+	if _, err := io.ReadFull(conn, hdr[:]); err != nil {
+		return "", nil, err
+	}
+	// Skip the NUL terminated USERID.
+	var b [1]byte
+	for {
+		if _, err := io.ReadFull(conn, b[:]); err != nil {
+			return "", nil, err
+		} else if b[0] == 0x00 {
+			break
+		}
+	}
+	port := binary.BigEndian.Uint16(hdr[2:4])
+	target := net.JoinHostPort(net.IP(hdr[4:8]).String(), strconv.Itoa(int(port)))
+	reply := func(ok bool) error {
+		resp := []byte{0x00, 0x5b, 0, 0, 0, 0, 0, 0}
+		if ok {
+			resp[1] = 0x5a
+		}
+		_, err := conn.Write(resp)
+		return err
+	}
+	return target, reply, nil
+}
+
+func socks5Handshake(conn net.Conn) (string, func(bool) error, error) {
+	req, err := socks5.Handshake(conn)
+	if err != nil {
+		return "", nil, err
+	}
+	reply := func(ok bool) error {
+		if ok {
+			return req.Reply(socks5.ReplySucceeded)
+		}
+		return req.Reply(socks5.ReplyGeneralFailure)
+	}
+	return req.Target, reply, nil
+}
+
+type serverListener interface {
+	Listen(network, address string) (net.Listener, error)
+}
+
+// testServer is an echo server for a transport, with a client factory and
+// the client arguments to reach it.
+type testServer struct {
+	name string
+	sf   base.ServerFactory
+	ln   net.Listener
+	cf   base.ClientFactory
+	args interface{}
+}
+
+// newTestServer starts a server for the transport, with the server options
+// (which may be nil), that echoes back all data received over the obfuscated
+// connections.
+func newTestServer(t *testing.T, tr base.Transport, opts *pt.Args) *testServer {
+	name := tr.Name()
+	if opts == nil {
+		opts = &pt.Args{}
+	}
+	stateDir, err := ioutil.TempDir(testStateDir, name)
+	if err != nil {
+		t.Fatalf("failed to create state dir: %s", err)
+	}
+	sf, err := tr.ServerFactory(stateDir, opts)
+	if err != nil {
+		t.Fatalf("%s: ServerFactory() failed: %s", name, err)
+	}
+	s := &testServer{name: name, sf: sf, ln: listenEcho(t, sf)}
+	if s.cf, err = tr.ClientFactory(""); err != nil {
+		s.ln.Close()
+		t.Fatalf("%s: ClientFactory() failed: %s", name, err)
+	}
+	if s.args, err = s.cf.ParseArgs(sf.Args()); err != nil {
+		s.ln.Close()
+		t.Fatalf("%s: ParseArgs() failed: %s", name, err)
+	}
+	return s
+}
+
+// dial connects to the server through dialer.
+func (s *testServer) dial(t *testing.T, dialer base.Dialer) net.Conn {
+	conn, err := s.cf.Dial("tcp", s.ln.Addr().String(), dialer, s.args)
+	if err != nil {
+		t.Fatalf("%s: Dial() failed: %s", s.name, err)
+	}
+	return conn
+}
+
+// dialTransport starts an echo server for the transport, with the server
+// options (which may be nil), and connects to it.  The caller closes both.
+func dialTransport(t *testing.T, tr base.Transport, opts *pt.Args) (*testServer, net.Conn) {
+	s := newTestServer(t, tr, opts)
+	return s, s.dial(t, base.Dialer{})
+}
+
+// listenEcho listens with the server factory, echoing back the data of the
+// connections that complete the handshake.
+func listenEcho(t *testing.T, sf base.ServerFactory) net.Listener {
+	name := sf.Transport().Name()
+	sl, ok := sf.(serverListener)
+	if !ok {
+		t.Fatalf("%s: ServerFactory does not provide Listen()", name)
+	}
+	ln, err := sl.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("%s: failed to listen: %s", name, err)
+	}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				_, _ = io.Copy(conn, conn)
+			}()
+		}
+	}()
+	return ln
+}
+
+// echo sends msg over conn, and returns an error unless it is echoed back.
+func echo(conn net.Conn, msg []byte) error {
+	errCh := make(chan error, 1)
+	go func() {
+		_, err := conn.Write(msg)
+		errCh <- err
+	}()
+	resp := make([]byte, len(msg))
+	if _, err := io.ReadFull(conn, resp); err != nil {
+		return err
+	}
+	if err := <-errCh; err != nil {
+		return err
+	}
+	if !bytes.Equal(resp, msg) {
+		return fmt.Errorf("echo mismatch: %q != %q", resp, msg)
+	}
+	return nil
+}
+
+func TestDialViaUpstreamProxy(t *testing.T) {
+	proxies := []struct {
+		scheme    string
+		handshake func(net.Conn) (string, func(bool) error, error)
+	}{
+		{"http", httpConnectHandshake},
+		{"socks4a", socks4Handshake},
+		{"socks5", socks5Handshake},
+	}
+
+	for _, name := range Transports() {
+		s := newTestServer(t, Get(name), nil)
+		defer s.ln.Close()
+
+		for _, v := range proxies {
+			p := newStandInProxy(t, v.handshake)
+			defer p.ln.Close()
+
+			conn := s.dial(t, base.Dialer{ProxyURI: p.url(v.scheme)})
+			err := echo(conn, []byte("The quick brown fox jumps over the lazy dog."))
+			conn.Close()
+			if err != nil {
+				t.Fatalf("%s(%s): %s", name, v.scheme, err)
+			}
+			if n := atomic.LoadInt32(&p.relayed); n != 1 {
+				t.Fatalf("%s(%s): proxy relayed %d connections, expected 1", name, v.scheme, n)
+			}
+		}
+	}
+}
+
+func TestDialContextAbortsHandshake(t *testing.T) {
+	// A server that accepts connections, but never completes the handshake.
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %s", err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				_, _ = io.Copy(ioutil.Discard, conn)
+			}()
+		}
+	}()
+
+	for _, name := range Transports() {
+		s := newTestServer(t, Get(name), nil)
+		s.ln.Close()
+
+		ctx, cancel := context.WithTimeout(context.Background(), 250*time.Millisecond)
+		start := time.Now()
+		conn, err := s.cf.DialContext(ctx, "tcp", ln.Addr().String(), base.Dialer{}, s.args)
+		cancel()
+		if err != context.DeadlineExceeded {
+			if conn != nil {
+				conn.Close()
+			}
+			t.Fatalf("%s: DialContext() returned %v, expected %v", name, err, context.DeadlineExceeded)
+		}
+		if elapsed := time.Since(start); elapsed > 5*time.Second {
+			t.Fatalf("%s: DialContext() took %v to abort", name, elapsed)
+		}
+	}
+}
+
+func TestListenerSkipsFailedHandshakes(t *testing.T) {
+	for _, name := range Transports() {
+		s := newTestServer(t, Get(name), nil)
+		s.ln.Close()
+		ln, err := base.Listen(s.sf, "tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatalf("%s: Listen() failed: %s", name, err)
+		}
+
+		// Send a (probably) invalid handshake, that will never complete.
+		probe, err := net.Dial("tcp", ln.Addr().String())
+		if err != nil {
+			t.Fatalf("%s: probe Dial() failed: %s", name, err)
+		}
+		_, _ = probe.Write(bytes.Repeat([]byte{0x42}, 8192))
+
+		// Then a legitimate client.
+		accepted := make(chan net.Conn, 2)
+		go func() {
+			for {
+				conn, err := ln.Accept()
+				if err != nil {
+					close(accepted)
+					return
+				}
+				accepted <- conn
+			}
+		}()
+		client, err := s.cf.Dial("tcp", ln.Addr().String(), base.Dialer{}, s.args)
+		if err != nil {
+			t.Fatalf("%s: Dial() failed: %s", name, err)
+		}
+
+		select {
+		case conn := <-accepted:
+			// The probe can't have completed a handshake, so this must be
+			// the client.
+			msg := []byte("hello")
+			if _, err = client.Write(msg); err != nil {
+				t.Fatalf("%s: client Write() failed: %s", name, err)
+			}
+			buf := make([]byte, len(msg))
+			if _, err = io.ReadFull(conn, buf); err != nil || !bytes.Equal(buf, msg) {
+				t.Fatalf("%s: accepted connection is not the client: %v", name, err)
+			}
+			conn.Close()
+		case <-time.After(10 * time.Second):
+			t.Fatalf("%s: Accept() did not return the client", name)
+		}
+
+		client.Close()
+		probe.Close()
+		ln.Close()
+		if _, ok := <-accepted; ok {
+			t.Fatalf("%s: Accept() returned the probe", name)
+		}
+	}
+}
+
+func TestCapabilities(t *testing.T) {
+	for _, name := range Transports() {
+		caps := base.GetCapabilities(Get(name))
+		if caps.WireOverhead <= 0 {
+			t.Errorf("%s: implausible WireOverhead %f", name, caps.WireOverhead)
+		}
+
+		s, conn := dialTransport(t, Get(name), nil)
+		defer s.ln.Close()
+		defer conn.Close()
+
+		dt, ok := conn.(base.DummyTrafficConn)
+		if ok != caps.DummyTraffic {
+			t.Errorf("%s: DummyTraffic is %v, but the connection disagrees", name, caps.DummyTraffic)
+		} else if ok {
+			if b, err := dt.GetDummyTraffic(100); err != nil || len(b) == 0 {
+				t.Errorf("%s: GetDummyTraffic() failed: %v", name, err)
+			}
+		}
+		if _, ok = conn.(base.HalfCloser); ok != caps.HalfClose {
+			t.Errorf("%s: HalfClose is %v, but the connection disagrees", name, caps.HalfClose)
+		}
+	}
+
+	if caps := base.GetCapabilities(Get("obfs5")); !caps.SocketControl {
+		t.Errorf("obfs5: SocketControl is not set")
+	} else if caps.WireOverhead <= base.GetCapabilities(Get("obfs4")).WireOverhead {
+		t.Errorf("obfs5: WireOverhead does not account for riverrun")
+	}
+}
+
+// copyArgs returns a copy of args, without the keys in skip.
+func copyArgs(args *pt.Args, skip ...string) pt.Args {
+	c := pt.Args{}
+	for k, v := range *args {
+		c[k] = v
+	}
+	for _, k := range skip {
+		delete(c, k)
+	}
+	return c
+}
+
+// unregister removes the named transport from the registry once the test
+// completes.
+func unregister(t *testing.T, name string) {
+	t.Cleanup(func() {
+		transportMapLock.Lock()
+		defer transportMapLock.Unlock()
+		delete(transportMap, name)
+	})
+}
+
+func TestCompose(t *testing.T) {
+	tr, err := Compose("obfs4rs", "riverrun", "obfs4", "sharknado")
+	if err != nil {
+		t.Fatalf("Compose() failed: %s", err)
+	}
+	if Get("obfs4rs") != nil {
+		t.Fatalf("Compose() registered the transport")
+	}
+	caps := base.GetCapabilities(tr)
+	if !caps.SocketControl || !caps.DummyTraffic {
+		t.Fatalf("Compose() did not apply the layer capabilities: %+v", caps)
+	}
+
+	s, conn := dialTransport(t, tr, nil)
+	defer s.ln.Close()
+	err = echo(conn, bytes.Repeat([]byte("The quick brown fox jumps over the lazy dog."), 1000))
+	conn.Close()
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	// Layer arguments are validated by the layer.
+	bad := copyArgs(s.sf.Args())
+	bad.Add("riverrun-bogus", "1")
+	if _, err = s.cf.ParseArgs(&bad); err == nil {
+		t.Fatalf("ParseArgs() accepted an unknown layer argument")
+	}
+
+	invalid := [][]string{
+		{"riverrun", "sharknado"},
+		{"obfs4", "obfs4"},
+		{"obfs4", "riverrun"},
+		{"riverrun", "obfs5"},
+		{"bogus", "obfs4"},
+		{"riverrun", "obfs4", "riverrun"},
+	}
+	for _, v := range invalid {
+		if _, err = Compose("invalid", v...); err == nil {
+			t.Errorf("Compose(%v) succeeded", v)
+		}
+	}
+
+	unregister(t, "obfs4rs")
+	if tr, err = RegisterComposed("obfs4rs", "riverrun", "obfs4"); err != nil {
+		t.Fatalf("RegisterComposed() failed: %s", err)
+	}
+	if Get("obfs4rs") != tr {
+		t.Fatalf("RegisterComposed() did not register the transport")
+	}
+	if _, err = RegisterComposed("obfs4rs", "riverrun", "obfs4"); err == nil {
+		t.Errorf("RegisterComposed() registered the same name twice")
+	}
+}
+
+func TestObfs5Params(t *testing.T) {
+	serverArgs := pt.Args{}
+	serverArgs.Add("rr-bias-min", "0.2")
+	serverArgs.Add("rr-bias-max", "0.4")
+	serverArgs.Add("rr-compressed-bits", "8")
+	serverArgs.Add("rr-expanded-bits", "24")
+	serverArgs.Add("rr-mss-min", "1000")
+	serverArgs.Add("rr-mss-max", "1200")
+	serverArgs.Add("rr-mss-dev", "10")
+	serverArgs.Add("sharknado", "1")
+
+	s, conn := dialTransport(t, Get("obfs5"), &serverArgs)
+	defer s.ln.Close()
+	err := echo(conn, bytes.Repeat([]byte("The quick brown fox jumps over the lazy dog."), 1000))
+	conn.Close()
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	// The server advertises the parameters that the clients need.
+	for k, v := range serverArgs {
+		if got, _ := s.sf.Args().Get(k); got != v[0] {
+			t.Fatalf("Args() %s = '%s', expected '%s'", k, got, v[0])
+		}
+	}
+
+	// The derived parameters are within the configured ranges.
+	params, err := s.sf.(base.ParamsDescriber).DescribeParams()
+	if err != nil {
+		t.Fatalf("DescribeParams() failed: %s", err)
+	}
+	bias, _ := strconv.ParseFloat(params["rr-bias"], 64)
+	mss, _ := strconv.Atoi(params["rr-mss"])
+	mssDev, _ := strconv.ParseFloat(params["rr-mss-dev"], 64)
+	if bias < 0.2 || bias >= 0.4 || mss < 1000 || mss >= 1200 || mssDev < 0 || mssDev >= 10 {
+		t.Fatalf("DescribeParams() out of range: %v", params)
+	}
+	if params["rr-expanded-bits"] != "24" || params["sharknado"] != "true" || params["iat-mode"] == "" {
+		t.Fatalf("DescribeParams() unexpected: %v", params)
+	}
+
+	// Invalid parameters are rejected by both sides.
+	invalid := [][2]string{
+		{"rr-bias-min", "0.01"},
+		{"rr-bias-max", "0.9"},
+		{"rr-bias-min", "bogus"},
+		{"rr-compressed-bits", "12"},
+		{"rr-expanded-bits", "36"},
+		{"rr-expanded-bits", "128"},
+		{"rr-mss-min", "100"},
+		{"rr-mss-max", "9000"},
+		{"rr-mss-dev", "-1"},
+		{"sharknado", "maybe"},
+	}
+	for _, v := range invalid {
+		bad := copyArgs(s.sf.Args(), v[0])
+		bad.Add(v[0], v[1])
+		if _, err = s.cf.ParseArgs(&bad); err == nil {
+			t.Errorf("ParseArgs() accepted %s=%s", v[0], v[1])
+		}
+
+		stateDir, err := ioutil.TempDir(testStateDir, "obfs5")
+		if err != nil {
+			t.Fatalf("failed to create state dir: %s", err)
+		}
+		opts := pt.Args{}
+		opts.Add(v[0], v[1])
+		if _, err = Get("obfs5").ServerFactory(stateDir, &opts); err == nil {
+			t.Errorf("ServerFactory() accepted %s=%s", v[0], v[1])
+		}
+	}
+}
+
+func TestHandshakePool(t *testing.T) {
+	pool := workerpool.New(1, 16, 10*time.Second)
+	obfs4.SetHandshakePool(pool)
+	defer func() {
+		obfs4.SetHandshakePool(nil)
+		pool.Close()
+	}()
+
+	for _, name := range Transports() {
+		s := newTestServer(t, Get(name), nil)
+		defer s.ln.Close()
+
+		// Concurrent handshakes queue for the single worker.
+		const n = 4
+		errs := make(chan error, n)
+		for i := 0; i < n; i++ {
+			go func() {
+				conn, err := s.cf.Dial("tcp", s.ln.Addr().String(), base.Dialer{}, s.args)
+				if err == nil {
+					err = echo(conn, []byte("ping"))
+					conn.Close()
+				}
+				errs <- err
+			}()
+		}
+		for i := 0; i < n; i++ {
+			if err := <-errs; err != nil {
+				t.Fatalf("%s: handshake failed: %s", name, err)
+			}
+		}
+	}
+
+	st := pool.Stats()
+	if st.Completed == 0 || st.TimedOut != 0 || st.Rejected != 0 {
+		t.Fatalf("unexpected pool stats: %+v", st)
+	}
+}
+
+func TestPuzzle(t *testing.T) {
+	for _, name := range []string{"obfs4", "obfs5"} {
+		serverArgs := pt.Args{}
+		serverArgs.Add("puzzle", "20")
+		serverArgs.Add("puzzle-mode", "always")
+		s := newTestServer(t, Get(name), &serverArgs)
+		defer s.ln.Close()
+		if got, _ := s.sf.Args().Get("puzzle"); got != "20" {
+			t.Fatalf("%s: Args() puzzle = '%s'", name, got)
+		}
+
+		// Clients with the puzzle in their bridge line connect, the others
+		// are turned away (with 2^-20 odds of passing by chance).
+		noPuzzleArgs := copyArgs(s.sf.Args(), "puzzle")
+		for _, v := range []struct {
+			args *pt.Args
+			ok   bool
+		}{
+			{s.sf.Args(), true},
+			{&noPuzzleArgs, false},
+		} {
+			args, err := s.cf.ParseArgs(v.args)
+			if err != nil {
+				t.Fatalf("%s: ParseArgs() failed: %s", name, err)
+			}
+			timeout := 2 * time.Second
+			if v.ok {
+				timeout = time.Minute
+			}
+			ctx, cancel := context.WithTimeout(context.Background(), timeout)
+			conn, err := s.cf.DialContext(ctx, "tcp", s.ln.Addr().String(), base.Dialer{}, args)
+			cancel()
+			if err == nil {
+				err = echo(conn, []byte("ping"))
+				conn.Close()
+			}
+			if (err == nil) != v.ok {
+				t.Fatalf("%s: puzzle %v: %v", name, v.ok, err)
+			}
+		}
+	}
+}
+
+func TestAuto(t *testing.T) {
+	tr := Get(autoTransportName)
+	if tr == nil {
+		t.Fatalf("auto is not registered")
+	}
+	for _, name := range Transports() {
+		if name == autoTransportName {
+			t.Fatalf("Transports() lists the client only auto")
+		}
+	}
+	found := false
+	for _, name := range ClientTransports() {
+		found = found || name == autoTransportName
+	}
+	if !found {
+		t.Fatalf("ClientTransports() does not list auto")
+	}
+	if _, err := tr.ServerFactory(testStateDir, &pt.Args{}); err == nil {
+		t.Fatalf("ServerFactory() succeeded")
+	}
+
+	// An obfs5 and an obfs4 server, sharing the identity keys.
+	serverDir, err := ioutil.TempDir(testStateDir, "auto-server")
+	if err != nil {
+		t.Fatalf("failed to create state dir: %s", err)
+	}
+	listen := func(name string) (base.ServerFactory, net.Listener) {
+		sf, err := Get(name).ServerFactory(serverDir, &pt.Args{})
+		if err != nil {
+			t.Fatalf("%s: ServerFactory() failed: %s", name, err)
+		}
+		return sf, listenEcho(t, sf)
+	}
+	sf, obfs5Ln := listen("obfs5")
+	defer obfs5Ln.Close()
+	_, obfs4Ln := listen("obfs4")
+	defer obfs4Ln.Close()
+
+	clientDir, err := ioutil.TempDir(testStateDir, "auto-client")
+	if err != nil {
+		t.Fatalf("failed to create state dir: %s", err)
+	}
+	cf, err := tr.ClientFactory(clientDir)
+	if err != nil {
+		t.Fatalf("ClientFactory() failed: %s", err)
+	}
+	parse := func(extra ...string) *autoArgs {
+		args := copyArgs(sf.Args())
+		args.Add("obfs4-addr", obfs4Ln.Addr().String())
+		for i := 0; i < len(extra); i += 2 {
+			args.Add(extra[i], extra[i+1])
+		}
+		a, err := cf.ParseArgs(&args)
+		if err != nil {
+			t.Fatalf("ParseArgs(%v) failed: %s", extra, err)
+		}
+		return a.(*autoArgs)
+	}
+	dial := func(addr string, a *autoArgs) {
+		conn, err := cf.Dial("tcp", addr, base.Dialer{}, a)
+		if err != nil {
+			t.Fatalf("Dial() failed: %s", err)
+		}
+		defer conn.Close()
+		if err = echo(conn, []byte("Hello, world!")); err != nil {
+			t.Fatalf("%s", err)
+		}
+	}
+	state := cf.(*autoClientFactory).state
+	remembered := func(addr string, a *autoArgs) string {
+		return state.order(addr+" "+a.identity, a.order, a.retry)[0]
+	}
+
+	// The preferred transport works.
+	a := parse()
+	addr := obfs5Ln.Addr().String()
+	dial(addr, a)
+	if got := remembered(addr, a); got != "obfs5" {
+		t.Fatalf("remembered %s, expected obfs5", got)
+	}
+
+	// The obfs5 handshake is blocked (the bridge never answers), so the
+	// client falls back to obfs4 once the attempt times out, and remembers
+	// it.
+	silent, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %s", err)
+	}
+	defer silent.Close()
+	a = parse("timeout", "200ms")
+	addr = silent.Addr().String()
+	start := time.Now()
+	dial(addr, a)
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Fatalf("the fallback took %s", elapsed)
+	}
+	if got := remembered(addr, a); got != "obfs4" {
+		t.Fatalf("remembered %s, expected obfs4", got)
+	}
+
+	// It is kept across restarts, and the preferred transport is retried
+	// once the retry interval passes.
+	autoStates.Lock()
+	delete(autoStates.m, state.path)
+	autoStates.Unlock()
+	if cf, err = tr.ClientFactory(clientDir); err != nil {
+		t.Fatalf("ClientFactory() failed: %s", err)
+	}
+	state = cf.(*autoClientFactory).state
+	if got := remembered(addr, a); got != "obfs4" {
+		t.Fatalf("remembered %s after a restart, expected obfs4", got)
+	}
+	a.retry = time.Nanosecond
+	if got := remembered(addr, a); got != "obfs5" {
+		t.Fatalf("%s is tried first, expected the preferred obfs5", got)
+	}
+
+	// The order is configurable.
+	if a = parse("transports", "obfs4"); len(a.order) != 1 || a.order[0] != "obfs4" {
+		t.Fatalf("order %v, expected obfs4", a.order)
+	}
+	dial(obfs5Ln.Addr().String(), a)
+
+	for _, bad := range [][]string{
+		{"transports", "obfs4,obfs4"},
+		{"transports", "auto"},
+		{"transports", "bogus"},
+		{"retry", "soon"},
+		{"timeout", "-1s"},
+		{"obfs5-addr", "nowhere"},
+	} {
+		args := copyArgs(sf.Args())
+		args.Add(bad[0], bad[1])
+		if _, err = cf.ParseArgs(&args); err == nil {
+			t.Errorf("ParseArgs() accepted %s=%s", bad[0], bad[1])
+		}
+	}
+}